@@ -0,0 +1,103 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientAccess restricts which client addresses are served, before requests are handled. It
+// applies to all endpoints, gRPC included
+type ClientAccess struct {
+	// CIDRs (or single addresses) of clients served exclusively, empty allows all clients
+	Allow []string `json:",omitempty"`
+	// CIDRs of clients refused even if allowed
+	Deny []string `json:",omitempty"`
+}
+
+// clientACL is ClientAccess parsed
+type clientACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Check validates the CIDRs
+func (a *ClientAccess) Check() error {
+	_, err := a.compile()
+	return err
+}
+
+func (a *ClientAccess) compile() (*clientACL, error) {
+	if a == nil {
+		return nil, nil
+	}
+	allow, err := parsePrefixes(a.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes(a.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &clientACL{allow: allow, deny: deny}, nil
+}
+
+// parsePrefixes parses CIDRs, single addresses standing for themselves
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid client address %s: %s", cidr, err.Error()))
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid client CIDR %s: %s", cidr, err.Error()))
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed tells whether addr may be served. Denials take precedence over the allow list
+func (acl *clientACL) allowed(addr netip.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	addr = addr.Unmap()
+	if containsAddr(acl.deny, addr) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsAddr(acl.allow, addr)
+}
+
+// checkClient refuses clients (see clientAddr) not allowed by ClientAccess with 403. Clients of
+// unknown address are refused once access is restricted
+func (p *ProxyServer) checkClient(w http.ResponseWriter, r *http.Request, addr netip.Addr) bool {
+	if p.clientACL == nil {
+		return true
+	}
+	if addr.IsValid() && p.clientACL.allowed(addr) {
+		return true
+	}
+	p.metrics.ClientsDenied.Add(1)
+	loggerYellow.Printf("checkClient: Refusing client %s (connected from %s): %s %s"+LOG_RST, addr, r.RemoteAddr, r.Method, r.RequestURI)
+	httpRespString(w, http.StatusForbidden, "client address is not allowed")
+	return false
+}
@@ -0,0 +1,149 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Tokens are sent as "Authorization: Bearer <token>": AdminToken by admin clients, and
+// ReplicationToken by a primary to its standby
+const bearerAuthScheme = "Bearer "
+
+// Admin endpoints changing the state of the cache with other methods than GET and HEAD. They
+// require AdminToken
+var adminWriteEndpoints = map[string]bool{
+	"freeze":   true,
+	"thaw":     true,
+	"snapshot": true,
+	"pin":      true,
+	"unpin":    true,
+	"purge":    true,
+	"refresh":  true,
+	"prefetch": true,
+}
+
+// Admin endpoints that reach remotes, upstream or OSV, or generate module zips, whatever the method.
+// They can be used for amplification, and require AdminToken when it is set
+var adminCostlyEndpoints = map[string]bool{
+	"check-reuse": true,
+	"compare":     true,
+	"licenses":    true,
+	"sbom":        true,
+	"vulns":       true,
+}
+
+// adminAuthorized tells if the request carries AdminToken, never the case when it is empty
+func (p *ProxyServer) adminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerAuthScheme)
+	return ok && p.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) == 1
+}
+
+func (p *ProxyServer) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if endpoint, ok := strings.CutPrefix(r.URL.Path, "replica/"); ok {
+		p.serveAdminReplica(w, r, endpoint)
+		return
+	}
+	write := adminWriteEndpoints[r.URL.Path] && r.Method != http.MethodGet && r.Method != http.MethodHead
+	costly := adminCostlyEndpoints[r.URL.Path] && p.AdminToken != ""
+	if (write || costly) && !p.adminAuthorized(r) {
+		loggerYellow.Printf(requestTag(r.Context())+"serveAdmin: Refusing %s %s without the admin token"+LOG_RST, r.Method, r.URL.Path)
+		httpRespString(w, http.StatusForbidden, "admin token is not set or wrong")
+		return
+	}
+	switch r.URL.Path {
+	case "metrics":
+		httpRespJSON(w, http.StatusOK, p.metricsSnapshot())
+	case "integrity":
+		httpRespJSON(w, http.StatusOK, p.integrityReport())
+	case "popularity":
+		httpRespJSON(w, http.StatusOK, p.popularityReport())
+	case "freeze":
+		p.serveAdminFreeze(w, r, true)
+	case "thaw":
+		p.serveAdminFreeze(w, r, false)
+	case "snapshots":
+		httpRespJSON(w, http.StatusOK, p.listSnapshots())
+	case "snapshot":
+		p.serveAdminSnapshot(w, r)
+	case "pins":
+		httpRespJSON(w, http.StatusOK, p.allPins())
+	case "pin":
+		p.serveAdminPin(w, r)
+	case "unpin":
+		p.serveAdminUnpin(w, r)
+	case "quotas":
+		httpRespJSON(w, http.StatusOK, p.quotaReport())
+	case "checksums":
+		httpRespJSON(w, http.StatusOK, p.sumCheckReport())
+	case "deprecations":
+		httpRespJSON(w, http.StatusOK, p.deprecationReport())
+	case "clones":
+		httpRespJSON(w, http.StatusOK, p.cloneJobs(r.URL.Query().Get("path")))
+	case "attestation":
+		p.serveAdminAttestation(w, r)
+	case "signing-key":
+		if p.signer == nil {
+			httpRespString(w, http.StatusNotFound, "signing is not enabled")
+			return
+		}
+		httpRespBytes(w, "application/x-pem-file", p.signer.publicKeyPEM())
+	case "sbom":
+		p.serveAdminSBOM(w, r)
+	case "artifact":
+		p.serveAdminArtifact(w, r)
+	case "licenses":
+		p.serveAdminLicenses(w, r)
+	case "vulns":
+		p.serveAdminVulns(w, r)
+	case "mirrors":
+		httpRespJSON(w, http.StatusOK, p.listMirrors(r.Context(), r.URL.Query().Get("path")))
+	case "purge":
+		p.serveAdminPurge(w, r)
+	case "refresh":
+		p.serveAdminRefresh(w, r)
+	case "check-reuse":
+		p.serveAdminCheckReuse(w, r)
+	case "modules":
+		p.serveAdminModules(w, r)
+	case "info":
+		p.serveAdminBatchInfo(w, r)
+	case "prefetch":
+		p.serveAdminPrefetch(w, r)
+	case "compare":
+		p.serveAdminCompare(w, r)
+	default:
+		err := errors.New(fmt.Sprintf("Unsupported admin path: %s", r.URL.Path))
+		httpRespString(w, http.StatusNotFound, err.Error())
+	}
+}
+
+// serveAdminModules reports every module the mirror of ?path= can serve at ?rev= (HEAD by default)
+func (p *ProxyServer) serveAdminModules(w http.ResponseWriter, r *http.Request) {
+	modulePath := r.URL.Query().Get("path")
+	rev := r.URL.Query().Get("rev")
+	if rev == "" {
+		rev = "HEAD"
+	}
+	parentPath, _, vcs, err := p.checkModVcsLocal(modulePath)
+	if err != nil || vcs != ".git" {
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("no git mirror found for %s", modulePath))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.localTimeout())
+	defer cancel()
+	modules, err := listMirrorModules(ctx, path.Join(parentPath, ".git"), rev)
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpRespJSON(w, http.StatusOK, map[string]any{
+		"Mirror":  parentPath,
+		"Rev":     rev,
+		"Modules": modules,
+	})
+}
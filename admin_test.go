@@ -0,0 +1,39 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Requests refused before reaching the endpoint, for want of the admin token
+func TestServeAdminRefused(t *testing.T) {
+	tests := []struct {
+		token, method, endpoint, auth string
+	}{
+		// Changing the cache, with or without a token set
+		{"", http.MethodPost, "purge", ""},
+		{"", http.MethodPost, "purge", "Bearer "},
+		{"secret", http.MethodPost, "refresh", ""},
+		{"secret", http.MethodDelete, "snapshot", "Bearer wrong"},
+		// Reaching the network or generating zips, once a token is set
+		{"secret", http.MethodGet, "compare", ""},
+		{"secret", http.MethodGet, "check-reuse", "Bearer wrong"},
+		{"secret", http.MethodGet, "sbom", ""},
+		{"secret", http.MethodGet, "licenses", ""},
+		{"secret", http.MethodGet, "vulns", "secret"},
+	}
+	for _, tt := range tests {
+		p := &ProxyServer{AdminToken: tt.token}
+		r := httptest.NewRequest(tt.method, "/admin/"+tt.endpoint, nil)
+		r.URL.Path = tt.endpoint
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		p.serveAdmin(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with token %q and %q: %d, want 403", tt.method, tt.endpoint, tt.token, tt.auth, w.Code)
+		}
+	}
+}
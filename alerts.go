@@ -0,0 +1,281 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of alerts
+const (
+	// Clones or updates of a mirror failed Alerting.CloneFailures times in a row
+	AlertCloneFailure = "clone-failure"
+	// The commit of a pseudo-version has another time than the version says
+	AlertTimestampMismatch = "timestamp-mismatch"
+	// Artifacts generated from a mirror differ from the checksum database
+	AlertChecksumMismatch = "checksum-mismatch"
+	// An identity went over one of its Quotas
+	AlertQuotaBreach = "quota-breach"
+)
+
+// Alerts of the same kind and subject are sent once per AlertInterval, unless Alerting.Interval
+// says otherwise. AlertCloneFailures failures in a row of a mirror raise an alert
+const (
+	AlertInterval      = time.Hour
+	AlertCloneFailures = 3
+)
+
+// Alerts waiting to be sent, beyond which they're dropped
+const maxPendingAlerts = 100
+
+// Alerting sends high-signal events to operators
+type Alerting struct {
+	// URL receiving each Alert as a JSON POST
+	Webhook string `json:",omitempty"`
+	// Slack incoming webhook URL
+	Slack string `json:",omitempty"`
+	// Email through SMTP
+	Email *EmailAlerts `json:",omitempty"`
+	// Failures in a row of clones/updates of a mirror raising an alert, 0 uses AlertCloneFailures
+	CloneFailures int `json:",omitempty"`
+	// How often alerts of the same kind and subject are sent at most, 0 uses AlertInterval
+	Interval Duration `json:",omitempty"`
+}
+
+type EmailAlerts struct {
+	// SMTP server, host:port
+	Server string
+	// PLAIN authentication if set, only over TLS (STARTTLS) or to localhost
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"`
+	From     string
+	To       []string
+}
+
+// Alert is an event operators should hear about
+type Alert struct {
+	Kind string
+	// Module or module version concerned
+	Subject string
+	Message string
+	Time    time.Time
+	// Node raising it in a cluster
+	Node string `json:",omitempty"`
+}
+
+func (a *Alert) String() string {
+	return fmt.Sprintf("goproxy %s: %s: %s", a.Kind, a.Subject, a.Message)
+}
+
+// Check validates the configuration
+func (a *Alerting) Check() error {
+	if a.Email != nil {
+		if _, _, err := net.SplitHostPort(a.Email.Server); err != nil {
+			return errors.New(fmt.Sprintf("invalid SMTP server %s: %s", a.Email.Server, err.Error()))
+		}
+		if _, err := mail.ParseAddress(a.Email.From); err != nil {
+			return errors.New(fmt.Sprintf("invalid email sender %s: %s", a.Email.From, err.Error()))
+		}
+		if len(a.Email.To) == 0 {
+			return errors.New("no email recipients")
+		}
+		for _, to := range a.Email.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return errors.New(fmt.Sprintf("invalid email recipient %s: %s", to, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+type alertState struct {
+	queue chan *Alert
+	mu    sync.Mutex
+	// Last sent per kind and subject
+	sent map[string]time.Time
+	// Consecutive failures of clones/updates per mirror
+	cloneFailures map[string]int
+}
+
+func (p *ProxyServer) alertInterval() time.Duration {
+	if p.Alerts.Interval <= 0 {
+		return AlertInterval
+	}
+	return time.Duration(p.Alerts.Interval)
+}
+
+func (p *ProxyServer) startAlerts() {
+	if p.Alerts == nil {
+		return
+	}
+	p.alerts.queue = make(chan *Alert, maxPendingAlerts)
+	p.alerts.sent = make(map[string]time.Time)
+	p.alerts.cloneFailures = make(map[string]int)
+	go p.alertSender()
+}
+
+// alert queues an alert to be sent in the background, unless one of the same kind and subject was
+// sent recently. Without Alerting, alerts are only logged by those raising them
+func (p *ProxyServer) alert(kind, subject, message string) {
+	if p.Alerts == nil {
+		return
+	}
+	now := time.Now()
+	key := kind + " " + subject
+	p.alerts.mu.Lock()
+	if last, ok := p.alerts.sent[key]; ok && now.Sub(last) < p.alertInterval() {
+		p.alerts.mu.Unlock()
+		return
+	}
+	p.alerts.sent[key] = now
+	p.alerts.mu.Unlock()
+	a := &Alert{Kind: kind, Subject: subject, Message: message, Time: now.UTC()}
+	if p.Cluster != nil {
+		a.Node = p.Cluster.node()
+	}
+	select {
+	case p.alerts.queue <- a:
+		p.metrics.Alerts.Add(1)
+	default:
+		loggerRed.Printf("alert: Too many pending alerts, dropping %s"+LOG_RST, a.String())
+	}
+}
+
+// cloneFailed counts a failed clone/update of modulePath, alerting once they keep failing
+func (p *ProxyServer) cloneFailed(modulePath, remote string, err error) {
+	if p.Alerts == nil {
+		return
+	}
+	threshold := p.Alerts.CloneFailures
+	if threshold <= 0 {
+		threshold = AlertCloneFailures
+	}
+	p.alerts.mu.Lock()
+	p.alerts.cloneFailures[modulePath]++
+	n := p.alerts.cloneFailures[modulePath]
+	p.alerts.mu.Unlock()
+	if n >= threshold {
+		p.alert(AlertCloneFailure, modulePath, fmt.Sprintf("%d clones/updates in a row failed, last from %s: %s", n, remote, err.Error()))
+	}
+}
+
+func (p *ProxyServer) cloneSucceeded(modulePath string) {
+	if p.Alerts == nil {
+		return
+	}
+	p.alerts.mu.Lock()
+	delete(p.alerts.cloneFailures, modulePath)
+	p.alerts.mu.Unlock()
+}
+
+func (p *ProxyServer) alertSender() {
+	for a := range p.alerts.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), UpstreamProxyTimeout)
+		if p.Alerts.Webhook != "" {
+			data, _ := json.Marshal(a)
+			p.sendAlert("webhook", a, postAlert(ctx, p.upstreamClient, p.Alerts.Webhook, data))
+		}
+		if p.Alerts.Slack != "" {
+			data, _ := json.Marshal(map[string]string{"text": a.String()})
+			p.sendAlert("Slack", a, postAlert(ctx, p.upstreamClient, p.Alerts.Slack, data))
+		}
+		if p.Alerts.Email != nil {
+			p.sendAlert("email", a, mailAlert(p.Alerts.Email, a))
+		}
+		cancel()
+	}
+}
+
+func (p *ProxyServer) sendAlert(sink string, a *Alert, err error) {
+	if err != nil {
+		p.metrics.AlertFailures.Add(1)
+		loggerRed.Printf("alertSender: Failed to send %s by %s: %s"+LOG_RST, a.String(), sink, err.Error())
+	}
+}
+
+func postAlert(ctx context.Context, client *http.Client, url string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("HTTP error %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// mailAlert is smtp.SendMail with a timeout
+func mailAlert(e *EmailAlerts, a *Alert) error {
+	host, _, _ := net.SplitHostPort(e.Server)
+	conn, err := net.DialTimeout("tcp", e.Server, DirectConnectTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(UpstreamProxyTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", e.Username, e.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(e.From)
+	err = c.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	for _, addr := range e.To {
+		to, _ := mail.ParseAddress(addr)
+		err = c.Rcpt(to.Address)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(w, "From: %s\r\n", e.From)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(w, "Subject: [goproxy] %s: %s\r\n", a.Kind, a.Subject)
+	fmt.Fprintf(w, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(w, "%s\r\n\r\nHost: %s\r\n", a.Message, hostname)
+	if a.Node != "" {
+		fmt.Fprintf(w, "Node: %s\r\n", a.Node)
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,77 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+const ZstdCommand = "zstd"
+const ArchiveStoreDir = ".archives"
+
+func compressedArchivePath(prefix string) string {
+	// prefix is in the form of module@version/
+	return path.Join(ArchiveStoreDir, strings.TrimSuffix(prefix, "/")+".zip.zst")
+}
+
+// loadCompressedArchive reconstitutes the module zip from the zstd-compressed copy
+// Zstd is lossless, so the result is byte-identical to what was originally generated
+func (p *ProxyServer) loadCompressedArchive(ctx context.Context, prefix string) (*os.File, error) {
+	compressed, err := p.Storage.Get(ctx, compressedArchivePath(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer compressed.Close()
+	archiveTmp, err := createUnnamedTmpFile(inCacheDir(ctx, ".tmp"), 0600)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to create temp file (decompress): %s", err.Error()))
+	}
+	cmd := exec.CommandContext(ctx, ZstdCommand, "-q", "-d", "-c")
+	sandboxCmd(cmd, cacheDirOf(ctx), false)
+	cmd.Stdin = compressed
+	cmd.Stdout = archiveTmp
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		archiveTmp.Close()
+		return nil, errors.New(fmt.Sprintf("failed to decompress archive: %s", err.Error()))
+	}
+	archiveTmp.Seek(0, io.SeekStart)
+	return archiveTmp, nil
+}
+
+// storeCompressedArchive keeps a zstd-compressed copy of the module zip in Storage
+// Errors are only logged. The archive can always be regenerated from the mirror. It reports whether
+// the archive was stored
+func (p *ProxyServer) storeCompressedArchive(ctx context.Context, prefix string, archive *os.File) bool {
+	compressedTmp, err := createUnnamedTmpFile(inCacheDir(ctx, ".tmp"), 0600)
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"storeCompressedArchive: failed to create temp file: %s"+LOG_RST, err.Error())
+		return false
+	}
+	defer compressedTmp.Close()
+	defer archive.Seek(0, io.SeekStart)
+	archive.Seek(0, io.SeekStart)
+	cmd := exec.CommandContext(ctx, ZstdCommand, "-q", "-c")
+	sandboxCmd(cmd, cacheDirOf(ctx), false)
+	cmd.Stdin = archive
+	cmd.Stdout = compressedTmp
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"storeCompressedArchive: failed to compress %s: %s"+LOG_RST, prefix, err.Error())
+		return false
+	}
+	// Storage never exposes partial objects, FileStorage links the file into place
+	err = p.Storage.Put(ctx, compressedArchivePath(prefix), compressedTmp)
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"storeCompressedArchive: failed to store %s: %s"+LOG_RST, prefix, err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/sys/unix"
+)
+
+// Metadata of artifacts served from mirrors is kept in ArtifactStoreDir (<module>@<version>.json),
+// so that HEAD requests are answered without generating the zip, and the hashes of go.sum are
+// computed once rather than for every check
+const ArtifactStoreDir = ".artifacts"
+
+// ArtifactInfo describes the zip and go.mod of a module version as generated from its mirror
+type ArtifactInfo struct {
+	Module  string
+	Version string
+	// Size of the zip in bytes
+	Size int64 `json:",omitempty"`
+	// dirhash of the zip, as in go.sum
+	H1 string `json:",omitempty"`
+	// Hash of the go.mod, as in the /go.mod line of go.sum
+	ModH1     string `json:",omitempty"`
+	Generated time.Time
+}
+
+func (p *ProxyServer) loadArtifactInfo(escapedModulePath, escapedVersion string) (*ArtifactInfo, error) {
+	info := &ArtifactInfo{}
+	err := p.loadRecord(context.Background(), recordKey(ArtifactStoreDir, escapedModulePath, escapedVersion), info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// updateArtifactInfo stores the metadata of a module version if update changes it, returning the
+// metadata. Artifacts of directory sources change along with the directory, thus aren't recorded.
+// Errors are only logged
+func (p *ProxyServer) updateArtifactInfo(ctx context.Context, escapedModulePath, escapedVersion string, update func(info *ArtifactInfo) (bool, error)) *ArtifactInfo {
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return nil
+	}
+	version, err := module.UnescapeVersion(escapedVersion)
+	if err != nil {
+		return nil
+	}
+	if _, _, vcs, err := p.checkModVcsLocal(modulePath); err != nil || vcs != ".git" {
+		return nil
+	}
+	// Another process sharing the cache may be recording the same version
+	l, _, err := lockFile(ctx, p.lockPath(path.Join(ArtifactStoreDir, escapedModulePath+"@"+escapedVersion+".lock")), unix.LOCK_EX)
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"updateArtifactInfo: Failed to lock %s@%s: %s"+LOG_RST, modulePath, version, err.Error())
+		return nil
+	}
+	defer l.unlock()
+	info, err := p.loadArtifactInfo(escapedModulePath, escapedVersion)
+	if err != nil {
+		info = &ArtifactInfo{Module: modulePath, Version: version}
+	}
+	changed, err := update(info)
+	if err == nil && changed {
+		info.Generated = time.Now().UTC()
+		err = p.storeRecord(ctx, recordKey(ArtifactStoreDir, escapedModulePath, escapedVersion), info)
+	}
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"updateArtifactInfo: Failed to record %s@%s: %s"+LOG_RST, modulePath, version, err.Error())
+		return nil
+	}
+	return info
+}
+
+// recordArtifact keeps the size and hash of a zip being served, unless they're already there
+func (p *ProxyServer) recordArtifact(ctx context.Context, escapedModulePath, escapedVersion string, zip *os.File) *ArtifactInfo {
+	fi, err := zip.Stat()
+	if err != nil {
+		return nil
+	}
+	return p.updateArtifactInfo(ctx, escapedModulePath, escapedVersion, func(info *ArtifactInfo) (bool, error) {
+		if info.Size == fi.Size() && info.H1 != "" {
+			return false, nil
+		}
+		hash, err := hashZipFile(zip)
+		if err != nil {
+			return false, err
+		}
+		info.Size, info.H1 = fi.Size(), hash
+		return true, nil
+	})
+}
+
+// recordModHash keeps the hash of a go.mod being served, unless it's already there
+func (p *ProxyServer) recordModHash(ctx context.Context, escapedModulePath, escapedVersion string, data []byte) {
+	p.updateArtifactInfo(ctx, escapedModulePath, escapedVersion, func(info *ArtifactInfo) (bool, error) {
+		if info.ModH1 != "" {
+			return false, nil
+		}
+		hash, err := modHash(data)
+		if err != nil {
+			return false, err
+		}
+		info.ModH1 = hash
+		return true, nil
+	})
+}
+
+// zipHash returns the dirhash of a zip, from its metadata if it's been recorded
+func (p *ProxyServer) zipHash(escapedModulePath, escapedVersion string, zip *os.File) (string, error) {
+	if fi, err := zip.Stat(); err == nil {
+		info, err := p.loadArtifactInfo(escapedModulePath, escapedVersion)
+		if err == nil && info.H1 != "" && info.Size == fi.Size() {
+			return info.H1, nil
+		}
+	}
+	return hashZipFile(zip)
+}
+
+func hashZipFile(zip *os.File) (string, error) {
+	// Opening through /dev/fd gets a separate offset, and works for unnamed files
+	hash, err := dirhash.HashZip(fmt.Sprintf("/dev/fd/%d", zip.Fd()), dirhash.Hash1)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to hash zip: %s", err.Error()))
+	}
+	return hash, nil
+}
+
+// modHash returns the hash of a go.mod, as in the /go.mod line of go.sum
+func modHash(data []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+func artifactETag(info *ArtifactInfo) string {
+	return `"` + info.H1 + `"`
+}
+
+// serveAdminArtifact serves the metadata of ?path=<module>&version=<version>
+func (p *ProxyServer) serveAdminArtifact(w http.ResponseWriter, r *http.Request) {
+	modulePath, version := r.URL.Query().Get("path"), r.URL.Query().Get("version")
+	err := module.Check(modulePath, version)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	escapedModulePath, _ := module.EscapePath(modulePath)
+	escapedVersion, _ := module.EscapeVersion(version)
+	info, err := p.loadArtifactInfo(escapedModulePath, escapedVersion)
+	if err != nil {
+		httpRespString(w, http.StatusNotFound, "not recorded, neither the zip nor go.mod has been served from a mirror yet")
+		return
+	}
+	httpRespJSON(w, http.StatusOK, info)
+}
+
+// serveZipHead answers a HEAD request of a zip from its recorded metadata, with the headers a GET
+// would have. Zips of directory sources change along with the directory, so only zips of git
+// mirrors are answered. It reports false if the zip has to be generated to answer
+func (p *ProxyServer) serveZipHead(w http.ResponseWriter, r *http.Request, escapedModulePath, prop, fullPath, modulePath string) bool {
+	escapedVersion := strings.TrimSuffix(prop, ".zip")
+	info, err := p.loadArtifactInfo(escapedModulePath, escapedVersion)
+	if err != nil || info.H1 == "" {
+		return false
+	}
+	_, _, vcs, err := p.checkModVcsLocal(modulePath)
+	if err != nil || vcs != ".git" {
+		return false
+	}
+	if p.signer != nil {
+		if att, err := p.loadAttestation(escapedModulePath, escapedVersion); err == nil {
+			setAttestationHeaders(w, att)
+		}
+	}
+	p.setDeprecationHeader(w, fullPath)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", artifactETag(info))
+	w.WriteHeader(http.StatusOK)
+	return true
+}
@@ -0,0 +1,198 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Module versions per batch request, and the size of its body
+const (
+	MaxBatchSize    = 10000
+	MaxBatchRequest = 1 << 20
+)
+
+// BatchInfo answers for one module version of a batch request
+type BatchInfo struct {
+	Module  string
+	Version string
+	// Whether the version can be served from the cache, without fetching anything
+	Cached bool
+	Info   *RevInfo `json:",omitempty"`
+	// Why the version isn't cached or can't be served
+	Error string `json:",omitempty"`
+}
+
+// serveAdminBatchInfo answers the .info of many module versions at once, listed in the body as a
+// JSON array of "<module>@<version>", or one per line (also as "<module> <version>", the output of
+// go list -m all). Only the cache is consulted, missing versions are not fetched
+func (p *ProxyServer) serveAdminBatchInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpRespString(w, http.StatusMethodNotAllowed, "info requires POST")
+		return
+	}
+	versions, ok := readBatchRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.localTimeout())
+	defer cancel()
+	httpRespJSON(w, http.StatusOK, p.batchInfos(ctx, versions))
+}
+
+// readBatchRequest parses the module versions of the body of a batch request. It returns false,
+// after responding, if it's invalid
+func readBatchRequest(w http.ResponseWriter, r *http.Request) ([]module.Version, bool) {
+	body, err := io.ReadAll(&bodyLimiter{r: r.Body, n: MaxBatchRequest})
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	versions, err := parseBatchRequest(body)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	if len(versions) > MaxBatchSize {
+		httpRespString(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d versions per request", MaxBatchSize))
+		return nil, false
+	}
+	return versions, true
+}
+
+// batchInfos runs batchInfo for the versions, a few at a time
+func (p *ProxyServer) batchInfos(ctx context.Context, versions []module.Version) []BatchInfo {
+	results := make([]BatchInfo, len(versions))
+	// Versions of mirrors are generated by git commands, a few at a time
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				results[k] = p.batchInfo(ctx, versions[k])
+			}
+		}()
+	}
+	for k := range versions {
+		work <- k
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
+
+func parseBatchRequest(body []byte) ([]module.Version, error) {
+	var items []string
+	if trimmed := bytes.TrimSpace(body); len(trimmed) != 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &items)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				items = append(items, line)
+			}
+		}
+	}
+	versions := make([]module.Version, 0, len(items))
+	for _, item := range items {
+		modulePath, version, ok := strings.Cut(item, "@")
+		if !ok {
+			f := strings.Fields(item)
+			if len(f) != 2 {
+				return nil, errors.New(fmt.Sprintf("invalid module version %q, expecting <module>@<version>", item))
+			}
+			modulePath, version = f[0], f[1]
+		}
+		versions = append(versions, module.Version{Path: modulePath, Version: version})
+	}
+	return versions, nil
+}
+
+func (p *ProxyServer) batchInfo(ctx context.Context, v module.Version) BatchInfo {
+	result := BatchInfo{Module: v.Path, Version: v.Version}
+	err := module.Check(v.Path, v.Version)
+	if err == nil && p.Policy != nil {
+		if reason := p.Policy.denied(v.Path); reason != "" {
+			err = errors.New("refused by policy: " + reason)
+		}
+	}
+	var data []byte
+	if err == nil {
+		data, err = p.cachedInfo(ctx, v.Path, v.Version)
+	}
+	if err == nil {
+		info := &RevInfo{}
+		err = json.Unmarshal(data, info)
+		result.Info = info
+	}
+	if err != nil {
+		result.Info, result.Error = nil, err.Error()
+		return result
+	}
+	result.Cached = true
+	return result
+}
+
+// cachedInfo returns the .info of a canonical version the way the cached-only endpoint serves it
+// (see serveModCached), from the memory cache, stores of artifacts or mirrors, never fetching it
+func (p *ProxyServer) cachedInfo(ctx context.Context, modulePath, version string) ([]byte, error) {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Join(escapedModulePath, "@v", escapedVersion+".info")
+	data, ok := p.metaCache.Get(name)
+	if ok {
+		return data, nil
+	}
+	for _, store := range []*cacheRoot{p.modCache, p.layout, p.peerStore, p.upstreamStore, p.toolchainStore} {
+		if store == nil {
+			continue
+		}
+		f, err := store.openFile(name)
+		if err != nil {
+			continue
+		}
+		data, err = io.ReadAll(&bodyLimiter{r: f, n: MaxUpstreamResponse})
+		f.Close()
+		if err == nil {
+			return data, nil
+		}
+	}
+	modulePathTrim, verMajorTag, incompat, ok := checkModulePathVer(modulePath, version)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("module path/ver %s[%s] is invalid or not supported", modulePath, version))
+	}
+	reader, err := p.serveModLocal(ctx, modulePathTrim, verMajorTag, semver.Canonical(version), ".info", incompat)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err = io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	p.metaCache.Add(name, data)
+	return data, nil
+}
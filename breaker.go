@@ -0,0 +1,135 @@
+package goproxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The breaker of the upstream proxy opens once at least BreakerMinCalls of the last BreakerWindow
+// calls were made and BreakerFailureRatio of them failed transiently (see isTransient)
+const (
+	BreakerWindow       = 20
+	BreakerMinCalls     = 5
+	BreakerFailureRatio = 0.5
+)
+
+var errBreakerOpen = errors.New("upstream circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops calls to a failing upstream, so that requests don't pile up waiting for its
+// timeouts. Open, calls are refused for the cooldown. Then a single probe call is let through (half
+// open), closing the breaker if it succeeds, opening it again otherwise. A nil breaker never opens
+type circuitBreaker struct {
+	cooldown time.Duration
+	metrics  *proxyMetrics
+	mu       sync.Mutex
+	state    breakerState
+	// Outcomes of the last calls, true for failures
+	window   [BreakerWindow]bool
+	calls    int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(cooldown time.Duration, metrics *proxyMetrics) *circuitBreaker {
+	if cooldown <= 0 {
+		return nil
+	}
+	return &circuitBreaker{cooldown: cooldown, metrics: metrics}
+}
+
+// allow tells if a call may be made now, which must then be recorded
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.metrics.BreakerRejections.Add(1)
+			return false
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			b.metrics.BreakerRejections.Add(1)
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record accounts for the outcome of an allowed call. Errors other than transient ones are
+// answers of a working upstream, such as 404
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	failed := err != nil && isTransient(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			loggerGreen.Printf("circuitBreaker: Upstream is back, closing" + LOG_RST)
+			b.state, b.calls = breakerClosed, 0
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		return
+	}
+	b.window[b.calls%BreakerWindow] = failed
+	b.calls++
+	n := min(b.calls, BreakerWindow)
+	failures := 0
+	for _, f := range b.window[:n] {
+		if f {
+			failures++
+		}
+	}
+	if n >= BreakerMinCalls && float64(failures) >= BreakerFailureRatio*float64(n) {
+		b.open()
+	}
+}
+
+// open must be called with mu held
+func (b *circuitBreaker) open() {
+	loggerRed.Printf("circuitBreaker: Upstream is failing, not calling it for %s"+LOG_RST, b.cooldown)
+	b.state, b.openedAt, b.calls = breakerOpen, time.Now(), 0
+	b.metrics.BreakerOpens.Add(1)
+}
+
+// isOpen tells if calls are being refused, half open counting as open: only the probe gets through
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// call runs fn if the breaker allows it and records its outcome, errBreakerOpen otherwise
+func (b *circuitBreaker) call(fn func() error) error {
+	if !b.allow() {
+		return errBreakerOpen
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
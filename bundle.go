@@ -0,0 +1,190 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup layout, one directory per module:
+//
+//	<dir>/<module path>/remote                  URL of origin
+//	<dir>/<module path>/refs                    ref hashes at the last export, base of incremental bundles
+//	<dir>/<module path>/<timestamp>.full.bundle
+//	<dir>/<module path>/<timestamp>.incr.bundle
+const bundleTimeFormat = "20060102T150405Z"
+
+func exportBundle(modulePath, outDir string, incremental bool, now time.Time) error {
+	gitdir := path.Join(modulePath, ".git")
+	dstDir, err := filepath.Abs(path.Join(outDir, modulePath))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dstDir, 0755)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GitLocalTimeout)
+	defer cancel()
+	remote, err := runGitOutputShort(ctx, gitdir, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return err
+	}
+	refs, err := runGitOutputShort(ctx, gitdir, "for-each-ref", "--format=%(objectname)")
+	if err != nil {
+		return err
+	}
+	kind := "full"
+	var excludes []string
+	if incremental {
+		// Without a previous export, fall back to a full bundle
+		prev, err := os.ReadFile(path.Join(dstDir, "refs"))
+		if err == nil {
+			if string(prev) == refs {
+				// Nothing changed since the last export
+				return nil
+			}
+			kind = "incr"
+			for _, hash := range strings.Fields(string(prev)) {
+				// Refs may have been deleted or force-pushed since, only exclude objects still around
+				_, err := runGitOutputShort(ctx, gitdir, "cat-file", "-e", hash)
+				if err == nil {
+					excludes = append(excludes, "^"+hash)
+				}
+			}
+		}
+	}
+	bundle := path.Join(dstDir, fmt.Sprintf("%s.%s.bundle", now.Format(bundleTimeFormat), kind))
+	_, err = runGitOutputShort(ctx, gitdir,
+		append([]string{"bundle", "create", "--quiet", bundle, "--all"}, excludes...)...)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path.Join(dstDir, "remote"), []byte(remote), 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dstDir, "refs"), []byte(refs), 0644)
+}
+
+// ExportBundles writes git bundles of all cached mirrors into outDir. With incremental,
+// only objects added since the last export are bundled for mirrors exported before.
+func ExportBundles(outDir string, incremental bool) error {
+	now := time.Now().UTC()
+	var failed []string
+	walkLocalMirrors("", func(modulePath, vcs string) {
+		if vcs != ".git" {
+			return
+		}
+		err := exportBundle(modulePath, outDir, incremental, now)
+		if err != nil {
+			loggerRed.Printf("ExportBundles: Failed to export %s: %s"+LOG_RST, modulePath, err.Error())
+			failed = append(failed, modulePath)
+			return
+		}
+		loggerGreen.Printf("ExportBundles: Exported %s"+LOG_RST, modulePath)
+	})
+	if len(failed) != 0 {
+		return errors.New(fmt.Sprintf("failed to export: %s", strings.Join(failed, ", ")))
+	}
+	return nil
+}
+
+func restoreBundle(modulePath, srcDir string) error {
+	remote, err := os.ReadFile(path.Join(srcDir, "remote"))
+	if err != nil {
+		return err
+	}
+	bundles, err := filepath.Glob(path.Join(srcDir, "*.bundle"))
+	if err != nil {
+		return err
+	}
+	// Timestamps sort lexically. Start from the latest full bundle and apply the later incrementals
+	sort.Strings(bundles)
+	start := -1
+	for i, bundle := range bundles {
+		if strings.HasSuffix(bundle, ".full.bundle") {
+			start = i
+		}
+	}
+	if start == -1 {
+		return errors.New("no full bundle found")
+	}
+	err = os.MkdirAll(modulePath, 0755)
+	if err != nil {
+		return err
+	}
+	// Same as cloning, restore into a temporary directory and rename it to .git (atomicity)
+	tmpdir, err := os.MkdirTemp(modulePath, ".gittmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	ctx, cancel := context.WithTimeout(context.Background(), GitCloneTimeout)
+	defer cancel()
+	for i, bundle := range bundles[start:] {
+		bundle, err = filepath.Abs(bundle)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			_, err = runGitOutputShort(ctx, ".", "clone", "--template=.gittemplate", "--quiet", "--mirror", bundle, tmpdir)
+		} else {
+			_, err = runGitOutputShort(ctx, tmpdir, "fetch", "--quiet", bundle, "+refs/*:refs/*")
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to apply %s: %s", bundle, err.Error()))
+		}
+	}
+	_, err = runGitOutputShort(ctx, tmpdir, "remote", "set-url", "origin", strings.TrimSpace(string(remote)))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpdir, path.Join(modulePath, ".git"))
+	if err != nil {
+		return err
+	}
+	return os.Symlink(".git", path.Join(modulePath, ".vcs"))
+}
+
+// RestoreBundles recreates mirrors from a directory written by ExportBundles.
+// Modules already present in the cache are left untouched.
+func RestoreBundles(inDir string) error {
+	var failed []string
+	err := filepath.WalkDir(inDir, func(name string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != "remote" {
+			return err
+		}
+		srcDir := filepath.Dir(name)
+		modulePath, err := filepath.Rel(inDir, srcDir)
+		if err != nil {
+			return err
+		}
+		_, err = os.Readlink(path.Join(modulePath, ".vcs"))
+		if err == nil {
+			loggerYellow.Printf("RestoreBundles: %s already cached, skipping"+LOG_RST, modulePath)
+			return nil
+		}
+		err = restoreBundle(modulePath, srcDir)
+		if err != nil {
+			loggerRed.Printf("RestoreBundles: Failed to restore %s: %s"+LOG_RST, modulePath, err.Error())
+			failed = append(failed, modulePath)
+			return nil
+		}
+		loggerGreen.Printf("RestoreBundles: Restored %s"+LOG_RST, modulePath)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) != 0 {
+		return errors.New(fmt.Sprintf("failed to restore: %s", strings.Join(failed, ", ")))
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Combined bundle of the system roots and CABundle, handed to git (GIT_SSL_CAINFO)
+const CABundleFile = ".ca-bundle.pem"
+
+// Locations of the system CA bundle, as crypto/x509 looks them up
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+	"/usr/local/etc/ssl/cert.pem",
+}
+
+func systemCABundle() []byte {
+	if name := os.Getenv("SSL_CERT_FILE"); name != "" {
+		if data, err := os.ReadFile(name); err == nil {
+			return data
+		}
+	}
+	for _, name := range systemCABundles {
+		if data, err := os.ReadFile(name); err == nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// setupCABundle trusts the roots of CABundle in addition to the system ones: for the Go clients
+// (upstream, go-import discovery, checksum database, OSV, alerts) through the returned pool, and for
+// git over HTTPS through CABundleFile, as GIT_SSL_CAINFO replaces the default bundle of git rather
+// than adding to it. The system trust store is left alone
+func (p *ProxyServer) setupCABundle() (*x509.CertPool, error) {
+	extra, err := os.ReadFile(p.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(extra) {
+		return nil, errors.New(fmt.Sprintf("no certificates in %s", p.CABundle))
+	}
+	bundle := append(systemCABundle(), '\n')
+	bundle = append(bundle, extra...)
+	tmp := p.cachePath(fmt.Sprintf("%s.%d", CABundleFile, os.Getpid()))
+	err = os.WriteFile(tmp, bundle, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp, p.cachePath(CABundleFile))
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	p.caBundlePath, err = filepath.Abs(p.cachePath(CABundleFile))
+	if err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// trustCABundle points git commands (those talking to remotes are never sandboxed) at the
+// CABundleFile attached to ctx, if any. The environment takes precedence over http.sslCAInfo
+func trustCABundle(ctx context.Context, cmd *exec.Cmd) {
+	if bundle, ok := ctx.Value(caBundleKey{}).(string); ok {
+		cmd.Env = append(cmd.Environ(), "GIT_SSL_CAINFO="+bundle)
+	}
+}
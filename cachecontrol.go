@@ -0,0 +1,108 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+const (
+	// Versioned artifacts never change, CDNs may keep them as long as they like
+	CacheControlImmutable = "public, max-age=31536000, immutable"
+	// Lists and queries change as versions are tagged
+	CacheControlQuery = "public, max-age=60"
+	// Redirects to upstream only last until the version is cached, errors may be transient
+	CacheControlNoStore = "no-store"
+)
+
+// CacheControl overrides the Cache-Control header per endpoint. Empty fields keep the default,
+// "-" leaves the header out. Errors are always sent with no-store
+type CacheControl struct {
+	// .info, .mod and .zip of canonical versions, CacheControlImmutable by default
+	Info string `json:",omitempty"`
+	Mod  string `json:",omitempty"`
+	Zip  string `json:",omitempty"`
+	// @v/list, CacheControlQuery by default
+	List string `json:",omitempty"`
+	// @latest and non-canonical version queries, CacheControlQuery by default
+	Latest string `json:",omitempty"`
+	// Redirects to upstream while fetching, CacheControlNoStore by default
+	Redirect string `json:",omitempty"`
+}
+
+// Set sets an endpoint from <endpoint>=<value>, for command line flags
+func (c *CacheControl) Set(s string) error {
+	endpoint, value, _ := strings.Cut(s, "=")
+	field := c.field(endpoint)
+	if field == nil {
+		return errors.New(fmt.Sprintf("unknown endpoint %s, expecting info, mod, zip, list, latest or redirect", endpoint))
+	}
+	*field = value
+	return nil
+}
+
+func (c *CacheControl) String() string {
+	return ""
+}
+
+func (c *CacheControl) field(endpoint string) *string {
+	switch endpoint {
+	case "info":
+		return &c.Info
+	case "mod":
+		return &c.Mod
+	case "zip":
+		return &c.Zip
+	case "list":
+		return &c.List
+	case "latest":
+		return &c.Latest
+	case "redirect":
+		return &c.Redirect
+	}
+	return nil
+}
+
+// endpointOf maps the property of a request (list, latest, <version>.<ext>) to its endpoint
+func endpointOf(prop string) string {
+	ext := path.Ext(prop)
+	switch ext {
+	case ".info", ".mod", ".zip":
+		version, err := module.UnescapeVersion(strings.TrimSuffix(prop, ext))
+		// Such as branch names or v1.2, which resolve differently over time
+		if err != nil || module.CanonicalVersion(version) != version {
+			return "latest"
+		}
+		return ext[1:]
+	}
+	return prop
+}
+
+// setCacheControl sets the header for a response of the endpoint
+func (p *ProxyServer) setCacheControl(w http.ResponseWriter, endpoint string) {
+	value := ""
+	if field := p.CacheControl.field(endpoint); field != nil {
+		value = *field
+	}
+	if value == "" {
+		switch endpoint {
+		case "info", "mod", "zip":
+			value = CacheControlImmutable
+		case "list", "latest":
+			value = CacheControlQuery
+		case "redirect":
+			value = CacheControlNoStore
+		default:
+			return
+		}
+	}
+	if value == "-" {
+		w.Header().Del("Cache-Control")
+		return
+	}
+	w.Header().Set("Cache-Control", value)
+}
@@ -0,0 +1,77 @@
+package goproxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// Paths throughout the server are relative to the cache: Dir, or the working directory if empty.
+// File operations resolve them with cachePath, commands run relative to the cache directory
+// carried by their context (see withCacheDir)
+
+type cacheDirKey struct{}
+
+type caBundleKey struct{}
+
+// NewProxyServer returns a server caching in dir (created if missing), configured with the exported
+// fields of config (nil for the defaults). Nothing is shared with other instances, so several
+// can run in one process, such as in parallel tests
+func NewProxyServer(dir string, config *ProxyServer) (*ProxyServer, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	p := &ProxyServer{}
+	if config != nil {
+		// The unexported fields are state, copying them (including locks) would be wrong
+		src, dst := reflect.ValueOf(config).Elem(), reflect.ValueOf(p).Elem()
+		for i := 0; i < src.NumField(); i++ {
+			if src.Type().Field(i).IsExported() {
+				dst.Field(i).Set(src.Field(i))
+			}
+		}
+	}
+	p.Dir = dir
+	return p, nil
+}
+
+// cachePath resolves name relative to the cache directory
+func (p *ProxyServer) cachePath(name string) string {
+	if p.Dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(p.Dir, name)
+}
+
+// withCacheDir attaches the cache directory (and CABundleFile) to ctx, for commands and helpers without
+// access to the server
+func (p *ProxyServer) withCacheDir(ctx context.Context) context.Context {
+	if p.caBundlePath != "" {
+		ctx = context.WithValue(ctx, caBundleKey{}, p.caBundlePath)
+	}
+	if p.Dir == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, cacheDirKey{}, p.Dir)
+}
+
+// cacheDirOf returns the cache directory attached to ctx, "" for the working directory
+func cacheDirOf(ctx context.Context) string {
+	dir, _ := ctx.Value(cacheDirKey{}).(string)
+	return dir
+}
+
+// inCacheDir resolves name relative to the cache directory attached to ctx
+func inCacheDir(ctx context.Context, name string) string {
+	dir := cacheDirOf(ctx)
+	if dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
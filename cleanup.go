@@ -0,0 +1,117 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cleanStaleState repairs what a crash may leave behind in the cache: clones (.gittmp*) that never
+// made it into place, scratch files in .tmp, and mirrors missing their .vcs link. Skipped in a
+// cluster, where other nodes may be using them
+func (p *ProxyServer) cleanStaleState() {
+	if p.Cluster != nil {
+		return
+	}
+	ctx := p.withCacheDir(context.Background())
+	removed, relinked, quarantined := 0, 0, 0
+	entries, _ := os.ReadDir(p.cachePath(".tmp"))
+	for _, e := range entries {
+		if e.Name() == "zip-fd3.zip" {
+			continue
+		}
+		if p.root.removeAll(path.Join(".tmp", e.Name())) == nil {
+			removed++
+		}
+	}
+	root := p.cachePath(".")
+	filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		modulePath, err := filepath.Rel(root, name)
+		if err != nil || modulePath == "." {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".gittmp") {
+			if p.root.removeAll(filepath.ToSlash(modulePath)) == nil {
+				removed++
+			}
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		switch p.repairVcsLink(ctx, filepath.ToSlash(modulePath)) {
+		case vcsRelinked:
+			relinked++
+		case vcsQuarantined:
+			quarantined++
+		}
+		return nil
+	})
+	if removed+relinked+quarantined != 0 {
+		loggerYellow.Printf("cleanStaleState: Removed %d temporary files and clones, relinked %d mirrors, quarantined %d"+LOG_RST,
+			removed, relinked, quarantined)
+	}
+}
+
+type vcsRepair int
+
+const (
+	vcsIntact vcsRepair = iota
+	vcsRelinked
+	vcsQuarantined
+)
+
+// repairVcsLink handles a .git without .vcs, left by a crash between moving a clone into place and
+// linking it, or between unlinking and moving away a mirror being healed or purged. A mirror
+// passing fsck is linked again (a purge then has to be repeated), otherwise it's quarantined.
+// Aliases are linked again if the mirror they share is still there, and removed otherwise
+func (p *ProxyServer) repairVcsLink(ctx context.Context, modulePath string) vcsRepair {
+	vcsdir := path.Join(modulePath, ".vcs")
+	gitdir := path.Join(modulePath, ".git")
+	if _, err := p.root.lstat(vcsdir); err == nil {
+		return vcsIntact
+	}
+	mode, err := p.root.lstat(gitdir)
+	if err != nil {
+		return vcsIntact
+	}
+	if mode&fs.ModeSymlink != 0 {
+		owner := p.mirrorOwner(modulePath)
+		if p.root.beneath(gitdir) != nil {
+			loggerYellow.Printf("cleanStaleState: Removing alias %s of vanished mirror %s"+LOG_RST, modulePath, owner)
+			p.root.remove(gitdir)
+			return vcsIntact
+		}
+		p.mirrors.addAlias(modulePath, owner)
+	} else {
+		checkCtx, cancel := context.WithTimeout(ctx, p.localTimeout())
+		err = checkMirrorIntegrity(checkCtx, gitdir, false)
+		cancel()
+		if err != nil {
+			quarantine := path.Join(QuarantineDir, fmt.Sprintf("%s@%d", modulePath, time.Now().Unix()))
+			p.root.mkdirAll(path.Dir(quarantine), 0700)
+			err = p.root.rename(gitdir, quarantine)
+			if err != nil {
+				loggerRed.Printf("cleanStaleState: Failed to quarantine %s: %s"+LOG_RST, gitdir, err.Error())
+				return vcsIntact
+			}
+			loggerYellow.Printf("cleanStaleState: Quarantined unlinked mirror %s to %s"+LOG_RST, gitdir, quarantine)
+			return vcsQuarantined
+		}
+	}
+	err = p.root.symlink(".git", vcsdir)
+	if err != nil {
+		loggerRed.Printf("cleanStaleState: Failed to link %s: %s"+LOG_RST, vcsdir, err.Error())
+		return vcsIntact
+	}
+	loggerYellow.Printf("cleanStaleState: Linked mirror %s again"+LOG_RST, modulePath)
+	return vcsRelinked
+}
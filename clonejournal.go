@@ -0,0 +1,138 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Clone/update jobs are kept in CloneJournalDir (<module path>.json) from being queued until they
+// finish, so that jobs lost to a restart, such as during a big warm-up, are queued again on startup
+const CloneJournalDir = ".jobs"
+
+type cloneJournalRecord struct {
+	ModulePath string
+	// Empty for updates of existing mirrors
+	Remote   string `json:",omitempty"`
+	Priority string
+	Queued   time.Time
+}
+
+func parseClonePriority(s string) clonePriority {
+	for prio := clonePriorityInteractive; prio < numClonePriorities; prio++ {
+		if prio.String() == s {
+			return prio
+		}
+	}
+	return clonePriorityBackground
+}
+
+// cloneJournalDir is per node in a cluster, each node resuming its own jobs
+func (p *ProxyServer) cloneJournalDir() string {
+	if p.Cluster != nil {
+		return p.cachePath(path.Join(CloneJournalDir, p.Cluster.node()))
+	}
+	return p.cachePath(CloneJournalDir)
+}
+
+func (p *ProxyServer) cloneJournalPath(modulePath string) string {
+	return path.Join(p.cloneJournalDir(), modulePath+".json")
+}
+
+// journalCloneJob records a newly queued job. Errors are only logged, the job runs regardless
+func (p *ProxyServer) journalCloneJob(job *cloneJob) {
+	s := job.snapshot()
+	data, _ := json.Marshal(cloneJournalRecord{ModulePath: s.ModulePath, Remote: s.Remote, Priority: s.Priority, Queued: s.Queued})
+	dst := p.cloneJournalPath(s.ModulePath)
+	err := os.MkdirAll(path.Dir(dst), 0755)
+	if err == nil {
+		tmp := fmt.Sprintf("%s.%d", dst, os.Getpid())
+		err = os.WriteFile(tmp, data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, dst)
+		}
+	}
+	if err != nil {
+		loggerYellow.Printf("journalCloneJob: Failed to journal %s: %s"+LOG_RST, s.ModulePath, err.Error())
+	}
+}
+
+// forgetCloneJob drops a finished job from the journal, whether it succeeded or not. Jobs
+// interrupted by shutdown stay (see SuspendCloneJobs)
+func (p *ProxyServer) forgetCloneJob(modulePath string) {
+	if p.jobsSuspended.Load() {
+		return
+	}
+	err := os.Remove(p.cloneJournalPath(modulePath))
+	if err != nil && !os.IsNotExist(err) {
+		loggerYellow.Printf("forgetCloneJob: Failed to remove %s from the journal: %s"+LOG_RST, modulePath, err.Error())
+	}
+}
+
+// SuspendCloneJobs keeps the clone/update jobs still pending in the journal, so that they're
+// resumed by the next start. Meant for shutdown, before killing the commands (KillSubprocesses)
+func (p *ProxyServer) SuspendCloneJobs() {
+	p.jobsSuspended.Store(true)
+}
+
+// resumeCloneJobs queues the jobs of the journal again, interrupted clones starting over. Clones
+// that completed meanwhile (such as by another node) are dropped, and so are updates of mirrors
+// that are gone
+func (p *ProxyServer) resumeCloneJobs() {
+	var records []cloneJournalRecord
+	filepath.WalkDir(p.cloneJournalDir(), func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if !strings.HasSuffix(name, ".json") {
+			// Left over by a crash while journaling
+			os.Remove(name)
+			return nil
+		}
+		var record cloneJournalRecord
+		data, err := os.ReadFile(name)
+		if err == nil {
+			err = json.Unmarshal(data, &record)
+		}
+		if err != nil || name != p.cloneJournalPath(record.ModulePath) {
+			loggerYellow.Printf("resumeCloneJobs: Dropping invalid journal entry %s"+LOG_RST, name)
+			os.Remove(name)
+			return nil
+		}
+		records = append(records, record)
+		return nil
+	})
+	sort.Slice(records, func(i, k int) bool {
+		return records[i].Queued.Before(records[k].Queued)
+	})
+	ctx := p.withCacheDir(context.Background())
+	for _, record := range records {
+		name := p.cloneJournalPath(record.ModulePath)
+		prio := parseClonePriority(record.Priority)
+		if record.Remote == "" {
+			if _, _, vcs, err := p.checkModVcsLocal(record.ModulePath); err != nil || vcs != ".git" {
+				os.Remove(name)
+				continue
+			}
+			loggerGreen.Printf("resumeCloneJobs: Resuming update of %s, queued %s"+LOG_RST, record.ModulePath, record.Queued.Format(time.RFC3339))
+			p.queueGitJob(ctx, record.ModulePath, "", "", prio)
+			continue
+		}
+		if p.root.beneath(path.Join(record.ModulePath, ".vcs")) == nil {
+			os.Remove(name)
+			continue
+		}
+		loggerGreen.Printf("resumeCloneJobs: Resuming clone of %s from %s, queued %s"+LOG_RST, record.ModulePath, record.Remote, record.Queued.Format(time.RFC3339))
+		if p.cacheModGit(ctx, record.ModulePath, "", "", record.Remote, prio) == nil {
+			// Shares the mirror of another module path now
+			os.Remove(name)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package goproxy
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clonePriority orders clone/update jobs, lower values are served first
+type clonePriority int
+
+const (
+	// A client is waiting for the module
+	clonePriorityInteractive clonePriority = iota
+	// Healing and refreshes nobody is waiting for
+	clonePriorityBackground
+	// Warm-up and prefetch batches
+	clonePriorityBulk
+	numClonePriorities
+)
+
+func (prio clonePriority) String() string {
+	switch prio {
+	case clonePriorityInteractive:
+		return "interactive"
+	case clonePriorityBackground:
+		return "background"
+	case clonePriorityBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+// cloneQueue hands out clone jobs to workers by priority. Non-interactive jobs
+// never occupy all workers, so a live request does not wait behind a warm-up batch.
+// With a single worker, they run only while no interactive job is pending and are
+// preempted by the next one
+type cloneQueue struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	queued [numClonePriorities][]string
+	// Workers running non-interactive jobs, and the limit of them
+	busyLow  int
+	limitLow int
+	// Cancels the non-interactive jobs running on the single worker, by module path
+	preemptible map[string]context.CancelFunc
+}
+
+func (q *cloneQueue) init(workers int) {
+	q.cond.L = &q.mu
+	q.limitLow = workers - 1
+	q.preemptible = map[string]context.CancelFunc{}
+}
+
+func (q *cloneQueue) push(modulePath string, prio clonePriority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queued[prio] = append(q.queued[prio], modulePath)
+	q.preemptLocked(prio)
+	q.cond.Signal()
+}
+
+// requeue puts a preempted job back at the head of its priority
+func (q *cloneQueue) requeue(modulePath string, prio clonePriority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queued[prio] = append([]string{modulePath}, q.queued[prio]...)
+	q.cond.Signal()
+}
+
+// preemptLocked cancels the jobs holding the single worker when an interactive job is queued
+func (q *cloneQueue) preemptLocked(prio clonePriority) {
+	if prio != clonePriorityInteractive {
+		return
+	}
+	for modulePath, cancel := range q.preemptible {
+		cancel()
+		delete(q.preemptible, modulePath)
+	}
+}
+
+// promote moves a queued job to a higher priority. Jobs already running are not
+// preempted anymore once a client waits for them
+func (q *cloneQueue) promote(modulePath string, prio clonePriority) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if prio == clonePriorityInteractive {
+		delete(q.preemptible, modulePath)
+	}
+	for cur := prio + 1; cur < numClonePriorities; cur++ {
+		for i, queued := range q.queued[cur] {
+			if queued != modulePath {
+				continue
+			}
+			q.queued[cur] = append(q.queued[cur][:i], q.queued[cur][i+1:]...)
+			q.queued[prio] = append(q.queued[prio], modulePath)
+			q.preemptLocked(prio)
+			q.cond.Signal()
+			return true
+		}
+	}
+	return false
+}
+
+// pop blocks until a job can be run. The job runs with ctx, canceled if it is preempted.
+// done must be called with the priority returned
+func (q *cloneQueue) pop() (string, clonePriority, context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for prio := clonePriorityInteractive; prio < numClonePriorities; prio++ {
+			if len(q.queued[prio]) == 0 {
+				continue
+			}
+			ctx := context.Background()
+			if prio != clonePriorityInteractive {
+				if q.busyLow >= max(q.limitLow, 1) {
+					break
+				}
+				q.busyLow++
+				if q.limitLow == 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithCancel(ctx)
+					q.preemptible[q.queued[prio][0]] = cancel
+				}
+			}
+			modulePath := q.queued[prio][0]
+			q.queued[prio] = q.queued[prio][1:]
+			return modulePath, prio, ctx
+		}
+		q.cond.Wait()
+	}
+}
+
+// len is the number of jobs waiting for a worker
+func (q *cloneQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, queued := range q.queued {
+		n += len(queued)
+	}
+	return n
+}
+
+func (q *cloneQueue) done(modulePath string, prio clonePriority) {
+	if prio == clonePriorityInteractive {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cancel, ok := q.preemptible[modulePath]; ok {
+		cancel()
+		delete(q.preemptible, modulePath)
+	}
+	q.busyLow--
+	// Wake up a worker that may be waiting for the low priority slot
+	q.cond.Broadcast()
+}
+
+// CloneJob is the state of a pending clone/update job as reported by the admin endpoint
+type CloneJob struct {
+	ModulePath string
+	// Empty for updates of existing mirrors
+	Remote   string `json:",omitempty"`
+	Priority string
+	Queued   time.Time
+	Started  *time.Time `json:",omitempty"`
+	// Last progress line of git, such as "Receiving objects:  45% (4500/10000)"
+	Progress string `json:",omitempty"`
+}
+
+type cloneJob struct {
+	mu  sync.Mutex
+	job CloneJob
+	// Closed when the job finishes
+	done chan struct{}
+}
+
+func newCloneJob(modulePath, remote string, prio clonePriority) *cloneJob {
+	return &cloneJob{job: CloneJob{
+		ModulePath: modulePath,
+		Remote:     remote,
+		Priority:   prio.String(),
+		Queued:     time.Now(),
+	}, done: make(chan struct{})}
+}
+
+// wait blocks until the job finishes, nil jobs are done already
+func (j *cloneJob) wait() {
+	if j != nil {
+		<-j.done
+	}
+}
+
+func (j *cloneJob) start() {
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Started = &now
+}
+
+// stop resets a preempted job to queued
+func (j *cloneJob) stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Started = nil
+	j.job.Progress = ""
+}
+
+func (j *cloneJob) setPriority(prio clonePriority) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Priority = prio.String()
+}
+
+func (j *cloneJob) snapshot() CloneJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.job
+}
+
+// Write collects the progress output of git, which updates lines in place with \r
+func (j *cloneJob) Write(p []byte) (int, error) {
+	lines := strings.FieldsFunc(string(p), func(r rune) bool {
+		return r == '\r' || r == '\n'
+	})
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		j.mu.Lock()
+		j.job.Progress = line
+		j.mu.Unlock()
+		break
+	}
+	return len(p), nil
+}
+
+// cloneJobs reports pending jobs whose module path starts with prefix, oldest first
+func (p *ProxyServer) cloneJobs(prefix string) []CloneJob {
+	jobs := []CloneJob{}
+	p.pendingGit.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			jobs = append(jobs, value.(*cloneJob).snapshot())
+		}
+		return true
+	})
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Queued.Before(jobs[k].Queued)
+	})
+	return jobs
+}
@@ -0,0 +1,55 @@
+package goproxy
+
+import (
+	"testing"
+)
+
+// With a single worker, a warm-up job gives way to the next interactive job and runs again after it
+func TestCloneQueuePreempt(t *testing.T) {
+	q := cloneQueue{}
+	q.init(1)
+	q.push("example.com/bulk", clonePriorityBulk)
+	modulePath, prio, ctx := q.pop()
+	if modulePath != "example.com/bulk" || prio != clonePriorityBulk {
+		t.Fatalf("pop() = %s %s", modulePath, prio)
+	}
+	q.push("example.com/live", clonePriorityInteractive)
+	if ctx.Err() == nil {
+		t.Fatalf("bulk job not preempted")
+	}
+	q.requeue(modulePath, prio)
+	q.done(modulePath, prio)
+	modulePath, prio, ctx = q.pop()
+	if modulePath != "example.com/live" || prio != clonePriorityInteractive {
+		t.Fatalf("pop() = %s %s, want the interactive job", modulePath, prio)
+	}
+	q.done(modulePath, prio)
+	modulePath, prio, ctx = q.pop()
+	if modulePath != "example.com/bulk" || prio != clonePriorityBulk {
+		t.Fatalf("pop() = %s %s, want the preempted job", modulePath, prio)
+	}
+	// Not preempted anymore once a client waits for it
+	q.promote(modulePath, clonePriorityInteractive)
+	q.push("example.com/live2", clonePriorityInteractive)
+	if ctx.Err() != nil {
+		t.Errorf("promoted job preempted")
+	}
+	q.done(modulePath, prio)
+
+	// With more workers, one is left for interactive jobs instead
+	q = cloneQueue{}
+	q.init(2)
+	q.push("example.com/bulk", clonePriorityBulk)
+	q.push("example.com/bulk2", clonePriorityBulk)
+	_, _, ctx = q.pop()
+	q.push("example.com/live", clonePriorityInteractive)
+	if ctx.Err() != nil {
+		t.Errorf("bulk job preempted with a free worker")
+	}
+	if modulePath, _, _ = q.pop(); modulePath != "example.com/live" {
+		t.Errorf("pop() = %s, want the interactive job", modulePath)
+	}
+	if n := q.len(); n != 1 {
+		t.Errorf("len() = %d, want 1", n)
+	}
+}
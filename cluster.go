@@ -0,0 +1,245 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+const LeaseDir = ".leases"
+const DefaultLeaseDuration = 2 * time.Minute
+
+// How often a node waiting for a lease held by another node checks it again
+const leasePollInterval = 2 * time.Second
+
+// Cluster lets several instances share one cache volume (such as NFS). Clone and update jobs
+// take a lease on the mirror in LeaseDir first, so that no two nodes fetch the same repo at once
+// or race renaming the temporary clone into place
+type Cluster struct {
+	// Name of this node in leases, hostname:pid if empty
+	Node string `json:",omitempty"`
+	// Leases not renewed for this long are considered abandoned by a crashed node and taken over,
+	// DefaultLeaseDuration if 0. Holders renew them at a third of it
+	LeaseDuration Duration `json:",omitempty"`
+	// Lock backend electing the node running background maintenance: "file" (the default, a lease
+	// in LeaseDir) or redis://[:password@]host[:port][/db]
+	LeaderLock string `json:",omitempty"`
+	// Other backends, for programs embedding the server. This is where etcd plugs in, there's no
+	// built-in etcd backend. Takes precedence over LeaderLock
+	Elector LeaderLock `json:"-"`
+}
+
+type leaseRecord struct {
+	Node    string
+	Expires time.Time
+}
+
+// lease is held by this node until released
+type lease struct {
+	name   string
+	record leaseRecord
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func (c *Cluster) node() string {
+	if c.Node != "" {
+		return c.Node
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+func (c *Cluster) duration() time.Duration {
+	if c.LeaseDuration <= 0 {
+		return DefaultLeaseDuration
+	}
+	return time.Duration(c.LeaseDuration)
+}
+
+func readLease(name string) (leaseRecord, error) {
+	var record leaseRecord
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// extendLease renews the lease name held by record.Node until record.Expires. It's moved aside
+// first, so that nothing else can replace it while it's checked to still be ours and rewritten,
+// then linked back, which fails if another node created it meanwhile. held is false if it's no
+// longer ours
+func extendLease(name string, record leaseRecord) (held bool, err error) {
+	current, err := readLease(name)
+	if err != nil || current.Node != record.Node {
+		return false, nil
+	}
+	moved := fmt.Sprintf("%s.%s.renew", name, record.Node)
+	err = os.Rename(name, moved)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Taken over or released in the meantime
+			err = nil
+		}
+		return false, err
+	}
+	defer os.Remove(moved)
+	current, err = readLease(moved)
+	if err != nil || current.Node != record.Node {
+		// Taken over between reading and moving it, give it back unless yet another node got in
+		os.Link(moved, name)
+		return false, nil
+	}
+	data, _ := json.Marshal(record)
+	err = os.WriteFile(moved, data, 0644)
+	if err != nil {
+		os.Link(moved, name)
+		return false, err
+	}
+	err = os.Link(moved, name)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// dropLease removes the lease name if node holds it, checking the holder the same way as extendLease
+func dropLease(name, node string) error {
+	current, err := readLease(name)
+	if err != nil || current.Node != node {
+		return nil
+	}
+	moved := fmt.Sprintf("%s.%s.release", name, node)
+	err = os.Rename(name, moved)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	defer os.Remove(moved)
+	current, err = readLease(moved)
+	if err != nil || current.Node != node {
+		os.Link(moved, name)
+	}
+	return nil
+}
+
+// tryLease takes the lease name if it's free or expired. Creation relies on O_EXCL, which shared
+// file systems such as NFSv3+ implement atomically. Expired leases are moved aside first, then the
+// moved file is checked to be the expired one, as another node may have taken it over meanwhile
+func tryLease(name, node string, ttl time.Duration) (*lease, leaseRecord, error) {
+	record := leaseRecord{Node: node, Expires: time.Now().Add(ttl)}
+	data, _ := json.Marshal(record)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(data)
+			f.Close()
+			if err != nil {
+				os.Remove(name)
+				return nil, leaseRecord{}, err
+			}
+			return &lease{name: name, record: record}, record, nil
+		}
+		if !os.IsExist(err) {
+			return nil, leaseRecord{}, err
+		}
+		holder, err := readLease(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Released in the meantime
+				continue
+			}
+			// Being written, or written by a node that crashed halfway. Judge by its age
+			fi, statErr := os.Stat(name)
+			if statErr != nil {
+				continue
+			}
+			holder = leaseRecord{Expires: fi.ModTime().Add(ttl)}
+		}
+		if time.Now().Before(holder.Expires) {
+			return nil, holder, nil
+		}
+		stale := fmt.Sprintf("%s.%s.stale", name, record.Node)
+		if os.Rename(name, stale) != nil {
+			continue
+		}
+		moved, err := readLease(stale)
+		if err == nil && time.Now().Before(moved.Expires) {
+			// Took over a fresh lease of another node, give it back unless yet another node got in
+			os.Link(stale, name)
+			os.Remove(stale)
+			return nil, moved, nil
+		}
+		os.Remove(stale)
+		loggerYellow.Printf("tryLease: Taking over %s, expired at %s (%s)"+LOG_RST, name, holder.Expires.Format(time.RFC3339), holder.Node)
+	}
+	return nil, leaseRecord{}, errors.New(fmt.Sprintf("contention on %s", name))
+}
+
+// acquireLease takes the lease of the mirror at modulePath, waiting for other nodes holding it.
+// waited reports whether another node held it, meaning it just fetched the mirror
+func (p *ProxyServer) acquireLease(ctx context.Context, modulePath string) (l *lease, waited bool, err error) {
+	name := p.cachePath(path.Join(LeaseDir, modulePath+".lease"))
+	err = os.MkdirAll(path.Dir(name), 0755)
+	if err != nil {
+		return nil, false, err
+	}
+	for {
+		l, holder, err := tryLease(name, p.Cluster.node(), p.Cluster.duration())
+		if l != nil || err != nil {
+			if l != nil {
+				l.stop, l.done = make(chan struct{}), make(chan struct{})
+				go p.renewLease(l)
+			}
+			return l, waited, err
+		}
+		if !waited {
+			loggerGreen.Printf("acquireLease: %s is being fetched by %s, waiting"+LOG_RST, modulePath, holder.Node)
+		}
+		waited = true
+		select {
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+func (p *ProxyServer) renewLease(l *lease) {
+	defer close(l.done)
+	ticker := time.NewTicker(p.Cluster.duration() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		record := leaseRecord{Node: l.record.Node, Expires: time.Now().Add(p.Cluster.duration())}
+		held, err := extendLease(l.name, record)
+		if err != nil {
+			loggerYellow.Printf("renewLease: Failed to renew %s: %s"+LOG_RST, l.name, err.Error())
+			continue
+		}
+		if !held {
+			current, _ := readLease(l.name)
+			loggerRed.Printf("renewLease: Lost %s to %s"+LOG_RST, l.name, current.Node)
+			return
+		}
+		l.record = record
+	}
+}
+
+func (l *lease) release() {
+	close(l.stop)
+	<-l.done
+	dropLease(l.name, l.record.Node)
+}
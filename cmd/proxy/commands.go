@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ganboing/goproxy"
+)
+
+// prefetch fetches the requirements of go.mod and go.work files into the cache, as
+// proxyctl prefetch asks a running server to, but waiting for them
+func prefetch(args []string) {
+	fs := newFlagSet("prefetch", "<go.mod|go.work>...")
+	load := configFlags(fs)
+	dryRun := fs.Bool("n", false, "only print the module versions that would be prefetched")
+	proxy := load(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	versions, err := goproxy.Requirements(fs.Args())
+	if err != nil {
+		log.Fatalf("Failed to read requirements: %s", err.Error())
+	}
+	if *dryRun {
+		for _, v := range versions {
+			fmt.Println(v.String())
+		}
+		return
+	}
+	report := proxy.Prefetch(commandContext(), versions)
+	refused := make([]string, 0, len(report.Refused))
+	for v := range report.Refused {
+		refused = append(refused, v)
+	}
+	sort.Strings(refused)
+	for _, v := range refused {
+		fmt.Printf("%s: %s\n", v, report.Refused[v])
+	}
+	for _, v := range report.Failed {
+		fmt.Printf("%s: failed to fetch\n", v)
+	}
+	fmt.Printf("%d cached, %d fetched, %d refused, %d failed\n",
+		report.Cached, report.Queued-len(report.Failed), len(report.Refused), len(report.Failed))
+	if len(report.Failed) != 0 {
+		os.Exit(1)
+	}
+}
+
+// purge removes the mirrors of modules from the cache
+func purge(args []string) {
+	fs := newFlagSet("purge", "<module>...")
+	load := configFlags(fs)
+	proxy := load(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	ctx := commandContext()
+	failed := false
+	for _, modulePath := range fs.Args() {
+		err := proxy.Purge(ctx, modulePath)
+		if err != nil {
+			log.Printf("Failed to purge %s: %s", modulePath, err.Error())
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// bundleDir loads the configuration of the export and import commands, and returns the bundle
+// directory, made absolute since the bundles are written and read from the cache directory
+func bundleDir(fs *flag.FlagSet, load func([]string) *goproxy.ProxyServer, args []string) string {
+	proxy := load(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Invalid directory %s: %s", fs.Arg(0), err.Error())
+	}
+	if proxy.Dir != "" {
+		err = os.Chdir(proxy.Dir)
+		if err != nil {
+			log.Fatalf("Failed to enter the cache directory: %s", err.Error())
+		}
+	}
+	return dir
+}
+
+// exportBundles writes git bundles of the mirrors of the cache
+func exportBundles(args []string) {
+	fs := newFlagSet("export", "<dir>")
+	load := configFlags(fs)
+	incremental := fs.Bool("incremental", false, "only bundle objects added since the last export")
+	dir := bundleDir(fs, load, args)
+	err := goproxy.ExportBundles(dir, *incremental)
+	if err != nil {
+		log.Fatalf("export failed: %s", err.Error())
+	}
+}
+
+// importBundles restores mirrors from bundles written by export
+func importBundles(args []string) {
+	fs := newFlagSet("import", "<dir>")
+	load := configFlags(fs)
+	dir := bundleDir(fs, load, args)
+	err := goproxy.RestoreBundles(dir)
+	if err != nil {
+		log.Fatalf("import failed: %s", err.Error())
+	}
+}
+
+// doctor checks what serving depends on, exiting with 1 if anything is wrong
+func doctor(args []string) {
+	fs := newFlagSet("doctor", "")
+	load := configFlags(fs)
+	proxy := load(args)
+	failed := false
+	for _, d := range proxy.Diagnose(commandContext()) {
+		status := "ok"
+		if !d.OK {
+			status, failed = "FAILED", true
+		}
+		fmt.Printf("%-8s %-6s %s\n", d.Check, status, d.Detail)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
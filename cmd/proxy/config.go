@@ -0,0 +1,309 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ganboing/goproxy"
+)
+
+// configFlags defines the flags configuring the server on fs, shared by all commands. The function
+// returned parses args, loads the configuration file and returns the server configured
+func configFlags(fs *flag.FlagSet) func(args []string) *goproxy.ProxyServer {
+	proxy := &goproxy.ProxyServer{}
+	workdir := fs.String("workdir", "", "change to this working directory first, relative paths of other options being relative to it")
+	umask := fs.String("umask", "", "umask of the files and directories created, in octal such as 027 (inherited by default)")
+	config := fs.String("config", "", "JSON configuration file, explicitly passed flags take precedence")
+	fs.StringVar(&proxy.Dir, "dir", "", "cache directory (default the working directory)")
+	fs.BoolVar(&proxy.CompressArchives, "compress", false, "keep module zips zstd-compressed on disk")
+	fs.Int64Var(&proxy.MetadataCacheSize, "meta-cache", 16<<20, "size in bytes of in-memory .info/.mod/@v/list cache, 0 to disable")
+	fs.Var(&proxy.IntegrityCheckInterval, "integrity-interval", "interval between rolling integrity checks, e.g. 10m (disabled by default)")
+	fs.Var(&proxy.SumDBCheckInterval, "sumdb-check", "interval between checks of a sampled module version against the checksum database, e.g. 1m (disabled by default)")
+	fs.StringVar(&proxy.SumDB, "sumdb", "", "base URL of the checksum database (default "+goproxy.SumDBURL+")")
+	fs.BoolVar(&proxy.DeprecationHeader, "deprecation-header", false, "add X-Go-Module-Deprecated to responses of deprecated modules")
+	fs.Var(&proxy.StallTimeout, "stall-timeout", "abort zip responses when the client reads nothing for this long (default 1m)")
+	fs.Var(&proxy.LocalTimeout, "local-timeout", "timeout of git/zip commands archiving and reading the cache (default 5m)")
+	fs.BoolVar(&proxy.ReapOrphans, "reap", true, "kill helper processes that outlived their git command")
+	fs.BoolVar(&proxy.IgnoreGitAttributes, "ignore-gitattributes", false, "generate module zips ignoring the .gitattributes of repos, from the committed content only")
+	fs.Int64Var(&proxy.MaxZipSize, "max-zip-size", 0, "abort generating module zips larger than this many bytes (default and maximum 500MiB)")
+	fs.Int64Var(&proxy.ServeRateLimit, "serve-rate", 0, "limit in bytes per second of .info/.mod/.zip responses, all together (unlimited by default)")
+	fs.Int64Var(&proxy.CloneRateLimit, "clone-rate", 0, "limit in bytes per second received by clones and updates of mirrors over http(s), all together (unlimited by default)")
+	fs.StringVar(&proxy.ModCacheDir, "modcache", "", "serve artifacts found in this read-only GOMODCACHE directory")
+	fs.StringVar(&proxy.LayoutDir, "layout", "", "also keep served artifacts in this directory in the GOPROXY layout")
+	fs.StringVar(&proxy.RecordDir, "record", "", "record the responses into this directory, fetching from upstream instead of redirecting")
+	fs.StringVar(&proxy.ReplayDir, "replay", "", "serve only the responses recorded into this directory by -record")
+	fs.StringVar(&proxy.SigningKey, "signing-key", "", "PEM encoded ed25519 key signing served zips and their provenance")
+	fs.Var(&proxy.CacheControl, "cache-control", "Cache-Control of an endpoint as <endpoint>=<value>, endpoints being info, mod, zip, list, latest and redirect, - omits it (repeatable)")
+	fs.StringVar(&proxy.Upstream, "upstream", "", "base URL of the upstream proxy (default "+goproxy.UpstreamProxy+")")
+	fs.Var(&proxy.UpstreamBreakerCooldown, "upstream-breaker", "stop calling upstream for this long once most recent calls failed, e.g. 30s (disabled by default)")
+	fs.BoolVar(&proxy.SyncFetch, "sync", false, "wait for fetches and serve from the cache instead of redirecting to upstream")
+	sandbox := goproxy.Sandbox{}
+	fs.BoolVar(&sandbox.Landlock, "sandbox-landlock", false, "restrict read-only git/zip/zstd commands to the cache with Landlock")
+	fs.BoolVar(&sandbox.NoNetwork, "sandbox-no-network", false, "deny network access of read-only git/zip/zstd commands with seccomp")
+	sandboxUser := fs.String("sandbox-user", "", "run read-only git commands as uid:gid (requires root)")
+	limits := goproxy.ResourceLimits{}
+	fs.Var(&limits.CPUTime, "limit-cpu", "CPU time limit of each git/zip/zstd command, e.g. 10m")
+	fs.Uint64Var(&limits.Memory, "limit-memory", 0, "address space limit in bytes of each git/zip/zstd command")
+	fs.Uint64Var(&limits.FileSize, "limit-file-size", 0, "limit in bytes of files written by git/zip/zstd commands")
+	fs.Uint64Var(&limits.OpenFiles, "limit-files", 0, "open file limit of each git/zip/zstd command")
+	fs.StringVar(&limits.Cgroup, "cgroup", "", "cgroup v2 directory to start git/zip/zstd commands in")
+	logSink := fs.String("log", "stderr", "log output: stderr, syslog or journald")
+	osvWarn := fs.Bool("osv", false, "query OSV for served versions and list their advisories in X-Go-Module-Vulnerabilities")
+	osvBlock := fs.String("osv-block", "", "refuse zips of versions with OSV advisories of this severity or above (LOW, MODERATE, HIGH, CRITICAL)")
+	allow := fs.String("allow", "", "serve only modules matching these comma separated patterns (GOPRIVATE syntax)")
+	deny := fs.String("deny", "", "refuse modules matching these comma separated patterns (GOPRIVATE syntax)")
+	policyStatus := fs.Int("policy-status", 0, "status of refusals by policy, 403 (default) or 410")
+	policyContact := fs.String("policy-contact", "", "contact (such as a URL) included in refusals by policy")
+	clusterNode := fs.String("cluster-node", "", "share the cache directory with other instances, under this node name")
+	leaderLock := fs.String("leader-lock", "", "lock backend electing the node running maintenance in a cluster: file or redis://host:port")
+	fs.BoolVar(&proxy.CachedOnlyFallback, "cached-only-fallback", false, "fetch versions from upstream when serving them from local mirrors fails in cached-only mode")
+	fs.Var(&proxy.MetadataMaxAge, "metadata-max-age", "update mirrors last updated longer than this ago before answering @latest and branches from them, e.g. 24h")
+	fs.Var(&proxy.StaleWhileRevalidate, "stale-while-revalidate", "serve @latest and branches from mirrors older than this, updating them in the background, e.g. 1h")
+	fs.StringVar(&proxy.Standby, "standby", "", "standby instance to push new mirrors and archives to")
+	fs.StringVar(&proxy.ReplicationToken, "replication-token", "", "shared secret between primary and standby")
+	fs.StringVar(&proxy.AdminToken, "admin-token", "", "token required by admin requests changing the cache (purge, refresh, freeze...), refused without it")
+	peers := fs.String("peers", "", "comma separated URLs of sibling proxies asked before going upstream")
+	dnsServer := fs.String("dns-server", "", "DNS server (host[:port]) resolving go-import hosts and http(s) git remotes, instead of the system resolver")
+	var dnsHosts goproxy.StaticHosts
+	fs.Var(&dnsHosts, "dns-host", "static addresses of a go-import host or git remote as <host>=<addr>[,<addr>...] (repeatable)")
+	var dnsTTL goproxy.Duration
+	fs.Var(&dnsTTL, "dns-ttl", "cache resolved go-import hosts and git remotes for this long (default 5m once any -dns flag is set)")
+	alertWebhook := fs.String("alert-webhook", "", "URL alerts (repeated clone failures, checksum and timestamp mismatches) are POSTed to as JSON")
+	alertSlack := fs.String("alert-slack", "", "Slack incoming webhook URL alerts are sent to")
+	alertSMTP := fs.String("alert-smtp", "", "SMTP server (host:port) emailing alerts, credentials are set in the configuration file")
+	alertFrom := fs.String("alert-email-from", "", "sender of alert emails")
+	alertTo := fs.String("alert-email-to", "", "comma separated recipients of alert emails")
+	allowClients := fs.String("allow-clients", "", "serve only clients in these comma separated CIDRs or addresses")
+	denyClients := fs.String("deny-clients", "", "refuse clients in these comma separated CIDRs or addresses, even if allowed")
+	trustedProxies := fs.String("trusted-proxies", "", "comma separated CIDRs or addresses of load balancers whose Forwarded/X-Forwarded-For headers are honored")
+	fs.StringVar(&proxy.CABundle, "ca-bundle", "", "PEM file of root CAs trusted in addition to the system ones for upstream, go-import and git over HTTPS")
+	var egress goproxy.EgressRules
+	fs.Var(&egress, "egress", "route outbound connections to hosts matching comma separated patterns as <hosts>=direct|http://<proxy>|socks5://<proxy> (repeatable, the first match wins)")
+	fs.Var(&proxy.RefreshInterval, "refresh-interval", "update mirrors in the background this often if requested once a day, more or less often with their requests, e.g. 24h")
+	fs.Var(&proxy.RefreshIdle, "refresh-idle", "stop updating mirrors in the background once not requested for this long (default 720h)")
+	fs.BoolVar(&proxy.Freeze, "freeze", false, "serve only what's already cached, refusing to cache anything new with 403")
+	fs.StringVar(&proxy.FreezeReason, "freeze-reason", "", "why the cache is frozen, included in refusals")
+	sumAllowlist := fs.String("sum-allowlist", "", "comma separated go.sum files whose module versions are the only ones served, with matching hashes")
+	var pins goproxy.Pins
+	fs.Var(&pins, "pin", "never purge the mirror of <module>[@<version>], and keep the tags of a pinned version where they are (repeatable)")
+	var credentialHelpers goproxy.CredentialHelpers
+	fs.Var(&credentialHelpers, "git-credential-helper", "git credential helper authenticating clones and updates of every remote, as in credential.helper (repeatable)")
+	var quota goproxy.Quota
+	fs.Int64Var(&quota.Requests, "quota-requests", 0, "requests a day of each identity to the module endpoints, 0 unlimited")
+	fs.Int64Var(&quota.Bytes, "quota-bytes", 0, "bytes a day served to each identity, 0 unlimited")
+	fs.Int64Var(&quota.NewModules, "quota-new-modules", 0, "distinct modules each identity may newly cache a day, 0 unlimited")
+	identityHeader := fs.String("identity-header", "", "header naming the authenticated identity of quotas, set by a -trusted-proxies")
+	scanCommand := fs.String("scan-command", "", "command scanning every generated zip (given as /dev/fd/3), a non-zero exit refuses serving it")
+	return func(args []string) *goproxy.ProxyServer {
+		fs.Parse(args)
+		// Before anything else, so that relative paths (including -config) are relative to it
+		if *workdir != "" {
+			err := os.Chdir(*workdir)
+			if err != nil {
+				log.Fatalf("Failed to change the working directory: %s", err.Error())
+			}
+		}
+		if *umask != "" {
+			mask, err := strconv.ParseUint(*umask, 8, 32)
+			if err != nil || mask > 0777 {
+				log.Fatalf("Invalid -umask %s, expecting octal such as 027", *umask)
+			}
+			syscall.Umask(int(mask))
+		}
+		if *config != "" {
+			err := proxy.LoadConfig(*config)
+			if err != nil {
+				log.Fatalf("Failed to load config: %s", err.Error())
+			}
+			// Parse again so that flags on the command line override the config file
+			fs.Parse(args)
+		}
+		if proxy.Dir != "" {
+			var err error
+			proxy, err = goproxy.NewProxyServer(proxy.Dir, proxy)
+			if err != nil {
+				log.Fatalf("Failed to set up cache directory: %s", err.Error())
+			}
+		}
+		if *osvWarn || *osvBlock != "" {
+			if proxy.Vulns == nil {
+				proxy.Vulns = &goproxy.VulnPolicy{}
+			}
+			proxy.Vulns.Warn = proxy.Vulns.Warn || *osvWarn
+			if *osvBlock != "" {
+				proxy.Vulns.Block = *osvBlock
+			}
+			err := proxy.Vulns.Check()
+			if err != nil {
+				log.Fatalf("Invalid -osv-block: %s", err.Error())
+			}
+		}
+		if *allow != "" || *deny != "" || *policyStatus != 0 || *policyContact != "" {
+			if proxy.Policy == nil {
+				proxy.Policy = &goproxy.ModulePolicy{}
+			}
+			if *allow != "" {
+				proxy.Policy.Allow = *allow
+			}
+			if *deny != "" {
+				proxy.Policy.Deny = *deny
+			}
+			if *policyStatus != 0 {
+				proxy.Policy.Status = *policyStatus
+			}
+			if *policyContact != "" {
+				proxy.Policy.Contact = *policyContact
+			}
+			err := proxy.Policy.Check()
+			if err != nil {
+				log.Fatalf("Invalid policy: %s", err.Error())
+			}
+		}
+		if *clusterNode != "" {
+			if proxy.Cluster == nil {
+				proxy.Cluster = &goproxy.Cluster{}
+			}
+			proxy.Cluster.Node = *clusterNode
+			if *leaderLock != "" {
+				proxy.Cluster.LeaderLock = *leaderLock
+			}
+		}
+		if *dnsServer != "" || len(dnsHosts) != 0 || dnsTTL != 0 {
+			if proxy.Resolver == nil {
+				proxy.Resolver = &goproxy.Resolver{}
+			}
+			if *dnsServer != "" {
+				proxy.Resolver.Server = *dnsServer
+			}
+			for host, addrs := range dnsHosts {
+				if proxy.Resolver.Hosts == nil {
+					proxy.Resolver.Hosts = goproxy.StaticHosts{}
+				}
+				proxy.Resolver.Hosts[host] = addrs
+			}
+			if dnsTTL != 0 {
+				proxy.Resolver.TTL = dnsTTL
+			}
+			err := proxy.Resolver.Check()
+			if err != nil {
+				log.Fatalf("Invalid resolver: %s", err.Error())
+			}
+		}
+		if *alertWebhook != "" || *alertSlack != "" || *alertSMTP != "" {
+			if proxy.Alerts == nil {
+				proxy.Alerts = &goproxy.Alerting{}
+			}
+			if *alertWebhook != "" {
+				proxy.Alerts.Webhook = *alertWebhook
+			}
+			if *alertSlack != "" {
+				proxy.Alerts.Slack = *alertSlack
+			}
+			if *alertSMTP != "" {
+				if proxy.Alerts.Email == nil {
+					proxy.Alerts.Email = &goproxy.EmailAlerts{}
+				}
+				proxy.Alerts.Email.Server = *alertSMTP
+				if *alertFrom != "" {
+					proxy.Alerts.Email.From = *alertFrom
+				}
+				if *alertTo != "" {
+					proxy.Alerts.Email.To = strings.Split(*alertTo, ",")
+				}
+			}
+			err := proxy.Alerts.Check()
+			if err != nil {
+				log.Fatalf("Invalid alerting: %s", err.Error())
+			}
+		}
+		if *allowClients != "" || *denyClients != "" {
+			if proxy.Clients == nil {
+				proxy.Clients = &goproxy.ClientAccess{}
+			}
+			if *allowClients != "" {
+				proxy.Clients.Allow = strings.Split(*allowClients, ",")
+			}
+			if *denyClients != "" {
+				proxy.Clients.Deny = strings.Split(*denyClients, ",")
+			}
+			err := proxy.Clients.Check()
+			if err != nil {
+				log.Fatalf("Invalid client access lists: %s", err.Error())
+			}
+		}
+		if len(egress) != 0 {
+			// Rules of the command line come first, so that they take precedence
+			proxy.Egress = append(egress, proxy.Egress...)
+		}
+		if len(pins) != 0 {
+			proxy.Pins = append(proxy.Pins, pins...)
+		}
+		if len(credentialHelpers) != 0 {
+			proxy.CredentialHelpers = append(proxy.CredentialHelpers, credentialHelpers...)
+		}
+		if quota != (goproxy.Quota{}) || *identityHeader != "" {
+			if proxy.Quotas == nil {
+				proxy.Quotas = &goproxy.Quotas{}
+			}
+			if quota.Requests != 0 {
+				proxy.Quotas.Default.Requests = quota.Requests
+			}
+			if quota.Bytes != 0 {
+				proxy.Quotas.Default.Bytes = quota.Bytes
+			}
+			if quota.NewModules != 0 {
+				proxy.Quotas.Default.NewModules = quota.NewModules
+			}
+			if *identityHeader != "" {
+				proxy.Quotas.IdentityHeader = *identityHeader
+			}
+		}
+		if *trustedProxies != "" {
+			proxy.TrustedProxies = strings.Split(*trustedProxies, ",")
+		}
+		if *sumAllowlist != "" {
+			proxy.SumAllowlist = append(proxy.SumAllowlist, strings.Split(*sumAllowlist, ",")...)
+		}
+		if *peers != "" {
+			proxy.Peers = append(proxy.Peers, strings.Split(*peers, ",")...)
+		}
+		if *scanCommand != "" {
+			proxy.ScanCommands = append(proxy.ScanCommands, strings.Fields(*scanCommand))
+		}
+		switch *logSink {
+		case "stderr":
+		case "syslog":
+			err := goproxy.UseSyslog("goproxy")
+			if err != nil {
+				log.Fatalf("Failed to connect to syslog: %s", err.Error())
+			}
+		case "journald":
+			err := goproxy.UseJournald("goproxy")
+			if err != nil {
+				log.Fatalf("Failed to connect to journald: %s", err.Error())
+			}
+		default:
+			log.Fatalf("Unknown log output %s", *logSink)
+		}
+		if *sandboxUser != "" {
+			_, err := fmt.Sscanf(*sandboxUser, "%d:%d", &sandbox.Uid, &sandbox.Gid)
+			if err != nil {
+				log.Fatalf("Invalid -sandbox-user %s, expecting uid:gid", *sandboxUser)
+			}
+		}
+		err := goproxy.UseSandbox(sandbox)
+		if err != nil {
+			log.Fatalf("Failed to set up sandbox: %s", err.Error())
+		}
+		err = goproxy.UseResourceLimits(limits)
+		if err != nil {
+			log.Fatalf("Failed to set up resource limits: %s", err.Error())
+		}
+		return proxy
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set in the environment of the process started by -daemon, to the descriptor telling its parent
+// it's serving
+const daemonEnv = "GOPROXY_DAEMON_READY_FD"
+
+// Working directory the process was started in, before -workdir
+var launchDir, _ = os.Getwd()
+
+// daemonize starts the command again in a new session, detached from the terminal, and exits once
+// it's serving, or with 1 if it failed to start, its errors going to stderr until then. It returns
+// in the detached process
+func daemonize() {
+	if os.Getenv(daemonEnv) != "" {
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("Failed to detach: %s", err.Error())
+	}
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	// Relative paths of the arguments resolve as they did
+	cmd.Dir = launchDir
+	cmd.Env = append(os.Environ(), daemonEnv+"=3")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		log.Fatalf("Failed to detach: %s", err.Error())
+	}
+	w.Close()
+	ready, _ := io.ReadAll(r)
+	if string(ready) != "ready" {
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Serving in the background, pid %d\n", cmd.Process.Pid)
+	os.Exit(0)
+}
+
+// daemonReady tells the parent of a process started by -daemon that it's serving, and detaches
+// stdout and stderr. Logs going to stderr are discarded from then on
+func daemonReady() {
+	fd, err := strconv.Atoi(os.Getenv(daemonEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(daemonEnv)
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalf("Failed to detach: %s", err.Error())
+	}
+	defer devNull.Close()
+	for _, stdio := range []int{1, 2} {
+		err = unix.Dup2(int(devNull.Fd()), stdio)
+		if err != nil {
+			log.Fatalf("Failed to detach: %s", err.Error())
+		}
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.WriteString("ready")
+	ready.Close()
+}
+
+// pidFile holds the pid file of the server, locked while the server runs
+type pidFile struct {
+	f *os.File
+}
+
+// createPidFile writes the pid of the process to name, refusing to if another running process holds
+// it. Pid files of processes that are gone are replaced
+func createPidFile(name string) (*pidFile, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		pid, _ := io.ReadAll(f)
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, errors.New(fmt.Sprintf("already running, pid %s", strings.TrimSpace(string(pid))))
+		}
+		return nil, err
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pidFile{f: f}, nil
+}
+
+// remove deletes the pid file on shutdown
+func (p *pidFile) remove() {
+	os.Remove(p.f.Name())
+	p.f.Close()
+}
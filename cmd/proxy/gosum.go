@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// sumLines hashes the extracted module version in dir. The go.mod of the /go.mod line is mod if
+// set, the go.mod in dir otherwise, or synthesized like the go command does for modules without one
+func sumLines(dir, modulePath, version string, mod []byte) (string, error) {
+	err := module.Check(modulePath, version)
+	if err != nil {
+		return "", err
+	}
+	hash, err := dirhash.HashDir(dir, modulePath+"@"+version, dirhash.Hash1)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to HashDir: %s", err.Error()))
+	}
+	if mod == nil {
+		mod, err = os.ReadFile(filepath.Join(dir, "go.mod"))
+		if os.IsNotExist(err) {
+			mod, err = []byte(fmt.Sprintf("module %s\n", modulePath)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	modHash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(mod)), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", modulePath, version, hash, modulePath, version, modHash), nil
+}
+
+// modCacheVersion locates <module>@<version> in GOMODCACHE, along with the go.mod the go command
+// downloaded for it
+func modCacheVersion(modCache, modulePath, version string) (string, []byte, error) {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", nil, err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := filepath.Join(modCache, filepath.FromSlash(escapedModulePath)+"@"+escapedVersion)
+	// Missing if the go.mod of the version was downloaded without its zip, the go.mod of dir is used then
+	mod, _ := os.ReadFile(filepath.Join(modCache, "cache", "download", filepath.FromSlash(escapedModulePath), "@v", escapedVersion+".mod"))
+	return dir, mod, nil
+}
+
+// walkModCache lists the module versions extracted in GOMODCACHE
+func walkModCache(modCache string) ([]string, error) {
+	var versions []string
+	err := filepath.WalkDir(modCache, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || name == modCache {
+			return nil
+		}
+		rel, _ := filepath.Rel(modCache, name)
+		if rel == "cache" {
+			return filepath.SkipDir
+		}
+		escapedModulePath, escapedVersion, ok := strings.Cut(filepath.ToSlash(rel), "@")
+		if !ok {
+			return nil
+		}
+		modulePath, err := module.UnescapePath(escapedModulePath)
+		if err == nil {
+			var version string
+			version, err = module.UnescapeVersion(escapedVersion)
+			if err == nil {
+				versions = append(versions, modulePath+"@"+version)
+			}
+		}
+		if err != nil {
+			log.Printf("Skipping %s: %s", name, err.Error())
+		}
+		return filepath.SkipDir
+	})
+	return versions, err
+}
+
+// printSumLines prints the go.sum lines of the module versions extracted in directories, args being
+// <dir> <module>@<version> pairs, or in modCache if set, args being <module>@<version> (all of them
+// if none). It returns false if any failed
+func printSumLines(fs *flag.FlagSet, modCache string, args []string) bool {
+	type target struct {
+		dir, modulePath, version string
+		mod                      []byte
+	}
+	var targets []target
+	if modCache != "" {
+		if len(args) == 0 {
+			var err error
+			args, err = walkModCache(modCache)
+			if err != nil {
+				log.Fatalf("failed to walk %s: %s", modCache, err.Error())
+			}
+		}
+		for _, arg := range args {
+			modulePath, version, ok := strings.Cut(arg, "@")
+			if !ok {
+				fs.Usage()
+				os.Exit(2)
+			}
+			dir, mod, err := modCacheVersion(modCache, modulePath, version)
+			if err != nil {
+				log.Fatalf("invalid module version %s: %s", arg, err.Error())
+			}
+			targets = append(targets, target{dir: dir, modulePath: modulePath, version: version, mod: mod})
+		}
+	} else {
+		if len(args) == 0 || len(args)%2 != 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		for i := 0; i < len(args); i += 2 {
+			modulePath, version, ok := strings.Cut(args[i+1], "@")
+			if !ok {
+				fs.Usage()
+				os.Exit(2)
+			}
+			targets = append(targets, target{dir: args[i], modulePath: modulePath, version: version})
+		}
+	}
+	failed := false
+	for _, t := range targets {
+		lines, err := sumLines(t.dir, t.modulePath, t.version, t.mod)
+		if err != nil {
+			log.Printf("%s@%s: %s", t.modulePath, t.version, err.Error())
+			failed = true
+			continue
+		}
+		os.Stdout.WriteString(lines)
+	}
+	return !failed
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/ganboing/goproxy"
+)
+
+// listenSpec is where and what to serve: [<endpoints>=]<address>[/<prefix>]
+type listenSpec struct {
+	endpoints string
+	addr      string
+	prefix    string
+}
+
+var listenEndpoints = []string{"all", "monitor", "cached-only", "sync", "snapshot", "admin"}
+
+func parseListen(s string) (listenSpec, error) {
+	spec := listenSpec{endpoints: "all"}
+	if endpoints, addr, ok := strings.Cut(s, "="); ok {
+		spec.endpoints, s = endpoints, addr
+	}
+	if !slices.Contains(listenEndpoints, spec.endpoints) {
+		return spec, errors.New(fmt.Sprintf("unknown endpoints %s, expecting one of %s", spec.endpoints, strings.Join(listenEndpoints, ", ")))
+	}
+	spec.addr = s
+	if idx := strings.IndexByte(s, '/'); idx != -1 {
+		spec.addr, spec.prefix = s[:idx], strings.TrimSuffix(s[idx:], "/")
+	}
+	return spec, nil
+}
+
+// handler serves the endpoints beneath the prefix, along with expvar for all and admin
+func (l listenSpec) handler(proxy *goproxy.ProxyServer, publishExpvar bool) http.Handler {
+	var h http.Handler
+	switch l.endpoints {
+	case "monitor":
+		h = proxy.MonitorHandler()
+	case "cached-only":
+		h = proxy.CachedHandler()
+	case "sync":
+		h = proxy.SyncHandler()
+	case "snapshot":
+		h = proxy.SnapshotHandler()
+	case "admin":
+		h = proxy.AdminHandler()
+	default:
+		h = proxy.Handler()
+	}
+	mux := http.NewServeMux()
+	mux.Handle(l.prefix+"/", http.StripPrefix(l.prefix, h))
+	if publishExpvar && (l.endpoints == "all" || l.endpoints == "admin") {
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	return mux
+}
+
+// listenFlag collects repeated -listen flags. The command line is parsed twice (see -config),
+// specifications already there aren't added again
+type listenFlag []string
+
+func (l *listenFlag) Set(s string) error {
+	if _, err := parseListen(s); err != nil {
+		return err
+	}
+	if !slices.Contains(*l, s) {
+		*l = append(*l, s)
+	}
+	return nil
+}
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, " ")
+}
@@ -1,47 +1,68 @@
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
-	"github.com/ganboing/goproxy"
-	"log"
-	"net"
-	"net/http"
 	"os"
-	"os/signal"
-	"strings"
-	"syscall"
-	"time"
 )
 
+const usage = `Usage: proxy [serve] [options] <listen address>[/<prefix>]...
+       proxy prefetch [options] [-n] <go.mod|go.work>...
+       proxy verify [options]
+       proxy verify -zip <zip>...
+       proxy verify -gosum <go.sum> <dir>
+       proxy verify -extracted <dir> <module>@<version> [<dir> <module>@<version>...]
+       proxy verify -extracted -modcache <GOMODCACHE> [<module>@<version>...]
+       proxy purge [options] <module>...
+       proxy export [options] [-incremental] <dir>
+       proxy import [options] <dir>
+       proxy doctor [options]
+
+Commands:
+  serve     serve the GOPROXY protocol, the default
+  prefetch  fetch the requirements of go.mod and go.work files into the cache, and wait for them
+  verify    check the mirrors and archives of the cache, or hash module zips and directories as in go.sum
+  purge     remove the mirrors of modules from the cache, cloned afresh when requested next
+  export    write git bundles of the mirrors into a directory, only what's new with -incremental
+  import    restore mirrors from the bundles written by export, onto a new host
+  doctor    check the cache directory, git, and that upstream and peers answer
+
+The options configuring the cache and the server (-dir, -config...) are shared by all commands,
+see proxy <command> -h. Commands may work on the cache while a server serves it.
+`
+
+// Commands by name, serve being the default
+var commands = map[string]func(args []string){
+	"serve":    serve,
+	"prefetch": prefetch,
+	"verify":   verify,
+	"purge":    purge,
+	"export":   exportBundles,
+	"import":   importBundles,
+	"doctor":   doctor,
+}
+
 func main() {
-	addr := os.Args[1]
-	idx := strings.LastIndexByte(addr, '/')
-	prefix := ""
-	if idx != -1 {
-		prefix = addr[idx:]
-		addr = addr[:idx]
-	}
-	proxy := &goproxy.ProxyServer{Prefix: prefix}
-	server := &http.Server{
-		Addr:    addr,
-		Handler: proxy,
+	args := os.Args[1:]
+	command := serve
+	if len(args) != 0 {
+		if args[0] == "help" {
+			fmt.Print(usage)
+			return
+		}
+		if fn, ok := commands[args[0]]; ok {
+			command, args = fn, args[1:]
+		}
 	}
-	ln, err := net.Listen("tcp", server.Addr)
-	if err != nil {
-		log.Panicf("Failed to listen: %s", err.Error())
+	command(args)
+}
+
+// newFlagSet returns the flag set of a command, taking arguments after its options
+func newFlagSet(name, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet("proxy "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: proxy %s [options] %s\nRun proxy help for the other commands\n\nOptions:\n", name, arguments)
+		fs.PrintDefaults()
 	}
-	fmt.Fprintf(os.Stderr, "Listening on %s, Prefix=%s\n", ln.Addr().String(), prefix)
-	sigchan := make(chan os.Signal)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-	notify := make(chan struct{})
-	go func() {
-		<-sigchan
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		server.Shutdown(ctx)
-		notify <- struct{}{}
-	}()
-	server.Serve(ln)
-	<-notify
+	return fs
 }
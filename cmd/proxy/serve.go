@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ganboing/goproxy"
+)
+
+// serve runs the server until SIGINT or SIGTERM
+func serve(args []string) {
+	fs := newFlagSet("serve", "<listen address>[/<prefix>]...")
+	load := configFlags(fs)
+	grpcAddr := fs.String("grpc", "", "also serve the gRPC admin API (proto/admin.proto) over TLS on this address")
+	grpcCert := fs.String("grpc-cert", "", "PEM certificate chain of the gRPC listener")
+	grpcKey := fs.String("grpc-key", "", "PEM private key of the gRPC listener")
+	publishExpvar := fs.Bool("expvar", false, "publish metrics via expvar at /debug/vars")
+	readTimeout := goproxy.Duration(time.Minute)
+	writeTimeout := goproxy.Duration(time.Minute)
+	idleTimeout := goproxy.Duration(2 * time.Minute)
+	fs.Var(&readTimeout, "read-timeout", "timeout for reading requests")
+	fs.Var(&writeTimeout, "write-timeout", "timeout for writing responses, zips are extended by -stall-timeout as long as the client reads")
+	fs.Var(&idleTimeout, "idle-timeout", "timeout for idle keep-alive connections")
+	var listens listenFlag
+	fs.Var(&listens, "listen", "also listen on [<endpoints>=]<address>[/<prefix>], endpoints being all (default), monitor, cached-only, sync, snapshot or admin (repeatable)")
+	pidFileName := fs.String("pidfile", "", "write the pid to this file while serving, refusing to start if another running server holds it")
+	daemon := fs.Bool("daemon", false, "serve in the background, detached from the terminal once listening (logs to stderr are discarded then, use -log)")
+	proxy := load(args)
+	if *daemon {
+		daemonize()
+	}
+	if *publishExpvar {
+		proxy.PublishExpvar("goproxy")
+	}
+	var servers []*http.Server
+	var listeners []net.Listener
+	for _, arg := range append(fs.Args(), listens...) {
+		spec, err := parseListen(arg)
+		if err != nil {
+			log.Fatalf("Invalid listen address %s: %s", arg, err.Error())
+		}
+		if !strings.Contains(arg, "/") {
+			spec.prefix = strings.TrimSuffix(proxy.Prefix, "/")
+		}
+		server := &http.Server{
+			Addr:              spec.addr,
+			Handler:           spec.handler(proxy, *publishExpvar),
+			ReadHeaderTimeout: time.Duration(readTimeout),
+			ReadTimeout:       time.Duration(readTimeout),
+			WriteTimeout:      time.Duration(writeTimeout),
+			IdleTimeout:       time.Duration(idleTimeout),
+		}
+		ln, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Panicf("Failed to listen: %s", err.Error())
+		}
+		fmt.Fprintf(os.Stderr, "Listening on %s, Prefix=%s/, serving %s\n", ln.Addr().String(), spec.prefix, spec.endpoints)
+		servers = append(servers, server)
+		listeners = append(listeners, ln)
+	}
+	if len(servers) == 0 {
+		log.Fatalf("No listen address, pass <listen address>[/<prefix>] or -listen")
+	}
+	var pid *pidFile
+	if *pidFileName != "" {
+		var err error
+		pid, err = createPidFile(*pidFileName)
+		if err != nil {
+			log.Fatalf("Failed to create pid file %s: %s", *pidFileName, err.Error())
+		}
+	}
+	proxy.Start()
+	var grpcServer *http.Server
+	if *grpcAddr != "" {
+		if *grpcCert == "" || *grpcKey == "" {
+			log.Fatalf("-grpc requires -grpc-cert and -grpc-key, gRPC needs HTTP/2 which is only served over TLS")
+		}
+		grpcServer = &http.Server{
+			Addr:              *grpcAddr,
+			Handler:           proxy.GRPCHandler(),
+			ReadHeaderTimeout: time.Duration(readTimeout),
+			IdleTimeout:       time.Duration(idleTimeout),
+		}
+		grpcLn, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Panicf("Failed to listen for gRPC: %s", err.Error())
+		}
+		fmt.Fprintf(os.Stderr, "Serving gRPC admin API on %s\n", grpcLn.Addr().String())
+		go grpcServer.ServeTLS(grpcLn, *grpcCert, *grpcKey)
+	}
+	stopped := commandContext()
+	notify := make(chan struct{})
+	go func() {
+		<-stopped.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			server.Shutdown(ctx)
+		}
+		if grpcServer != nil {
+			grpcServer.Shutdown(ctx)
+		}
+		proxy.StepDown(ctx)
+		proxy.SuspendCloneJobs()
+		goproxy.KillSubprocesses()
+		if pid != nil {
+			pid.remove()
+		}
+		notify <- struct{}{}
+	}()
+	for i := range servers {
+		go servers[i].Serve(listeners[i])
+	}
+	if *daemon {
+		daemonReady()
+	}
+	<-notify
+}
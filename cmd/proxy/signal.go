@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Signals stopping a command gracefully. os.Interrupt is Ctrl-C on every platform, SIGTERM is what
+// service managers send
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// commandContext returns a context cancelled by the first stop signal. A second one kills the
+// process, as if the command didn't handle them
+func commandContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), stopSignals...)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
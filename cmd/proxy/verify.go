@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ganboing/goproxy"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// readGoSum maps "<module> <version>" to the hash of its zip
+func readGoSum(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	return sums, scanner.Err()
+}
+
+// zipVersion derives the module version of a zip from its name in the GOPROXY layout
+// (<module>/@v/<version>.zip under dir), or else from the prefix of its files (<module>@<version>/)
+func zipVersion(dir, name string) (string, string, error) {
+	if rel, err := filepath.Rel(dir, name); err == nil {
+		escapedModulePath, escapedVersion, ok := strings.Cut(filepath.ToSlash(rel), "/@v/")
+		if ok {
+			modulePath, err := module.UnescapePath(escapedModulePath)
+			if err == nil {
+				version, err := module.UnescapeVersion(strings.TrimSuffix(escapedVersion, ".zip"))
+				if err == nil {
+					return modulePath, version, nil
+				}
+			}
+		}
+	}
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer zr.Close()
+	if len(zr.File) == 0 {
+		return "", "", errors.New("empty zip")
+	}
+	modulePath, rest, ok := strings.Cut(zr.File[0].Name, "@")
+	version, _, ok2 := strings.Cut(rest, "/")
+	if !ok || !ok2 {
+		return "", "", errors.New(fmt.Sprintf("no <module>@<version>/ prefix in %s", zr.File[0].Name))
+	}
+	return modulePath, version, module.Check(modulePath, version)
+}
+
+func verifyDir(goSum, dir string) bool {
+	sums, err := readGoSum(goSum)
+	if err != nil {
+		log.Fatalf("failed to read %s: %s", goSum, err.Error())
+	}
+	verified, mismatches, unknown, failed := 0, 0, 0, 0
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(name, ".zip") {
+			return nil
+		}
+		modulePath, version, err := zipVersion(dir, name)
+		if err != nil {
+			log.Printf("%s: %s", name, err.Error())
+			failed++
+			return nil
+		}
+		want, ok := sums[modulePath+" "+version]
+		if !ok {
+			log.Printf("%s: %s %s is not in %s", name, modulePath, version, goSum)
+			unknown++
+			return nil
+		}
+		got, err := dirhash.HashZip(name, dirhash.Hash1)
+		if err != nil {
+			log.Printf("%s: failed to HashZip: %s", name, err.Error())
+			failed++
+			return nil
+		}
+		if got != want {
+			log.Printf("%s: MISMATCH %s %s: %s in go.sum, %s", name, modulePath, version, want, got)
+			mismatches++
+			return nil
+		}
+		verified++
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to walk %s: %s", dir, err.Error())
+	}
+	log.Printf("%d verified, %d mismatched, %d not in go.sum, %d failed", verified, mismatches, unknown, failed)
+	return mismatches == 0 && failed == 0
+}
+
+// verify checks the mirrors and archives of the cache, or hashes module zips and directories as
+// go.sum does
+func verify(args []string) {
+	fs := newFlagSet("verify", "[<zip>... | <dir> | <dir> <module>@<version>... | <module>@<version>...]")
+	load := configFlags(fs)
+	zips := fs.Bool("zip", false, "print the go.sum hash of module zips")
+	goSum := fs.String("gosum", "", "go.sum to verify the module zips under a directory against, exiting with 1 on mismatches")
+	extracted := fs.Bool("extracted", false, "print the go.sum lines of extracted module directories, given as <dir> <module>@<version>, or of the versions of -modcache (all of them by default)")
+	proxy := load(args)
+	switch {
+	case *zips:
+		if fs.NArg() == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		log.SetFlags(0)
+		failed := false
+		for _, name := range fs.Args() {
+			hash, err := dirhash.HashZip(name, dirhash.Hash1)
+			if err != nil {
+				log.Printf("%s: failed to HashZip: %s", name, err.Error())
+				failed = true
+				continue
+			}
+			fmt.Printf("%s %s\n", hash, name)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	case *goSum != "":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		log.SetFlags(0)
+		if !verifyDir(*goSum, fs.Arg(0)) {
+			os.Exit(1)
+		}
+	case *extracted:
+		log.SetFlags(0)
+		if !printSumLines(fs, proxy.ModCacheDir, fs.Args()) {
+			os.Exit(1)
+		}
+	default:
+		if fs.NArg() != 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		verifyCache(proxy)
+	}
+}
+
+// verifyCache checks every mirror and stored archive of the cache, exiting with 1 if any is corrupted
+func verifyCache(proxy *goproxy.ProxyServer) {
+	report := proxy.CheckIntegrity(commandContext())
+	names := make([]string, 0, len(report))
+	for name := range report {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	corrupted := 0
+	for _, name := range names {
+		if report[name].OK {
+			fmt.Printf("%s: ok\n", name)
+			continue
+		}
+		fmt.Printf("%s: CORRUPTED: %s\n", name, report[name].Error)
+		corrupted++
+	}
+	fmt.Printf("%d checked, %d corrupted\n", len(names), corrupted)
+	if corrupted != 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,369 @@
+// proxyctl talks to the admin API of a running proxy
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ganboing/goproxy"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: proxyctl [-server <url>] [-token <token>] [-json] <command> [args]
+
+Commands:
+  mirrors [prefix]            list local mirrors and directory sources
+  purge <module>              remove a mirror and its stored archives
+  refresh [-wait] <module>    update a mirror from its remote
+  jobs [-follow] [prefix]     show pending clone and update jobs
+  stats                       show counters and gauges
+  integrity                   show results of integrity checks
+  prefetch [-n] <file>...     fetch the requirements of go.mod or go.work files into the cache
+  compare <module>@<version>...
+  compare -sample <n>         compare artifacts generated from mirrors with upstream
+
+The server is the address of the proxy including its prefix, such as http://localhost:8080/go,
+taken from $PROXYCTL_SERVER if -server is not given. Commands changing the cache, and compare,
+send the admin token of the proxy (-admin-token), taken from $PROXYCTL_TOKEN if -token is not given.
+`
+
+type client struct {
+	server  string
+	token   string
+	rawJSON bool
+}
+
+func (c *client) call(method, endpoint string, query url.Values, v any) error {
+	return c.send(method, endpoint, query, nil, v)
+}
+
+// send is call with a request body
+func (c *client) send(method, endpoint string, query url.Values, body io.Reader, v any) error {
+	u := strings.TrimSuffix(c.server, "/") + "/admin/" + endpoint
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(data))))
+	}
+	if c.rawJSON && v != nil {
+		os.Stdout.Write(data)
+		fmt.Println()
+		return errRawPrinted
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// errRawPrinted tells commands the response was printed as it is with -json
+var errRawPrinted = errors.New("printed")
+
+func (c *client) mirrors(args []string) error {
+	query := url.Values{}
+	if len(args) > 0 {
+		query.Set("path", args[0])
+	}
+	var mirrors []goproxy.MirrorInfo
+	err := c.call(http.MethodGet, "mirrors", query, &mirrors)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODULE\tVCS\tREMOTE\tALIASES")
+	for _, m := range mirrors {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.ModulePath, m.VCS, m.Remote, strings.Join(m.Aliases, ","))
+	}
+	return tw.Flush()
+}
+
+func (c *client) purge(args []string) error {
+	if len(args) != 1 {
+		return errors.New("purge takes the module path")
+	}
+	err := c.call(http.MethodPost, "purge", url.Values{"path": {args[0]}}, nil)
+	if err == nil {
+		fmt.Printf("Purged %s\n", args[0])
+	}
+	return err
+}
+
+func (c *client) refresh(args []string) error {
+	fs := flag.NewFlagSet("refresh", flag.ExitOnError)
+	wait := fs.Bool("wait", false, "wait for the update to finish")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("refresh takes the module path")
+	}
+	query := url.Values{"path": {fs.Arg(0)}}
+	if *wait {
+		query.Set("wait", "1")
+	}
+	var job goproxy.CloneJob
+	err := c.call(http.MethodPost, "refresh", query, &job)
+	if err != nil {
+		return err
+	}
+	if *wait {
+		fmt.Printf("Updated %s\n", job.ModulePath)
+	} else {
+		fmt.Printf("Queued update of %s (%s priority)\n", job.ModulePath, job.Priority)
+	}
+	return nil
+}
+
+func printJobs(jobs []goproxy.CloneJob) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODULE\tKIND\tPRIORITY\tSTATE\tPROGRESS")
+	for _, job := range jobs {
+		kind := "update"
+		if job.Remote != "" {
+			kind = "clone"
+		}
+		state := fmt.Sprintf("queued %s", time.Since(job.Queued).Round(time.Second))
+		if job.Started != nil {
+			state = fmt.Sprintf("running %s", time.Since(*job.Started).Round(time.Second))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", job.ModulePath, kind, job.Priority, state, job.Progress)
+	}
+	return tw.Flush()
+}
+
+func (c *client) jobs(args []string) error {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	follow := fs.Bool("follow", false, "keep refreshing every second")
+	fs.Parse(args)
+	query := url.Values{}
+	if fs.NArg() > 0 {
+		query.Set("path", fs.Arg(0))
+	}
+	for {
+		var jobs []goproxy.CloneJob
+		err := c.call(http.MethodGet, "clones", query, &jobs)
+		if err != nil {
+			return err
+		}
+		if *follow {
+			// Clear the screen between refreshes
+			fmt.Print("\033[H\033[2J")
+		}
+		err = printJobs(jobs)
+		if err != nil || !*follow {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *client) stats(args []string) error {
+	var metrics map[string]int64
+	err := c.call(http.MethodGet, "metrics", nil, &metrics)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%d\n", name, metrics[name])
+	}
+	return tw.Flush()
+}
+
+func (c *client) integrity(args []string) error {
+	var report map[string]goproxy.IntegrityStatus
+	err := c.call(http.MethodGet, "integrity", nil, &report)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(report))
+	for name := range report {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tCHECKED\tSTATUS")
+	for _, name := range names {
+		status := "ok"
+		if !report[name].OK {
+			status = report[name].Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, report[name].Checked.Format(time.RFC3339), status)
+	}
+	return tw.Flush()
+}
+
+func (c *client) prefetch(args []string) error {
+	fs := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	dryRun := fs.Bool("n", false, "only print the module versions that would be prefetched")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("prefetch takes go.mod or go.work files")
+	}
+	versions, err := goproxy.Requirements(fs.Args())
+	if err != nil {
+		return err
+	}
+	var body strings.Builder
+	for _, v := range versions {
+		fmt.Fprintln(&body, v.String())
+	}
+	if *dryRun {
+		fmt.Print(body.String())
+		return nil
+	}
+	var report goproxy.PrefetchReport
+	err = c.send(http.MethodPost, "prefetch", nil, strings.NewReader(body.String()), &report)
+	if err != nil {
+		return err
+	}
+	refused := make([]string, 0, len(report.Refused))
+	for v := range report.Refused {
+		refused = append(refused, v)
+	}
+	sort.Strings(refused)
+	for _, v := range refused {
+		fmt.Printf("%s: %s\n", v, report.Refused[v])
+	}
+	fmt.Printf("%d cached, %d queued, %d refused\n", report.Cached, report.Queued, len(report.Refused))
+	return nil
+}
+
+func printComparison(c goproxy.UpstreamComparison) {
+	name := c.Module + "@" + c.Version
+	switch {
+	case c.Error != "":
+		fmt.Printf("%s: error: %s\n", name, c.Error)
+		return
+	case c.Match:
+		fmt.Printf("%s: matches upstream\n", name)
+	default:
+		fmt.Printf("%s: DIFFERS from upstream\n", name)
+	}
+	for _, a := range []struct {
+		ext string
+		cmp *goproxy.ArtifactComparison
+	}{{".info", c.Info}, {".mod", c.Mod}, {".zip", c.Zip}} {
+		if a.cmp == nil || a.cmp.Identical {
+			continue
+		}
+		fmt.Printf("  %s: %d bytes here, %d upstream", a.ext, a.cmp.Size, a.cmp.UpstreamSize)
+		if a.cmp.FirstDifference != nil {
+			fmt.Printf(", first difference at %d", *a.cmp.FirstDifference)
+		}
+		if a.cmp.H1 != a.cmp.UpstreamH1 {
+			fmt.Printf(", %s here, %s upstream", a.cmp.H1, a.cmp.UpstreamH1)
+		}
+		fmt.Println()
+		for _, diff := range a.cmp.Differences {
+			fmt.Printf("    %s\n", diff)
+		}
+	}
+}
+
+func (c *client) compare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	sample := fs.Int("sample", 0, "compare this many module versions served from mirrors, picked at random")
+	fs.Parse(args)
+	var queries []url.Values
+	if *sample > 0 {
+		queries = append(queries, url.Values{"sample": {fmt.Sprint(*sample)}})
+	}
+	for _, arg := range fs.Args() {
+		modulePath, version, ok := strings.Cut(arg, "@")
+		if !ok {
+			return errors.New(fmt.Sprintf("invalid module version %s, expecting <module>@<version>", arg))
+		}
+		queries = append(queries, url.Values{"path": {modulePath}, "version": {version}})
+	}
+	if len(queries) == 0 {
+		return errors.New("compare takes module versions or -sample")
+	}
+	differ, total := 0, 0
+	for _, query := range queries {
+		var results []goproxy.UpstreamComparison
+		err := c.call(http.MethodGet, "compare", query, &results)
+		if err == errRawPrinted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			printComparison(result)
+			total++
+			if !result.Match {
+				differ++
+			}
+		}
+	}
+	if differ != 0 {
+		return errors.New(fmt.Sprintf("%d of %d module versions differ from upstream or couldn't be compared", differ, total))
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	c := &client{}
+	flag.StringVar(&c.server, "server", os.Getenv("PROXYCTL_SERVER"), "address of the proxy including its prefix")
+	flag.StringVar(&c.token, "token", os.Getenv("PROXYCTL_TOKEN"), "admin token of the proxy, required by purge, refresh and prefetch, and by compare once set")
+	flag.BoolVar(&c.rawJSON, "json", false, "print the responses of the admin API as they are")
+	flag.Parse()
+	if flag.NArg() == 0 || c.server == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	commands := map[string]func([]string) error{
+		"mirrors":   c.mirrors,
+		"purge":     c.purge,
+		"refresh":   c.refresh,
+		"jobs":      c.jobs,
+		"stats":     c.stats,
+		"integrity": c.integrity,
+		"prefetch":  c.prefetch,
+		"compare":   c.compare,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := command(flag.Args()[1:])
+	if err != nil && err != errRawPrinted {
+		fmt.Fprintf(os.Stderr, "proxyctl: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,354 @@
+package goproxy
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Module versions compared per sample
+const MaxCompareSample = 100
+
+// UpstreamComparison compares the artifacts of a module version generated from its mirror with
+// those of the upstream proxy
+type UpstreamComparison struct {
+	Module  string
+	Version string
+	Checked time.Time
+	// Whether the .info versions and times, and the go.sum hashes of .mod and .zip are the same,
+	// what clients can tell apart
+	Match bool
+	Info  *ArtifactComparison `json:",omitempty"`
+	Mod   *ArtifactComparison `json:",omitempty"`
+	Zip   *ArtifactComparison `json:",omitempty"`
+	// Why the version couldn't be compared
+	Error string `json:",omitempty"`
+}
+
+// ArtifactComparison compares one artifact generated here with upstream's
+type ArtifactComparison struct {
+	// Byte for byte
+	Identical    bool
+	Size         int64
+	UpstreamSize int64
+	// Offset of the first byte differing, if not identical
+	FirstDifference *int64 `json:",omitempty"`
+	// go.sum hashes of .mod and .zip
+	H1         string `json:",omitempty"`
+	UpstreamH1 string `json:",omitempty"`
+	// Fields of .info, files of .zip differing
+	Differences []string `json:",omitempty"`
+}
+
+// compareUpstream generates the artifacts of a module version from its mirror, downloads those of
+// upstream and compares them
+func (p *ProxyServer) compareUpstream(ctx context.Context, modulePath, version string) UpstreamComparison {
+	result := UpstreamComparison{Module: modulePath, Version: version, Checked: time.Now()}
+	err := module.Check(modulePath, version)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Match = true
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		cmp, err := p.compareArtifact(ctx, modulePath, version, ext)
+		if err != nil {
+			result.Match, result.Error = false, fmt.Sprintf("%s: %s", ext, err.Error())
+			return result
+		}
+		switch ext {
+		case ".info":
+			result.Info = cmp
+			result.Match = result.Match && len(cmp.Differences) == 0
+		case ".mod":
+			result.Mod = cmp
+			result.Match = result.Match && cmp.H1 == cmp.UpstreamH1
+		case ".zip":
+			result.Zip = cmp
+			result.Match = result.Match && cmp.H1 == cmp.UpstreamH1
+		}
+	}
+	return result
+}
+
+func (p *ProxyServer) compareArtifact(ctx context.Context, modulePath, version, ext string) (*ArtifactComparison, error) {
+	modulePathTrim, verMajorTag, incompat, ok := checkModulePathVer(modulePath, version)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("module path/ver %s[%s] is invalid or not supported", modulePath, version))
+	}
+	reader, err := p.serveModLocal(ctx, modulePathTrim, verMajorTag, semver.Canonical(version), ext, incompat)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	local, err := createUnnamedTmpFile(p.cachePath(".tmp"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer local.Close()
+	_, err = io.Copy(local, reader)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := p.downloadUpstream(ctx, modulePath, version, ext)
+	if err != nil {
+		return nil, err
+	}
+	defer upstream.Close()
+	cmp := &ArtifactComparison{}
+	err = compareFiles(cmp, local, upstream)
+	if err != nil {
+		return nil, err
+	}
+	switch ext {
+	case ".info":
+		cmp.Differences, err = compareInfo(local, upstream)
+	case ".mod":
+		cmp.H1, cmp.UpstreamH1, err = modHashes(local, upstream)
+	case ".zip":
+		cmp.H1, err = hashZipFile(local)
+		if err == nil {
+			cmp.UpstreamH1, err = hashZipFile(upstream)
+		}
+		if err == nil && cmp.H1 != cmp.UpstreamH1 {
+			cmp.Differences, err = compareZips(local, upstream)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cmp, nil
+}
+
+// downloadUpstream downloads an artifact of upstream into an unnamed temporary file
+func (p *ProxyServer) downloadUpstream(ctx context.Context, modulePath, version, ext string) (*os.File, error) {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(modzip.MaxZipFile)
+	if ext != ".zip" {
+		limit = MaxGoImportResponse
+	}
+	tmp, err := createUnnamedTmpFile(p.cachePath(".tmp"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	url := p.upstreamURL() + "/" + path.Join(escapedModulePath, "@v", escapedVersion+ext)
+	_, err = downloadResumable(ctx, p.upstreamClient, url, tmp, limit)
+	if err != nil {
+		tmp.Close()
+		return nil, errors.New(fmt.Sprintf("%s: %s", url, err.Error()))
+	}
+	return tmp, nil
+}
+
+// compareFiles compares the content of the files generated here and upstream, filling cmp
+func compareFiles(cmp *ArtifactComparison, local, upstream *os.File) error {
+	fi, err := local.Stat()
+	if err != nil {
+		return err
+	}
+	cmp.Size = fi.Size()
+	fi, err = upstream.Stat()
+	if err != nil {
+		return err
+	}
+	cmp.UpstreamSize = fi.Size()
+	ra := io.NewSectionReader(local, 0, cmp.Size)
+	rb := io.NewSectionReader(upstream, 0, cmp.UpstreamSize)
+	bufA, bufB := make([]byte, 32<<10), make([]byte, 32<<10)
+	for offset := int64(0); ; {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		n := min(na, nb)
+		// One ending there differs too
+		i := 0
+		for i < n && bufA[i] == bufB[i] {
+			i++
+		}
+		if i < n || na != nb {
+			first := offset + int64(i)
+			cmp.FirstDifference = &first
+			return nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			cmp.Identical = true
+			return nil
+		}
+		if errA != nil {
+			return errA
+		}
+		if errB != nil {
+			return errB
+		}
+		offset += int64(n)
+	}
+}
+
+// compareInfo compares the Version and Time of two .info
+func compareInfo(local, upstream *os.File) ([]string, error) {
+	var infos [2]RevInfo
+	for i, f := range []*os.File{local, upstream} {
+		err := json.NewDecoder(io.NewSectionReader(f, 0, MaxGoImportResponse)).Decode(&infos[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	var diffs []string
+	if infos[0].Version != infos[1].Version {
+		diffs = append(diffs, fmt.Sprintf("Version: %s here, %s upstream", infos[0].Version, infos[1].Version))
+	}
+	if !infos[0].Time.Equal(infos[1].Time) {
+		diffs = append(diffs, fmt.Sprintf("Time: %s here, %s upstream",
+			infos[0].Time.UTC().Format(time.RFC3339), infos[1].Time.UTC().Format(time.RFC3339)))
+	}
+	return diffs, nil
+}
+
+func modHashes(local, upstream *os.File) (string, string, error) {
+	var hashes [2]string
+	for i, f := range []*os.File{local, upstream} {
+		data, err := io.ReadAll(io.NewSectionReader(f, 0, MaxGoImportResponse))
+		if err != nil {
+			return "", "", err
+		}
+		hashes[i], err = modHash(data)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return hashes[0], hashes[1], nil
+}
+
+type zipEntry struct {
+	size   uint64
+	sha256 string
+}
+
+// zipEntries returns the files of a module zip by their name in the module
+func zipEntries(f *os.File) (map[string]zipEntry, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	z, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]zipEntry, len(z.File))
+	for _, file := range z.File {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		// Names are <module>@<version>/<file>, versions have no slash
+		_, name, _ := strings.Cut(file.Name, "@")
+		_, name, _ = strings.Cut(name, "/")
+		entries[name] = zipEntry{size: file.UncompressedSize64, sha256: hex.EncodeToString(h.Sum(nil))}
+	}
+	return entries, nil
+}
+
+// compareZips lists the files of two module zips differing
+func compareZips(local, upstream *os.File) ([]string, error) {
+	here, err := zipEntries(local)
+	if err != nil {
+		return nil, err
+	}
+	there, err := zipEntries(upstream)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	for name, a := range here {
+		b, ok := there[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: only here", name))
+		case a != b:
+			diffs = append(diffs, fmt.Sprintf("%s: %d bytes sha256 %s here, %d bytes sha256 %s upstream", name, a.size, a.sha256, b.size, b.sha256))
+		}
+	}
+	for name := range there {
+		if _, ok := here[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: only upstream", name))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// compareSample compares up to n module versions served from mirrors, picked at random. Modules
+// matching GONOSUMDB (or GOPRIVATE) are left out, not to leak their paths
+func (p *ProxyServer) compareSample(ctx context.Context, n int) []UpstreamComparison {
+	results := []UpstreamComparison{}
+	for _, target := range p.collectSumCheckTargets() {
+		if len(results) >= n || ctx.Err() != nil {
+			break
+		}
+		escapedModulePath, escapedVersion, ok := cutLast(target, "@")
+		if !ok {
+			continue
+		}
+		modulePath, err := module.UnescapePath(escapedModulePath)
+		if err != nil {
+			continue
+		}
+		version, err := module.UnescapeVersion(escapedVersion)
+		if err != nil || module.MatchPrefixPatterns(noSumDBPatterns(), modulePath) {
+			continue
+		}
+		results = append(results, p.compareUpstream(ctx, modulePath, version))
+	}
+	return results
+}
+
+// serveAdminCompare compares ?path=<module>&version=<version>, or ?sample=<n> module versions
+// served from mirrors, with upstream
+func (p *ProxyServer) serveAdminCompare(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ctx, cancel := context.WithTimeout(r.Context(), p.localTimeout())
+	defer cancel()
+	if sample := query.Get("sample"); sample != "" {
+		n, err := strconv.Atoi(sample)
+		if err != nil || n <= 0 || n > MaxCompareSample {
+			httpRespString(w, http.StatusBadRequest, fmt.Sprintf("sample must be 1 to %d", MaxCompareSample))
+			return
+		}
+		httpRespJSON(w, http.StatusOK, p.compareSample(ctx, n))
+		return
+	}
+	result := p.compareUpstream(ctx, query.Get("path"), query.Get("version"))
+	loggerGreen.Printf(requestTag(ctx)+"serveAdminCompare: %s@%s matches upstream: %t"+LOG_RST, result.Module, result.Version, result.Match)
+	httpRespJSON(w, http.StatusOK, []UpstreamComparison{result})
+}
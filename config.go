@@ -0,0 +1,242 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// CloneOverride customizes how mirrors of matching modules are cloned and updated
+type CloneOverride struct {
+	// Comma-separated glob patterns of module path prefixes, same syntax as GOPRIVATE
+	Pattern string
+	// Partial clone filter, such as "blob:none"
+	Filter string `json:",omitempty"`
+	// Shallow clone depth, 0 for full history
+	Depth int `json:",omitempty"`
+	// Additional fetch refspecs of origin
+	Refspecs []string `json:",omitempty"`
+	// Replaces GitCloneTimeout for clone and update
+	Timeout Duration `json:",omitempty"`
+	// Replaces the remote discovered from upstream or go-import
+	Remote string `json:",omitempty"`
+	// Mirrors of the repo, tried in order when cloning or updating from the remote fails
+	Remotes []string `json:",omitempty"`
+}
+
+// SourceOverride pins where a module is cloned from, skipping upstream and go-import discovery.
+// Needed for modules whose vanity host is dead but whose repo still exists
+type SourceOverride struct {
+	// Module path, also covering the module paths beneath it
+	Module string
+	// Git URL of the repo
+	Remote string
+	// Directory of the module in the repo. Mirrors are stored at the module path without
+	// the subdirectory, thus the module path must end with it
+	Subdir string `json:",omitempty"`
+}
+
+// ForgeMirror redirects clones and updates of repos on a forge to an internal mirror of it.
+// Mirrors keep the canonical remote, which is also reported in .info, only the transfer is redirected
+type ForgeMirror struct {
+	// Host of the forge, such as github.com
+	Host string
+	// Base URL of the mirror, such as https://git.internal.example.com/github-mirror.
+	// https://<Host>/owner/repo is fetched from <Mirror>/owner/repo
+	Mirror string
+}
+
+// TagRule describes how versions of matching modules are tagged, for repos not following vX.Y.Z
+type TagRule struct {
+	// Comma-separated glob patterns of module path prefixes, same syntax as GOPRIVATE
+	Pattern string
+	// Replaces the "v" of tags, such as "" for 1.2.3 or "release-" for release-1.2.3
+	Prefix string
+}
+
+// LoadConfig reads the JSON configuration file into the exported fields of p
+func (p *ProxyServer) LoadConfig(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(p)
+	if err != nil {
+		return err
+	}
+	if p.Vulns != nil {
+		err = p.Vulns.Check()
+		if err != nil {
+			return err
+		}
+	}
+	if p.Policy != nil {
+		err = p.Policy.Check()
+		if err != nil {
+			return err
+		}
+	}
+	if p.Resolver != nil {
+		err = p.Resolver.Check()
+		if err != nil {
+			return err
+		}
+	}
+	if p.Alerts != nil {
+		err = p.Alerts.Check()
+		if err != nil {
+			return err
+		}
+	}
+	if p.Clients != nil {
+		err = p.Clients.Check()
+		if err != nil {
+			return err
+		}
+	}
+	err = p.Pins.Check()
+	if err != nil {
+		return err
+	}
+	err = p.CredentialHelpers.Check()
+	if err != nil {
+		return err
+	}
+	err = p.Egress.Check()
+	if err != nil {
+		return err
+	}
+	_, err = parsePrefixes(p.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if len(p.SumAllowlist) != 0 {
+		_, err = newSumAllowlist(p.SumAllowlist)
+		if err != nil {
+			return err
+		}
+	}
+	return p.checkSourceOverrides()
+}
+
+// cloneOverride returns the first CloneOverride matching modulePath
+func (p *ProxyServer) cloneOverride(modulePath string) *CloneOverride {
+	for i := range p.CloneOverrides {
+		if module.MatchPrefixPatterns(p.CloneOverrides[i].Pattern, modulePath) {
+			return &p.CloneOverrides[i]
+		}
+	}
+	return nil
+}
+
+// sourceOverride returns the mirror path, the path of the module in it and the remote of the
+// SourceOverride with the longest module path covering modulePath
+func (p *ProxyServer) sourceOverride(modulePath string) (string, string, string, bool) {
+	var match *SourceOverride
+	for i := range p.SourceOverrides {
+		o := &p.SourceOverrides[i]
+		if modulePath != o.Module && !strings.HasPrefix(modulePath, o.Module+"/") {
+			continue
+		}
+		if match == nil || len(o.Module) > len(match.Module) {
+			match = o
+		}
+	}
+	if match == nil {
+		return "", "", "", false
+	}
+	mirrorPath := match.Module
+	subPath := strings.TrimPrefix(strings.TrimPrefix(modulePath, match.Module), "/")
+	if match.Subdir != "" {
+		mirrorPath = strings.TrimSuffix(match.Module, "/"+match.Subdir)
+		subPath = path.Join(match.Subdir, subPath)
+	}
+	return mirrorPath, subPath, match.Remote, true
+}
+
+// forgeMirrorArgs returns the git options of commands talking to remotes: rewriting them with
+// ForgeMirrors (url.<base>.insteadOf), going through the remote proxy (CloneRateLimit, Resolver,
+// Egress), and authenticating with CredentialHelpers
+func (p *ProxyServer) forgeMirrorArgs() []string {
+	var args []string
+	for _, m := range p.ForgeMirrors {
+		args = append(args, "-c", fmt.Sprintf("url.%s/.insteadOf=https://%s/", strings.TrimSuffix(m.Mirror, "/"), m.Host))
+	}
+	if p.remoteProxy != nil {
+		args = append(args, "-c", "http.proxy="+p.remoteProxy.url())
+	}
+	return append(args, p.CredentialHelpers.args()...)
+}
+
+// localRemotePath returns the directory of a local repo remote: an absolute path or a file:// URL
+func localRemotePath(remote string) (string, bool) {
+	if strings.HasPrefix(remote, "/") {
+		return path.Clean(remote), true
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return path.Clean(u.Path), true
+}
+
+// checkDiscoveredRemote vets a remote found via upstream or go-import, which is under the control
+// of whoever hosts the module. Local repos are only allowed beneath LocalRemoteDirs, and transports
+// other than http(s), ssh and git are refused. Remotes from the configuration are trusted
+func (p *ProxyServer) checkDiscoveredRemote(remote string) error {
+	dir, local := localRemotePath(remote)
+	if !local {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "https", "http", "ssh", "git", "git+ssh":
+			return nil
+		}
+		return errors.New(fmt.Sprintf("remote %s uses unsupported transport", remote))
+	}
+	for _, allowed := range p.LocalRemoteDirs {
+		allowed = path.Clean(allowed)
+		if dir == allowed || strings.HasPrefix(dir, allowed+"/") {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("local remote %s is not beneath LocalRemoteDirs", remote))
+}
+
+// checkSourceOverrides validates SourceOverrides
+func (p *ProxyServer) checkSourceOverrides() error {
+	for _, o := range p.SourceOverrides {
+		if o.Remote == "" {
+			return errors.New(fmt.Sprintf("source override of %s has no remote", o.Module))
+		}
+		err := module.CheckImportPath(o.Module)
+		if err != nil {
+			return err
+		}
+		if o.Subdir != "" && !strings.HasSuffix(o.Module, "/"+o.Subdir) {
+			return errors.New(fmt.Sprintf("module path %s doesn't end with its subdirectory %s", o.Module, o.Subdir))
+		}
+	}
+	return nil
+}
+
+// tagRule returns the first TagRule matching modulePath
+func (p *ProxyServer) tagRule(modulePath string) *TagRule {
+	for i := range p.TagRules {
+		if module.MatchPrefixPatterns(p.TagRules[i].Pattern, modulePath) {
+			return &p.TagRules[i]
+		}
+	}
+	return nil
+}
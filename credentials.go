@@ -0,0 +1,89 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// CredentialHelper is a git credential helper authenticating clones and updates of remotes
+// matching URL, such as one handing out short-lived tokens from Vault or a cloud IAM. git runs it
+// for every command talking to the remote, so that credentials rotate without restarting
+type CredentialHelper struct {
+	// Remotes the helper is for, as in credential.<url>.helper (scheme and host, optionally a
+	// path prefix). Empty for every remote
+	URL string `json:",omitempty"`
+	// Helper as in credential.helper: the name of a git-credential-<name> program with its
+	// arguments, an absolute path, or a shell snippet starting with "!"
+	Helper string
+	// Hand the path of the repo to the helper too (credential.useHttpPath), for per repo tokens
+	UseHttpPath bool `json:",omitempty"`
+}
+
+// Check validates the helper
+func (h *CredentialHelper) Check() error {
+	if strings.TrimSpace(h.Helper) == "" {
+		return errors.New("credential helper without Helper")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New(fmt.Sprintf("invalid URL %s of credential helper, expecting <scheme>://<host>[/<path>]", h.URL))
+		}
+	}
+	return nil
+}
+
+// CredentialHelpers are consulted in order, after those of the git configuration
+type CredentialHelpers []CredentialHelper
+
+// Set adds a helper for every remote, for command line flags. The command line is parsed twice
+// (see -config), helpers already there aren't added again
+func (c *CredentialHelpers) Set(s string) error {
+	h := CredentialHelper{Helper: s}
+	err := h.Check()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(*c, h) {
+		*c = append(*c, h)
+	}
+	return nil
+}
+
+func (c *CredentialHelpers) String() string {
+	var helpers []string
+	for _, h := range *c {
+		helpers = append(helpers, h.Helper)
+	}
+	return strings.Join(helpers, " ")
+}
+
+// Check validates the helpers
+func (c CredentialHelpers) Check() error {
+	for i := range c {
+		err := c[i].Check()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// args returns the git options configuring the helpers
+func (c CredentialHelpers) args() []string {
+	var args []string
+	for _, h := range c {
+		key := "credential"
+		if h.URL != "" {
+			key += "." + h.URL
+		}
+		args = append(args, "-c", key+".helper="+h.Helper)
+		if h.UseHttpPath {
+			args = append(args, "-c", key+".useHttpPath=true")
+		}
+	}
+	return args
+}
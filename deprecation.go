@@ -0,0 +1,80 @@
+package goproxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+const DeprecationHeader = "X-Go-Module-Deprecated"
+
+type Deprecation struct {
+	// Highest version seen carrying the comment
+	Version string
+	Message string
+	Seen    time.Time
+}
+
+type deprecationState struct {
+	mu      sync.Mutex
+	modules map[string]Deprecation
+	// Highest version of go.mod seen per module, deprecated or not
+	versions map[string]string
+}
+
+// recordDeprecation parses the "// Deprecated:" comment of a served go.mod.
+// Like cmd/go, only the go.mod of the highest version seen decides whether the module is deprecated
+func (p *ProxyServer) recordDeprecation(modulePath, ver string, data []byte) {
+	f, err := modfile.ParseLax("go.mod", data, nil)
+	if err != nil || f.Module == nil {
+		return
+	}
+	p.deprecations.mu.Lock()
+	defer p.deprecations.mu.Unlock()
+	if p.deprecations.modules == nil {
+		p.deprecations.modules = make(map[string]Deprecation)
+		p.deprecations.versions = make(map[string]string)
+	}
+	highest, ok := p.deprecations.versions[modulePath]
+	if ok && semver.Compare(ver, highest) < 0 {
+		return
+	}
+	p.deprecations.versions[modulePath] = ver
+	if f.Module.Deprecated == "" {
+		delete(p.deprecations.modules, modulePath)
+		return
+	}
+	if _, ok := p.deprecations.modules[modulePath]; !ok {
+		loggerYellow.Printf("recordDeprecation: %s@%s is deprecated: %s"+LOG_RST, modulePath, ver, f.Module.Deprecated)
+	}
+	p.deprecations.modules[modulePath] = Deprecation{
+		Version: ver,
+		Message: f.Module.Deprecated,
+		Seen:    time.Now(),
+	}
+}
+
+func (p *ProxyServer) deprecationReport() map[string]Deprecation {
+	p.deprecations.mu.Lock()
+	defer p.deprecations.mu.Unlock()
+	report := make(map[string]Deprecation, len(p.deprecations.modules))
+	for k, v := range p.deprecations.modules {
+		report[k] = v
+	}
+	return report
+}
+
+func (p *ProxyServer) setDeprecationHeader(w http.ResponseWriter, modulePath string) {
+	if !p.DeprecationHeader {
+		return
+	}
+	p.deprecations.mu.Lock()
+	defer p.deprecations.mu.Unlock()
+	d, ok := p.deprecations.modules[modulePath]
+	if ok {
+		w.Header().Set(DeprecationHeader, d.Message)
+	}
+}
@@ -0,0 +1,160 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Directory-backed modules have <module>/.vcs pointing to .mod instead of .git. Their versions
+// are plain source trees (no VCS) listed in <module>/.mod/versions.json, and .info/.mod/.zip
+// are generated from them on demand:
+//
+//	{
+//	  "v1.2.0": {"Dir": "v1.2.0", "Time": "2024-05-01T00:00:00Z"},
+//	  "v1.3.0": {"Dir": "/srv/drops/foo-1.3.0"}
+//	}
+const dirSourceManifest = "versions.json"
+
+// DirVersion is a version of a directory-backed module
+type DirVersion struct {
+	// Source tree, relative to the .mod directory or absolute. Nested modules and
+	// /vN modules are found beneath it like in a repo
+	Dir string
+	// Reported in .info, the modification time of Dir if zero
+	Time time.Time `json:",omitempty"`
+}
+
+func loadDirVersions(moddir string) (map[string]DirVersion, error) {
+	data, err := os.ReadFile(path.Join(moddir, dirSourceManifest))
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]DirVersion)
+	err = json.Unmarshal(data, &versions)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid %s: %s", dirSourceManifest, err.Error()))
+	}
+	return versions, nil
+}
+
+func (p *ProxyServer) serveModPlain(ctx context.Context, modulePath, verMajorTag, subPath, verCanonical, ext string, incompat bool) (io.ReadSeekCloser, error) {
+	moddir := p.cachePath(path.Join(modulePath, ".mod"))
+	versions, err := loadDirVersions(moddir)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to load versions of %s: %s", modulePath, err.Error()))
+	}
+	ver := verCanonical
+	if incompat {
+		ver += "+incompatible"
+	}
+	dirVer, ok := versions[ver]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("version %s of %s not found in %s", ver, modulePath, dirSourceManifest))
+	}
+	dir := dirVer.Dir
+	if !path.IsAbs(dir) {
+		// Relative directories must stay in the cache
+		dir = path.Join(modulePath, ".mod", dir)
+		err = p.root.beneath(dir)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid directory of %s@%s: %s", modulePath, ver, err.Error()))
+		}
+		dir = p.cachePath(dir)
+	}
+	modFull := modulePath
+	if subPath != "" {
+		dir = path.Join(dir, subPath)
+		modFull = path.Join(modFull, subPath)
+	}
+	if verMajorTag != "" {
+		modFull = path.Join(modFull, verMajorTag)
+		// Like in repos, vN/ is used if it holds the go.mod of the major version
+		_, err = os.Stat(path.Join(dir, verMajorTag, "go.mod"))
+		if err == nil {
+			dir = path.Join(dir, verMajorTag)
+		}
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch ext {
+	case ".info":
+		tm := dirVer.Time
+		if tm.IsZero() {
+			tm = fi.ModTime()
+		}
+		data, err := json.Marshal(RevInfo{Version: ver, Time: tm.In(time.UTC)})
+		if err != nil {
+			return nil, err
+		}
+		return nopSeekCloser{bytes.NewReader(data)}, nil
+	case ".mod":
+		data, err := os.ReadFile(path.Join(dir, "go.mod"))
+		if errors.Is(err, os.ErrNotExist) {
+			loggerYellow.Printf(requestTag(ctx)+"serveModPlain: Using synthesized go.mod for %s"+LOG_RST, modFull)
+			data = []byte(fmt.Sprintf("module %s\n", modFull))
+		} else if err != nil {
+			return nil, err
+		}
+		return nopSeekCloser{bytes.NewReader(data)}, nil
+	case ".zip":
+		archiveTmp, err := createUnnamedTmpFile(p.cachePath(".tmp"), 0600)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to create temp file (archive): %s", err.Error()))
+		}
+		prefix := modFull + "@" + ver + "/"
+		out := &limitedWriter{w: archiveTmp, n: p.maxZipSize()}
+		p.metrics.ActiveArchives.Add(1)
+		// CreateFromDir applies the rules of the go command: nested modules, vendor and files
+		// not allowed in module zips are left out, and the size limits are checked
+		err = modzip.CreateFromDir(out, module.Version{Path: modFull, Version: ver}, dir)
+		p.metrics.ActiveArchives.Add(-1)
+		if out.exceeded {
+			archiveTmp.Close()
+			return nil, &ZipTooLargeError{Prefix: prefix, Limit: p.maxZipSize()}
+		}
+		if err != nil {
+			archiveTmp.Close()
+			return nil, errors.New(fmt.Sprintf("failed to create zip of %s: %s", prefix, err.Error()))
+		}
+		archiveTmp.Seek(0, io.SeekStart)
+		err = p.scanZip(ctx, modFull, ver, archiveTmp, nil)
+		if err != nil {
+			archiveTmp.Close()
+			return nil, err
+		}
+		return archiveTmp, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported extension %s", ext))
+}
+
+// isDirSource tells if the module is directory-backed, or served by a registered VCSBackend.
+// Those are never on upstream, thus are always served from the cache
+func (p *ProxyServer) isDirSource(escapedModulePath string) bool {
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return false
+	}
+	_, _, vcs, err := p.checkModVcsLocal(modulePath)
+	_, backend := p.vcsBackends[vcs]
+	return err == nil && (vcs == ".mod" || backend)
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,229 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Answers are cached for DNSCacheTTL unless Resolver.TTL says otherwise, names that don't exist
+// for DNSNegativeTTL at most. When the resolver fails, the last answer keeps being used and the
+// resolver is asked again after DNSNegativeTTL
+const (
+	DNSCacheTTL    = 5 * time.Minute
+	DNSNegativeTTL = 30 * time.Second
+)
+
+// Resolver configures how hosts of go-import lookups and http(s) git remotes are resolved. Answers
+// are cached, and concurrent lookups of a host share one query, so that a slow or flaky DNS doesn't
+// hold up module resolution
+type Resolver struct {
+	// DNS server (host:port, port 53 if omitted) queried instead of the system resolver
+	Server string `json:",omitempty"`
+	// Addresses of hosts, like /etc/hosts, taking precedence over DNS
+	Hosts StaticHosts `json:",omitempty"`
+	// How long answers are cached, 0 uses DNSCacheTTL
+	TTL Duration `json:",omitempty"`
+}
+
+// StaticHosts maps host names to their addresses
+type StaticHosts map[string][]string
+
+// Set adds a host from <host>=<addr>[,<addr>...], for command line flags
+func (h *StaticHosts) Set(s string) error {
+	host, addrs, ok := strings.Cut(s, "=")
+	if !ok || host == "" || addrs == "" {
+		return errors.New(fmt.Sprintf("invalid host %s, expecting <host>=<addr>[,<addr>...]", s))
+	}
+	if *h == nil {
+		*h = StaticHosts{}
+	}
+	(*h)[host] = strings.Split(addrs, ",")
+	return nil
+}
+
+func (h *StaticHosts) String() string {
+	var entries []string
+	for host, addrs := range *h {
+		entries = append(entries, host+"="+strings.Join(addrs, ","))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " ")
+}
+
+// Check validates the resolver configuration
+func (r *Resolver) Check() error {
+	for host, addrs := range r.Hosts {
+		for _, addr := range addrs {
+			if net.ParseIP(addr) == nil {
+				return errors.New(fmt.Sprintf("address %s of host %s is not an IP address", addr, host))
+			}
+		}
+	}
+	if r.Server != "" {
+		_, _, err := net.SplitHostPort(r.serverAddr())
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid DNS server %s: %s", r.Server, err.Error()))
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) serverAddr() string {
+	if _, _, err := net.SplitHostPort(r.Server); err == nil {
+		return r.Server
+	}
+	return net.JoinHostPort(strings.Trim(r.Server, "[]"), "53")
+}
+
+// dnsCache resolves and caches hosts as configured by Resolver. A nil cache leaves resolution to
+// the system, uncached
+type dnsCache struct {
+	resolver *net.Resolver
+	hosts    map[string][]string
+	ttl      time.Duration
+	mu       sync.Mutex
+	entries  map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	// Closed once the lookup is done
+	done    chan struct{}
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func newDNSCache(r *Resolver) *dnsCache {
+	if r == nil {
+		return nil
+	}
+	c := &dnsCache{
+		resolver: net.DefaultResolver,
+		hosts:    make(map[string][]string),
+		ttl:      time.Duration(r.TTL),
+		entries:  make(map[string]*dnsEntry),
+	}
+	if c.ttl <= 0 {
+		c.ttl = DNSCacheTTL
+	}
+	for host, addrs := range r.Hosts {
+		c.hosts[strings.ToLower(host)] = addrs
+	}
+	if r.Server != "" {
+		server := r.serverAddr()
+		c.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				dialer := &net.Dialer{Timeout: DirectConnectTimeout}
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return c
+}
+
+// lookup returns the addresses of host. Callers of a host being looked up wait for that lookup,
+// which isn't bound to the context of any of them
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addrs, ok := c.hosts[host]; ok {
+		return addrs, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	c.mu.Lock()
+	e := c.entries[host]
+	if e != nil {
+		select {
+		case <-e.done:
+			if time.Now().Before(e.expires) {
+				c.mu.Unlock()
+				return e.addrs, e.err
+			}
+		default:
+			c.mu.Unlock()
+			return e.wait(ctx)
+		}
+	}
+	last := e
+	e = &dnsEntry{done: make(chan struct{})}
+	c.entries[host] = e
+	c.mu.Unlock()
+	go c.resolve(host, e, last)
+	return e.wait(ctx)
+}
+
+func (e *dnsEntry) wait(ctx context.Context) ([]string, error) {
+	select {
+	case <-e.done:
+		return e.addrs, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve fills e, falling back to the last answer if the resolver fails
+func (c *dnsCache) resolve(host string, e, last *dnsEntry) {
+	defer close(e.done)
+	ctx, cancel := context.WithTimeout(context.Background(), DirectConnectTimeout)
+	defer cancel()
+	e.addrs, e.err = c.resolver.LookupHost(ctx, host)
+	now := time.Now()
+	if e.err == nil {
+		e.expires = now.Add(c.ttl)
+		return
+	}
+	var dnsErr *net.DNSError
+	if errors.As(e.err, &dnsErr) && dnsErr.IsNotFound {
+		e.expires = now.Add(min(c.ttl, DNSNegativeTTL))
+		return
+	}
+	if last != nil && last.err == nil {
+		loggerYellow.Printf("dnsCache: Failed to resolve %s, using last addresses %v: %s"+LOG_RST, host, last.addrs, e.err.Error())
+		e.addrs, e.err = last.addrs, nil
+		e.expires = now.Add(DNSNegativeTTL)
+		return
+	}
+	// Not cached, the next caller asks again
+	e.expires = now
+}
+
+// dial connects to addr (host:port), trying the addresses of host in turn
+func (c *dnsCache) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DirectConnectTimeout, KeepAlive: 30 * time.Second}
+	if c == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New(fmt.Sprintf("no addresses for %s", host))
+	}
+	return nil, firstErr
+}
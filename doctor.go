@@ -0,0 +1,75 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Diagnosis is the outcome of one check of Diagnose
+type Diagnosis struct {
+	Check string
+	OK    bool
+	// What was found, or why the check failed
+	Detail string
+}
+
+// Diagnose checks what serving depends on: the cache directory being writable, the git and zstd
+// commands, and the upstream proxy, checksum database and peers answering through the configured
+// egress routes and CA bundle
+func (p *ProxyServer) Diagnose(ctx context.Context) []Diagnosis {
+	p.initOnce.Do(p.init)
+	var results []Diagnosis
+	add := func(check, detail string, err error) {
+		if err != nil {
+			detail = err.Error()
+		}
+		results = append(results, Diagnosis{Check: check, OK: err == nil, Detail: detail})
+	}
+	tmp, err := createUnnamedTmpFile(p.cachePath(".tmp"), 0600)
+	if err == nil {
+		tmp.Close()
+	}
+	dir, _ := filepath.Abs(p.cachePath("."))
+	add("cache", dir, err)
+	commands := []string{GitCommand}
+	if p.CompressArchives {
+		commands = append(commands, ZstdCommand)
+	}
+	for _, command := range commands {
+		out, err := exec.CommandContext(ctx, command, "--version").Output()
+		add(command, strings.TrimSpace(string(out)), err)
+	}
+	add("upstream", p.upstreamURL(), p.diagnoseURL(ctx, p.upstreamURL()+"/"))
+	if p.SumDBCheckInterval != 0 {
+		add("sumdb", p.sumDBURL(), p.diagnoseURL(ctx, p.sumDBURL()+"/latest"))
+	}
+	for _, peer := range p.Peers {
+		peer = strings.TrimSuffix(peer, "/")
+		add("peer", peer, p.diagnoseURL(ctx, peer+"/"))
+	}
+	return results
+}
+
+// diagnoseURL tells if url answers without a server error
+func (p *ProxyServer) diagnoseURL(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, UpstreamProxyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.New(fmt.Sprintf("%s: HTTP status %d", url, resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Requests of an artifact from upstream or peers, each resuming the previous interrupted one
+const DownloadAttempts = 5
+
+// downloadResumable copies the artifact at url into tmp, up to limit bytes. A transfer interrupted
+// after making progress is resumed with a Range request, If-Range making sure the pieces are of the
+// same content; a server ignoring it or whose content changed sends it all again, like one sending
+// neither ETag nor Last-Modified is asked for. It returns the headers of the response the download
+// started with
+func downloadResumable(ctx context.Context, client *http.Client, url string, tmp *os.File, limit int64) (http.Header, error) {
+	var header http.Header
+	// ETag or Last-Modified of the content being downloaded
+	validator := ""
+	size := int64(-1)
+	written := int64(0)
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if written > 0 && validator != "" {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			req.Header.Set("If-Range", validator)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && written > 0:
+			start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+			if !ok || start != written || (size >= 0 && total != size) {
+				resp.Body.Close()
+				return nil, errors.New(fmt.Sprintf("unexpected Content-Range %s resuming at %d", resp.Header.Get("Content-Range"), written))
+			}
+		case resp.StatusCode == http.StatusOK:
+			if written > 0 {
+				loggerYellow.Printf(requestTag(ctx)+"downloadResumable: %s changed or can't be resumed, starting over"+LOG_RST, url)
+			}
+			written = 0
+			_, err = tmp.Seek(0, io.SeekStart)
+			if err == nil {
+				err = tmp.Truncate(0)
+			}
+			if err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			header, size = resp.Header, resp.ContentLength
+			validator = resp.Header.Get("ETag")
+			if validator == "" || strings.HasPrefix(validator, "W/") {
+				// Weak ETags can't be used for ranges
+				validator = resp.Header.Get("Last-Modified")
+			}
+		default:
+			resp.Body.Close()
+			return nil, errors.New(fmt.Sprintf("HTTP error %d", resp.StatusCode))
+		}
+		n, err := io.Copy(tmp, &bodyLimiter{r: resp.Body, n: limit - written})
+		resp.Body.Close()
+		written += n
+		if err == nil && size >= 0 && written != size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			return header, nil
+		}
+		if err == errResponseTooLarge || ctx.Err() != nil || n == 0 || attempt == DownloadAttempts {
+			return nil, err
+		}
+		loggerYellow.Printf(requestTag(ctx)+"downloadResumable: %s interrupted at %d bytes, retrying: %s"+LOG_RST, url, written, err.Error())
+	}
+}
+
+// parseContentRange parses "bytes <start>-<end>/<total>"
+func parseContentRange(s string) (start, total int64, ok bool) {
+	r, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	r, totalStr, ok := strings.Cut(r, "/")
+	startStr, _, ok2 := strings.Cut(r, "-")
+	if !ok || !ok2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if totalStr != "*" {
+		total, err = strconv.ParseInt(totalStr, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
+
+// verifyDownload checks the downloaded artifact against the digests the server sent, if any:
+// Repr-Digest or Digest (sha-256), X-Goog-Hash (md5, sent by Google Cloud Storage) and for zips,
+// X-GoProxy-H1 of signing peers. Zips must also be well-formed module zips of the version
+func verifyDownload(tmp *os.File, header http.Header, escapedModulePath, prop string) error {
+	for _, check := range []struct {
+		name, value, alg string
+		h                func() hash.Hash
+	}{
+		{"Repr-Digest", header.Get("Repr-Digest"), "sha-256", sha256.New},
+		{"Digest", header.Get("Digest"), "sha-256", sha256.New},
+		{"X-Goog-Hash", header.Get("X-Goog-Hash"), "md5", md5.New},
+	} {
+		want := digestValue(check.value, check.alg)
+		if want == "" {
+			continue
+		}
+		h := check.h()
+		_, err := tmp.Seek(0, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(h, tmp)
+		}
+		if err != nil {
+			return err
+		}
+		got := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if got != want {
+			return errors.New(fmt.Sprintf("%s mismatch: %s=%s, downloaded %s", check.name, check.alg, want, got))
+		}
+	}
+	if !strings.HasSuffix(prop, ".zip") {
+		return nil
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return err
+	}
+	version, err := module.UnescapeVersion(strings.TrimSuffix(prop, ".zip"))
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("/dev/fd/%d", tmp.Fd())
+	_, err = modzip.CheckZip(module.Version{Path: modulePath, Version: version}, name)
+	if err != nil {
+		return err
+	}
+	if want := header.Get("X-GoProxy-H1"); want != "" {
+		got, err := dirhash.HashZip(name, dirhash.Hash1)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return errors.New(fmt.Sprintf("X-GoProxy-H1 mismatch: %s, downloaded %s", want, got))
+		}
+	}
+	return nil
+}
+
+// digestValue extracts the base64 digest of alg from a digest header, such as
+// "sha-256=:<base64>:" (Repr-Digest), "SHA-256=<base64>" (Digest) or "crc32c=<base64>, md5=<base64>" (X-Goog-Hash)
+func digestValue(header, alg string) string {
+	for _, item := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if ok && strings.EqualFold(name, alg) {
+			return strings.Trim(value, ":")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,229 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Proxy of EgressRule connecting directly, regardless of the environment
+const EgressDirect = "direct"
+
+// EgressRule routes outbound connections to some hosts directly or through a proxy
+type EgressRule struct {
+	// Comma-separated glob patterns of host names, such as "*.corp.example.com,github.com"
+	Hosts string
+	// EgressDirect, or the URL of an HTTP (http://[user:password@]host[:port]) or SOCKS5
+	// (socks5://[user:password@]host[:port]) proxy
+	Proxy string
+}
+
+// EgressRules route the outbound connections of the server: the upstream proxy, go-import
+// discovery, peers, checksum database and git remotes over http(s). The first rule matching the
+// host applies, hosts matching none go through the proxy of the environment (HTTPS_PROXY etc.)
+type EgressRules []EgressRule
+
+// Set adds a rule from <hosts>=<proxy>, for command line flags. The command line is parsed twice
+// (see -config), rules already there aren't added again
+func (e *EgressRules) Set(s string) error {
+	hosts, proxy, ok := strings.Cut(s, "=")
+	if !ok || hosts == "" || proxy == "" {
+		return errors.New(fmt.Sprintf("invalid egress rule %s, expecting <hosts>=direct|<proxy URL>", s))
+	}
+	rule := EgressRule{Hosts: hosts, Proxy: proxy}
+	err := EgressRules{rule}.Check()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(*e, rule) {
+		*e = append(*e, rule)
+	}
+	return nil
+}
+
+func (e *EgressRules) String() string {
+	var rules []string
+	for _, rule := range *e {
+		rules = append(rules, rule.Hosts+"="+rule.Proxy)
+	}
+	return strings.Join(rules, " ")
+}
+
+// Check validates the rules
+func (e EgressRules) Check() error {
+	for _, rule := range e {
+		if rule.Hosts == "" {
+			return errors.New(fmt.Sprintf("egress rule through %s has no hosts", rule.Proxy))
+		}
+		if rule.Proxy == EgressDirect {
+			continue
+		}
+		u, err := url.Parse(rule.Proxy)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid proxy of egress rule %s: %s", rule.Hosts, err.Error()))
+		}
+		if (u.Scheme != "http" && u.Scheme != "socks5") || u.Host == "" {
+			return errors.New(fmt.Sprintf("invalid proxy %s of egress rule %s, expecting %s, http:// or socks5://", u.Redacted(), rule.Hosts, EgressDirect))
+		}
+	}
+	return nil
+}
+
+// proxy is the Proxy of http.Transport: the proxy of the rule matching the host of req, nil if
+// it's direct
+func (e EgressRules) proxy(req *http.Request) (*url.URL, error) {
+	host := req.URL.Hostname()
+	for _, rule := range e {
+		if !module.MatchPrefixPatterns(rule.Hosts, host) {
+			continue
+		}
+		if rule.Proxy == EgressDirect {
+			return nil, nil
+		}
+		return url.Parse(rule.Proxy)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// SOCKS5 (RFC 1928, RFC 1929) constants
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPassword = 2
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+// dialSOCKS5 connects to addr (host:port) through the SOCKS5 proxy at proxyURL. Host names are
+// resolved by the proxy
+func dialSOCKS5(ctx context.Context, dns *dnsCache, proxyURL *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+	conn, err := dns.dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(DirectConnectTimeout))
+	err = socks5Handshake(conn, proxyURL.User, host, port)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("SOCKS5 proxy %s: %s", proxyURL.Redacted(), err.Error()))
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = append(methods, socks5UserPassword)
+	}
+	_, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	var reply [2]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New(fmt.Sprintf("unexpected version %d", reply[0]))
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPassword:
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("credentials too long")
+		}
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply[:])
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	case socks5NoAcceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return errors.New(fmt.Sprintf("unexpected authentication method %d", reply[1]))
+	}
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			req = append(req, socks5IPv4)
+		} else {
+			req = append(req, socks5IPv6)
+		}
+		req = append(req, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New(fmt.Sprintf("host name %s too long", host))
+		}
+		req = append(append(req, socks5Domain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+	// VER REP RSV ATYP, then the bound address and port
+	var head [4]byte
+	_, err = io.ReadFull(conn, head[:])
+	if err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return errors.New(fmt.Sprintf("connect to %s failed with code %d", net.JoinHostPort(host, fmt.Sprint(port)), head[1]))
+	}
+	var bound int
+	switch head[3] {
+	case socks5IPv4:
+		bound = 4
+	case socks5IPv6:
+		bound = 16
+	case socks5Domain:
+		var n [1]byte
+		_, err = io.ReadFull(conn, n[:])
+		if err != nil {
+			return err
+		}
+		bound = int(n[0])
+	default:
+		return errors.New(fmt.Sprintf("unexpected address type %d", head[3]))
+	}
+	_, err = io.ReadFull(conn, make([]byte, bound+2))
+	return err
+}
@@ -0,0 +1,37 @@
+package goproxy
+
+import (
+	"errors"
+	"net/http"
+	"path"
+)
+
+// Artifacts fetched from upstream after local generation failed are kept here in the GOPROXY layout,
+// and served like LayoutDir
+const UpstreamStoreDir = ".upstream"
+
+// fallbackUpstream fetches the artifact of a cached-only request from the upstream proxy after
+// serving it locally failed with err, and serves it. Refusals by policy, such as scanner vetoes and
+// size limits, are final. It returns false, without responding, if upstream doesn't have it either
+func (p *ProxyServer) fallbackUpstream(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string, err error) bool {
+	var statusErr interface{ Status() int }
+	var notFound *NotFoundError
+	if errors.As(err, &statusErr) && !errors.As(err, &notFound) {
+		return false
+	}
+	if !p.hasLocalSource(escapedModulePath) {
+		return false
+	}
+	loggerYellow.Printf(requestTag(r.Context())+"fallbackUpstream: Serving %s@%s locally failed, falling back to upstream: %s"+LOG_RST,
+		escapedModulePath, prop, err.Error())
+	url := p.upstreamURL() + "/" + path.Join(escapedModulePath, "@v", prop)
+	fetchErr := p.upstreamBreaker.call(func() error {
+		return p.fetchArtifact(r.Context(), url, p.upstreamStore, escapedModulePath, prop)
+	})
+	if fetchErr != nil {
+		loggerRed.Printf(requestTag(r.Context())+"fallbackUpstream: %s: %s"+LOG_RST, url, fetchErr.Error())
+		return false
+	}
+	p.metrics.UpstreamFallbacks.Add(1)
+	return p.serveModDownloadDir(w, r, p.upstreamStore, escapedModulePath, prop)
+}
@@ -0,0 +1,72 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxy tells whether addr is one of TrustedProxies
+func (p *ProxyServer) trustedProxy(addr netip.Addr) bool {
+	return addr.IsValid() && containsAddr(p.trustedProxies, addr.Unmap())
+}
+
+// clientAddr returns the address of the client of r. Behind TrustedProxies, it's the last address
+// of Forwarded (or else X-Forwarded-For) that isn't a trusted proxy: the hops are walked from the
+// connection back to the client, and what untrusted hops claim is ignored. Invalid if unknown (such
+// as over a unix socket)
+func (p *ProxyServer) clientAddr(r *http.Request) netip.Addr {
+	addr := remoteAddr(r.RemoteAddr)
+	if !p.trustedProxy(addr) {
+		return addr
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := remoteAddr(hops[i])
+		if !hop.IsValid() {
+			// Obfuscated or unknown, the last proxy is all that's known
+			break
+		}
+		addr = hop
+		if !p.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// remoteAddr parses an address, with or without port and brackets
+func remoteAddr(s string) netip.Addr {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// forwardedFor lists the for= of Forwarded (RFC 7239) or else the addresses of X-Forwarded-For,
+// the client first
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) != 0 {
+		for _, elements := range values {
+			for _, element := range strings.Split(elements, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						hops = append(hops, strings.Trim(value, `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, values := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(values, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
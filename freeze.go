@@ -0,0 +1,123 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Freezing through the admin API is recorded in the cache, so that it holds across restarts and
+// for every node of a cluster
+const FreezeFile = ".freeze.json"
+
+// FreezeStatus tells whether the cache is frozen, and why
+type FreezeStatus struct {
+	Frozen bool
+	Reason string `json:",omitempty"`
+	// Frozen in the configuration, rather than through the admin API
+	Configured bool       `json:",omitempty"`
+	Since      *time.Time `json:",omitempty"`
+}
+
+var errFrozen = errors.New("the cache is frozen")
+
+// freezeStatus returns whether the cache is frozen, by the configuration or through the admin API
+func (p *ProxyServer) freezeStatus() FreezeStatus {
+	if p.Freeze {
+		return FreezeStatus{Frozen: true, Reason: p.FreezeReason, Configured: true}
+	}
+	data, err := os.ReadFile(p.cachePath(FreezeFile))
+	if err != nil {
+		return FreezeStatus{}
+	}
+	var status FreezeStatus
+	if json.Unmarshal(data, &status) != nil {
+		// Better frozen for no known reason than caching what's meant to be locked down
+		return FreezeStatus{Frozen: true}
+	}
+	status.Frozen = true
+	return status
+}
+
+func (p *ProxyServer) frozen() bool {
+	return p.freezeStatus().Frozen
+}
+
+// refuseFrozen answers 403 to requests that would cache something new while frozen
+func (p *ProxyServer) refuseFrozen(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string) {
+	p.metrics.FrozenRefusals.Add(1)
+	reason := errFrozen.Error()
+	if status := p.freezeStatus(); status.Reason != "" {
+		reason += ": " + status.Reason
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		modulePath = escapedModulePath
+	}
+	version := strings.TrimSuffix(prop, path.Ext(prop))
+	loggerYellow.Printf(requestTag(r.Context())+"refuseFrozen: Not caching %s@%s: %s"+LOG_RST, modulePath, version, reason)
+	p.refusePolicy(w, modulePath, version, reason, http.StatusForbidden)
+}
+
+// freeze freezes the cache through the admin API, or thaws it if reason is nil
+func (p *ProxyServer) freeze(reason *string) error {
+	if p.Freeze {
+		return errFrozen
+	}
+	if reason == nil {
+		err := os.Remove(p.cachePath(FreezeFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	now := time.Now()
+	data, _ := json.Marshal(FreezeStatus{Frozen: true, Reason: *reason, Since: &now})
+	tmp := fmt.Sprintf("%s.%d", p.cachePath(FreezeFile), os.Getpid())
+	err := os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, p.cachePath(FreezeFile))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (p *ProxyServer) serveAdminFreeze(w http.ResponseWriter, r *http.Request, freeze bool) {
+	if r.Method == http.MethodGet && freeze {
+		httpRespJSON(w, http.StatusOK, p.freezeStatus())
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpRespString(w, http.StatusMethodNotAllowed, "freezing requires POST")
+		return
+	}
+	var reason *string
+	if freeze {
+		s := r.URL.Query().Get("reason")
+		reason = &s
+	}
+	err := p.freeze(reason)
+	if err == errFrozen {
+		httpRespString(w, http.StatusConflict, "the cache is frozen in the configuration")
+		return
+	}
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if freeze {
+		loggerYellow.Printf(requestTag(r.Context())+"serveAdminFreeze: Froze the cache: %s"+LOG_RST, *reason)
+	} else {
+		loggerYellow.Printf(requestTag(r.Context()) + "serveAdminFreeze: Thawed the cache" + LOG_RST)
+	}
+	httpRespJSON(w, http.StatusOK, p.freezeStatus())
+}
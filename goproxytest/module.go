@@ -0,0 +1,128 @@
+// Package goproxytest provides fixtures for end-to-end tests of programs embedding the proxy, with
+// neither network nor git hosts: a fake upstream proxy serving modules from memory, bare git repos
+// built from module fixtures, and a ProxyServer served by httptest with its cache in a temporary
+// directory.
+//
+//	mod := goproxytest.Module{Path: "example.com/m", Version: "v1.0.0", Files: map[string]string{"m.go": "package m\n"}}
+//	repo := goproxytest.NewRepo(t, mod)
+//	mod.Origin = &goproxy.Origin{VCS: "git", URL: repo}
+//	upstream := goproxytest.NewUpstream(t, mod)
+//	srv := goproxytest.NewServer(t, &goproxy.ProxyServer{
+//		Upstream: upstream.URL, SyncFetch: true, LocalRemoteDirs: []string{filepath.Dir(repo)},
+//	})
+//	code, body := srv.Get(t, "example.com/m/@v/v1.0.0.zip")
+package goproxytest
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/ganboing/goproxy"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Time of Modules not setting theirs
+var DefaultTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Module is a fixture of a module version
+type Module struct {
+	Path    string
+	Version string
+	// Commit time, DefaultTime if zero
+	Time time.Time
+	// Files relative to the module root. go.mod is synthesized if missing
+	Files map[string]string
+	// Reported in .info and @latest by Upstream, pointing the proxy at where to clone the module from
+	Origin *goproxy.Origin
+}
+
+func (m *Module) time() time.Time {
+	if m.Time.IsZero() {
+		return DefaultTime
+	}
+	return m.Time.UTC()
+}
+
+// GoMod returns the go.mod of the module
+func (m *Module) GoMod() []byte {
+	if data, ok := m.Files["go.mod"]; ok {
+		return []byte(data)
+	}
+	return []byte("module " + m.Path + "\n")
+}
+
+// Info returns the .info of the module
+func (m *Module) Info() *goproxy.RevInfo {
+	return &goproxy.RevInfo{Version: m.Version, Time: m.time(), Origin: m.Origin}
+}
+
+// Zip returns the module zip, as created by the go command
+func (m *Module) Zip() ([]byte, error) {
+	files := []modzip.File{memFile{name: "go.mod", data: m.GoMod()}}
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		if name != "go.mod" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files = append(files, memFile{name: name, data: []byte(m.Files[name])})
+	}
+	buf := bytes.Buffer{}
+	err := modzip.Create(&buf, module.Version{Path: m.Path, Version: m.Version}, files)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// memFile is a file of a Module for modzip.Create
+type memFile struct {
+	name string
+	data []byte
+}
+
+func (f memFile) Path() string {
+	return f.name
+}
+
+func (f memFile) Lstat() (fs.FileInfo, error) {
+	return memFileInfo{f}, nil
+}
+
+func (f memFile) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+type memFileInfo struct {
+	f memFile
+}
+
+func (i memFileInfo) Name() string {
+	return i.f.name
+}
+
+func (i memFileInfo) Size() int64 {
+	return int64(len(i.f.data))
+}
+
+func (i memFileInfo) Mode() fs.FileMode {
+	return 0644
+}
+
+func (i memFileInfo) ModTime() time.Time {
+	return DefaultTime
+}
+
+func (i memFileInfo) IsDir() bool {
+	return false
+}
+
+func (i memFileInfo) Sys() any {
+	return nil
+}
@@ -0,0 +1,67 @@
+package goproxytest
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// NewRepo creates a bare git repo in a temporary directory holding versions of a module, committed
+// in order at the repo root (each commit has exactly the files of its version) and tagged with their
+// version. It returns the path of the repo, usable as the remote of a mirror: add its parent
+// directory to LocalRemoteDirs when the repo is reported by Upstream
+func NewRepo(tb testing.TB, versions ...Module) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	work := filepath.Join(dir, "work")
+	repo := filepath.Join(dir, "repo.git")
+	runGit(tb, "", nil, "init", "--quiet", work)
+	for _, m := range versions {
+		entries, err := os.ReadDir(work)
+		if err != nil {
+			tb.Fatalf("goproxytest: %s", err.Error())
+		}
+		for _, entry := range entries {
+			if entry.Name() != ".git" {
+				os.RemoveAll(filepath.Join(work, entry.Name()))
+			}
+		}
+		files := map[string]string{"go.mod": string(m.GoMod())}
+		for name, data := range m.Files {
+			files[name] = data
+		}
+		for name, data := range files {
+			name = filepath.Join(work, filepath.FromSlash(name))
+			err = os.MkdirAll(filepath.Dir(name), 0755)
+			if err == nil {
+				err = os.WriteFile(name, []byte(data), 0644)
+			}
+			if err != nil {
+				tb.Fatalf("goproxytest: %s", err.Error())
+			}
+		}
+		date := m.time().Format(time.RFC3339)
+		env := []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date}
+		runGit(tb, work, nil, "add", "-A")
+		runGit(tb, work, env, "commit", "--quiet", "--allow-empty", "-m", m.Version)
+		runGit(tb, work, nil, "tag", m.Version)
+	}
+	runGit(tb, "", nil, "clone", "--quiet", "--bare", work, repo)
+	return repo
+}
+
+func runGit(tb testing.TB, dir string, env []string, args ...string) {
+	tb.Helper()
+	args = append([]string{"-c", "user.name=goproxytest", "-c", "user.email=goproxytest@localhost",
+		"-c", "init.defaultBranch=main"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		tb.Fatalf("goproxytest: git %s: %s: %s", strings.Join(args, " "), err.Error(), out)
+	}
+}
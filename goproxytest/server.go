@@ -0,0 +1,55 @@
+package goproxytest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ganboing/goproxy"
+)
+
+// Server is a ProxyServer served by httptest, with its cache in a temporary directory
+type Server struct {
+	*httptest.Server
+	Proxy *goproxy.ProxyServer
+	// Cache directory
+	Dir string
+}
+
+// NewServer starts serving proxy (nil for the defaults) at the root of the URL of the server,
+// stopped when the test ends. Its cache is a new temporary directory, thus tests using NewServer
+// can run in parallel. proxy is copied by NewProxyServer, use Proxy to reach the instance served
+func NewServer(tb testing.TB, proxy *goproxy.ProxyServer) *Server {
+	tb.Helper()
+	dir := tb.TempDir()
+	p, err := goproxy.NewProxyServer(dir, proxy)
+	if err != nil {
+		tb.Fatalf("goproxytest: %s", err.Error())
+	}
+	s := &Server{Server: httptest.NewServer(p.Handler()), Proxy: p, Dir: p.Dir}
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Get requests path relative to the root of the server, such as "cached-only/example.com/m/@v/v1.0.0.info",
+// and returns the status and body. Redirects are not followed
+func (s *Server) Get(tb testing.TB, path string) (int, []byte) {
+	tb.Helper()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(s.URL + "/" + strings.TrimPrefix(path, "/"))
+	if err != nil {
+		tb.Fatalf("goproxytest: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tb.Fatalf("goproxytest: %s", err.Error())
+	}
+	return resp.StatusCode, body
+}
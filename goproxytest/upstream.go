@@ -0,0 +1,134 @@
+package goproxytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Upstream is a fake upstream proxy serving Modules from memory, with the GOPROXY protocol
+type Upstream struct {
+	*httptest.Server
+	mu       sync.Mutex
+	modules  map[string][]Module
+	requests []string
+}
+
+// NewUpstream starts an Upstream serving modules, closed when the test ends
+func NewUpstream(tb testing.TB, modules ...Module) *Upstream {
+	u := &Upstream{modules: make(map[string][]Module)}
+	for _, m := range modules {
+		u.Add(m)
+	}
+	u.Server = httptest.NewServer(u)
+	tb.Cleanup(u.Close)
+	return u
+}
+
+// Add serves another module version
+func (u *Upstream) Add(m Module) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.modules[m.Path] = append(u.modules[m.Path], m)
+}
+
+// Requests returns the paths requested so far, in order
+func (u *Upstream) Requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.requests...)
+}
+
+func (u *Upstream) lookup(modulePath, version string) (Module, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var found *Module
+	for i, m := range u.modules[modulePath] {
+		if version == "latest" {
+			if found == nil || semver.Compare(m.Version, found.Version) > 0 {
+				found = &u.modules[modulePath][i]
+			}
+		} else if m.Version == version {
+			found = &u.modules[modulePath][i]
+		}
+	}
+	if found == nil {
+		return Module{}, false
+	}
+	return *found, true
+}
+
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.requests = append(u.requests, r.URL.Path)
+	u.mu.Unlock()
+	escapedModulePath, prop, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@")
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if !ok || err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", r.URL.Path), http.StatusBadRequest)
+		return
+	}
+	if prop == "latest" {
+		m, ok := u.lookup(modulePath, "latest")
+		if !ok {
+			http.Error(w, fmt.Sprintf("not found: %s@latest: no matching versions", modulePath), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, m.Info())
+		return
+	}
+	prop, ok = strings.CutPrefix(prop, "v/")
+	if !ok {
+		http.Error(w, fmt.Sprintf("bad request: %s", r.URL.Path), http.StatusBadRequest)
+		return
+	}
+	if prop == "list" {
+		u.mu.Lock()
+		var versions []string
+		for _, m := range u.modules[modulePath] {
+			versions = append(versions, m.Version+"\n")
+		}
+		u.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write([]byte(strings.Join(versions, "")))
+		return
+	}
+	ext := path.Ext(prop)
+	version, err := module.UnescapeVersion(strings.TrimSuffix(prop, ext))
+	m, ok := u.lookup(modulePath, version)
+	if err != nil || !ok {
+		http.Error(w, fmt.Sprintf("not found: %s@%s: invalid version: unknown revision %s", modulePath, version, version),
+			http.StatusNotFound)
+		return
+	}
+	switch ext {
+	case ".info":
+		writeJSON(w, m.Info())
+	case ".mod":
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write(m.GoMod())
+	case ".zip":
+		data, err := m.Zip()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(data)
+	default:
+		http.Error(w, fmt.Sprintf("bad request: %s", r.URL.Path), http.StatusBadRequest)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
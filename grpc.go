@@ -0,0 +1,292 @@
+package goproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gRPC service of proto/admin.proto. The wire format is simple enough for the few messages
+// involved to be encoded by hand, rather than pulling in the gRPC and protobuf modules.
+// gRPC needs HTTP/2, which net/http only speaks over TLS
+const grpcAdminService = "/goproxy.admin.v1.Admin/"
+
+// Requests are tiny, anything larger is not from a well-behaved client
+const maxGRPCRequest = 64 << 10
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+)
+
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// protoWriter encodes proto3 fields. Like generated code, fields with default values are left out
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field<<3|wireType))
+}
+
+func (w *protoWriter) bytes(field int, b []byte) {
+	w.tag(field, 2)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *protoWriter) string(field int, s string) {
+	if s != "" {
+		w.bytes(field, []byte(s))
+	}
+}
+
+func (w *protoWriter) int64(field int, v int64) {
+	if v != 0 {
+		w.tag(field, 0)
+		w.buf = binary.AppendUvarint(w.buf, uint64(v))
+	}
+}
+
+// message always writes the field, empty messages included, as they are elements of repeated fields
+func (w *protoWriter) message(field int, m *protoWriter) {
+	w.bytes(field, m.buf)
+}
+
+// parseProto calls fn for every field of the message, with the value for varints or the content
+// of length-delimited fields. Fixed size fields, unknown to the messages here, are skipped
+func parseProto(data []byte, fn func(field int, varint uint64, b []byte)) error {
+	errTruncated := errors.New("truncated message")
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+			fn(field, v, nil)
+		case 1:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			data = data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errTruncated
+			}
+			fn(field, 0, data[n:n+int(l)])
+			data = data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			data = data[4:]
+		default:
+			return errors.New(fmt.Sprintf("unsupported wire type %d", key&7))
+		}
+	}
+	return nil
+}
+
+// grpcRequest holds the fields of all request messages, their numbers don't overlap in meaning:
+// prefix and module_path are field 1 of the respective requests, wait is field 2
+type grpcRequest struct {
+	str  string
+	wait bool
+}
+
+func parseGRPCRequest(data []byte) (grpcRequest, error) {
+	var req grpcRequest
+	err := parseProto(data, func(field int, varint uint64, b []byte) {
+		switch field {
+		case 1:
+			req.str = string(b)
+		case 2:
+			req.wait = varint != 0
+		}
+	})
+	return req, err
+}
+
+func encodeJob(job CloneJob) *protoWriter {
+	m := &protoWriter{}
+	m.string(1, job.ModulePath)
+	m.string(2, job.Remote)
+	m.string(3, job.Priority)
+	m.int64(4, job.Queued.UnixNano())
+	if job.Started != nil {
+		m.int64(5, job.Started.UnixNano())
+	}
+	m.string(6, job.Progress)
+	return m
+}
+
+// Methods changing the state of the cache, requiring AdminToken like adminWriteEndpoints
+var grpcWriteMethods = map[string]bool{
+	"Purge":   true,
+	"Refresh": true,
+}
+
+func (p *ProxyServer) callGRPC(r *http.Request, method string, req grpcRequest) (*protoWriter, error) {
+	resp := &protoWriter{}
+	ctx := r.Context()
+	if grpcWriteMethods[method] && !p.adminAuthorized(r) {
+		return nil, &grpcError{grpcPermissionDenied, "admin token is not set or wrong"}
+	}
+	switch method {
+	case "ListMirrors":
+		for _, mirror := range p.listMirrors(ctx, req.str) {
+			m := &protoWriter{}
+			m.string(1, mirror.ModulePath)
+			m.string(2, mirror.VCS)
+			m.string(3, mirror.Remote)
+			for _, alias := range mirror.Aliases {
+				m.bytes(4, []byte(alias))
+			}
+			resp.message(1, m)
+		}
+	case "Purge":
+		err := p.purgeMirror(ctx, req.str)
+		if err == errJobPending || err == errPinned || err == errFrozen {
+			return nil, &grpcError{grpcFailedPrecondition, err.Error()}
+		}
+		if err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+	case "Refresh":
+		job, err := p.refreshMirror(ctx, req.str, req.wait)
+		if err == errFrozen {
+			return nil, &grpcError{grpcFailedPrecondition, err.Error()}
+		}
+		if err != nil {
+			return nil, &grpcError{grpcNotFound, err.Error()}
+		}
+		resp.message(1, encodeJob(job))
+	case "ListJobs":
+		for _, job := range p.cloneJobs(req.str) {
+			resp.message(1, encodeJob(job))
+		}
+	case "GetStats":
+		metrics := p.metricsSnapshot()
+		names := make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entry := &protoWriter{}
+			entry.string(1, name)
+			entry.int64(2, metrics[name])
+			resp.message(1, entry)
+		}
+	default:
+		return nil, &grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", method)}
+	}
+	return resp, nil
+}
+
+// serveGRPC serves unary calls of the Admin service
+func (p *ProxyServer) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		httpRespString(w, http.StatusUnsupportedMediaType, "gRPC endpoint")
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	method, ok := strings.CutPrefix(r.URL.Path, grpcAdminService)
+	var resp *protoWriter
+	var err error
+	if !ok {
+		err = &grpcError{grpcUnimplemented, fmt.Sprintf("unknown service %s", r.URL.Path)}
+	} else {
+		var req grpcRequest
+		req, err = readGRPCMessage(r.Body)
+		if err == nil {
+			resp, err = p.callGRPC(r, method, req)
+		}
+	}
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		var gerr *grpcError
+		if errors.As(err, &gerr) {
+			code = gerr.code
+		}
+		loggerYellow.Printf(requestTag(r.Context())+"serveGRPC: %s: %s"+LOG_RST, r.URL.Path, msg)
+	}
+	w.WriteHeader(http.StatusOK)
+	if resp != nil {
+		frame := make([]byte, 5, 5+len(resp.buf))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp.buf)))
+		w.Write(append(frame, resp.buf...))
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(msg))
+	}
+}
+
+func readGRPCMessage(body io.Reader) (grpcRequest, error) {
+	var prefix [5]byte
+	_, err := io.ReadFull(body, prefix[:])
+	if err != nil {
+		return grpcRequest{}, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return grpcRequest{}, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCRequest {
+		return grpcRequest{}, &grpcError{grpcInvalidArgument, "request message too large"}
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(body, data)
+	if err != nil {
+		return grpcRequest{}, &grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	req, err := parseGRPCRequest(data)
+	if err != nil {
+		return grpcRequest{}, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return req, nil
+}
+
+// grpcEncodeMessage percent-encodes the status message as the gRPC spec requires
+func grpcEncodeMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,108 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Start initializes the server right away rather than on the first request, so that journaled
+// clone jobs are resumed and background maintenance starts without waiting for traffic
+func (p *ProxyServer) Start() {
+	p.initOnce.Do(p.init)
+}
+
+// Handler serves all endpoints relative to the root of its path:
+//
+//	/<module>/@v/...                  MonitorHandler
+//	/cached-only/<module>/@v/...      CachedHandler
+//	/sync/<module>/@v/...             SyncHandler
+//	/snapshot/<name>/<module>/@v/...  SnapshotHandler
+//	/admin/...                        AdminHandler
+//
+// To mount it beneath a prefix of another mux, strip the prefix without the trailing slash:
+// mux.Handle("/go/", http.StripPrefix("/go", p.Handler()))
+func (p *ProxyServer) Handler() http.Handler {
+	if p.ReplayDir != "" {
+		return p.endpoint(p.serveReplay)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", p.MonitorHandler())
+	mux.Handle("/cached-only/", http.StripPrefix("/cached-only", p.CachedHandler()))
+	mux.Handle("/sync/", http.StripPrefix("/sync", p.SyncHandler()))
+	mux.Handle("/snapshot/", http.StripPrefix("/snapshot", p.SnapshotHandler()))
+	mux.Handle("/admin/", http.StripPrefix("/admin", p.AdminHandler()))
+	if p.RecordDir != "" {
+		return p.recording(mux)
+	}
+	return mux
+}
+
+// MonitorHandler serves modules, fetching and redirecting to upstream when not cached
+func (p *ProxyServer) MonitorHandler() http.Handler {
+	return p.moduleEndpoint(p.monitorModFetch)
+}
+
+// CachedHandler serves modules only from the cache
+func (p *ProxyServer) CachedHandler() http.Handler {
+	return p.moduleEndpoint(p.serveModCached)
+}
+
+// SyncHandler serves modules, waiting for fetches to complete instead of redirecting
+func (p *ProxyServer) SyncHandler() http.Handler {
+	return p.moduleEndpoint(p.syncModFetch)
+}
+
+// SnapshotHandler serves modules of named snapshots (<name>/<module>/@v/...), from the cache
+func (p *ProxyServer) SnapshotHandler() http.Handler {
+	return p.moduleEndpoint(p.serveSnapshot)
+}
+
+// moduleEndpoint is endpoint for the GOPROXY endpoints, metered by Quotas and counting requests
+// towards the popularity of mirrors
+func (p *ProxyServer) moduleEndpoint(fn http.HandlerFunc) http.Handler {
+	return p.endpoint(p.metered(func(w http.ResponseWriter, r *http.Request) {
+		p.countRequest(r)
+		fn(w, r)
+	}))
+}
+
+// AdminHandler serves the admin endpoints (metrics, integrity, clones...)
+func (p *ProxyServer) AdminHandler() http.Handler {
+	return p.endpoint(p.serveAdmin)
+}
+
+// GRPCHandler serves the Admin service of proto/admin.proto. gRPC clients need HTTP/2,
+// thus it must be served over TLS (http.Server.ServeTLS), unless behind a proxy terminating it
+func (p *ProxyServer) GRPCHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.initOnce.Do(p.init)
+		addr := p.clientAddr(r)
+		if !p.checkClient(w, r, addr) {
+			return
+		}
+		id := requestID(r)
+		p.serveGRPC(w, r.WithContext(withRequest(p.withCacheDir(r.Context()), id, addr)))
+	})
+}
+
+// endpoint initializes the server on first use, refuses clients not allowed by ClientAccess, tags
+// the request with an ID, its client and the cache directory, and makes the path relative: the
+// endpoints take the path with no leading slash
+func (p *ProxyServer) endpoint(fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.initOnce.Do(p.init)
+		addr := p.clientAddr(r)
+		if !p.checkClient(w, r, addr) {
+			return
+		}
+		id := requestID(r)
+		w.Header().Set(RequestIDHeader, id)
+		r2 := r.WithContext(withRequest(p.withCacheDir(r.Context()), id, addr))
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, "/")
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, "/")
+		fn(w, r2)
+	})
+}
@@ -0,0 +1,161 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ganboing/goproxy"
+	"github.com/ganboing/goproxy/goproxytest"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// A module cloned from a local repo reported by upstream is served from its mirror, with the same
+// .info, .mod and .zip as the go command creates
+func TestHandlerServesMirror(t *testing.T) {
+	t.Parallel()
+	mod := goproxytest.Module{
+		Path:    "example.com/m",
+		Version: "v1.0.0",
+		Files: map[string]string{
+			"go.mod":     "module example.com/m\n\ngo 1.21\n",
+			"m.go":       "package m\n",
+			"sub/sub.go": "package sub\n",
+		},
+	}
+	repo := goproxytest.NewRepo(t, mod)
+	mod.Origin = &goproxy.Origin{VCS: "git", URL: repo}
+	upstream := goproxytest.NewUpstream(t, mod)
+	srv := goproxytest.NewServer(t, &goproxy.ProxyServer{
+		Upstream:        upstream.URL,
+		SyncFetch:       true,
+		LocalRemoteDirs: []string{filepath.Dir(repo)},
+	})
+
+	code, body := srv.Get(t, "example.com/m/@v/v1.0.0.info")
+	if code != http.StatusOK {
+		t.Fatalf(".info: %d %s", code, body)
+	}
+	var info goproxy.RevInfo
+	err := json.Unmarshal(body, &info)
+	if err != nil {
+		t.Fatalf(".info: %s: %s", err.Error(), body)
+	}
+	if info.Version != mod.Version || !info.Time.Equal(goproxytest.DefaultTime) {
+		t.Errorf(".info = %s %s, want %s %s", info.Version, info.Time, mod.Version, goproxytest.DefaultTime)
+	}
+
+	code, body = srv.Get(t, "cached-only/example.com/m/@v/v1.0.0.mod")
+	if code != http.StatusOK || !bytes.Equal(body, mod.GoMod()) {
+		t.Errorf(".mod = %d %q, want %q", code, body, mod.GoMod())
+	}
+
+	code, body = srv.Get(t, "cached-only/example.com/m/@v/v1.0.0.zip")
+	if code != http.StatusOK {
+		t.Fatalf(".zip: %d %s", code, body)
+	}
+	want, err := mod.Zip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := zipHash(t, body), zipHash(t, want); got != want {
+		t.Errorf(".zip hash = %s, want %s", got, want)
+	}
+
+	// Branches resolve to the version tagged on their head, revision syntax isn't taken for a branch
+	code, body = srv.Get(t, "example.com/m/@v/main.info")
+	if code != http.StatusOK {
+		t.Fatalf("main.info: %d %s", code, body)
+	}
+	info = goproxy.RevInfo{}
+	err = json.Unmarshal(body, &info)
+	if err != nil || info.Version != mod.Version {
+		t.Errorf("main.info = %s, want %s", body, mod.Version)
+	}
+	for _, rev := range []string{"main~0", "main^0", "main@{0}"} {
+		code, body = srv.Get(t, "example.com/m/@v/"+rev+".info")
+		if code == http.StatusOK {
+			t.Errorf("%s.info = %s, want an error", rev, body)
+		}
+	}
+
+	_, err = os.Readlink(filepath.Join(srv.Dir, "example.com/m/.vcs"))
+	if err != nil {
+		t.Errorf("not mirrored: %s", err.Error())
+	}
+	// Served from the mirror, upstream is only asked where the module lives
+	for _, req := range upstream.Requests() {
+		if filepath.Ext(req) == ".zip" {
+			t.Errorf("zip requested from upstream: %s", req)
+		}
+	}
+}
+
+// @v/list of a mirrored module is answered from the mirror, and from the metadata cache until the
+// mirror is updated
+func TestHandlerListFromMirror(t *testing.T) {
+	t.Parallel()
+	files := map[string]string{"m.go": "package m\n"}
+	v1 := goproxytest.Module{Path: "example.com/m", Version: "v1.0.0", Files: files}
+	v2 := goproxytest.Module{Path: "example.com/m", Version: "v1.1.0", Files: files}
+	repo := goproxytest.NewRepo(t, v1)
+	later := goproxytest.NewRepo(t, v1, v2)
+	v1.Origin = &goproxy.Origin{VCS: "git", URL: repo}
+	v2.Origin = v1.Origin
+	upstream := goproxytest.NewUpstream(t, v1)
+	srv := goproxytest.NewServer(t, &goproxy.ProxyServer{
+		Upstream:          upstream.URL,
+		SyncFetch:         true,
+		LocalRemoteDirs:   []string{filepath.Dir(repo)},
+		MetadataCacheSize: 1 << 20,
+	})
+
+	code, body := srv.Get(t, "example.com/m/@v/v1.0.0.info")
+	if code != http.StatusOK {
+		t.Fatalf(".info: %d %s", code, body)
+	}
+	code, body = srv.Get(t, "cached-only/example.com/m/@v/list")
+	if code != http.StatusOK || string(body) != "v1.0.0\n" {
+		t.Fatalf("list = %d %q, want v1.0.0", code, body)
+	}
+
+	// Tagged upstream, then fetched into the mirror by a request of the new version
+	out, err := exec.Command("git", "-C", repo, "fetch", "--quiet", later, "refs/tags/v1.1.0:refs/tags/v1.1.0").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git fetch: %s: %s", err.Error(), out)
+	}
+	upstream.Add(v2)
+	code, body = srv.Get(t, "example.com/m/@v/v1.1.0.info")
+	if code != http.StatusOK {
+		t.Fatalf(".info: %d %s", code, body)
+	}
+	code, body = srv.Get(t, "cached-only/example.com/m/@v/list")
+	if code != http.StatusOK || string(body) != "v1.0.0\nv1.1.0\n" {
+		t.Errorf("list = %d %q after the update, want v1.0.0 and v1.1.0", code, body)
+	}
+}
+
+// zipHash returns the go.sum hash of a module zip
+func zipHash(t *testing.T, data []byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "m.zip")
+	err := os.WriteFile(name, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = modzip.CheckZip(module.Version{Path: "example.com/m", Version: "v1.0.0"}, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := dirhash.HashZip(name, dirhash.DefaultHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
@@ -0,0 +1,60 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const QuarantineDir = ".quarantine"
+
+// healMirror quarantines a corrupted mirror and re-clones it through the usual clone worker. The
+// mirror is only quarantined if a full git fsck fails, git errors may be transient
+func (p *ProxyServer) healMirror(ctx context.Context, modulePath string, prio clonePriority) {
+	modulePath = p.mirrorOwner(modulePath)
+	if p.frozen() {
+		// It couldn't be cloned again
+		loggerRed.Printf(requestTag(ctx)+"healMirror: The cache is frozen, leaving corrupted mirror %s as is until thawed"+LOG_RST, modulePath)
+		return
+	}
+	gitdir := path.Join(modulePath, ".git")
+	checkCtx, cancel := context.WithTimeout(ctx, GitCloneTimeout)
+	err := checkMirrorIntegrity(checkCtx, gitdir, true)
+	timedOut := checkCtx.Err() != nil
+	cancel()
+	if timedOut {
+		loggerRed.Printf(requestTag(ctx)+"healMirror: Timed out checking %s, leaving it as is"+LOG_RST, modulePath)
+		return
+	}
+	if err == nil {
+		loggerYellow.Printf(requestTag(ctx)+"healMirror: %s passes git fsck, leaving it as is"+LOG_RST, modulePath)
+		return
+	}
+	loggerRed.Printf(requestTag(ctx)+"healMirror: %s fails git fsck: %s"+LOG_RST, modulePath, err.Error())
+	// Read the config file directly, the repo itself may not be usable
+	remote, err := runGitOutputShort(ctx, gitdir,
+		"config", "--file", "config", "--get", "remote.origin.url")
+	remote = strings.TrimSpace(remote)
+	if err != nil || remote == "" {
+		loggerRed.Printf(requestTag(ctx)+"healMirror: Cannot determine remote of corrupted mirror %s, manual intervention needed"+LOG_RST, modulePath)
+		return
+	}
+	// Removing .vcs first hides the mirror from lookups. Whoever removes it owns the healing
+	err = p.root.remove(path.Join(modulePath, ".vcs"))
+	if err != nil {
+		return
+	}
+	p.vcsIndex.remove(modulePath)
+	quarantine := path.Join(QuarantineDir, fmt.Sprintf("%s@%d", modulePath, time.Now().Unix()))
+	p.root.mkdirAll(path.Dir(quarantine), 0700)
+	err = p.root.rename(gitdir, quarantine)
+	if err != nil {
+		loggerRed.Printf(requestTag(ctx)+"healMirror: Failed to quarantine %s: %s"+LOG_RST, gitdir, err.Error())
+		return
+	}
+	loggerYellow.Printf(requestTag(ctx)+"healMirror: Quarantined %s to %s, re-cloning from %s"+LOG_RST, gitdir, quarantine, remote)
+	p.metrics.MirrorsHealed.Add(1)
+	p.cacheModGit(ctx, modulePath, "", "", remote, prio)
+}
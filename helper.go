@@ -2,18 +2,25 @@ package goproxy
 
 import (
 	"archive/tar"
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const LOG_RED = "\033[0;31m"
@@ -25,52 +32,249 @@ var loggerRed = log.New(os.Stderr, LOG_RED, log.LstdFlags)
 var loggerGreen = log.New(os.Stderr, LOG_GRN, log.LstdFlags)
 var loggerYellow = log.New(os.Stderr, LOG_YEL, log.LstdFlags)
 
+// forwardHttpResp relays an upstream response. Athens and some CDNs send chunked responses without
+// Content-Length, which are streamed chunked in turn, and a missing Content-Type is sniffed
 func forwardHttpResp(w http.ResponseWriter, resp *http.Response) {
+	body := bufio.NewReaderSize(resp.Body, sniffLen)
 	hdrContentType := resp.Header.Get("Content-Type")
-	hdrContentLength := resp.Header.Get("Content-Length")
-	if hdrContentType == "" || hdrContentLength == "" {
-		io.Copy(io.Discard, resp.Body)
-		httpRespString(w, http.StatusInternalServerError,
-			"Upstream server failed to provide Content-Type/Length")
-		return
+	if hdrContentType == "" {
+		// Peek returns what it could read along with the error, short bodies are sniffed as well
+		head, _ := body.Peek(sniffLen)
+		hdrContentType = http.DetectContentType(head)
 	}
 	w.Header().Set("Content-Type", hdrContentType)
-	w.Header().Set("Content-Length", hdrContentLength)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	io.Copy(w, body)
+}
+
+// Bytes http.DetectContentType considers
+const sniffLen = 512
+
+// Amount of data sent between extensions of the write deadline
+const stallWriterChunk = 1 << 20
+
+// stallWriter extends the write deadline as long as the client keeps reading.
+// A stalled client fails the write instead of pinning the reader forever
+type stallWriter struct {
+	http.ResponseWriter
+	rc    *http.ResponseController
+	stall time.Duration
+	// Paces the writes when set, see newArtifactWriter
+	ctx     context.Context
+	limiter *rateLimiter
+	// First write error, if any
+	err error
+}
+
+func newStallWriter(w http.ResponseWriter, stall time.Duration) *stallWriter {
+	return &stallWriter{ResponseWriter: w, rc: http.NewResponseController(w), stall: stall}
+}
+
+func (s *stallWriter) Write(p []byte) (int, error) {
+	if s.limiter != nil {
+		var total int
+		for len(p) != 0 {
+			chunk := p[:min(int64(len(p)), s.limiter.chunk())]
+			n, err := s.write(chunk)
+			total += n
+			if err == nil {
+				err = s.limiter.wait(s.ctx, n)
+			}
+			if err != nil {
+				return total, err
+			}
+			p = p[n:]
+		}
+		return total, nil
+	}
+	return s.write(p)
+}
+
+func (s *stallWriter) write(p []byte) (int, error) {
+	// Error is ignored if the underlying writer does not support deadlines
+	s.rc.SetWriteDeadline(time.Now().Add(s.stall))
+	n, err := s.ResponseWriter.Write(p)
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// ReadFrom keeps the zero-copy path (sendfile) of the underlying writer when copying from files,
+// only splitting the copy into chunks to extend the deadline in between. sendfile only sees
+// through one *io.LimitedReader, thus the one of http.ServeContent or io.CopyN is capped to the
+// chunk in place rather than wrapped in another
+func (s *stallWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := s.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{s}, src)
+	}
+	chunk := int64(stallWriterChunk)
+	if s.limiter != nil {
+		chunk = s.limiter.chunk()
+	}
+	lr, ok := src.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: src, N: math.MaxInt64}
+	}
+	var total int64
+	for lr.N > 0 {
+		s.rc.SetWriteDeadline(time.Now().Add(s.stall))
+		remaining := lr.N
+		lr.N = min(remaining, chunk)
+		limit := lr.N
+		n, err := rf.ReadFrom(lr)
+		lr.N = remaining - n
+		total += n
+		if err == nil {
+			err = s.limiter.wait(s.ctx, int(n))
+		}
+		if err != nil {
+			if s.err == nil {
+				s.err = err
+			}
+			return total, err
+		}
+		if n < limit {
+			return total, nil
+		}
+	}
+	return total, nil
 }
 
 func httpRespString(w http.ResponseWriter, code int, resp string) {
+	id := w.Header().Get(RequestIDHeader)
+	if code >= 400 && id != "" {
+		resp += "\nrequest id: " + id
+	}
+	if code >= 400 {
+		// Replaces whatever was set for the successful response
+		w.Header().Set("Cache-Control", CacheControlNoStore)
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(code)
 	w.Write([]byte(resp))
 }
 
-func parseRequest(w http.ResponseWriter, r *http.Request) (escapedModulePath string, prop string, ok bool) {
-	if strings.HasPrefix(r.URL.Path, "sumdb/") {
-		httpRespString(w, http.StatusNotFound, "not found")
-		return "", "", false
+// httpRespError responds with the status of errors implementing Status() int (such as NotFoundError,
+// ZipTooLargeError and ScanError), 500 otherwise
+func httpRespError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var statusErr interface{ Status() int }
+	if errors.As(err, &statusErr) {
+		code = statusErr.Status()
+	}
+	httpRespString(w, code, err.Error())
+}
+
+func httpRespBytes(w http.ResponseWriter, contentTy string, data []byte) {
+	w.Header().Set("Content-Type", contentTy)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func httpRespJSON(w http.ResponseWriter, code int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	escapedModulePath, prop, ok = strings.Cut(r.URL.Path, "/@v/")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// Requests longer than this are rejected before any parsing
+const MaxRequestPathLen = 1024
+
+// splitRequestPath splits <module>/@v/<prop> or <module>/@latest, rejecting anything malformed
+// before it can reach git or the filesystem. It's a pure function of the URL, see
+// FuzzSplitRequestPath
+func splitRequestPath(urlPath, rawPath string) (escapedModulePath string, prop string, err error) {
+	if len(urlPath) > MaxRequestPathLen || len(rawPath) > MaxRequestPathLen {
+		return "", "", errors.New("URL path too long")
+	}
+	// Encoded separators would decode into extra path elements
+	raw := strings.ToLower(rawPath)
+	if strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") {
+		return "", "", errors.New(fmt.Sprintf("URL path %s contains encoded separators", rawPath))
+	}
+	escapedModulePath, prop, ok := strings.Cut(urlPath, "/@v/")
 	if !ok {
 		prop = "latest"
-		escapedModulePath, ok = strings.CutSuffix(r.URL.Path, "/@latest")
+		escapedModulePath, ok = strings.CutSuffix(urlPath, "/@latest")
 	}
 	if !ok {
-		err := errors.New(fmt.Sprintf("Unsupported URL path: %s", r.URL.Path))
-		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return "", "", errors.New(fmt.Sprintf("Unsupported URL path: %s", urlPath))
+	}
+	if prop == "" || prop == "." || prop == ".." || strings.ContainsAny(prop, "/\\") {
+		return "", "", errors.New(fmt.Sprintf("Invalid version in URL path: %s", urlPath))
+	}
+	// Backslashes are separators on some filesystems, whatever module.CheckPath allows
+	if strings.Contains(escapedModulePath, "\\") {
+		return "", "", errors.New(fmt.Sprintf("Invalid module path in URL path: %s", urlPath))
+	}
+	for _, elem := range strings.Split(escapedModulePath, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return "", "", errors.New(fmt.Sprintf("Invalid path element in URL path: %s", urlPath))
+		}
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return "", "", err
+	}
+	err = module.CheckPath(modulePath)
+	if err != nil {
+		return "", "", err
+	}
+	return escapedModulePath, prop, nil
+}
+
+func parseRequest(w http.ResponseWriter, r *http.Request) (escapedModulePath string, prop string, ok bool) {
+	if strings.HasPrefix(r.URL.Path, "sumdb/") {
+		httpRespString(w, http.StatusNotFound, "not found")
 		return "", "", false
 	}
-	return
+	escapedModulePath, prop, err := splitRequestPath(r.URL.Path, r.URL.RawPath)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return "", "", false
+	}
+	return escapedModulePath, prop, true
 }
 
-func redirectToUpstream(w http.ResponseWriter, r *http.Request) {
+func (p *ProxyServer) redirectToUpstream(w http.ResponseWriter, r *http.Request) {
 	url := *r.URL
 	url.Scheme = UpstreamProxyScheme
 	url.Host = UpstreamProxyHost
+	if p.Upstream != "" {
+		base, err := neturl.Parse(p.upstreamURL())
+		if err == nil {
+			url.Scheme, url.Host = base.Scheme, base.Host
+			url.Path = base.Path + "/" + r.URL.Path
+			url.RawPath = ""
+		}
+	}
+	if p.RecordDir != "" {
+		p.forwardToUpstream(w, r, url.String())
+		return
+	}
 	http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
 }
 
+// upstreamURL is the base URL of the upstream proxy, without trailing slash
+func (p *ProxyServer) upstreamURL() string {
+	if p.Upstream == "" {
+		return UpstreamProxy
+	}
+	return strings.TrimSuffix(p.Upstream, "/")
+}
+
 // Does not handle gopkg.in/
 func splitModuleMajorVer(modulePath string) (string, string, bool) {
 	components := strings.Split(modulePath, "/")
@@ -115,32 +319,98 @@ func checkModulePathVer(modulePath, ver string) (path string, major string, inco
 	if !ok {
 		return
 	}
+	// ok is already set by splitModuleMajorVer, don't use naked returns from here on
 	if major == "" && !strings.HasPrefix(ver, "v0.") && !strings.HasPrefix(ver, "v1.") && !incompat {
-		return
+		return "", "", false, false
+	}
+	// repo/v4 and repo/sub/v4 only have v4.x.y versions, which are never +incompatible
+	if major != "" && (incompat || semver.Major(ver) != major) {
+		return "", "", false, false
 	}
 	return path, major, incompat, true
 }
 
-func checkEsModulePathUpstream(ctx context.Context, escapedModulePath string) (RevInfo, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
-		fmt.Sprintf("%s/%s/@latest", UpstreamProxy, escapedModulePath), nil)
-	if err != nil {
-		return RevInfo{}, err
+// Limits on responses of upstream and go-get hosts, which may be broken or malicious
+const (
+	MaxUpstreamResponse = 64 << 10
+	MaxGoImportResponse = 1 << 20
+	MaxResponseHeader   = 64 << 10
+	MaxRedirects        = 5
+)
+
+var errResponseTooLarge = errors.New("response body too large")
+
+var upstreamClient = newUpstreamClient(nil, nil, nil)
+
+// newUpstreamClient returns a client of upstream and go-get hosts, resolving hosts with dns,
+// trusting roots (the system roots if nil) and connecting as egress says
+func newUpstreamClient(dns *dnsCache, roots *x509.CertPool, egress EgressRules) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = egress.proxy
+	if roots != nil {
+		t.TLSClientConfig = &tls.Config{RootCAs: roots}
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return RevInfo{}, err
+	t.MaxResponseHeaderBytes = MaxResponseHeader
+	// The whole exchange is bounded by the context of the caller, this only catches hosts sitting on the request
+	t.ResponseHeaderTimeout = DirectConnectTimeout
+	if dns != nil {
+		t.DialContext = dns.dial
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(resp.Body)
-		if err == nil {
-			err = errors.New(string(body))
+	return &http.Client{
+		Transport: t,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= MaxRedirects {
+				return errors.New(fmt.Sprintf("stopped after %d redirects", MaxRedirects))
+			}
+			return nil
+		},
+	}
+}
+
+// bodyLimiter is io.LimitReader, but fails instead of truncating when the limit is hit
+type bodyLimiter struct {
+	r io.Reader
+	n int64
+}
+
+func (l *bodyLimiter) Read(b []byte) (int, error) {
+	if l.n <= 0 {
+		// Tell a body that is exactly n bytes from a longer one
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
 		}
-		return RevInfo{}, err
+		return 0, err
+	}
+	if int64(len(b)) > l.n {
+		b = b[:l.n]
 	}
+	n, err := l.r.Read(b)
+	l.n -= int64(n)
+	return n, err
+}
+
+// checkEsModulePathUpstream queries @latest of the module on the upstream proxy, retrying transient failures
+func (p *ProxyServer) checkEsModulePathUpstream(ctx context.Context, escapedModulePath string) (RevInfo, error) {
+	url := fmt.Sprintf("%s/%s/@latest", p.upstreamURL(), escapedModulePath)
 	var info RevInfo
-	err = json.NewDecoder(resp.Body).Decode(&info)
+	err := retryUpstream(ctx, p.upstreamBreaker, url, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := p.upstreamClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return newUpstreamError(resp)
+		}
+		info = RevInfo{}
+		return json.NewDecoder(&bodyLimiter{r: resp.Body, n: MaxUpstreamResponse}).Decode(&info)
+	})
 	if err != nil {
 		return RevInfo{}, err
 	}
@@ -156,16 +426,17 @@ func attrValue(attrs []xml.Attr, name string) string {
 	return ""
 }
 
-func checkModuleVcsDirect(modulePath string) ([]MetaImport, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), DirectConnectTimeout)
+// checkModuleVcsDirect fetches the go-import meta tags of modulePath from its host
+func (p *ProxyServer) checkModuleVcsDirect(ctx context.Context, modulePath string) ([]MetaImport, error) {
+	ctx, cancel := context.WithTimeout(ctx, DirectConnectTimeout)
 	defer cancel()
 	link := fmt.Sprintf("https://%s?go-get=1", modulePath)
-	loggerGreen.Printf("VcsDirect: Trying %s"+LOG_RST, modulePath)
+	loggerGreen.Printf(requestTag(ctx)+"VcsDirect: Trying %s"+LOG_RST, modulePath)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.goGetClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -173,7 +444,7 @@ func checkModuleVcsDirect(modulePath string) ([]MetaImport, error) {
 	if resp.StatusCode != http.StatusOK {
 		return nil, errors.New(fmt.Sprintf("HTTP error %d", resp.StatusCode))
 	}
-	decoder := xml.NewDecoder(resp.Body)
+	decoder := xml.NewDecoder(&bodyLimiter{r: resp.Body, n: MaxGoImportResponse})
 	decoder.Strict = false
 	var imports []MetaImport
 	for {
@@ -208,13 +479,13 @@ func checkModuleVcsDirect(modulePath string) ([]MetaImport, error) {
 	return imports, nil
 }
 
-func searchModuleVcsDirect(modulePath string) (string, []MetaImport, error) {
+func (p *ProxyServer) searchModuleVcsDirect(ctx context.Context, modulePath string) (string, []MetaImport, error) {
 	for {
-		imports, err := checkModuleVcsDirect(modulePath)
+		imports, err := p.checkModuleVcsDirect(ctx, modulePath)
 		if err == nil {
 			return modulePath, imports, nil
 		}
-		loggerYellow.Printf("VcsDirect: Failed to get %s: %s, continue trying"+LOG_RST, modulePath, err.Error())
+		loggerYellow.Printf(requestTag(ctx)+"VcsDirect: Failed to get %s: %s, continue trying"+LOG_RST, modulePath, err.Error())
 		idx := strings.LastIndexByte(modulePath, '/')
 		if idx == -1 {
 			return "", nil, errors.New("not found")
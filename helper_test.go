@@ -0,0 +1,69 @@
+package goproxy
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+func FuzzSplitRequestPath(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"example.com/m/@v/list", ""},
+		{"example.com/m/@v/v1.0.0.info", ""},
+		{"example.com/m/@v/v1.0.0.mod", ""},
+		{"example.com/m/v2/@v/v2.0.0.zip", ""},
+		{"example.com/m/@latest", ""},
+		{"github.com/!burnt!sushi/toml/@v/v1.3.2.info", ""},
+		{"github.com/!burnt!sushi/toml/@latest", ""},
+		{"github.com/BurntSushi/toml/@v/list", ""},
+		{"github.com/!!x/@v/list", ""},
+		{"example.com/m/@v/", ""},
+		{"example.com/m/@v/..", ""},
+		{"example.com/m/@v/../../x", ""},
+		{"example.com/../m/@v/list", ""},
+		{"example.com/./m/@latest", ""},
+		{"example.com//m/@latest", ""},
+		{"/example.com/m/@latest", ""},
+		{"../../etc/@v/list", ""},
+		{"example.com/m/@v/v1.0.0.info", "example.com%2Fm/@v/v1.0.0.info"},
+		{"example.com\\m/@v/list", "example.com%5cm/@v/list"},
+		{"example.com/m\\..\\x/@v/list", ""},
+		{"example.com/m@v/list", ""},
+		{"@v/list", ""},
+		{"", ""},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	f.Fuzz(func(t *testing.T, urlPath, rawPath string) {
+		escapedModulePath, prop, err := splitRequestPath(urlPath, rawPath)
+		if err != nil {
+			return
+		}
+		if urlPath != escapedModulePath+"/@v/"+prop && (prop != "latest" || urlPath != escapedModulePath+"/@latest") {
+			t.Fatalf("%q split into %q and %q", urlPath, escapedModulePath, prop)
+		}
+		if prop == "" || prop == "." || prop == ".." || strings.ContainsAny(prop, "/\\") {
+			t.Fatalf("%q: invalid prop %q", urlPath, prop)
+		}
+		raw := strings.ToLower(rawPath)
+		if strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") {
+			t.Fatalf("%q: encoded separators accepted in %q", urlPath, rawPath)
+		}
+		if strings.Contains(escapedModulePath, "\\") {
+			t.Fatalf("%q: backslash accepted in %q", urlPath, escapedModulePath)
+		}
+		for _, elem := range strings.Split(escapedModulePath, "/") {
+			if elem == "" || elem == "." || elem == ".." {
+				t.Fatalf("%q: invalid path element %q", urlPath, elem)
+			}
+		}
+		modulePath, err := module.UnescapePath(escapedModulePath)
+		if err != nil {
+			t.Fatalf("%q: %s", urlPath, err.Error())
+		}
+		if err = module.CheckPath(modulePath); err != nil {
+			t.Fatalf("%q: %s", urlPath, err.Error())
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package goproxy
+
+import (
+	"html/template"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+type IndexEndpoint struct {
+	Path        string
+	Description string
+}
+
+// Index describes the server, served at the root of the prefix
+type Index struct {
+	Version   string
+	Upstream  string
+	Endpoints []IndexEndpoint
+	Metrics   map[string]int64
+}
+
+var indexEndpoints = []IndexEndpoint{
+	{"<module>/@v/...", "GOPROXY endpoint: fetches into the cache, redirects to upstream until cached"},
+	{"sync/<module>/@v/...", "GOPROXY endpoint: waits for the fetch and serves from the cache"},
+	{"cached-only/<module>/@v/...", "GOPROXY endpoint: serves only from the cache"},
+	{"admin/metrics", "counters and gauges"},
+	{"admin/integrity", "results of integrity checks"},
+	{"admin/checksums", "results of checks against the checksum database"},
+	{"admin/quotas", "usage and quotas of every identity today"},
+	{"admin/popularity", "requests and background refresh schedule of mirrors"},
+	{"admin/deprecations", "deprecated modules seen"},
+	{"admin/clones", "pending clone jobs, ?path=<prefix>"},
+	{"admin/attestation", "signed provenance of a zip, ?path=<module>&version=<version>"},
+	{"admin/signing-key", "public key signing zips"},
+	{"admin/sbom", "SBOM of a module version, ?path=<module>&version=<version>&format=cyclonedx|spdx"},
+	{"admin/artifact", "size and go.sum hashes of a module version, ?path=<module>&version=<version>"},
+	{"admin/licenses", "license inventory, of a module version with ?path=<module>&version=<version>"},
+	{"admin/vulns", "OSV advisories of a module version, ?path=<module>&version=<version>"},
+	{"admin/mirrors", "local mirrors, ?path=<prefix>"},
+	{"admin/purge", "POST: remove a mirror and its archives, ?path=<module>"},
+	{"admin/refresh", "POST: update a mirror, ?path=<module>&wait=1"},
+	{"snapshot/<name>/<module>/@v/...", "GOPROXY endpoint: serves the versions of a snapshot from the cache"},
+	{"admin/snapshots", "snapshots of the cache"},
+	{"admin/snapshot", "versions of a snapshot, POST: take it, DELETE: remove it, ?name=<name>"},
+	{"admin/freeze", "whether the cache is frozen, POST: freeze it, ?reason=<reason>"},
+	{"admin/thaw", "POST: thaw the cache frozen through admin/freeze"},
+	{"admin/pins", "pinned modules and versions"},
+	{"admin/pin", "POST: pin a module against purging, ?path=<module>&version=<version>&norefresh=1&reason=<reason>"},
+	{"admin/unpin", "POST: remove a pin of the admin API, ?path=<module>&version=<version>"},
+	{"admin/check-reuse", "POST an Origin or .info: still valid against the remote of the mirror? ?path=<module>"},
+	{"admin/modules", "modules in a mirror, ?path=<module>&rev=<rev>"},
+	{"admin/info", "POST: .info of many module versions, from the cache only"},
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>goproxy</title></head>
+<body>
+<h1>goproxy {{.Version}}</h1>
+<p>Upstream: {{.Upstream}}</p>
+<h2>Endpoints</h2>
+<table>
+{{range .Endpoints}}<tr><td><code>{{.Path}}</code></td><td>{{.Description}}</td></tr>
+{{end}}</table>
+<h2>Cache</h2>
+<table>
+{{range $k, $v := .Metrics}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/ganboing/goproxy" {
+			return dep.Version
+		}
+	}
+	return info.Main.Version
+}
+
+func (p *ProxyServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	index := Index{
+		Version:   buildVersion(),
+		Upstream:  p.upstreamURL(),
+		Endpoints: indexEndpoints,
+		Metrics:   p.metricsSnapshot(),
+	}
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		httpRespJSON(w, http.StatusOK, index)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	indexTemplate.Execute(w, index)
+}
@@ -0,0 +1,161 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type IntegrityStatus struct {
+	Checked time.Time
+	OK      bool
+	Error   string `json:",omitempty"`
+}
+
+type integrityState struct {
+	mu      sync.Mutex
+	results map[string]IntegrityStatus
+	// Mirrors and artifacts yet to be checked in the current round
+	pending []string
+}
+
+func (p *ProxyServer) integrityReport() map[string]IntegrityStatus {
+	p.integrity.mu.Lock()
+	defer p.integrity.mu.Unlock()
+	report := make(map[string]IntegrityStatus, len(p.integrity.results))
+	for k, v := range p.integrity.results {
+		report[k] = v
+	}
+	return report
+}
+
+func (p *ProxyServer) recordIntegrity(name string, err error) {
+	status := IntegrityStatus{Checked: time.Now(), OK: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+		p.metrics.IntegrityFailures.Add(1)
+	}
+	p.metrics.IntegrityChecks.Add(1)
+	p.integrity.mu.Lock()
+	defer p.integrity.mu.Unlock()
+	prev, existed := p.integrity.results[name]
+	if existed && prev.OK != status.OK {
+		if status.OK {
+			p.metrics.CorruptedMirrors.Add(-1)
+		} else {
+			p.metrics.CorruptedMirrors.Add(1)
+		}
+	} else if !existed && !status.OK {
+		p.metrics.CorruptedMirrors.Add(1)
+	}
+	p.integrity.results[name] = status
+}
+
+// checkMirrorIntegrity runs git fsck on the mirror. Unless full, only the connectivity of the
+// objects is checked, which doesn't inflate blobs and is much cheaper, but misses corrupted blobs
+func checkMirrorIntegrity(ctx context.Context, gitdir string, full bool) error {
+	args := []string{"fsck", "--no-progress"}
+	if !full {
+		args = append(args, "--connectivity-only")
+	}
+	out, err := getGitCmd(ctx, gitdir, args...).CombinedOutput()
+	if err != nil {
+		return &GitError{Err: err, Stderr: strings.TrimSpace(string(out))}
+	}
+	return nil
+}
+
+func (p *ProxyServer) checkArchiveIntegrity(ctx context.Context, archive string) error {
+	compressed, err := p.Storage.Get(ctx, archive)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+	// zstd frames carry a content checksum, testing is enough to detect bit rot
+	cmd := exec.CommandContext(ctx, ZstdCommand, "-q", "-t")
+	sandboxCmd(cmd, cacheDirOf(ctx), false)
+	cmd.Stdin = compressed
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("zstd test failed: %s: %s", err.Error(), strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+func (p *ProxyServer) collectIntegrityTargets() []string {
+	var targets []string
+	walkLocalMirrors(p.Dir, func(modulePath, vcs string) {
+		if vcs == ".git" {
+			targets = append(targets, path.Join(modulePath, vcs))
+		}
+	})
+	// Storage keys are relative to the cache, like the mirrors
+	archives, _ := p.Storage.List(context.Background(), ArchiveStoreDir+"/")
+	for _, name := range archives {
+		if strings.HasSuffix(name, ".zst") {
+			targets = append(targets, name)
+		}
+	}
+	return targets
+}
+
+// CheckIntegrity checks every mirror and stored archive of the cache once, rather than one per
+// IntegrityCheckInterval, and returns the results. Corrupted mirrors are left for the server to heal
+func (p *ProxyServer) CheckIntegrity(ctx context.Context) map[string]IntegrityStatus {
+	p.initOnce.Do(p.init)
+	ctx = p.withCacheDir(ctx)
+	for _, target := range p.collectIntegrityTargets() {
+		if ctx.Err() != nil {
+			break
+		}
+		var err error
+		if strings.HasSuffix(target, ".zst") {
+			err = p.checkArchiveIntegrity(ctx, target)
+		} else {
+			err = checkMirrorIntegrity(ctx, target, false)
+		}
+		p.recordIntegrity(target, err)
+	}
+	return p.integrityReport()
+}
+
+// integrityChecker checks one mirror or stored archive per tick, rolling over the whole cache.
+// In a cluster, only the leader does
+func (p *ProxyServer) integrityChecker() {
+	ticker := time.NewTicker(time.Duration(p.IntegrityCheckInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		if !p.isLeader() {
+			continue
+		}
+		if len(p.integrity.pending) == 0 {
+			p.integrity.pending = p.collectIntegrityTargets()
+			if len(p.integrity.pending) == 0 {
+				continue
+			}
+		}
+		target := p.integrity.pending[0]
+		p.integrity.pending = p.integrity.pending[1:]
+		var err error
+		ctx, cancel := context.WithTimeout(p.withCacheDir(context.Background()), p.localTimeout())
+		if strings.HasSuffix(target, ".zst") {
+			err = p.checkArchiveIntegrity(ctx, target)
+		} else {
+			err = checkMirrorIntegrity(ctx, target, false)
+		}
+		timedOut := ctx.Err() != nil
+		cancel()
+		if err != nil {
+			loggerRed.Printf("integrityChecker: %s is corrupted: %s"+LOG_RST, target, err.Error())
+		}
+		p.recordIntegrity(target, err)
+		if err != nil && !timedOut && !strings.HasSuffix(target, ".zst") {
+			p.healMirror(p.withCacheDir(context.Background()), path.Dir(target), clonePriorityBackground)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// tagVersion is the reverse of gitVersionRefs for tags, returns "" if tag isn't a version of the module
+func (p *ProxyServer) tagVersion(modulePath, subPath, verMajorTag, tag string) string {
+	if subPath != "" {
+		var ok bool
+		tag, ok = strings.CutPrefix(tag, subPath+"/")
+		if !ok {
+			return ""
+		}
+	}
+	ver := tag
+	rule := p.tagRule(modulePath)
+	if rule != nil {
+		trimmed, ok := strings.CutPrefix(tag, rule.Prefix)
+		if ok && semver.IsValid("v"+trimmed) {
+			ver = "v" + trimmed
+		}
+	} else if subPath == "" && !strings.HasPrefix(tag, "v") {
+		// Same fallback as gitVersionRefs, X.Y.Z tags
+		ver = "v" + tag
+	}
+	if !semver.IsValid(ver) || semver.Canonical(ver) != ver || semver.Build(ver) != "" {
+		return ""
+	}
+	major := semver.Major(ver)
+	if verMajorTag != "" {
+		if major != verMajorTag {
+			return ""
+		}
+	} else if major != "v0" && major != "v1" {
+		return ""
+	}
+	return ver
+}
+
+// preferVersion reports whether ver is preferred over cur for @latest, releases always win over pre-releases
+func preferVersion(ver, cur string) bool {
+	verRelease, curRelease := semver.Prerelease(ver) == "", semver.Prerelease(cur) == ""
+	if verRelease != curRelease {
+		return verRelease
+	}
+	return semver.Compare(ver, cur) > 0
+}
+
+// latestModGit finds the highest release (or else pre-release) version of the module. If the
+// repo has no version tags at all, a pseudo-version of the default branch head is returned
+func (p *ProxyServer) latestModGit(ctx context.Context, modulePath, verMajorTag, subPath string) (string, *RevInfo, error) {
+	gitdir := modulePath + "/.git"
+	ctx, cancel := context.WithTimeout(ctx, p.localTimeout())
+	defer cancel()
+	tags, err := runGitOutputShort(ctx, gitdir, "for-each-ref", "--format=%(refname:strip=2)", "refs/tags/")
+	if err != nil {
+		return "", nil, err
+	}
+	latest := ""
+	for _, tag := range strings.Split(tags, "\n") {
+		ver := p.tagVersion(modulePath, subPath, verMajorTag, tag)
+		if ver == "" {
+			continue
+		}
+		if latest == "" || preferVersion(ver, latest) {
+			latest = ver
+		}
+	}
+	if latest != "" {
+		return latest, nil, nil
+	}
+	out, err := runGitOutputShort(ctx, gitdir, "log", "-1", "--format=%ct %H", "HEAD")
+	if isGitNotFound(err) {
+		// Empty repo
+		return "", nil, &NotFoundError{Module: path.Join(modulePath, subPath, verMajorTag), Version: "latest", Reason: `no matching versions for query "latest"`}
+	}
+	if err != nil {
+		return "", nil, errors.New(fmt.Sprintf("failed to resolve default branch: %s", err.Error()))
+	}
+	unixTime, hash, _ := strings.Cut(strings.TrimSpace(out), " ")
+	tm, err := strconv.ParseInt(unixTime, 10, 64)
+	if err != nil {
+		return "", nil, err
+	}
+	timestamp := time.Unix(tm, 0).In(time.UTC)
+	origin := &Origin{VCS: "git", Subdir: subPath, Ref: "HEAD", Hash: hash}
+	remote, err := runGitOutputShort(ctx, gitdir, "config", "--get", "remote.origin.url")
+	if err == nil {
+		origin.URL = strings.TrimSpace(remote)
+	}
+	return "", &RevInfo{
+		Version: module.PseudoVersion(verMajorTag, "", timestamp, hash[:12]),
+		Time:    timestamp,
+		Origin:  origin,
+	}, nil
+}
+
+// listModGit lists the versions of the module tagged in its mirror, as @v/list does
+func (p *ProxyServer) listModGit(ctx context.Context, modulePath, verMajorTag, subPath string) ([]byte, error) {
+	gitdir := modulePath + "/.git"
+	ctx, cancel := context.WithTimeout(ctx, p.localTimeout())
+	defer cancel()
+	tags, err := runGitOutputShort(ctx, gitdir, "for-each-ref", "--format=%(refname:strip=2)", "refs/tags/")
+	if err != nil {
+		return nil, err
+	}
+	vers := []string{}
+	for _, tag := range strings.Split(tags, "\n") {
+		ver := p.tagVersion(modulePath, subPath, verMajorTag, tag)
+		// v1.2.3 and 1.2.3 tag the same version
+		if ver != "" && !slices.Contains(vers, ver) {
+			vers = append(vers, ver)
+		}
+	}
+	semver.Sort(vers)
+	list := strings.Builder{}
+	for _, ver := range vers {
+		list.WriteString(ver + "\n")
+	}
+	return []byte(list.String()), nil
+}
+
+// serveListCached answers @v/list from the mirror of the module. The list is kept in the metadata
+// cache until the mirror is updated, see dropMirrorLists
+func (p *ProxyServer) serveListCached(w http.ResponseWriter, r *http.Request, escapedModulePath string) {
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	modulePathTrim, verMajorTag, ok := splitModuleMajorVer(modulePath)
+	if !ok {
+		httpRespString(w, http.StatusInternalServerError,
+			fmt.Sprintf("module path %s is invalid or not supported", modulePath))
+		return
+	}
+	if strings.HasPrefix(modulePath, "gopkg.in/") {
+		modulePathTrim, verMajorTag = modulePath, ""
+	}
+	parentPath, subPath, vcs, err := p.checkModVcsLocal(modulePathTrim)
+	if err != nil || vcs != ".git" {
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("cached module %s not found", modulePath))
+		return
+	}
+	// Updating the mirror drops the list
+	if !p.revalidateMirror(w, r, parentPath) {
+		return
+	}
+	key := escapedModulePath + "/@v/list"
+	data, ok := p.metaCache.Get(key)
+	if !ok {
+		data, err = p.listModGit(r.Context(), parentPath, verMajorTag, subPath)
+		if err != nil {
+			httpRespError(w, err)
+			return
+		}
+		p.metaCache.Add(key, data)
+	}
+	httpRespBytes(w, "text/plain; charset=UTF-8", data)
+}
+
+// dropMirrorLists drops the cached @v/list of the modules served from the mirror at owner, once
+// it's updated. Other module paths sharing the mirror are found through its aliases
+func (p *ProxyServer) dropMirrorLists(owner string) {
+	for _, modulePath := range append(p.mirrors.aliasesOf(owner), owner) {
+		escaped, err := module.EscapePath(modulePath)
+		if err != nil {
+			continue
+		}
+		p.metaCache.RemoveFunc(func(key string) bool {
+			return strings.HasPrefix(key, escaped+"/") && strings.HasSuffix(key, "/@v/list")
+		})
+	}
+}
+
+func (p *ProxyServer) serveLatestCached(w http.ResponseWriter, r *http.Request, escapedModulePath string) {
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	modulePathTrim, verMajorTag, ok := splitModuleMajorVer(modulePath)
+	if !ok {
+		httpRespString(w, http.StatusInternalServerError,
+			fmt.Sprintf("module path %s is invalid or not supported", modulePath))
+		return
+	}
+	if strings.HasPrefix(modulePath, "gopkg.in/") {
+		modulePathTrim, verMajorTag = modulePath, ""
+	}
+	parentPath, subPath, vcs, err := p.checkModVcsLocal(modulePathTrim)
+	if backend, ok := p.vcsBackends[vcs]; err == nil && ok {
+		p.serveBackendQuery(w, r, backend, p.vcsRepo(parentPath, subPath, verMajorTag, vcs), "latest")
+		return
+	}
+	if err != nil || vcs != ".git" {
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("cached module %s not found", modulePath))
+		return
+	}
+	if !p.revalidateMirror(w, r, parentPath) {
+		return
+	}
+	ver, info, err := p.latestModGit(r.Context(), parentPath, verMajorTag, subPath)
+	if err != nil {
+		httpRespError(w, err)
+		return
+	}
+	if info == nil {
+		reader, err := p.serveModGit(r.Context(), parentPath, verMajorTag, subPath, ver, ".info", false)
+		if err != nil {
+			httpRespError(w, err)
+			return
+		}
+		info = &RevInfo{}
+		err = json.NewDecoder(reader).Decode(info)
+		reader.Close()
+		if err != nil {
+			httpRespString(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	// The result depends on the set of tags, a new one may change it. Like cmd/go, let clients
+	// revalidate it with the TagSum (see admin/check-reuse)
+	refs, err := localRefs(r.Context(), parentPath+"/.git")
+	if err == nil && info.Origin != nil {
+		info.Origin.TagPrefix = ""
+		if subPath != "" {
+			info.Origin.TagPrefix = subPath + "/"
+		}
+		info.Origin.TagSum = refs.tagSum(info.Origin.TagPrefix)
+	}
+	httpRespJSON(w, http.StatusOK, info)
+}
+
+// branchModGit resolves the head of a branch of the mirror, like the go command does for module@branch:
+// the highest version tagged on the head itself, or else a pseudo-version based on the highest ancestor version
+func (p *ProxyServer) branchModGit(ctx context.Context, modulePath, verMajorTag, subPath, branch string) (*RevInfo, error) {
+	gitdir := modulePath + "/.git"
+	ctx, cancel := context.WithTimeout(ctx, p.localTimeout())
+	defer cancel()
+	modFull := path.Join(modulePath, subPath, verMajorTag)
+	if !validBranchName(branch) {
+		return nil, &NotFoundError{Module: modFull, Version: branch, Reason: "invalid branch name " + branch}
+	}
+	ref := "refs/heads/" + branch
+	out, err := runGitOutputShort(ctx, gitdir, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+	if isGitNotFound(err) {
+		return nil, &NotFoundError{Module: modFull, Version: branch, Reason: "unknown revision " + branch}
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to resolve branch %s: %s", branch, err.Error()))
+	}
+	hash := strings.TrimSpace(out)
+	out, err = runGitOutputShort(ctx, gitdir, "log", "-1", "--format=%ct", hash)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to resolve branch %s: %s", branch, err.Error()))
+	}
+	tm, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	highestTag := func(filter string) (string, error) {
+		tags, err := runGitOutputShort(ctx, gitdir, "for-each-ref", "--format=%(refname:strip=2)", filter+"="+hash, "refs/tags/")
+		if err != nil {
+			return "", err
+		}
+		highest := ""
+		for _, tag := range strings.Split(tags, "\n") {
+			ver := p.tagVersion(modulePath, subPath, verMajorTag, tag)
+			if ver != "" && (highest == "" || semver.Compare(ver, highest) > 0) {
+				highest = ver
+			}
+		}
+		return highest, nil
+	}
+	ver, err := highestTag("--points-at")
+	if err != nil {
+		return nil, err
+	}
+	if ver == "" {
+		base, err := highestTag("--merged")
+		if err != nil {
+			return nil, err
+		}
+		major := verMajorTag
+		if base != "" {
+			major = semver.Major(base)
+		}
+		ver = module.PseudoVersion(major, base, time.Unix(tm, 0), hash[:12])
+	}
+	origin := &Origin{VCS: "git", Subdir: subPath, Ref: ref, Hash: hash}
+	remote, err := runGitOutputShort(ctx, gitdir, "config", "--get", "remote.origin.url")
+	if err == nil {
+		origin.URL = strings.TrimSpace(remote)
+	}
+	return &RevInfo{Version: ver, Time: time.Unix(tm, 0).In(time.UTC), Origin: origin}, nil
+}
+
+// validBranchName reports whether branch is a valid name of a branch, as by git check-ref-format --branch,
+// so that it can't be taken for revision syntax once prefixed with refs/heads/
+func validBranchName(branch string) bool {
+	if strings.HasPrefix(branch, "-") || strings.HasSuffix(branch, ".") ||
+		strings.Contains(branch, "..") || strings.Contains(branch, "@{") || strings.ContainsAny(branch, " ~^:?*[\\\x7f") {
+		return false
+	}
+	for _, c := range branch {
+		if c < ' ' {
+			return false
+		}
+	}
+	for _, elem := range strings.Split(branch, "/") {
+		if elem == "" || strings.HasPrefix(elem, ".") || strings.HasSuffix(elem, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// serveBranchInfo answers /@v/<branch>.info from the mirror of the module. It returns false,
+// without responding, if the version is not a branch name or the module isn't mirrored. With
+// fallback set, branches missing from the mirror are also left to the caller
+func (p *ProxyServer) serveBranchInfo(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string, fallback bool) bool {
+	if path.Ext(prop) != ".info" {
+		return false
+	}
+	branch, err := module.UnescapeVersion(strings.TrimSuffix(prop, ".info"))
+	if err != nil || semver.IsValid(branch) || !validBranchName(branch) {
+		return false
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return false
+	}
+	modulePathTrim, verMajorTag, ok := splitModuleMajorVer(modulePath)
+	if strings.HasPrefix(modulePath, "gopkg.in/") {
+		modulePathTrim, verMajorTag, ok = modulePath, "", true
+	}
+	if !ok {
+		return false
+	}
+	parentPath, subPath, vcs, err := p.checkModVcsLocal(modulePathTrim)
+	if backend, ok := p.vcsBackends[vcs]; err == nil && ok {
+		p.setCacheControl(w, endpointOf(prop))
+		p.serveBackendQuery(w, r, backend, p.vcsRepo(parentPath, subPath, verMajorTag, vcs), branch)
+		return true
+	}
+	if err != nil || vcs != ".git" {
+		return false
+	}
+	if !p.revalidateMirror(w, r, parentPath) {
+		return true
+	}
+	info, err := p.branchModGit(r.Context(), parentPath, verMajorTag, subPath, branch)
+	var notFound *NotFoundError
+	if fallback && errors.As(err, &notFound) {
+		return false
+	}
+	if err != nil {
+		httpRespError(w, err)
+		return true
+	}
+	p.setCacheControl(w, endpointOf(prop))
+	httpRespJSON(w, http.StatusOK, info)
+	return true
+}
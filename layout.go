@@ -0,0 +1,139 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/sys/unix"
+)
+
+func openLayout(dir string) (*cacheRoot, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return openCacheRoot(dir)
+}
+
+// storeLayout adds an artifact served from a mirror to LayoutDir, as <module>/@v/<version>.<ext>.
+// Artifacts are immutable, existing ones are left alone. Errors are only logged, the artifact
+// can always be regenerated
+func (p *ProxyServer) storeLayout(ctx context.Context, escapedModulePath, prop string, content io.ReadSeeker) {
+	ext := path.Ext(prop)
+	version, err := module.UnescapeVersion(strings.TrimSuffix(prop, ext))
+	if err != nil || module.CanonicalVersion(version) != version {
+		return
+	}
+	dir := path.Join(escapedModulePath, "@v")
+	name := path.Join(dir, prop)
+	if p.layout.beneath(name) == nil {
+		return
+	}
+	err = p.layout.mkdirAll(dir, 0755)
+	if err == nil {
+		err = writeLayoutFile(p.layout, name, content)
+	}
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"storeLayout: Failed to store %s: %s"+LOG_RST, name, err.Error())
+		return
+	}
+	// A version is listed once its .info is there, which is what the go command resolves first
+	if ext == ".info" && !module.IsPseudoVersion(version) {
+		p.addLayoutVersion(ctx, dir, version)
+	}
+}
+
+// writeLayoutFile atomically creates name in root with the content. Unnamed temp files (such as
+// generated zips) are linked in place rather than copied
+func writeLayoutFile(root *cacheRoot, name string, content io.ReadSeeker) error {
+	defer content.Seek(0, io.SeekStart)
+	if f, ok := content.(*os.File); ok {
+		err := root.linkFile(f, name)
+		if err == nil {
+			return f.Chmod(0644)
+		}
+		if err == unix.EEXIST {
+			return nil
+		}
+	}
+	tmp, err := root.createTemp(path.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer root.remove(tmp.Name())
+	content.Seek(0, io.SeekStart)
+	_, err = io.Copy(tmp, content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	// Like link, don't replace what another request stored in the meantime
+	err = root.link(tmp.Name(), name)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *ProxyServer) addLayoutVersion(ctx context.Context, dir, version string) {
+	p.layoutMu.Lock()
+	defer p.layoutMu.Unlock()
+	// Other processes sharing the cache may share the layout too
+	l, _, err := lockFile(ctx, p.lockPath(path.Join("layout", dir+".lock")), unix.LOCK_EX)
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"storeLayout: Failed to lock %s: %s"+LOG_RST, dir, err.Error())
+		return
+	}
+	defer l.unlock()
+	listPath := path.Join(dir, "list")
+	var data []byte
+	if f, err := p.layout.openFile(listPath); err == nil {
+		data, _ = io.ReadAll(f)
+		f.Close()
+	}
+	versions := strings.Fields(string(data))
+	for _, v := range versions {
+		if v == version {
+			return
+		}
+	}
+	versions = append(versions, version)
+	semver.Sort(versions)
+	var buf bytes.Buffer
+	for _, v := range versions {
+		buf.WriteString(v + "\n")
+	}
+	err = writeLayoutList(p.layout, listPath, buf.Bytes())
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"storeLayout: Failed to update %s: %s"+LOG_RST, listPath, err.Error())
+	}
+}
+
+// writeLayoutList replaces the version list name in root
+func writeLayoutList(root *cacheRoot, name string, data []byte) error {
+	tmp, err := root.createTemp(path.Dir(name), "list.")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	tmp.Close()
+	if err == nil {
+		err = root.rename(tmp.Name(), name)
+	}
+	if err != nil {
+		root.remove(tmp.Name())
+	}
+	return err
+}
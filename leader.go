@@ -0,0 +1,223 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LeaderLock is the lock backend electing the node running background maintenance (integrity
+// checks and such) in a cluster. All nodes keep serving requests
+type LeaderLock interface {
+	// TryAcquire takes the lock for node, or extends it if node already holds it, for ttl.
+	// It reports whether node holds the lock
+	TryAcquire(ctx context.Context, node string, ttl time.Duration) (bool, error)
+	// Release gives up the lock if node holds it
+	Release(ctx context.Context, node string) error
+}
+
+// fileLeaderLock is a lease in LeaseDir on the shared cache volume
+type fileLeaderLock struct {
+	name string
+}
+
+func (f *fileLeaderLock) TryAcquire(ctx context.Context, node string, ttl time.Duration) (bool, error) {
+	held, err := extendLease(f.name, leaseRecord{Node: node, Expires: time.Now().Add(ttl)})
+	if held || err != nil {
+		return held, err
+	}
+	l, _, err := tryLease(f.name, node, ttl)
+	return l != nil, err
+}
+
+func (f *fileLeaderLock) Release(ctx context.Context, node string) error {
+	return dropLease(f.name, node)
+}
+
+// redisLeaderLock is a key in Redis, set with NX and a TTL. Extending and releasing compare
+// the holder first, in a script so nothing can happen in between
+type redisLeaderLock struct {
+	addr     string
+	password string
+	db       int
+	key      string
+}
+
+const redisExtendScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+const redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// parseRedisLeaderLock parses redis://[:password@]host[:port][/db]
+func parseRedisLeaderLock(rawURL string) (*redisLeaderLock, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	lock := &redisLeaderLock{addr: u.Host, key: "goproxy:leader"}
+	if u.Port() == "" {
+		lock.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		lock.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		lock.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid redis database %s", db))
+		}
+	}
+	return lock, nil
+}
+
+// command runs a Redis command over a fresh connection, returning an integer, bulk string ("" for nil)
+// or status reply. Elections are infrequent, there's no point in keeping connections around
+func (rl *redisLeaderLock) command(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, DirectConnectTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", rl.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	var commands [][]string
+	if rl.password != "" {
+		commands = append(commands, []string{"AUTH", rl.password})
+	}
+	if rl.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(rl.db)})
+	}
+	commands = append(commands, args)
+	var req strings.Builder
+	for _, command := range commands {
+		fmt.Fprintf(&req, "*%d\r\n", len(command))
+		for _, arg := range command {
+			fmt.Fprintf(&req, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	_, err = conn.Write([]byte(req.String()))
+	if err != nil {
+		return "", err
+	}
+	reader := bufio.NewReader(conn)
+	var reply string
+	for range commands {
+		reply, err = readRedisReply(reader)
+		if err != nil {
+			return "", err
+		}
+	}
+	return reply, nil
+}
+
+func readRedisReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(fmt.Sprintf("redis: %s", line[1:]))
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return "", err
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		return string(buf[:n]), err
+	}
+	return "", errors.New(fmt.Sprintf("unexpected redis reply %q", line))
+}
+
+func (rl *redisLeaderLock) TryAcquire(ctx context.Context, node string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+	reply, err := rl.command(ctx, "SET", rl.key, node, "NX", "PX", ms)
+	if err != nil || reply == "OK" {
+		return err == nil, err
+	}
+	reply, err = rl.command(ctx, "EVAL", redisExtendScript, "1", rl.key, node, ms)
+	return reply == "1", err
+}
+
+func (rl *redisLeaderLock) Release(ctx context.Context, node string) error {
+	_, err := rl.command(ctx, "EVAL", redisReleaseScript, "1", rl.key, node)
+	return err
+}
+
+// leaderLock returns the configured lock, file leases being in the cache at dir
+func (c *Cluster) leaderLock(dir string) (LeaderLock, error) {
+	switch {
+	case c.Elector != nil:
+		return c.Elector, nil
+	case c.LeaderLock == "" || c.LeaderLock == "file":
+		return &fileLeaderLock{name: path.Join(dir, LeaseDir, "leader.lease")}, nil
+	case strings.HasPrefix(c.LeaderLock, "redis://"):
+		return parseRedisLeaderLock(c.LeaderLock)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown leader lock %s, expecting file or redis://", c.LeaderLock))
+}
+
+// elect keeps trying to become, or stay, the leader. Renewal happens at a third of the lease
+// duration, failing to renew in time (including errors of the backend) steps down
+func (p *ProxyServer) elect() {
+	lock := p.leaderLock
+	ttl := p.Cluster.duration()
+	node := p.Cluster.node()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	var renewed time.Time
+	for !p.steppedDown.Load() {
+		ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+		held, err := lock.TryAcquire(ctx, node, ttl)
+		cancel()
+		if err != nil {
+			loggerYellow.Printf("elect: Lock backend failed: %s"+LOG_RST, err.Error())
+		}
+		if held {
+			renewed = time.Now()
+		}
+		// Lost, or can't tell but the lease may have run out anyway
+		leader := held || (err != nil && time.Since(renewed) < ttl*2/3)
+		if p.leader.Swap(leader) != leader {
+			if leader {
+				loggerGreen.Printf("elect: %s is now the leader"+LOG_RST, node)
+			} else {
+				loggerYellow.Printf("elect: %s is no longer the leader"+LOG_RST, node)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// StepDown gives up leadership for good, meant for shutdown so another node takes over right away
+func (p *ProxyServer) StepDown(ctx context.Context) {
+	if p.Cluster == nil || p.leaderLock == nil || p.steppedDown.Swap(true) {
+		return
+	}
+	p.leader.Store(false)
+	err := p.leaderLock.Release(ctx, p.Cluster.node())
+	if err != nil {
+		loggerYellow.Printf("StepDown: Failed to release the leader lock: %s"+LOG_RST, err.Error())
+	}
+}
+
+// isLeader reports whether this node runs background maintenance. Without a cluster it always does
+func (p *ProxyServer) isLeader() bool {
+	return p.Cluster == nil || p.leader.Load()
+}
@@ -0,0 +1,44 @@
+package goproxy
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLeaderLock(t *testing.T) {
+	ctx := context.Background()
+	lock := &fileLeaderLock{name: filepath.Join(t.TempDir(), "leader.lease")}
+	try := func(node string, ttl time.Duration, want bool) {
+		t.Helper()
+		held, err := lock.TryAcquire(ctx, node, ttl)
+		if err != nil || held != want {
+			t.Fatalf("TryAcquire(%s) = %v, %v, want %v", node, held, err, want)
+		}
+	}
+	try("a", time.Minute, true)
+	try("b", time.Minute, false)
+	// Renewing
+	try("a", -time.Second, true)
+	// Taken over once expired, a doesn't get it back by renewing
+	try("b", time.Minute, true)
+	try("a", time.Minute, false)
+	err := lock.Release(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := readLease(lock.name)
+	if err != nil || current.Node != "b" {
+		t.Fatalf("holder after a released = %q, %v, want b", current.Node, err)
+	}
+	err = lock.Release(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	try("a", time.Minute, true)
+	files, _ := filepath.Glob(lock.name + ".*")
+	if len(files) != 0 {
+		t.Errorf("left behind %q", files)
+	}
+}
@@ -0,0 +1,236 @@
+package goproxy
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+const LicenseStoreDir = ".licenses"
+
+// Only this much of a license file is read for classification
+const maxLicenseFileSize = 256 << 10
+
+// LicenseFile is a license file found in a module zip
+type LicenseFile struct {
+	Name string
+	// SPDX identifier, or "unknown"
+	License string
+}
+
+// LicenseReport is the license inventory of a module version
+type LicenseReport struct {
+	Module  string
+	Version string
+	Files   []LicenseFile
+	// Distinct SPDX identifiers of the files at the root of the module
+	Licenses []string
+}
+
+// licensePhrases classify license texts, the first entry whose phrases all appear wins
+var licensePhrases = []struct {
+	id      string
+	phrases []string
+}{
+	{"AGPL-3.0", []string{"gnu affero general public license", "version 3"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license", "version 2.1"}},
+	{"GPL-3.0", []string{"gnu general public license", "version 3"}},
+	{"GPL-2.0", []string{"gnu general public license", "version 2"}},
+	{"MPL-2.0", []string{"mozilla public license", "2.0"}},
+	{"EPL-2.0", []string{"eclipse public license", "2.0"}},
+	{"Apache-2.0", []string{"apache license", "version 2.0"}},
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"ISC", []string{"permission to use, copy, modify, and/or distribute this software for any purpose with or without fee is hereby granted"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"CC0-1.0", []string{"cc0 1.0 universal"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "names of its contributors"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"Zlib", []string{"altered source versions must be plainly marked"}},
+}
+
+func classifyLicense(text string) string {
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	for _, entry := range licensePhrases {
+		matched := true
+		for _, phrase := range entry.phrases {
+			if !strings.Contains(text, phrase) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return entry.id
+		}
+	}
+	return "unknown"
+}
+
+func isLicenseFile(name string) bool {
+	base := strings.ToUpper(path.Base(name))
+	for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING", "UNLICENSE"} {
+		rest, ok := strings.CutPrefix(base, prefix)
+		if ok && (rest == "" || rest[0] == '.' || rest[0] == '-' || rest[0] == '_') {
+			return true
+		}
+	}
+	return false
+}
+
+// scanLicenses classifies the license files in a module zip
+func scanLicenses(modulePath, version string, archive *os.File) (*LicenseReport, error) {
+	fi, err := archive.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(archive, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	report := &LicenseReport{Module: modulePath, Version: version, Files: []LicenseFile{}, Licenses: []string{}}
+	prefix := modulePath + "@" + version + "/"
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok || !isLicenseFile(name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxLicenseFileSize))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		id := classifyLicense(string(data))
+		report.Files = append(report.Files, LicenseFile{Name: name, License: id})
+		if !strings.Contains(name, "/") && !slices.Contains(report.Licenses, id) {
+			report.Licenses = append(report.Licenses, id)
+		}
+	}
+	return report, nil
+}
+
+func (p *ProxyServer) loadLicenseReport(escapedModulePath, escapedVersion string) (*LicenseReport, error) {
+	report := &LicenseReport{}
+	err := p.loadRecord(context.Background(), recordKey(LicenseStoreDir, escapedModulePath, escapedVersion), report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// recordLicenses scans a zip being served, unless its report is already there. Errors are only logged
+func (p *ProxyServer) recordLicenses(ctx context.Context, escapedModulePath, escapedVersion string, archive *os.File) *LicenseReport {
+	report, err := p.loadLicenseReport(escapedModulePath, escapedVersion)
+	if err == nil {
+		return report
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return nil
+	}
+	version, err := module.UnescapeVersion(escapedVersion)
+	if err != nil {
+		return nil
+	}
+	report, err = scanLicenses(modulePath, version, archive)
+	if err == nil {
+		err = p.storeRecord(ctx, recordKey(LicenseStoreDir, escapedModulePath, escapedVersion), report)
+	}
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"recordLicenses: Failed to scan %s@%s: %s"+LOG_RST, modulePath, version, err.Error())
+	}
+	return report
+}
+
+// LicenseSummary aggregates the reports of all module versions scanned so far
+type LicenseSummary struct {
+	// SPDX identifier -> module@version
+	Licenses map[string][]string
+	// Module versions without any license file at their root
+	Unlicensed []string
+}
+
+func (p *ProxyServer) licenseSummary() LicenseSummary {
+	summary := LicenseSummary{Licenses: make(map[string][]string), Unlicensed: []string{}}
+	ctx := context.Background()
+	keys, _ := p.Storage.List(ctx, LicenseStoreDir+"/")
+	for _, key := range keys {
+		var report LicenseReport
+		if !strings.HasSuffix(key, ".json") || p.loadRecord(ctx, key, &report) != nil {
+			continue
+		}
+		modVer := report.Module + "@" + report.Version
+		if len(report.Licenses) == 0 {
+			summary.Unlicensed = append(summary.Unlicensed, modVer)
+		}
+		for _, id := range report.Licenses {
+			summary.Licenses[id] = append(summary.Licenses[id], modVer)
+		}
+	}
+	for _, modVers := range summary.Licenses {
+		sort.Strings(modVers)
+	}
+	sort.Strings(summary.Unlicensed)
+	return summary
+}
+
+// serveAdminLicenses serves the report of ?path=<module>&version=<version>, scanning the zip if needed,
+// or the summary of all scanned module versions without parameters
+func (p *ProxyServer) serveAdminLicenses(w http.ResponseWriter, r *http.Request) {
+	modulePath, version := r.URL.Query().Get("path"), r.URL.Query().Get("version")
+	if modulePath == "" && version == "" {
+		httpRespJSON(w, http.StatusOK, p.licenseSummary())
+		return
+	}
+	err := module.Check(modulePath, version)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	escapedModulePath, _ := module.EscapePath(modulePath)
+	escapedVersion, _ := module.EscapeVersion(version)
+	report, err := p.loadLicenseReport(escapedModulePath, escapedVersion)
+	if err == nil {
+		httpRespJSON(w, http.StatusOK, report)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.localTimeout())
+	defer cancel()
+	modulePathTrim, verMajorTag, incompat, ok := checkModulePathVer(modulePath, version)
+	if !ok {
+		httpRespString(w, http.StatusBadRequest, fmt.Sprintf("module path/ver %s[%s] is invalid or not supported", modulePath, version))
+		return
+	}
+	reader, err := p.serveModLocal(ctx, modulePathTrim, verMajorTag, semver.Canonical(version), ".zip", incompat)
+	if err != nil {
+		httpRespString(w, http.StatusNotFound, err.Error())
+		return
+	}
+	defer reader.Close()
+	archive, ok := reader.(*os.File)
+	if !ok {
+		httpRespString(w, http.StatusInternalServerError, errors.New("zip is not a file").Error())
+		return
+	}
+	report = p.recordLicenses(ctx, escapedModulePath, escapedVersion, archive)
+	if report == nil {
+		httpRespString(w, http.StatusInternalServerError, "failed to scan licenses")
+		return
+	}
+	httpRespJSON(w, http.StatusOK, report)
+}
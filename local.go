@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
 	"golang.org/x/sys/unix"
 	"io"
 	"log"
@@ -21,35 +22,100 @@ import (
 	"time"
 )
 
-func (p *ProxyServer) serveModGit(modulePath, verMajorTag, subPath, verCanonical, ext string, incompat bool) (io.ReadCloser, error) {
+// gitVersionRefs maps a module version to candidate git revisions, following the conventions of cmd/go
+// (modulePath is the repo root, verMajorTag/subPath are split from the requested module path):
+//
+//	module path    version          revision      tree
+//	repo           v1.2.3           v1.2.3        /
+//	repo/v4        v4.1.0           v4.1.0        v4/ if it has go.mod, else /
+//	repo/sub       v1.2.3           sub/v1.2.3    sub/
+//	repo/sub/v4    v4.1.0           sub/v4.1.0    sub/v4/ if it has go.mod, else sub/
+//	any            pseudo-version   commit hash   same as above
+//
+// Tags of repos not following vX.Y.Z are tried first according to the matching TagRule.
+func (p *ProxyServer) gitVersionRefs(modulePath, subPath, verCanonical string) (refspecs []string, pseudoVer bool) {
+	if module.IsPseudoVersion(verCanonical) {
+		rev, _ := module.PseudoVersionRev(verCanonical)
+		return []string{rev}, true
+	}
+	tagPrefix := ""
+	if subPath != "" {
+		tagPrefix = subPath + "/"
+	}
+	rule := p.tagRule(modulePath)
+	if rule != nil {
+		refspecs = append(refspecs, tagPrefix+rule.Prefix+strings.TrimPrefix(verCanonical, "v"))
+	}
+	refspecs = append(refspecs, tagPrefix+verCanonical)
+	if rule == nil && subPath == "" {
+		// This is necessary for some weird projects such as golang.zx2c4.com/wireguard
+		// It doesn't follow the vX.Y.Z as tag names, rather the tag name is X.Y.Z
+		// Without an explicit TagRule, limit this retrying only when there's no subPath
+		refspecs = append(refspecs, strings.TrimPrefix(verCanonical, "v"))
+	}
+	return refspecs, false
+}
+
+func (p *ProxyServer) serveModGit(ctx context.Context, modulePath, verMajorTag, subPath, verCanonical, ext string, incompat bool) (io.ReadCloser, error) {
+	// Everything returned is fully materialized in memory or a file, it's safe to cancel on return
+	ctx, cancel := context.WithTimeout(ctx, p.localTimeout())
+	defer cancel()
 	timestamp := time.Time{}
-	refspec := verCanonical
-	pseudoVer := module.IsPseudoVersion(verCanonical)
+	refspecs, pseudoVer := p.gitVersionRefs(modulePath, subPath, verCanonical)
 	if pseudoVer {
 		timestamp, _ = module.PseudoVersionTime(verCanonical)
 		timestamp = timestamp.In(time.UTC)
-		refspec, _ = module.PseudoVersionRev(verCanonical)
-	} else if subPath != "" {
-		refspec = strings.Join([]string{subPath, refspec}, "/")
+	}
+	modFull := modulePath
+	if subPath != "" {
+		modFull = strings.Join([]string{modFull, subPath}, "/")
+	}
+	if verMajorTag != "" {
+		modFull = strings.Join([]string{modFull, verMajorTag}, "/")
 	}
 	gitdir := path.Join(modulePath, ".git")
+	if pseudoVer {
+		// Resolve the short revision to the full hash, so that it's not mistaken for a different commit
+		full, err := runGitOutputShort(ctx, gitdir,
+			"rev-parse", "--verify", refspecs[0]+"^{commit}")
+		var gitErr *GitError
+		if errors.As(err, &gitErr) && strings.Contains(gitErr.Stderr, "is ambiguous") {
+			return nil, errors.New(
+				fmt.Sprintf("revision %s of %s is ambiguous in the mirror", refspecs[0], verCanonical))
+		}
+		if err == nil {
+			refspecs = []string{strings.TrimSpace(full)}
+		}
+	}
 	var tm int64
-retry_refspec:
-	// Use git log to get commit timestamp, instead of git show.
-	// Git show will spit out annotations for annotated tag
-	unixTime, err := runGitOutputShort(context.Background(), gitdir,
-		"log", "-1", "--format=%ct", refspec)
+	var refspec, logOut, hash string
+	var err error
+	for _, refspec = range refspecs {
+		// Use git log to get commit timestamp, instead of git show.
+		// Git show will spit out annotations for annotated tag
+		logOut, err = runGitOutputShort(ctx, gitdir,
+			"log", "-1", "--format=%ct %H", refspec)
+		if err == nil || isGitCorruption(err) {
+			break
+		}
+	}
 	if err == nil {
-		tm, err = strconv.ParseInt(strings.TrimSpace(unixTime), 10, 64)
+		var unixTime string
+		unixTime, hash, _ = strings.Cut(strings.TrimSpace(logOut), " ")
+		tm, err = strconv.ParseInt(unixTime, 10, 64)
 	}
 	if err != nil {
-		if !pseudoVer && subPath == "" && strings.HasPrefix(refspec, "v") {
-			// This is necessary for some weird projects such as golang.zx2c4.com/wireguard
-			// It doesn't follow the vX.Y.Z as tag names, rather the tag name is X.Y.Z
-			// We need to try again if the vX.Y.Z tag fails
-			// Currently let's limit this retrying only when there's no subPath
-			refspec, _ = strings.CutPrefix(refspec, "v")
-			goto retry_refspec
+		if isGitCorruption(err) {
+			go p.healMirror(context.WithoutCancel(ctx), modulePath, clonePriorityInteractive)
+			return nil, errors.New(
+				fmt.Sprintf("mirror of %s is corrupted, re-cloning: %s", modulePath, err.Error()))
+		}
+		if isGitNotFound(err) {
+			rev := verCanonical
+			if pseudoVer {
+				rev, _ = module.PseudoVersionRev(verCanonical)
+			}
+			return nil, &NotFoundError{Module: modFull, Version: verCanonical, Reason: "unknown revision " + rev}
 		}
 		return nil, errors.New(
 			fmt.Sprintf("failed to get commit date: %s", err.Error()))
@@ -58,23 +124,26 @@ retry_refspec:
 	if !timestamp.IsZero() {
 		// Check timestamp. Don't forget to enforce UTC timezone.
 		if timestampLocal != timestamp {
-			return nil, errors.New(fmt.Sprintf("timestamp mismatch: %s vs %s",
+			err = errors.New(fmt.Sprintf("timestamp mismatch: %s vs %s",
 				timestamp.String(), timestampLocal.String()))
+			p.alert(AlertTimestampMismatch, modFull+"@"+verCanonical, err.Error())
+			return nil, err
 		}
 	}
 	ver := verCanonical
 	if incompat {
 		ver += "+incompatible"
 	}
-	modFull := modulePath
-	if subPath != "" {
-		modFull = strings.Join([]string{modFull, subPath}, "/")
-	}
-	if verMajorTag != "" {
-		modFull = strings.Join([]string{modFull, verMajorTag}, "/")
-	}
 	if ext == ".info" {
-		info := RevInfo{Time: timestampLocal.In(time.UTC), Version: ver}
+		origin := &Origin{VCS: "git", Subdir: subPath, Hash: hash}
+		if !pseudoVer {
+			origin.Ref = "refs/tags/" + refspec
+		}
+		remote, err := runGitOutputShort(ctx, gitdir, "config", "--get", "remote.origin.url")
+		if err == nil {
+			origin.URL = strings.TrimSpace(remote)
+		}
+		info := RevInfo{Time: timestampLocal.In(time.UTC), Version: ver, Origin: origin}
 		data, err := json.Marshal(info)
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("Failed to encode to json: %s", err.Error()))
@@ -86,19 +155,19 @@ retry_refspec:
 		if subPath != "" {
 			treeish += subPath + "/"
 		}
-		cmdArgs := []string{
-			"archive", "--format=tar", treeish, "go.mod",
-		}
+		cmdArgs := gitArchiveArgs(p.IgnoreGitAttributes, "--format=tar", treeish, "go.mod")
+		// Index of the tree-ish
+		treeArg := len(cmdArgs) - 2
 		if verMajorTag != "" {
 			// Try vN/go.mod
-			cmdArgs[2] += verMajorTag
+			cmdArgs[treeArg] += verMajorTag
 		}
 	retry_mod:
 		cmd, out, err := getGitOutputCmd(
-			context.Background(), gitdir, cmdArgs...)
+			ctx, gitdir, cmdArgs...)
 		if err != nil {
 			return nil, errors.New(
-				fmt.Sprintf("Failed to run git archive (%s) %s: %s", cmdArgs[3], refspec, err.Error()))
+				fmt.Sprintf("Failed to run git archive (%s) %s: %s", cmdArgs[treeArg+1], refspec, err.Error()))
 		}
 		defer out.Close()
 		data, err := getSingleFileFromTar(out, "go.mod", tar.TypeReg)
@@ -106,111 +175,214 @@ retry_refspec:
 		if err2 == nil && err == nil {
 			return io.NopCloser(bytes.NewReader(data)), nil
 		}
-		if cmdArgs[2] != treeish {
-			cmdArgs[2] = treeish
+		if cmdArgs[treeArg] != treeish {
+			cmdArgs[treeArg] = treeish
 			goto retry_mod
 		}
-		loggerYellow.Printf("serveModGit: Using synthesized go.mod for %s"+LOG_RST, modulePath)
+		loggerYellow.Printf(requestTag(ctx)+"serveModGit: Using synthesized go.mod for %s"+LOG_RST, modulePath)
 		// If reached here, it means the project doesn't provide go.mod, synthesize one
 		mod := fmt.Sprintf("module %s\n", modFull)
 		return io.NopCloser(bytes.NewReader([]byte(mod))), nil
 	} else if ext == ".zip" {
 		prefix := strings.Join([]string{modFull, ver}, "@") + "/"
-		// First pass: Collect files with only vendor directory excluded
-		// This will help determine if more files needs to be excluded, and
-		// check if module is in the versioned (v1/v2...) directory
-		cmdArgs, hasLicense, err := collectGitArchiveOpts(gitdir, prefix, refspec+"^{tree}:"+subPath, verMajorTag)
-		if err != nil {
-			return nil, err
+		if p.CompressArchives {
+			archive, err := p.loadCompressedArchive(ctx, prefix)
+			if err == nil {
+				return archive, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				loggerYellow.Printf(requestTag(ctx)+"serveModGit: Failed to load compressed archive for %s: %s"+LOG_RST, prefix, err.Error())
+			}
 		}
-		// Second pass: actual archiving
-		archiveTmp, err := createUnnamedTmpFile(".tmp", 0600)
-		if err != nil {
-			return nil, errors.New(fmt.Sprintf("failed to create temp file (archive): %s", err.Error()))
-		}
-		// After this, archiveTmp should be closed if error to prevent fd leak
-		// loggerGreen.Printf("serveModGit: Archiving: %v"+LOG_RST, cmdArgs)
-		cmd := getGitCmd(context.Background(), gitdir, cmdArgs...)
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = archiveTmp
-		err = cmd.Run()
-		archiveTmp.Seek(0, io.SeekStart)
+		p.metrics.ActiveArchives.Add(1)
+		archive, err := archiveModGit(ctx, gitdir, modulePath, prefix, refspec, subPath, verMajorTag, p.maxZipSize(), p.IgnoreGitAttributes)
+		p.metrics.ActiveArchives.Add(-1)
 		if err != nil {
-			archiveTmp.Close()
-			return nil, errors.New(fmt.Sprintf("failed to run git archive (second pass): %s", err.Error()))
-		}
-		// Third pass: Remove directory entries
-		// Zip is really annoying in that the zip file name has to end with .zip suffix.
-		// Thus, we can't use /dev/fd/3. .tmp/zip-fd3.zip is essentially a symlink to /dev/fd/3
-		// Removing directory entries is necessary otherwise the module zip checksum will mismatch against sumdb
-		cmd = exec.Command("zip", "-d", ".tmp/zip-fd3.zip", "*/")
-		cmd.Stderr = os.Stderr
-		cmd.ExtraFiles = append(cmd.ExtraFiles, archiveTmp)
-		err = cmd.Run()
-		archiveTmp.Seek(0, io.SeekStart)
-		exitErr, ok := err.(*exec.ExitError)
-		if err != nil && (!ok || exitErr.ExitCode() != 12) {
-			// Exit code 12 is "nothing to do" for zip
-			archiveTmp.Close()
-			return nil, errors.New(fmt.Sprintf("failed to trim zip file (third pass): %s", err.Error()))
+			return nil, err
 		}
-		if hasLicense || (subPath == "" && verMajorTag == "") {
-			// If there's no license in submod/LICENSE, v4/LICENSE, submod/v4/LICENSE
-			// We need to do Fourth pass, else return
-			return archiveTmp, nil
+		origin := &Origin{VCS: "git", Subdir: subPath, Hash: hash}
+		if len(p.Scanners) != 0 {
+			remote, err := runGitOutputShort(ctx, gitdir, "config", "--get", "remote.origin.url")
+			if err == nil {
+				origin.URL = strings.TrimSpace(remote)
+			}
 		}
-		// Fourth pass (optional): try to add LICENSE file from parent repo if missing
-		licDir := path.Join(".tmp/licenses", prefix)
-		os.MkdirAll(licDir, 0700)
-		licPath := path.Join(licDir, "LICENSE")
-		err = unix.Access(licPath, unix.O_RDONLY)
+		err = p.scanZip(ctx, modFull, ver, archive, origin)
 		if err != nil {
-			licenseTmp, err := createUnnamedTmpFile(licDir, 0600)
-			if err != nil {
-				archiveTmp.Close()
-				return nil, errors.New(fmt.Sprintf("failed to create temp file (LICENSE): %s", err.Error()))
-			}
-			defer licenseTmp.Close()
-			cmd, out, err := getGitOutputCmd(
-				context.Background(), gitdir, "archive", "--format=tar", refspec+"^{tree}", "LICENSE")
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("failed to run git archive (LICENSE) %s: %s", refspec, err.Error()))
-			}
-			defer out.Close()
-			err = copySingleFileFromTar(out, licenseTmp, "LICENSE", tar.TypeReg)
-			// error is ignored. Rely on copySingleFileFromTar to tell if file exists or not
-			cmd.Wait()
-			if err != nil {
-				loggerYellow.Printf("serveModGit: LICENSE file not found for %s (ignored)"+LOG_RST, modulePath)
-				return archiveTmp, nil
+			archive.Close()
+			return nil, err
+		}
+		if p.CompressArchives {
+			if p.storeCompressedArchive(ctx, prefix, archive) {
+				p.replicate(replicaItem{archive: strings.TrimPrefix(compressedArchivePath(prefix), ArchiveStoreDir+"/")})
 			}
-			// This allows atomic creation of LICENSE, otherwise if we create the file first and write to it,
-			// Other threads could observe partial file
-			unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/dev/fd/%d", licenseTmp.Fd()), unix.AT_FDCWD, licPath, unix.AT_SYMLINK_FOLLOW)
-			// error is ignored here. If there's one, it's usually EEXIST
-		}
-		cmd = exec.Command("zip", "-g", "../zip-fd3.zip", path.Join(prefix, "LICENSE"))
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		cmd.Dir = ".tmp/licenses"
-		cmd.ExtraFiles = append(cmd.ExtraFiles, archiveTmp)
-		err = cmd.Run()
-		if err != nil {
-			archiveTmp.Close()
-			return nil, errors.New(fmt.Sprintf("failed to append LICENSE to zip: %s", err.Error()))
 		}
-		archiveTmp.Seek(0, io.SeekStart)
-		// error is ignored here.
-		return archiveTmp, nil
+		return archive, nil
 	}
 	return nil, nil
 }
 
-func (p *ProxyServer) serveModPlain(modulePath, verMajorTag, subPath, verCanonical, ext string, incompat bool) (io.ReadSeekCloser, error) {
-	return nil, errors.New("NOT IMPLEMENTED")
+// NotFoundError is a module version missing from the cache, worded like the go command's errors
+// (and proxy.golang.org's responses), so that client output stays familiar
+type NotFoundError struct {
+	Module  string
+	Version string
+	// Such as "unknown revision v1.2.3"
+	Reason string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Version == "latest" {
+		return fmt.Sprintf("not found: %s@latest: %s", e.Module, e.Reason)
+	}
+	return fmt.Sprintf("not found: %s@%s: invalid version: %s", e.Module, e.Version, e.Reason)
+}
+
+func (e *NotFoundError) Status() int {
+	return http.StatusNotFound
+}
+
+// ZipTooLargeError reports a module zip exceeding the size ceiling while being generated
+type ZipTooLargeError struct {
+	Prefix string
+	Limit  int64
+}
+
+func (e *ZipTooLargeError) Error() string {
+	return fmt.Sprintf("zip of %s exceeds %d bytes", strings.TrimSuffix(e.Prefix, "/"), e.Limit)
+}
+
+// Status is 502 if the module can't be valid at all (the go command would reject it),
+// and 413 if it's only refused by the configured ceiling
+func (e *ZipTooLargeError) Status() int {
+	if e.Limit >= modzip.MaxZipFile {
+		return http.StatusBadGateway
+	}
+	return http.StatusRequestEntityTooLarge
+}
+
+// limitedWriter fails writes beyond n bytes. Used as the stdout of a command, the
+// pipe gets closed and the command dies of SIGPIPE
+type limitedWriter struct {
+	w        io.Writer
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > l.n {
+		l.exceeded = true
+		return 0, errors.New("size limit exceeded")
+	}
+	n, err := l.w.Write(b)
+	l.n -= int64(n)
+	return n, err
+}
+
+func archiveModGit(ctx context.Context, gitdir, modulePath, prefix, refspec, subPath, verMajorTag string, maxSize int64, ignoreAttributes bool) (*os.File, error) {
+	// First pass: Collect files with only vendor directory excluded
+	// This will help determine if more files needs to be excluded, and
+	// check if module is in the versioned (v1/v2...) directory
+	cmdArgs, hasLicense, err := collectGitArchiveOpts(ctx, gitdir, prefix, refspec+"^{tree}:"+subPath, verMajorTag, ignoreAttributes)
+	if err != nil {
+		return nil, err
+	}
+	// Second pass: actual archiving
+	archiveTmp, err := createUnnamedTmpFile(inCacheDir(ctx, ".tmp"), 0600)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to create temp file (archive): %s", err.Error()))
+	}
+	// After this, archiveTmp should be closed if error to prevent fd leak
+	// loggerGreen.Printf("serveModGit: Archiving: %v"+LOG_RST, cmdArgs)
+	cmd := getGitCmd(ctx, gitdir, cmdArgs...)
+	cmd.Stderr = os.Stderr
+	// Files are stored (-0), thus the zip is at least as large as its extracted content
+	out := &limitedWriter{w: archiveTmp, n: maxSize}
+	cmd.Stdout = out
+	err = cmd.Run()
+	archiveTmp.Seek(0, io.SeekStart)
+	if out.exceeded {
+		archiveTmp.Close()
+		return nil, &ZipTooLargeError{Prefix: prefix, Limit: maxSize}
+	}
+	if err != nil {
+		archiveTmp.Close()
+		return nil, errors.New(fmt.Sprintf("failed to run git archive (second pass): %s", err.Error()))
+	}
+	// Third pass: Remove directory entries
+	// Zip is really annoying in that the zip file name has to end with .zip suffix.
+	// Thus, we can't use /dev/fd/3. .tmp/zip-fd3.zip is essentially a symlink to /dev/fd/3
+	// Removing directory entries is necessary otherwise the module zip checksum will mismatch against sumdb
+	cmd = exec.CommandContext(ctx, "zip", "-d", ".tmp/zip-fd3.zip", "*/")
+	sandboxCmd(cmd, cacheDirOf(ctx), false)
+	cmd.Dir = inCacheDir(ctx, ".")
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(cmd.ExtraFiles, archiveTmp)
+	err = cmd.Run()
+	archiveTmp.Seek(0, io.SeekStart)
+	exitErr, ok := err.(*exec.ExitError)
+	if err != nil && (!ok || exitErr.ExitCode() != 12) {
+		// Exit code 12 is "nothing to do" for zip
+		archiveTmp.Close()
+		return nil, errors.New(fmt.Sprintf("failed to trim zip file (third pass): %s", err.Error()))
+	}
+	if hasLicense || (subPath == "" && verMajorTag == "") {
+		// If there's no license in submod/LICENSE, v4/LICENSE, submod/v4/LICENSE
+		// We need to do Fourth pass, else return
+		return archiveTmp, nil
+	}
+	// Fourth pass (optional): try to add LICENSE file from parent repo if missing
+	licDir := inCacheDir(ctx, path.Join(".tmp/licenses", prefix))
+	os.MkdirAll(licDir, 0700)
+	licPath := path.Join(licDir, "LICENSE")
+	err = unix.Access(licPath, unix.O_RDONLY)
+	if err != nil {
+		licenseTmp, err := createUnnamedTmpFile(licDir, 0600)
+		if err != nil {
+			archiveTmp.Close()
+			return nil, errors.New(fmt.Sprintf("failed to create temp file (LICENSE): %s", err.Error()))
+		}
+		defer licenseTmp.Close()
+		cmd, out, err := getGitOutputCmd(
+			ctx, gitdir, gitArchiveArgs(ignoreAttributes, "--format=tar", refspec+"^{tree}", "LICENSE")...)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to run git archive (LICENSE) %s: %s", refspec, err.Error()))
+		}
+		defer out.Close()
+		err = copySingleFileFromTar(out, licenseTmp, "LICENSE", tar.TypeReg)
+		// error is ignored. Rely on copySingleFileFromTar to tell if file exists or not
+		cmd.Wait()
+		if err != nil {
+			loggerYellow.Printf(requestTag(ctx)+"serveModGit: LICENSE file not found for %s (ignored)"+LOG_RST, modulePath)
+			return archiveTmp, nil
+		}
+		// This allows atomic creation of LICENSE, otherwise if we create the file first and write to it,
+		// Other threads could observe partial file
+		unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/dev/fd/%d", licenseTmp.Fd()), unix.AT_FDCWD, licPath, unix.AT_SYMLINK_FOLLOW)
+		// error is ignored here. If there's one, it's usually EEXIST
+	}
+	cmd = exec.CommandContext(ctx, "zip", "-g", "../zip-fd3.zip", path.Join(prefix, "LICENSE"))
+	sandboxCmd(cmd, cacheDirOf(ctx), false)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Dir = inCacheDir(ctx, ".tmp/licenses")
+	cmd.ExtraFiles = append(cmd.ExtraFiles, archiveTmp)
+	err = cmd.Run()
+	if err != nil {
+		archiveTmp.Close()
+		return nil, errors.New(fmt.Sprintf("failed to append LICENSE to zip: %s", err.Error()))
+	}
+	fi, err := archiveTmp.Stat()
+	if err == nil && fi.Size() > maxSize {
+		archiveTmp.Close()
+		return nil, &ZipTooLargeError{Prefix: prefix, Limit: maxSize}
+	}
+	archiveTmp.Seek(0, io.SeekStart)
+	// error is ignored here.
+	return archiveTmp, nil
 }
 
-func (p *ProxyServer) serveModLocal(modulePath, verMajorTag, verCanonical, ext string, incompat bool) (io.ReadCloser, error) {
+func (p *ProxyServer) serveModLocal(ctx context.Context, modulePath, verMajorTag, verCanonical, ext string, incompat bool) (io.ReadCloser, error) {
 	parentPath, subPath, vcs, err := p.checkModVcsLocal(modulePath)
 	if err != nil {
 		return nil, errors.New(
@@ -219,9 +391,12 @@ func (p *ProxyServer) serveModLocal(modulePath, verMajorTag, verCanonical, ext s
 	modulePath = parentPath
 	switch vcs {
 	case ".git":
-		return p.serveModGit(modulePath, verMajorTag, subPath, verCanonical, ext, incompat)
+		return p.serveModGit(ctx, modulePath, verMajorTag, subPath, verCanonical, ext, incompat)
 	case ".mod":
-		return p.serveModPlain(modulePath, verMajorTag, subPath, verCanonical, ext, incompat)
+		return p.serveModPlain(ctx, modulePath, verMajorTag, subPath, verCanonical, ext, incompat)
+	}
+	if backend, ok := p.vcsBackends[vcs]; ok {
+		return p.serveModBackend(ctx, backend, p.vcsRepo(modulePath, subPath, verMajorTag, vcs), verCanonical, ext, incompat)
 	}
 	log.Panicf("Invalid local VCS type %s for module %s, should not happen", vcs, modulePath)
 	return nil, nil
@@ -229,7 +404,39 @@ func (p *ProxyServer) serveModLocal(modulePath, verMajorTag, verCanonical, ext s
 
 func (p *ProxyServer) serveModCached(w http.ResponseWriter, r *http.Request) {
 	escapedModulePath, prop, ok := parseRequest(w, r)
-	if !ok {
+	if !ok || !p.checkPolicy(w, r, escapedModulePath, prop) {
+		return
+	}
+	frozen := p.frozen()
+	if p.requestOptions(r).refresh {
+		if frozen {
+			p.refuseFrozen(w, r, escapedModulePath, prop)
+			return
+		}
+		if !p.refreshLocalMirror(w, r) {
+			return
+		}
+	}
+	p.setCacheControl(w, endpointOf(prop))
+	if !p.checkVulns(w, r, escapedModulePath, prop) {
+		return
+	}
+	if p.serveModCacheDir(w, r, escapedModulePath, prop) {
+		return
+	}
+	if frozen && !p.hasLocalSource(escapedModulePath) {
+		p.refuseFrozen(w, r, escapedModulePath, prop)
+		return
+	}
+	if prop == "latest" {
+		p.serveLatestCached(w, r, escapedModulePath)
+		return
+	}
+	if prop == "list" {
+		p.serveListCached(w, r, escapedModulePath)
+		return
+	}
+	if p.serveBranchInfo(w, r, escapedModulePath, prop, false) {
 		return
 	}
 	ext := path.Ext(prop)
@@ -242,8 +449,6 @@ func (p *ProxyServer) serveModCached(w http.ResponseWriter, r *http.Request) {
 	case ".zip":
 		contentTy = "application/zip"
 	default:
-		// For cached only mode, we do not provide @latest or @v/list
-		// The project must request explicit version of its dependencies
 		err := errors.New(fmt.Sprintf("Invalid URL path: %s", r.URL.Path))
 		httpRespString(w, http.StatusInternalServerError, err.Error())
 		return
@@ -260,28 +465,120 @@ func (p *ProxyServer) serveModCached(w http.ResponseWriter, r *http.Request) {
 			fmt.Sprintf("module path/ver %s[%s] is invalid or not supported", modulePath, ver))
 		return
 	}
+	fullPath := modulePath
 	modulePath = modulePathTrim
 	ver = semver.Canonical(ver)
-	reader, err := p.serveModLocal(modulePath, verMajorTag, ver, ext, incompat)
+	// .info and .mod are tiny and requested very often, serve them from memory if possible. Versions
+	// never change, purging the module is the only invalidation they need, unlike @v/list
+	cacheable := ext != ".zip"
+	if cacheable {
+		data, ok := p.metaCache.Get(r.URL.Path)
+		if ok {
+			if ext == ".mod" && !p.checkModSum(w, r, fullPath, ver, data) {
+				return
+			}
+			p.serveMetaBytes(w, fullPath, ver, ext, contentTy, data)
+			return
+		}
+	} else if r.Method == http.MethodHead && p.serveZipHead(w, r, escapedModulePath, prop, fullPath, modulePath) {
+		return
+	}
+	reader, err := p.serveModLocal(r.Context(), modulePath, verMajorTag, ver, ext, incompat)
 	if err != nil {
-		httpRespString(w, http.StatusInternalServerError, err.Error())
+		var notFound *NotFoundError
+		if frozen && errors.As(err, &notFound) {
+			p.refuseFrozen(w, r, escapedModulePath, prop)
+			return
+		}
+		if !frozen && p.upstreamStore != nil && p.fallbackUpstream(w, r, escapedModulePath, prop, err) {
+			return
+		}
+		var scanErr *ScanError
+		if errors.As(err, &scanErr) {
+			p.refusePolicy(w, scanErr.Module, scanErr.Version, "flagged by scanner: "+scanErr.Reason, scanErr.Code)
+			return
+		}
+		httpRespError(w, err)
 		return
 	}
 	defer reader.Close()
-	// Set Content-Length if the reader is seekable
-	seeker, seekable := reader.(io.Seeker)
-	if seekable {
-		off, err := seeker.Seek(0, io.SeekEnd)
-		if err == nil {
-			_, err = seeker.Seek(0, io.SeekStart)
-		}
+	if cacheable {
+		data, err := io.ReadAll(reader)
 		if err != nil {
 			httpRespString(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		w.Header().Set("Content-Length", strconv.FormatInt(off, 10))
+		p.metaCache.Add(r.URL.Path, data)
+		if ext == ".mod" {
+			p.recordModHash(r.Context(), escapedModulePath, strings.TrimSuffix(prop, ext), data)
+		}
+		if p.layout != nil {
+			p.storeLayout(r.Context(), escapedModulePath, prop, bytes.NewReader(data))
+		}
+		if ext == ".mod" && !p.checkModSum(w, r, fullPath, ver, data) {
+			return
+		}
+		p.serveMetaBytes(w, fullPath, ver, ext, contentTy, data)
+		return
+	}
+	if seeker, ok := reader.(io.ReadSeeker); ok && p.layout != nil {
+		p.storeLayout(r.Context(), escapedModulePath, prop, seeker)
+	}
+	zip, isFile := reader.(*os.File)
+	if isFile {
+		// Hashed before attesting, which then reuses the hash
+		if artifact := p.recordArtifact(r.Context(), escapedModulePath, strings.TrimSuffix(prop, ext), zip); artifact != nil {
+			w.Header().Set("ETag", artifactETag(artifact))
+		}
+	}
+	if p.sumAllow != nil {
+		hash := "unknown"
+		if isFile {
+			if h, err := p.zipHash(escapedModulePath, strings.TrimSuffix(prop, ext), zip); err == nil {
+				hash = h
+			}
+		}
+		if !p.checkSumHash(w, r, fullPath, ver, ext, hash) {
+			return
+		}
 	}
+	if isFile && p.signer != nil {
+		p.attestServedZip(w, r, escapedModulePath, prop, fullPath, zip, func() *Origin {
+			info, err := p.serveModLocal(r.Context(), modulePath, verMajorTag, ver, ".info", incompat)
+			if err != nil {
+				return nil
+			}
+			defer info.Close()
+			var rev RevInfo
+			json.NewDecoder(info).Decode(&rev)
+			return rev.Origin
+		})
+	}
+	p.setDeprecationHeader(w, fullPath)
+	sw := p.newArtifactWriter(w, r)
 	w.Header().Set("Content-Type", contentTy)
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, reader)
+	seeker, seekable := reader.(io.ReadSeeker)
+	if seekable {
+		// Zips are files on disk. ServeContent sets Content-Length, handles Range requests,
+		// and ends up in sendfile rather than copying through userspace
+		http.ServeContent(sw, r, "", time.Time{}, seeker)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		io.Copy(sw, reader)
+	}
+	if sw.err != nil {
+		loggerYellow.Printf(requestTag(r.Context())+"serveModCached: Aborted sending %s: %s"+LOG_RST, r.URL.Path, sw.err.Error())
+	}
+	// The zip is at hand, keep the license inventory for the admin API
+	if isFile {
+		p.recordLicenses(r.Context(), escapedModulePath, strings.TrimSuffix(prop, ext), zip)
+	}
+}
+
+func (p *ProxyServer) serveMetaBytes(w http.ResponseWriter, modulePath, ver, ext, contentTy string, data []byte) {
+	if ext == ".mod" {
+		p.recordDeprecation(modulePath, ver, data)
+	}
+	p.setDeprecationHeader(w, modulePath)
+	httpRespBytes(w, contentTy, data)
 }
@@ -0,0 +1,210 @@
+package goproxy
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckModulePathVer(t *testing.T) {
+	tests := []struct {
+		modulePath, ver string
+		path, major     string
+		incompat, ok    bool
+	}{
+		{"example.com/repo", "v1.2.3", "example.com/repo", "", false, true},
+		{"example.com/repo", "v0.1.0", "example.com/repo", "", false, true},
+		{"example.com/repo", "v2.0.0", "", "", false, false},
+		{"example.com/repo", "v2.0.0+incompatible", "example.com/repo", "", true, true},
+		{"example.com/repo/v2", "v2.1.0", "example.com/repo", "v2", false, true},
+		{"example.com/repo/v2", "v3.0.0", "", "", false, false},
+		{"example.com/repo/v2", "v1.0.0", "", "", false, false},
+		{"example.com/repo/v2", "v2.0.0+incompatible", "", "", false, false},
+		// The sub-directory isn't known yet, it's split off by the mirror lookup
+		{"example.com/repo/sub", "v1.0.0", "example.com/repo/sub", "", false, true},
+		{"example.com/repo/sub", "v4.1.0", "", "", false, false},
+		{"example.com/repo/sub/v4", "v4.1.0", "example.com/repo/sub", "v4", false, true},
+		{"example.com/repo/sub/v4", "v4.1.1-0.20240101000000-0123456789ab", "example.com/repo/sub", "v4", false, true},
+		{"example.com/repo/sub/v4", "v1.0.0", "", "", false, false},
+		{"example.com/repo/sub/v4", "v4.0.0+incompatible", "", "", false, false},
+		{"example.com/repo/.sub", "v1.0.0", "", "", false, false},
+		{"gopkg.in/yaml.v2", "v2.4.0", "gopkg.in/yaml.v2", "", false, true},
+		{"gopkg.in/yaml.v2", "v3.0.0", "", "", false, false},
+	}
+	for _, tt := range tests {
+		path, major, incompat, ok := checkModulePathVer(tt.modulePath, tt.ver)
+		if path != tt.path || major != tt.major || incompat != tt.incompat || ok != tt.ok {
+			t.Errorf("checkModulePathVer(%q, %q) = %q, %q, %v, %v, want %q, %q, %v, %v", tt.modulePath, tt.ver,
+				path, major, incompat, ok, tt.path, tt.major, tt.incompat, tt.ok)
+		}
+	}
+}
+
+func TestGitVersionRefs(t *testing.T) {
+	p := &ProxyServer{TagRules: []TagRule{{Pattern: "example.com/released", Prefix: "release-"}}}
+	tests := []struct {
+		modulePath, subPath, ver string
+		refspecs                 []string
+		pseudoVer                bool
+	}{
+		// repo and repo/v4
+		{"example.com/repo", "", "v1.2.3", []string{"v1.2.3", "1.2.3"}, false},
+		{"example.com/repo", "", "v4.1.0", []string{"v4.1.0", "4.1.0"}, false},
+		// repo/sub and repo/sub/v4
+		{"example.com/repo", "sub", "v1.2.3", []string{"sub/v1.2.3"}, false},
+		{"example.com/repo", "sub", "v4.1.0", []string{"sub/v4.1.0"}, false},
+		{"example.com/repo", "sub/deeper", "v4.1.0", []string{"sub/deeper/v4.1.0"}, false},
+		// Pseudo-versions name the commit, whatever the directory
+		{"example.com/repo", "", "v0.0.0-20240101000000-0123456789ab", []string{"0123456789ab"}, true},
+		{"example.com/repo", "sub", "v4.1.1-0.20240101000000-0123456789ab", []string{"0123456789ab"}, true},
+		// TagRule tags come first, no X.Y.Z fallback then
+		{"example.com/released", "", "v1.2.3", []string{"release-1.2.3", "v1.2.3"}, false},
+		{"example.com/released", "sub", "v4.1.0", []string{"sub/release-4.1.0", "sub/v4.1.0"}, false},
+	}
+	for _, tt := range tests {
+		refspecs, pseudoVer := p.gitVersionRefs(tt.modulePath, tt.subPath, tt.ver)
+		if !reflect.DeepEqual(refspecs, tt.refspecs) || pseudoVer != tt.pseudoVer {
+			t.Errorf("gitVersionRefs(%q, %q, %q) = %q, %v, want %q, %v", tt.modulePath, tt.subPath, tt.ver,
+				refspecs, pseudoVer, tt.refspecs, tt.pseudoVer)
+		}
+	}
+}
+
+func TestTagVersion(t *testing.T) {
+	p := &ProxyServer{TagRules: []TagRule{{Pattern: "example.com/released", Prefix: "release-"}}}
+	tests := []struct {
+		modulePath, subPath, verMajorTag, tag string
+		ver                                   string
+	}{
+		{"example.com/repo", "", "", "v1.2.3", "v1.2.3"},
+		{"example.com/repo", "", "", "1.2.3", "v1.2.3"},
+		{"example.com/repo", "", "", "v4.1.0", ""},
+		{"example.com/repo", "", "v4", "v4.1.0", "v4.1.0"},
+		{"example.com/repo", "", "v4", "v1.2.3", ""},
+		{"example.com/repo", "", "", "sub/v1.2.3", ""},
+		{"example.com/repo", "sub", "", "sub/v1.2.3", "v1.2.3"},
+		{"example.com/repo", "sub", "", "sub/1.2.3", ""},
+		{"example.com/repo", "sub", "", "v1.2.3", ""},
+		{"example.com/repo", "sub", "v4", "sub/v4.1.0", "v4.1.0"},
+		{"example.com/repo", "sub", "v4", "sub/v1.2.3", ""},
+		{"example.com/repo", "sub", "v4", "sub/v5.0.0", ""},
+		{"example.com/repo", "sub", "v4", "v4.1.0", ""},
+		{"example.com/released", "", "", "release-1.2.3", "v1.2.3"},
+		{"example.com/released", "sub", "v4", "sub/release-4.1.0", "v4.1.0"},
+	}
+	for _, tt := range tests {
+		ver := p.tagVersion(tt.modulePath, tt.subPath, tt.verMajorTag, tt.tag)
+		if ver != tt.ver {
+			t.Errorf("tagVersion(%q, %q, %q, %q) = %q, want %q", tt.modulePath, tt.subPath, tt.verMajorTag, tt.tag,
+				ver, tt.ver)
+		}
+	}
+}
+
+func TestValidBranchName(t *testing.T) {
+	tests := map[string]bool{
+		"main": true, "feature/x": true, "release-1.2": true, "v1.0.0-beta": true, "@": true,
+		"": false, "a..b": false, "HEAD~1": false, "main^": false, "a:b": false, "x?": false, "x*": false,
+		"x[1]": false, "a\\b": false, "main@{1}": false, "@{-1}": false, "-x": false, "x/": false, "/x": false,
+		"a//b": false, ".x": false, "a/.x": false, "x.lock": false, "a.lock/b": false, "x.": false, "a b": false,
+		"a\x01b": false,
+	}
+	for branch, ok := range tests {
+		if validBranchName(branch) != ok {
+			t.Errorf("validBranchName(%q) = %v, want %v", branch, !ok, ok)
+		}
+	}
+}
+
+// newTestRepo commits files into a new bare repo, tagged with tags
+func newTestRepo(t *testing.T, files map[string]string, tags ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	git := func(dir string, args ...string) {
+		t.Helper()
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@localhost"}, args...)
+		cmd := exec.Command(GitCommand, args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err.Error(), out)
+		}
+	}
+	git(dir, "init", "--quiet", work)
+	for name, data := range files {
+		name = filepath.Join(work, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = os.WriteFile(name, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(work, "add", "-A")
+	git(work, "commit", "--quiet", "-m", "test")
+	for _, tag := range tags {
+		git(work, "tag", tag)
+	}
+	repo := filepath.Join(dir, "repo.git")
+	git(dir, "clone", "--quiet", "--bare", work, repo)
+	return repo
+}
+
+// The tree archived for each combination of sub-directory and major version directory
+func TestCollectGitArchiveOptsTree(t *testing.T) {
+	repo := newTestRepo(t, map[string]string{
+		"go.mod":          "module example.com/repo\n",
+		"repo.go":         "package repo\n",
+		"v2/go.mod":       "module example.com/repo/v2\n",
+		"v2/repo.go":      "package repo\n",
+		"sub/go.mod":      "module example.com/repo/sub\n",
+		"sub/sub.go":      "package sub\n",
+		"sub/v4/go.mod":   "module example.com/repo/sub/v4\n",
+		"sub/v4/sub.go":   "package sub\n",
+		"other/go.mod":    "module example.com/repo/other/v5\n",
+		"other/other.go":  "package other\n",
+		"other/v6/doc.go": "package v6\n",
+	}, "v1.0.0", "v2.0.0", "sub/v1.0.0", "sub/v4.1.0", "other/v5.0.0")
+	tests := []struct {
+		name, refspec, subPath, verMajorTag string
+		treeish                             string
+		excluded                            []string
+	}{
+		{"root", "v1.0.0", "", "", "v1.0.0^{tree}:", []string{"other/", "sub/", "sub/v4/", "v2/"}},
+		{"major directory", "v2.0.0", "", "v2", "v2.0.0^{tree}:v2", nil},
+		{"major without directory", "v2.0.0", "", "v3", "v2.0.0^{tree}:", []string{"other/", "sub/", "sub/v4/", "v2/"}},
+		{"sub-directory", "sub/v1.0.0", "sub", "", "sub/v1.0.0^{tree}:sub", []string{"v4/"}},
+		{"major directory in sub-directory", "sub/v4.1.0", "sub", "v4", "sub/v4.1.0^{tree}:sub/v4", nil},
+		{"major in go.mod of sub-directory", "other/v5.0.0", "other", "v5", "other/v5.0.0^{tree}:other", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			treeish := tt.refspec + "^{tree}:" + tt.subPath
+			args, _, err := collectGitArchiveOpts(context.Background(), repo, "example.com/repo@v", treeish, tt.verMajorTag, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var excluded []string
+			for i, arg := range args {
+				if arg == "-0" {
+					treeish = args[i+1]
+				}
+				if path, ok := strings.CutPrefix(arg, ":(exclude,top)"); ok && !strings.Contains(path, "vendor") {
+					excluded = append(excluded, path)
+				}
+			}
+			if treeish != tt.treeish {
+				t.Errorf("archived %q, want %q (%q)", treeish, tt.treeish, args)
+			}
+			if !reflect.DeepEqual(excluded, tt.excluded) {
+				t.Errorf("excluded %q, want %q", excluded, tt.excluded)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package goproxy
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lock files of the cache, taken with flock(2) so that several processes (or a proxy and
+// maintenance tools) can share a cache directory. The kernel releases them when a process dies
+const LockDir = ".locks"
+
+// Held shared by every process using the cache, exclusively while repairing what a crash left
+const cacheLockFile = "cache.lock"
+
+// Held while changing MirrorIndexFile
+const mirrorIndexLockFile = "mirrors.lock"
+
+// How often a process waiting for a lock held by another one tries again
+const lockPollInterval = 250 * time.Millisecond
+
+// fileLock is an flock held on an open lock file
+type fileLock struct {
+	f *os.File
+}
+
+func openLockFile(name string) (*os.File, error) {
+	err := os.MkdirAll(path.Dir(name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// tryLockFile takes the lock (unix.LOCK_EX or unix.LOCK_SH) of name, created if missing. It
+// returns nil if another process (or another open of it) holds a conflicting lock
+func tryLockFile(name string, how int) (*fileLock, error) {
+	f, err := openLockFile(name)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		f.Close()
+		return nil, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// lockFile takes the lock of name, waiting for whoever holds it until ctx is done. waited reports
+// whether someone did
+func lockFile(ctx context.Context, name string, how int) (l *fileLock, waited bool, err error) {
+	for {
+		l, err = tryLockFile(name, how)
+		if l != nil || err != nil {
+			return l, waited, err
+		}
+		waited = true
+		select {
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// share turns an exclusive lock into a shared one. Like any flock conversion it's not atomic,
+// another process may take it exclusively in between
+func (l *fileLock) share() error {
+	return unix.Flock(int(l.f.Fd()), unix.LOCK_SH)
+}
+
+// unlock releases the lock. The lock file stays, removing it would race with processes opening it
+func (l *fileLock) unlock() {
+	unix.Flock(int(l.f.Fd()), unix.LOCK_UN)
+	l.f.Close()
+}
+
+func (p *ProxyServer) lockPath(name string) string {
+	return p.cachePath(path.Join(LockDir, name))
+}
+
+// lockMirror takes the lock of the mirror at modulePath for cloning, updating or removing it,
+// waiting for other processes holding it. waited reports whether one did, meaning it just
+// fetched the mirror
+func (p *ProxyServer) lockMirror(ctx context.Context, modulePath string) (*fileLock, bool, error) {
+	l, waited, err := lockFile(ctx, p.lockPath(modulePath+".lock"), unix.LOCK_EX)
+	if waited && err == nil {
+		loggerGreen.Printf("lockMirror: %s was locked by another process"+LOG_RST, modulePath)
+	}
+	return l, waited, err
+}
+
+// tryLockMirror is lockMirror without waiting, nil if another process holds the lock
+func (p *ProxyServer) tryLockMirror(modulePath string) (*fileLock, error) {
+	return tryLockFile(p.lockPath(modulePath+".lock"), unix.LOCK_EX)
+}
+
+// lockCache registers this process as a user of the cache with a shared lock, held until exit.
+// If no other process uses the cache, cleanup removes what a crash left behind, with the lock
+// held exclusively before sharing it. Otherwise it could be the work in progress of the others
+func (p *ProxyServer) lockCache(cleanup func()) {
+	name := p.lockPath(cacheLockFile)
+	l, err := tryLockFile(name, unix.LOCK_EX)
+	if err != nil {
+		loggerRed.Printf("lockCache: Failed to lock the cache: %s"+LOG_RST, err.Error())
+		return
+	}
+	if l != nil {
+		cleanup()
+	} else {
+		loggerYellow.Printf("lockCache: The cache is in use by another process, not cleaning up stale state" + LOG_RST)
+		l, _, err = lockFile(context.Background(), name, unix.LOCK_SH)
+		if err != nil {
+			loggerRed.Printf("lockCache: Failed to lock the cache: %s"+LOG_RST, err.Error())
+			return
+		}
+	}
+	err = l.share()
+	if err != nil {
+		loggerRed.Printf("lockCache: Failed to share the lock of the cache: %s"+LOG_RST, err.Error())
+	}
+	// Never released, the kernel does on exit
+	p.cacheLock = l
+}
@@ -0,0 +1,158 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const JournaldSocket = "/run/systemd/journal/socket"
+
+// Severities as defined by syslog(3)
+const (
+	severityErr     = 3
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+// logFields splits a log line into the message and structured fields
+// Log lines look like "[request id client address] function: message", see requestTag, the
+// address being left out when unknown
+func logFields(line string) (string, map[string]string) {
+	line = strings.TrimSuffix(strings.ReplaceAll(line, LOG_RST, ""), "\n")
+	fields := make(map[string]string)
+	if strings.HasPrefix(line, "[") {
+		tag, rest, ok := strings.Cut(line[1:], "] ")
+		id, addr, hasAddr := strings.Cut(tag, " ")
+		if hasAddr {
+			_, err := netip.ParseAddr(addr)
+			ok = ok && err == nil
+		}
+		if ok && validRequestID(id) {
+			fields["REQUEST_ID"] = id
+			if hasAddr {
+				fields["CLIENT_ADDR"] = addr
+			}
+			line = rest
+		}
+	}
+	fn, _, ok := strings.Cut(line, ": ")
+	if ok && !strings.ContainsAny(fn, " \t") {
+		fields["CODE_FUNC"] = fn
+	}
+	return line, fields
+}
+
+type syslogWriter struct {
+	w        *syslog.Writer
+	severity int
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	msg, _ := logFields(string(p))
+	var err error
+	switch s.severity {
+	case severityErr:
+		err = s.w.Err(msg)
+	case severityWarning:
+		err = s.w.Warning(msg)
+	default:
+		err = s.w.Info(msg)
+	}
+	return len(p), err
+}
+
+type journaldWriter struct {
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+	identifier string
+	severity   int
+}
+
+func appendJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	// Values with newlines use the binary form: KEY\n<little endian uint64 length><value>\n
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (j *journaldWriter) Write(p []byte) (int, error) {
+	msg, fields := logFields(string(p))
+	buf := bytes.Buffer{}
+	appendJournalField(&buf, "MESSAGE", msg)
+	appendJournalField(&buf, "PRIORITY", strconv.Itoa(j.severity))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	for k, v := range fields {
+		appendJournalField(&buf, k, v)
+	}
+	_, _, err := j.conn.WriteMsgUnix(buf.Bytes(), nil, j.addr)
+	return len(p), err
+}
+
+func redirectLoggers(writer func(severity int) (io.Writer, error)) error {
+	for _, l := range []struct {
+		logger   *log.Logger
+		severity int
+	}{
+		{loggerRed, severityErr},
+		{loggerYellow, severityWarning},
+		{loggerGreen, severityInfo},
+	} {
+		sink, err := writer(l.severity)
+		if err != nil {
+			return err
+		}
+		// Colors and timestamps are meaningless for these sinks
+		l.logger.SetOutput(sink)
+		l.logger.SetPrefix("")
+		l.logger.SetFlags(0)
+	}
+	return nil
+}
+
+// UseSyslog sends all logs of the package to the local syslog daemon
+func UseSyslog(tag string) error {
+	return redirectLoggers(func(severity int) (io.Writer, error) {
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.Priority(severity), tag)
+		if err != nil {
+			return nil, err
+		}
+		return &syslogWriter{w: w, severity: severity}, nil
+	})
+}
+
+// UseJournald sends all logs of the package to journald with the request ID and function as fields
+func UseJournald(identifier string) error {
+	addr := &net.UnixAddr{Name: JournaldSocket, Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(JournaldSocket)
+	if err != nil {
+		conn.Close()
+		return errors.New(fmt.Sprintf("journald not available: %s", err.Error()))
+	}
+	if identifier == "" {
+		identifier = path.Base(os.Args[0])
+	}
+	return redirectLoggers(func(severity int) (io.Writer, error) {
+		return &journaldWriter{conn: conn, addr: addr, identifier: identifier, severity: severity}, nil
+	})
+}
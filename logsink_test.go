@@ -0,0 +1,54 @@
+package goproxy
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestLogFields(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		line   string
+		msg    string
+		fields map[string]string
+	}{
+		{
+			line:   requestTag(withRequest(ctx, "0123abcd", netip.MustParseAddr("192.0.2.1"))) + "serveAdmin: Refusing POST purge" + LOG_RST + "\n",
+			msg:    "serveAdmin: Refusing POST purge",
+			fields: map[string]string{"REQUEST_ID": "0123abcd", "CLIENT_ADDR": "192.0.2.1", "CODE_FUNC": "serveAdmin"},
+		},
+		{
+			line:   requestTag(withRequest(ctx, "0123abcd", netip.MustParseAddr("2001:db8::1"))) + "fetch: done",
+			msg:    "fetch: done",
+			fields: map[string]string{"REQUEST_ID": "0123abcd", "CLIENT_ADDR": "2001:db8::1", "CODE_FUNC": "fetch"},
+		},
+		{
+			line:   requestTag(withRequest(ctx, "req-1", netip.Addr{})) + "fetch: done",
+			msg:    "fetch: done",
+			fields: map[string]string{"REQUEST_ID": "req-1", "CODE_FUNC": "fetch"},
+		},
+		{
+			line:   "cacheModGit: Updating example.com/foo",
+			msg:    "cacheModGit: Updating example.com/foo",
+			fields: map[string]string{"CODE_FUNC": "cacheModGit"},
+		},
+		{
+			line:   "[not an id] something happened",
+			msg:    "[not an id] something happened",
+			fields: map[string]string{},
+		},
+		{
+			line:   "[abcd not-an-address] something happened",
+			msg:    "[abcd not-an-address] something happened",
+			fields: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		msg, fields := logFields(tt.line)
+		if msg != tt.msg || !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("logFields(%q) = %q, %v, want %q, %v", tt.line, msg, fields, tt.msg, tt.fields)
+		}
+	}
+}
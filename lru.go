@@ -0,0 +1,116 @@
+package goproxy
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+type lruEntry struct {
+	key  string
+	data []byte
+}
+
+// lruCache is a size bounded (in bytes) LRU cache for small responses
+// A nil *lruCache is valid and caches nothing
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	entries  *list.List
+	index    map[string]*list.Element
+}
+
+func newLRUCache(capacity int64) *lruCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &lruCache{
+		capacity: capacity,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	c.entries.MoveToFront(elem)
+	return elem.Value.(*lruEntry).data, true
+}
+
+func (c *lruCache) Add(key string, data []byte) {
+	if c == nil || int64(len(data)) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.index[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		c.size += int64(len(data) - len(entry.data))
+		entry.data = data
+		c.entries.MoveToFront(elem)
+	} else {
+		c.index[key] = c.entries.PushFront(&lruEntry{key: key, data: data})
+		c.size += int64(len(data))
+	}
+	for c.size > c.capacity {
+		elem := c.entries.Back()
+		entry := elem.Value.(*lruEntry)
+		c.entries.Remove(elem)
+		delete(c.index, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+func (c *lruCache) stats() (entries int, size int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.index), c.size
+}
+
+func (c *lruCache) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.index[key]; ok {
+		c.entries.Remove(elem)
+		delete(c.index, key)
+		c.size -= int64(len(elem.Value.(*lruEntry).data))
+	}
+}
+
+// RemovePrefix drops the entries whose key starts with prefix
+func (c *lruCache) RemovePrefix(prefix string) {
+	c.RemoveFunc(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// RemoveFunc drops the entries whose key matches
+func (c *lruCache) RemoveFunc(match func(key string) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.index {
+		if match(key) {
+			c.entries.Remove(elem)
+			delete(c.index, key)
+			c.size -= int64(len(elem.Value.(*lruEntry).data))
+		}
+	}
+}
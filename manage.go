@@ -0,0 +1,196 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// MirrorInfo describes a local mirror or directory source, as listed by the admin APIs
+type MirrorInfo struct {
+	ModulePath string
+	// .git for mirrors, .mod for directory sources, or the name of a registered VCSBackend
+	VCS    string
+	Remote string `json:",omitempty"`
+	// Remote last cloned or updated from, another than Remote if it failed over to a fallback
+	FetchedFrom string `json:",omitempty"`
+	// Module paths sharing the mirror
+	Aliases []string `json:",omitempty"`
+}
+
+var errJobPending = errors.New("a clone or update of the mirror is running")
+
+// listMirrors reports the local mirrors whose module path starts with prefix
+func (p *ProxyServer) listMirrors(ctx context.Context, prefix string) []MirrorInfo {
+	aliases := make(map[string][]string)
+	p.mirrors.mu.Lock()
+	for alias, owner := range p.mirrors.Aliases {
+		aliases[owner] = append(aliases[owner], alias)
+	}
+	p.mirrors.mu.Unlock()
+	mirrors := []MirrorInfo{}
+	walkLocalMirrors(p.Dir, func(modulePath, vcs string) {
+		if !strings.HasPrefix(modulePath, prefix) {
+			return
+		}
+		info := MirrorInfo{ModulePath: modulePath, VCS: vcs, Aliases: aliases[modulePath]}
+		if vcs == ".git" {
+			remote, err := runGitOutputShort(ctx, path.Join(modulePath, ".git"),
+				"config", "--file", "config", "--get", "remote.origin.url")
+			if err == nil {
+				info.Remote = strings.TrimSpace(remote)
+			}
+			if fetched := p.fetchedRemote(path.Join(modulePath, ".git")); fetched != info.Remote {
+				info.FetchedFrom = fetched
+			}
+		}
+		sort.Strings(info.Aliases)
+		mirrors = append(mirrors, info)
+	})
+	return mirrors
+}
+
+// purgeMirror removes the mirror of modulePath along with its stored archives, so that it's cloned
+// afresh when requested next. Purging an alias only removes the alias
+func (p *ProxyServer) purgeMirror(ctx context.Context, modulePath string) error {
+	err := module.CheckImportPath(modulePath)
+	if err != nil {
+		return err
+	}
+	vcs, err := p.root.readlink(path.Join(modulePath, ".vcs"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("no mirror found for %s", modulePath))
+	}
+	if vcs != ".git" {
+		return errors.New(fmt.Sprintf("%s is a directory source, not a mirror", modulePath))
+	}
+	if p.frozen() {
+		return errFrozen
+	}
+	if len(p.mirrorPins(modulePath)) != 0 {
+		return errPinned
+	}
+	owner := p.mirrorOwner(modulePath)
+	if _, pending := p.pendingGit.Load(owner); pending {
+		return errJobPending
+	}
+	// Or in another process sharing the cache
+	fl, err := p.tryLockMirror(owner)
+	if err != nil {
+		return err
+	}
+	if fl == nil {
+		return errJobPending
+	}
+	defer fl.unlock()
+	if p.Cluster != nil {
+		l, _, err := p.acquireLease(ctx, owner)
+		if err != nil {
+			return err
+		}
+		defer l.release()
+	}
+	gitdir := path.Join(modulePath, ".git")
+	remote, _ := runGitOutputShort(ctx, gitdir, "config", "--file", "config", "--get", "remote.origin.url")
+	// Like healing, removing .vcs first hides the mirror from lookups
+	err = p.root.remove(path.Join(modulePath, ".vcs"))
+	if err != nil {
+		return err
+	}
+	p.vcsIndex.remove(modulePath)
+	if owner != modulePath {
+		p.mirrors.removeAlias(modulePath)
+		return p.root.remove(gitdir)
+	}
+	trash, err := p.root.mkdirTemp(".tmp", "purge-")
+	if err != nil {
+		return err
+	}
+	defer p.root.removeAll(trash)
+	err = p.root.rename(gitdir, path.Join(trash, ".git"))
+	if err != nil {
+		return err
+	}
+	if remote != "" {
+		p.mirrors.release(strings.TrimSpace(remote), modulePath)
+	}
+	// Including major versions, served by the same mirror
+	p.deleteStored(ctx, path.Join(ArchiveStoreDir, modulePath), "@*.zip.zst", "/v*@*.zip.zst")
+	if escaped, err := module.EscapePath(modulePath); err == nil {
+		p.metaCache.RemovePrefix(escaped + "/")
+		p.deleteStored(ctx, path.Join(ArtifactStoreDir, escaped), "@*.json", "/v*@*.json")
+	}
+	loggerYellow.Printf(requestTag(ctx)+"purgeMirror: Purged %s"+LOG_RST, modulePath)
+	return nil
+}
+
+// refreshMirror queues an update of the mirror of modulePath, waiting for it if wait is set
+func (p *ProxyServer) refreshMirror(ctx context.Context, modulePath string, wait bool) (CloneJob, error) {
+	if p.frozen() {
+		return CloneJob{}, errFrozen
+	}
+	parentPath, _, vcs, err := p.checkModVcsLocal(modulePath)
+	if err != nil || vcs != ".git" {
+		return CloneJob{}, errors.New(fmt.Sprintf("no mirror found for %s", modulePath))
+	}
+	job := p.queueGitJob(ctx, p.mirrorOwner(parentPath), "", "", clonePriorityInteractive)
+	if wait {
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			return CloneJob{}, ctx.Err()
+		}
+	}
+	return job.snapshot(), nil
+}
+
+// Purge removes the mirror serving the module from the cache, like admin/purge, such as from a
+// maintenance command while another process serves the cache
+func (p *ProxyServer) Purge(ctx context.Context, modulePath string) error {
+	p.initOnce.Do(p.init)
+	return p.purgeMirror(p.withCacheDir(ctx), modulePath)
+}
+
+func (p *ProxyServer) serveAdminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpRespString(w, http.StatusMethodNotAllowed, "purge requires POST")
+		return
+	}
+	err := p.purgeMirror(r.Context(), r.URL.Query().Get("path"))
+	if err == errFrozen {
+		httpRespString(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err == errJobPending || err == errPinned {
+		httpRespString(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpRespString(w, http.StatusOK, "OK")
+}
+
+func (p *ProxyServer) serveAdminRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpRespString(w, http.StatusMethodNotAllowed, "refresh requires POST")
+		return
+	}
+	job, err := p.refreshMirror(r.Context(), r.URL.Query().Get("path"), r.URL.Query().Get("wait") == "1")
+	if err == errFrozen {
+		httpRespString(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		httpRespString(w, http.StatusNotFound, err.Error())
+		return
+	}
+	httpRespJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,98 @@
+package goproxy
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+type proxyMetrics struct {
+	IntegrityChecks     atomic.Int64
+	IntegrityFailures   atomic.Int64
+	CorruptedMirrors    atomic.Int64
+	MirrorsHealed       atomic.Int64
+	PeerHits            atomic.Int64
+	PeerMisses          atomic.Int64
+	Replications        atomic.Int64
+	ReplicationFailures atomic.Int64
+	StaleRevalidations  atomic.Int64
+	MaxAgeRevalidations atomic.Int64
+	UpstreamFallbacks   atomic.Int64
+	BreakerOpens        atomic.Int64
+	BreakerRejections   atomic.Int64
+	SumChecks           atomic.Int64
+	SumMismatches       atomic.Int64
+	Alerts              atomic.Int64
+	AlertFailures       atomic.Int64
+	ClientsDenied       atomic.Int64
+	QuotaRefusals       atomic.Int64
+	ScheduledRefreshes  atomic.Int64
+	FrozenRefusals      atomic.Int64
+	AllowlistRefusals   atomic.Int64
+	RemoteFailovers     atomic.Int64
+	ToolchainDownloads  atomic.Int64
+	// Gauges
+	ActiveClones   atomic.Int64
+	ActiveArchives atomic.Int64
+}
+
+func (m *proxyMetrics) snapshot() map[string]int64 {
+	return map[string]int64{
+		"integrity_checks":      m.IntegrityChecks.Load(),
+		"integrity_failures":    m.IntegrityFailures.Load(),
+		"corrupted_mirrors":     m.CorruptedMirrors.Load(),
+		"mirrors_healed":        m.MirrorsHealed.Load(),
+		"peer_hits":             m.PeerHits.Load(),
+		"peer_misses":           m.PeerMisses.Load(),
+		"replications":          m.Replications.Load(),
+		"replication_failures":  m.ReplicationFailures.Load(),
+		"stale_revalidations":   m.StaleRevalidations.Load(),
+		"max_age_revalidations": m.MaxAgeRevalidations.Load(),
+		"upstream_fallbacks":    m.UpstreamFallbacks.Load(),
+		"breaker_opens":         m.BreakerOpens.Load(),
+		"breaker_rejections":    m.BreakerRejections.Load(),
+		"checksum_checks":       m.SumChecks.Load(),
+		"checksum_mismatches":   m.SumMismatches.Load(),
+		"alerts":                m.Alerts.Load(),
+		"alert_failures":        m.AlertFailures.Load(),
+		"clients_denied":        m.ClientsDenied.Load(),
+		"quota_refusals":        m.QuotaRefusals.Load(),
+		"scheduled_refreshes":   m.ScheduledRefreshes.Load(),
+		"frozen_refusals":       m.FrozenRefusals.Load(),
+		"allowlist_refusals":    m.AllowlistRefusals.Load(),
+		"remote_failovers":      m.RemoteFailovers.Load(),
+		"toolchain_downloads":   m.ToolchainDownloads.Load(),
+		"active_clones":         m.ActiveClones.Load(),
+		"active_archives":       m.ActiveArchives.Load(),
+	}
+}
+
+// metricsSnapshot adds the gauges derived from the state of the server to the counters
+func (p *ProxyServer) metricsSnapshot() map[string]int64 {
+	p.initOnce.Do(p.init)
+	snapshot := p.metrics.snapshot()
+	snapshot["clone_queue_length"] = int64(p.gitClones.len())
+	entries, size := p.metaCache.stats()
+	snapshot["meta_cache_entries"] = int64(entries)
+	snapshot["meta_cache_bytes"] = size
+	snapshot["mirrors"] = int64(p.mirrors.len())
+	snapshot["indexed_modules"] = int64(p.vcsIndex.len())
+	if p.isLeader() {
+		snapshot["leader"] = 1
+	} else {
+		snapshot["leader"] = 0
+	}
+	if p.upstreamBreaker.isOpen() {
+		snapshot["breaker_open"] = 1
+	} else {
+		snapshot["breaker_open"] = 0
+	}
+	return snapshot
+}
+
+// PublishExpvar publishes the metrics as the expvar name, served by expvar.Handler (/debug/vars).
+// Like expvar.Publish, it panics if the name is already taken
+func (p *ProxyServer) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return p.metricsSnapshot()
+	}))
+}
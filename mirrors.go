@@ -0,0 +1,311 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/sys/unix"
+)
+
+const MirrorIndexFile = ".mirrors.json"
+
+// mirrorIndex maps remotes to the module path hosting their mirror, so that
+// different module paths backed by the same repo (monorepos, vanity paths) share one mirror
+type mirrorIndex struct {
+	mu sync.Mutex
+	// The cache, where the index is saved as MirrorIndexFile
+	root *cacheRoot
+	// Lock of file, shared with the other processes using the cache
+	lockFile string
+	// Normalized remote URL -> module path of the mirror
+	Remotes map[string]string
+	// Module path -> module path of the mirror it shares
+	Aliases map[string]string
+}
+
+func normalizeRemote(remote string) string {
+	remote = strings.TrimSuffix(strings.TrimSuffix(remote, "/"), ".git")
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return remote
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.User = nil
+	return u.String()
+}
+
+// loadMirrorIndex reads the index, or rebuilds it from the remotes of existing mirrors
+func (p *ProxyServer) loadMirrorIndex() *mirrorIndex {
+	idx := &mirrorIndex{root: p.root, lockFile: p.lockPath(mirrorIndexLockFile)}
+	data, err := idx.read()
+	if err == nil {
+		err = json.Unmarshal(data, idx)
+	}
+	if err == nil && idx.Remotes != nil {
+		if idx.Aliases == nil {
+			idx.Aliases = make(map[string]string)
+		}
+		return idx
+	}
+	idx.Remotes = make(map[string]string)
+	idx.Aliases = make(map[string]string)
+	walkLocalMirrors(p.Dir, func(modulePath, vcs string) {
+		if vcs != ".git" {
+			return
+		}
+		remote, err := runGitOutputShort(p.withCacheDir(context.Background()), path.Join(modulePath, ".git"),
+			"config", "--file", "config", "--get", "remote.origin.url")
+		if err == nil {
+			idx.Remotes[normalizeRemote(strings.TrimSpace(remote))] = modulePath
+		}
+	})
+	err = idx.save()
+	if err != nil {
+		loggerYellow.Printf("mirrorIndex: Failed to save index: %s"+LOG_RST, err.Error())
+	}
+	return idx
+}
+
+// read returns the index as saved in the cache
+func (idx *mirrorIndex) read() ([]byte, error) {
+	f, err := idx.root.openFile(MirrorIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// save must be called with mu held, or before the index is shared
+func (idx *mirrorIndex) save() error {
+	data, err := json.MarshalIndent(idx, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := idx.root.createTemp(".tmp", "mirrors-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	tmp.Close()
+	if err == nil {
+		err = idx.root.rename(tmp.Name(), MirrorIndexFile)
+	}
+	if err != nil {
+		idx.root.remove(tmp.Name())
+	}
+	return err
+}
+
+// update changes the index with fn, saving it if fn reports a change. Other processes sharing
+// the cache may have changed the index since it was read: it's read again under the lock first.
+// Without the lock, the index is left alone rather than risking to lose their changes
+func (idx *mirrorIndex) update(fn func() bool) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	l, _, err := lockFile(context.Background(), idx.lockFile, unix.LOCK_EX)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to lock index: %s", err.Error()))
+	}
+	defer l.unlock()
+	var saved mirrorIndex
+	data, err := idx.read()
+	if err == nil && json.Unmarshal(data, &saved) == nil && saved.Remotes != nil {
+		idx.Remotes = saved.Remotes
+		idx.Aliases = saved.Aliases
+		if idx.Aliases == nil {
+			idx.Aliases = make(map[string]string)
+		}
+	}
+	if !fn() {
+		return nil
+	}
+	err = idx.save()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to save index: %s", err.Error()))
+	}
+	return nil
+}
+
+// logUpdate logs the failure of an update of the index, which only costs mirrors shared later
+func logUpdate(what string, err error) {
+	if err != nil {
+		loggerYellow.Printf("mirrorIndex: Failed to %s: %s"+LOG_RST, what, err.Error())
+	}
+}
+
+// claim registers modulePath as the mirror of remote. If another module path already
+// hosts the mirror, that path is returned instead
+func (idx *mirrorIndex) claim(remote, modulePath string) string {
+	key := normalizeRemote(remote)
+	existing := ""
+	err := idx.update(func() bool {
+		owner, ok := idx.Remotes[key]
+		if ok && owner != modulePath {
+			existing = owner
+			return false
+		}
+		if !ok {
+			idx.Remotes[key] = modulePath
+			return true
+		}
+		return false
+	})
+	logUpdate("claim "+remote+" for "+modulePath, err)
+	return existing
+}
+
+// release undoes claim when the clone fails
+func (idx *mirrorIndex) release(remote, modulePath string) {
+	key := normalizeRemote(remote)
+	err := idx.update(func() bool {
+		if idx.Remotes[key] != modulePath {
+			return false
+		}
+		delete(idx.Remotes, key)
+		return true
+	})
+	logUpdate("release "+remote+" of "+modulePath, err)
+}
+
+// len is the number of mirrors, not counting aliases
+func (idx *mirrorIndex) len() int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return len(idx.Remotes)
+}
+
+// aliasesOf returns the module paths sharing the mirror at owner
+func (idx *mirrorIndex) aliasesOf(owner string) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	aliases := []string{}
+	for modulePath, aliasOwner := range idx.Aliases {
+		if aliasOwner == owner {
+			aliases = append(aliases, modulePath)
+		}
+	}
+	return aliases
+}
+
+func (idx *mirrorIndex) addAlias(modulePath, owner string) {
+	err := idx.update(func() bool {
+		idx.Aliases[modulePath] = owner
+		return true
+	})
+	logUpdate("add alias "+modulePath+" of "+owner, err)
+}
+
+func (idx *mirrorIndex) removeAlias(modulePath string) {
+	err := idx.update(func() bool {
+		_, ok := idx.Aliases[modulePath]
+		delete(idx.Aliases, modulePath)
+		return ok
+	})
+	logUpdate("remove alias "+modulePath, err)
+}
+
+// createMirrorAlias makes modulePath share the mirror hosted at owner.
+// modulePath/.git is a relative symlink to owner/.git, thus is transparent to the serving path
+func (p *ProxyServer) createMirrorAlias(modulePath, owner string) error {
+	err := p.root.mkdirAll(modulePath, 0755)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(modulePath, owner)
+	if err != nil {
+		return err
+	}
+	err = p.root.symlink(path.Join(rel, ".git"), path.Join(modulePath, ".git"))
+	if err != nil {
+		return err
+	}
+	err = p.root.symlink(".git", path.Join(modulePath, ".vcs"))
+	if err != nil {
+		return err
+	}
+	p.vcsIndex.set(modulePath, vcsEntry{vcs: ".git", owner: owner})
+	p.mirrors.addAlias(modulePath, owner)
+	return nil
+}
+
+// mirrorOwner resolves an alias to the module path actually hosting the mirror
+func (p *ProxyServer) mirrorOwner(modulePath string) string {
+	if entry, ok := p.vcsIndex.get(modulePath); ok {
+		return entry.owner
+	}
+	return p.readMirrorOwner(modulePath)
+}
+
+// readMirrorOwner is mirrorOwner reading the .git link of an alias on the file system
+func (p *ProxyServer) readMirrorOwner(modulePath string) string {
+	target, err := os.Readlink(p.cachePath(path.Join(modulePath, ".git")))
+	if err != nil {
+		return modulePath
+	}
+	return path.Dir(path.Join(modulePath, target))
+}
+
+type MirrorModule struct {
+	ModulePath string
+	// Directory of go.mod relative to the repo root, empty for the root
+	Dir string `json:",omitempty"`
+	// Module lives in a major version directory, such as v2/
+	VersionedDir bool `json:",omitempty"`
+}
+
+// listMirrorModules scans the tree at rev for go.mod files and reports the modules they declare.
+// rev is resolved to a commit first, so that git only ever gets its hash as an argument
+func listMirrorModules(ctx context.Context, gitdir, rev string) ([]MirrorModule, error) {
+	if strings.HasPrefix(rev, "-") {
+		return nil, errors.New(fmt.Sprintf("invalid revision %s", rev))
+	}
+	hash, err := runGitOutputShort(ctx, gitdir, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unknown revision %s", rev))
+	}
+	rev = strings.TrimSpace(hash)
+	files, err := runGitOutputShort(ctx, gitdir, "ls-tree", "-r", "--name-only", rev)
+	if err != nil {
+		return nil, err
+	}
+	modules := []MirrorModule{}
+	for _, name := range strings.Split(files, "\n") {
+		if name != "go.mod" && !strings.HasSuffix(name, "/go.mod") {
+			continue
+		}
+		dir := strings.TrimSuffix(strings.TrimSuffix(name, "go.mod"), "/")
+		if dir == "vendor" || strings.HasPrefix(dir, "vendor/") || strings.Contains(dir, "/vendor/") ||
+			strings.Contains(dir, "testdata") {
+			continue
+		}
+		data, err := runGitOutputShort(ctx, gitdir, "cat-file", "blob", rev+":"+name)
+		if err != nil {
+			return nil, err
+		}
+		modulePath := modfile.ModulePath([]byte(data))
+		if modulePath == "" {
+			continue
+		}
+		_, major, _ := splitModuleMajorVer(modulePath)
+		modules = append(modules, MirrorModule{
+			ModulePath:   modulePath,
+			Dir:          dir,
+			VersionedDir: major != "" && path.Base(dir) == major,
+		})
+	}
+	return modules, nil
+}
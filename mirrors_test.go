@@ -0,0 +1,56 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The index is saved through the cache root, and left alone when it can't be locked
+func TestMirrorIndexUpdate(t *testing.T) {
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, ".tmp"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := openCacheRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := &mirrorIndex{root: root, lockFile: filepath.Join(dir, ".mirrors.lock"),
+		Remotes: map[string]string{}, Aliases: map[string]string{}}
+	if owner := idx.claim("https://example.com/repo.git", "example.com/repo"); owner != "" {
+		t.Fatalf("claim() = %s", owner)
+	}
+	if owner := idx.claim("https://EXAMPLE.com/repo", "example.com/other"); owner != "example.com/repo" {
+		t.Errorf("claim() = %q, want example.com/repo", owner)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, MirrorIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved mirrorIndex
+	err = json.Unmarshal(data, &saved)
+	if err != nil || saved.Remotes["https://example.com/repo"] != "example.com/repo" {
+		t.Errorf("saved %s, %v", data, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, ".tmp"))
+	if len(entries) != 0 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+
+	// A directory can't be opened as the lock
+	idx.lockFile = filepath.Join(dir, ".tmp")
+	err = idx.update(func() bool {
+		idx.Aliases["example.com/alias"] = "example.com/repo"
+		return true
+	})
+	if err == nil {
+		t.Errorf("updated without the lock")
+	}
+	after, _ := os.ReadFile(filepath.Join(dir, MirrorIndexFile))
+	if string(after) != string(data) {
+		t.Errorf("index saved without the lock: %s", after)
+	}
+}
@@ -0,0 +1,85 @@
+package goproxy
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// openModCache opens the download directory of the GOMODCACHE at dir. dir may also be the
+// download directory itself (GOMODCACHE/cache/download), which is the GOPROXY layout
+func openModCache(dir string) (*cacheRoot, error) {
+	download := path.Join(dir, "cache/download")
+	_, err := os.Stat(download)
+	if err == nil {
+		dir = download
+	}
+	return openCacheRoot(dir)
+}
+
+// serveModCacheDir serves the artifact from ModCacheDir, LayoutDir or the peer, upstream and toolchain
+// stores, if it's there.
+// Files in there are immutable (and for ModCacheDir, were verified against go.sum/sumdb when downloaded),
+// thus are preferred over generating them from the mirror. The list is only served from ModCacheDir,
+// as the others only have versions served before
+func (p *ProxyServer) serveModCacheDir(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string) bool {
+	if p.modCache != nil && p.serveModDownloadDir(w, r, p.modCache, escapedModulePath, prop) {
+		return true
+	}
+	if prop == "list" {
+		return false
+	}
+	if p.layout != nil && p.serveModDownloadDir(w, r, p.layout, escapedModulePath, prop) {
+		return true
+	}
+	if p.peerStore != nil && p.serveModDownloadDir(w, r, p.peerStore, escapedModulePath, prop) {
+		return true
+	}
+	if p.upstreamStore != nil && p.serveModDownloadDir(w, r, p.upstreamStore, escapedModulePath, prop) {
+		return true
+	}
+	return isToolchain(escapedModulePath) && p.serveModDownloadDir(w, r, p.toolchainStore, escapedModulePath, prop)
+}
+
+// serveModDownloadDir serves the artifact from dir in the GOPROXY layout
+func (p *ProxyServer) serveModDownloadDir(w http.ResponseWriter, r *http.Request, dir *cacheRoot, escapedModulePath, prop string) bool {
+	var contentTy string
+	switch {
+	case prop == "list":
+		contentTy = "text/plain; charset=UTF-8"
+	case strings.HasSuffix(prop, ".info"):
+		contentTy = "application/json"
+	case strings.HasSuffix(prop, ".mod"):
+		contentTy = "text/plain; charset=UTF-8"
+	case strings.HasSuffix(prop, ".zip"):
+		contentTy = "application/zip"
+	default:
+		return false
+	}
+	// The request path is already validated, and the download directory uses the same escaping
+	name := path.Join(escapedModulePath, "@v", prop)
+	f, err := dir.openFile(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	if p.sumAllow != nil && !p.checkDownloadSum(w, r, f, escapedModulePath, prop) {
+		return true
+	}
+	loggerGreen.Printf(requestTag(r.Context())+"serveModDownloadDir: Serving %s"+LOG_RST, name)
+	p.setCacheControl(w, endpointOf(prop))
+	if p.signer != nil && strings.HasSuffix(prop, ".zip") {
+		att, err := p.loadAttestation(escapedModulePath, strings.TrimSuffix(prop, ".zip"))
+		if err == nil {
+			setAttestationHeaders(w, att)
+		}
+	}
+	w.Header().Set("Content-Type", contentTy)
+	http.ServeContent(p.newArtifactWriter(w, r), r, "", fi.ModTime(), f)
+	return true
+}
@@ -11,20 +11,98 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
-func (p *ProxyServer) gitCloneWorkerFunc(modulePath, remote string) {
+func (p *ProxyServer) gitCloneWorkerFunc(jobCtx context.Context, job *cloneJob) {
+	modulePath, remote := job.job.ModulePath, job.job.Remote
+	discoveredRemote := remote
+	timeout := GitCloneTimeout
+	var cloneArgs []string
+	override := p.cloneOverride(modulePath)
+	if override != nil {
+		if override.Timeout > 0 {
+			timeout = time.Duration(override.Timeout)
+		}
+		if override.Filter != "" {
+			cloneArgs = append(cloneArgs, "--filter="+override.Filter)
+		}
+		if override.Depth > 0 {
+			cloneArgs = append(cloneArgs, fmt.Sprintf("--depth=%d", override.Depth))
+		}
+		if override.Remote != "" && remote != "" {
+			remote = override.Remote
+		}
+	}
+	if p.frozen() {
+		loggerYellow.Printf("cacheModGit: The cache is frozen, not cloning or updating %s"+LOG_RST, modulePath)
+		return
+	}
+	if remote == "" && p.refreshPinned(modulePath) {
+		loggerGreen.Printf("cacheModGit: %s is pinned, not updating"+LOG_RST, modulePath)
+		return
+	}
+	// Other processes sharing the cache directory may clone or update the mirror too
+	ctx, cancel := context.WithTimeout(jobCtx, timeout)
+	fl, waited, err := p.lockMirror(ctx, modulePath)
+	cancel()
+	if err != nil {
+		loggerRed.Printf("cacheModGit: Failed to lock %s: %s"+LOG_RST, modulePath, err.Error())
+		return
+	}
+	defer fl.unlock()
+	if remote == "" && waited {
+		loggerGreen.Printf("cacheModGit: %s was just updated by another process"+LOG_RST, modulePath)
+		return
+	}
+	if remote != "" && p.root.beneath(path.Join(modulePath, ".vcs")) == nil {
+		loggerGreen.Printf("cacheModGit: %s was cloned by another process"+LOG_RST, modulePath)
+		return
+	}
+	if p.Cluster != nil {
+		ctx, cancel := context.WithTimeout(p.withCacheDir(jobCtx), timeout)
+		l, waited, err := p.acquireLease(ctx, modulePath)
+		cancel()
+		if err != nil {
+			loggerRed.Printf("cacheModGit: Failed to take the lease of %s: %s"+LOG_RST, modulePath, err.Error())
+			return
+		}
+		defer l.release()
+		if remote == "" && waited {
+			loggerGreen.Printf("cacheModGit: %s was just updated by another node"+LOG_RST, modulePath)
+			return
+		}
+		if remote != "" && p.root.beneath(path.Join(modulePath, ".vcs")) == nil {
+			loggerGreen.Printf("cacheModGit: %s was cloned by another node"+LOG_RST, modulePath)
+			return
+		}
+	}
 	if remote == "" {
-		loggerGreen.Printf("cacheModGit: Updating %s"+LOG_RST, modulePath)
-		ctx, cancel := context.WithTimeout(context.Background(), GitCloneTimeout)
+		ctx, cancel := context.WithTimeout(p.withCacheDir(jobCtx), timeout)
 		defer cancel()
-		cmd := getGitCmd(ctx, path.Join(modulePath, ".git"), "remote", "update")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Run()
+		// Refs are much cheaper to compare than fetching. Extra refspecs may fetch beyond branches and tags
+		if (override == nil || len(override.Refspecs) == 0) && p.mirrorCurrent(ctx, path.Join(modulePath, ".git")) {
+			loggerGreen.Printf("cacheModGit: %s is up to date with its remote"+LOG_RST, modulePath)
+			markMirrorChecked(p.cachePath(path.Join(modulePath, ".git")))
+			p.cloneSucceeded(modulePath)
+			return
+		}
+		loggerGreen.Printf("cacheModGit: Updating %s"+LOG_RST, modulePath)
+		pinnedTags := p.pinnedTags(ctx, modulePath)
+		remote, err := p.updateMirror(ctx, modulePath, override)
+		p.restorePinnedTags(ctx, modulePath, pinnedTags)
+		if err != nil && jobCtx.Err() == nil {
+			p.cloneFailed(modulePath, remote, err)
+		}
+		if err != nil {
+			return
+		}
+		markMirrorChecked(p.cachePath(path.Join(modulePath, ".git")))
+		p.cloneSucceeded(modulePath)
+		p.replicate(replicaItem{mirror: modulePath})
 		return
 	}
-	err := os.MkdirAll(modulePath, 0755)
+	err = p.root.mkdirAll(modulePath, 0755)
 	if err != nil {
 		loggerRed.Printf("cacheModGit: Failed to create module directory: %s"+LOG_RST, err.Error())
 		return
@@ -32,105 +110,163 @@ func (p *ProxyServer) gitCloneWorkerFunc(modulePath, remote string) {
 	// Start cloning remote
 	gitdir := path.Join(modulePath, ".git")
 	// Clone to temporary directory and later rename it back to git (atomicity)
-	tmpdir, err := os.MkdirTemp(modulePath, ".gittmp")
+	tmpdir, err := p.root.mkdirTemp(modulePath, ".gittmp")
 	if err != nil {
 		loggerRed.Printf("cacheModGit: failed to create temp git dir: %s"+LOG_RST, err.Error())
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), GitCloneTimeout)
+	ctx, cancel = context.WithTimeout(p.withCacheDir(jobCtx), timeout)
 	defer cancel()
 	loggerGreen.Printf("cacheModGit: Git cloning to %s from %s"+LOG_RST, tmpdir, remote)
 	// Clone to temp directory first
-	err = getGitCmd(ctx, ".", "clone", "--template=.gittemplate", "--quiet", "--mirror", remote, tmpdir).Run()
+	cloneArgs = append(append(p.forgeMirrorArgs(), "clone", "--template=.gittemplate", "--progress", "--mirror"), cloneArgs...)
+	fetched, err := p.cloneMirror(ctx, job, cloneArgs, override, remote, tmpdir)
 	if err != nil {
 		loggerGreen.Printf("cacheModGit: Failed to git clone from %s"+LOG_RST, remote)
-		os.RemoveAll(tmpdir)
+		p.root.removeAll(tmpdir)
+		// A preempted clone runs again, keeping its claim of the remote
+		if jobCtx.Err() == nil {
+			p.cloneFailed(modulePath, remote, err)
+			p.mirrors.release(discoveredRemote, modulePath)
+		}
 		return
 	}
+	if override != nil {
+		for _, refspec := range override.Refspecs {
+			err = getGitCmd(ctx, tmpdir, "config", "--add", "remote.origin.fetch", refspec).Run()
+			if err != nil {
+				loggerYellow.Printf("cacheModGit: Failed to add refspec %s for %s"+LOG_RST, refspec, modulePath)
+			}
+		}
+		if len(override.Refspecs) != 0 {
+			getGitCmd(ctx, tmpdir, append(p.forgeMirrorArgs(), "fetch", "--quiet", "origin")...).Run()
+		}
+	}
+	// MkdirTemp creates 0700 directories, the mirror must stay readable by the sandbox user
+	os.Chmod(p.cachePath(tmpdir), 0755)
+	markMirrorChecked(p.cachePath(tmpdir))
 	// If rename failed, we are racing with others, abort
-	err = os.Rename(tmpdir, gitdir)
+	err = p.root.rename(tmpdir, gitdir)
 	if err != nil {
 		loggerYellow.Printf("cacheModGit: gitdir %s already exists, cleaning up"+LOG_RST, gitdir)
-		os.RemoveAll(tmpdir)
+		p.root.removeAll(tmpdir)
 		return
 	}
 	// Should be successful
-	err = os.Symlink(".git", path.Join(modulePath, ".vcs"))
+	err = p.root.symlink(".git", path.Join(modulePath, ".vcs"))
+	if err == nil {
+		p.vcsIndex.set(modulePath, vcsEntry{vcs: ".git", owner: modulePath})
+		p.recordFetchedRemote(gitdir, fetched)
+	}
 	if err != nil {
 		loggerRed.Printf("cacheModGit: Failed to create .vcs" + LOG_RST)
 	} else {
 		loggerGreen.Printf("cacheModGit: Done cloning %s"+LOG_RST, remote)
+		p.cloneSucceeded(modulePath)
+		p.replicate(replicaItem{mirror: modulePath})
 	}
 }
 
 func (p *ProxyServer) gitCloneWorker() {
 	for {
-		modulePath := <-p.gitClones
+		modulePath, prio, ctx := p.gitClones.pop()
 		v, loaded := p.pendingGit.Load(modulePath)
 		if !loaded {
 			log.Panicf("pendingGit must have %s", modulePath)
 		}
-		p.gitCloneWorkerFunc(modulePath, v.(string))
+		job := v.(*cloneJob)
+		job.start()
+		p.metrics.ActiveClones.Add(1)
+		p.gitCloneWorkerFunc(ctx, job)
+		p.metrics.ActiveClones.Add(-1)
+		// Whether this job or another process updated the mirror, its tags may have changed
+		if job.job.Remote == "" {
+			p.dropMirrorLists(modulePath)
+		}
+		if ctx.Err() != nil {
+			loggerYellow.Printf("cacheModGit: %s was preempted by an interactive job, queued again"+LOG_RST, modulePath)
+			job.stop()
+			p.gitClones.requeue(modulePath, prio)
+			p.gitClones.done(modulePath, prio)
+			continue
+		}
+		p.forgetCloneJob(modulePath)
 		p.pendingGit.Delete(modulePath)
+		close(job.done)
+		p.gitClones.done(modulePath, prio)
 	}
 }
 
-func (p *ProxyServer) cacheModGit(modulePath, subPath, ver, remote string) {
+// cacheModGit returns the clone/update job that fetches the version, or nil if there's nothing to wait for
+func (p *ProxyServer) cacheModGit(ctx context.Context, modulePath, subPath, ver, remote string, prio clonePriority) *cloneJob {
 	if remote == "" {
 		// The local repo already exists. Check if we have the version locally
-		refspec := semver.Canonical(ver)
-		pseudoVer := module.IsPseudoVersion(refspec)
-		if pseudoVer {
-			refspec, _ = module.PseudoVersionRev(refspec)
-		} else if subPath != "" {
-			refspec = strings.Join([]string{subPath, refspec}, "/")
-		}
+		refspecs, _ := p.gitVersionRefs(modulePath, subPath, semver.Canonical(ver))
 		gitdir := path.Join(modulePath, ".git")
-	retry_refspec:
-		cmd := getGitCmd(context.Background(), gitdir, "log", "-1", "--format=%H", refspec)
-		err := cmd.Run()
-		if err != nil {
-			if !pseudoVer && subPath == "" && strings.HasPrefix(refspec, "v") {
-				// This is necessary for some weird projects such as golang.zx2c4.com/wireguard
-				// It doesn't follow the vX.Y.Z as tag names, rather the tag name is X.Y.Z
-				// We need to try again if the vX.Y.Z tag fails
-				// Currently let's limit this retrying only when there's no subPath
-				refspec, _ = strings.CutPrefix(refspec, "v")
-				goto retry_refspec
+		for _, refspec := range refspecs {
+			err := getGitCmd(ctx, gitdir, "log", "-1", "--format=%H", refspec).Run()
+			if err == nil {
+				// The tag/commit exists, just return
+				return nil
 			}
 		}
-		if err == nil {
-			// The tag/commit exists, just return
-			return
+	}
+	if remote == "" {
+		// Aliases are updated through the mirror they share
+		modulePath = p.mirrorOwner(modulePath)
+	} else {
+		owner := p.mirrors.claim(remote, modulePath)
+		if owner != "" {
+			loggerGreen.Printf(requestTag(ctx)+"cacheModGit: %s shares the mirror of %s (%s)"+LOG_RST, modulePath, owner, remote)
+			err := p.createMirrorAlias(modulePath, owner)
+			if err != nil {
+				loggerRed.Printf(requestTag(ctx)+"cacheModGit: Failed to create mirror alias %s: %s"+LOG_RST, modulePath, err.Error())
+			}
+			return nil
 		}
 	}
-	loggerGreen.Printf("cacheModGit: Trying to create/update gitdir for %s, remote=%s, ver=%s"+LOG_RST,
-		modulePath, remote, ver)
-	_, running := p.pendingGit.LoadOrStore(modulePath, remote)
+	return p.queueGitJob(ctx, modulePath, remote, ver, prio)
+}
+
+// queueGitJob clones remote to modulePath, or updates the existing mirror if remote is empty
+func (p *ProxyServer) queueGitJob(ctx context.Context, modulePath, remote, ver string, prio clonePriority) *cloneJob {
+	loggerGreen.Printf(requestTag(ctx)+"cacheModGit: Trying to create/update gitdir for %s, remote=%s, ver=%s, priority=%s"+LOG_RST,
+		modulePath, remote, ver, prio)
+	v, running := p.pendingGit.LoadOrStore(modulePath, newCloneJob(modulePath, remote, prio))
+	job := v.(*cloneJob)
 	if running {
-		loggerGreen.Printf("cacheModGit: Git clone/update %s already running"+LOG_RST, remote)
-		return
+		loggerGreen.Printf(requestTag(ctx)+"cacheModGit: Git clone/update %s already running"+LOG_RST, remote)
+		if p.gitClones.promote(modulePath, prio) {
+			job.setPriority(prio)
+		}
+		return job
 	}
 	if p.gitCloneWorkers.Add(-1) < 0 {
 		p.gitCloneWorkers.Add(1)
 		// gitCloneWorkers is an Int64, Technically it's nearly impossible to underflow
 	} else {
 		go p.gitCloneWorker()
-		loggerGreen.Printf("cacheModGit: Starting git clone worker" + LOG_RST)
+		loggerGreen.Printf(requestTag(ctx) + "cacheModGit: Starting git clone worker" + LOG_RST)
 	}
-	// It's OK if we get blocked here. We should be invoked in a go routine that's separate from the HTTP worker
-	p.gitClones <- modulePath
+	if remote != "" {
+		p.countNewModule(ctx, modulePath)
+	}
+	p.journalCloneJob(job)
+	p.gitClones.push(modulePath, prio)
+	return job
 }
 
-func (p *ProxyServer) cacheModPlain(modulePath, subPath, ver string) {
+func (p *ProxyServer) cacheModPlain(ctx context.Context, modulePath, subPath, ver string) {
 
 }
 
-func (p *ProxyServer) refreshModPathVer(key, escapedModulePath, modulePath, ver string) {
+// refreshModPathVer closes done once the version is fetched, or fetching it failed
+func (p *ProxyServer) refreshModPathVer(ctx context.Context, key string, done chan struct{}, escapedModulePath, modulePath, ver string, prio clonePriority) {
+	defer close(done)
 	defer p.pendingMod.Delete(key)
-	modulePath, _, _, ok := checkModulePathVer(modulePath, ver)
+	modulePath, verMajorTag, _, ok := checkModulePathVer(modulePath, ver)
 	if !ok {
-		loggerYellow.Printf("refreshModPathVer: module path '%s' is invalid"+LOG_RST, modulePath)
+		loggerYellow.Printf(requestTag(ctx)+"refreshModPathVer: module path '%s' is invalid"+LOG_RST, modulePath)
 		return
 	}
 	parentPath, subPath, vcs, err := p.checkModVcsLocal(modulePath)
@@ -139,20 +275,34 @@ func (p *ProxyServer) refreshModPathVer(key, escapedModulePath, modulePath, ver
 		modulePath = parentPath
 		switch vcs {
 		case ".git":
-			p.cacheModGit(modulePath, subPath, ver, "")
+			p.cacheModGit(ctx, modulePath, subPath, ver, "", prio).wait()
 			return
 		case ".mod":
-			p.cacheModPlain(modulePath, subPath, ver)
+			p.cacheModPlain(ctx, modulePath, subPath, ver)
+			return
+		}
+		if backend, ok := p.vcsBackends[vcs]; ok {
+			p.cacheModBackend(ctx, backend, p.vcsRepo(modulePath, subPath, verMajorTag, vcs), ver)
 			return
 		}
 		log.Panicf("Invalid local VCS type %s for module %s, should not happen", vcs, modulePath)
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), UpstreamProxyTimeout)
-	defer cancel()
-	info, err := checkEsModulePathUpstream(ctx, escapedModulePath)
+	mirrorPath, subPath, remote, ok := p.sourceOverride(modulePath)
+	if ok {
+		loggerGreen.Printf(requestTag(ctx)+"refreshModPathVer: Using source override: modulepath=%s, subpath=%s, remote=%s"+LOG_RST,
+			mirrorPath, subPath, remote)
+		p.cacheModGit(ctx, mirrorPath, subPath, ver, remote, prio).wait()
+		return
+	}
+	// Each attempt is bounded by UpstreamProxyTimeout
+	info, err := p.checkEsModulePathUpstream(ctx, escapedModulePath)
+	if err == errBreakerOpen {
+		loggerYellow.Printf(requestTag(ctx)+"refreshModPathVer: Upstream is failing, discovering %s directly"+LOG_RST, modulePath)
+		info, err = RevInfo{}, nil
+	}
 	if err != nil {
-		loggerRed.Printf("refreshModPathVer: failed to check module path on upstream: %s"+LOG_RST, err.Error())
+		loggerRed.Printf(requestTag(ctx)+"refreshModPathVer: failed to check module path on upstream: %s"+LOG_RST, err.Error())
 		return
 	}
 	if info.Origin != nil {
@@ -160,66 +310,148 @@ func (p *ProxyServer) refreshModPathVer(key, escapedModulePath, modulePath, ver
 		subPath = info.Origin.Subdir
 		modulePath = strings.TrimRight(strings.TrimSuffix(modulePath, subPath), "/")
 		if info.Origin.VCS == "git" {
-			p.cacheModGit(modulePath, subPath, ver, info.Origin.URL)
+			err = p.checkDiscoveredRemote(info.Origin.URL)
+			if err != nil {
+				loggerRed.Printf(requestTag(ctx)+"refreshModPathVer: Refusing remote of %s: %s"+LOG_RST, modulePath, err.Error())
+				return
+			}
+			p.cacheModGit(ctx, modulePath, subPath, ver, info.Origin.URL, prio).wait()
 		} else {
-			p.cacheModPlain(modulePath, subPath, ver)
+			p.cacheModPlain(ctx, modulePath, subPath, ver)
 		}
 		return
 	}
 	// Now we'll have to get the repo link ourselves
-	prefix, imports, err := searchModuleVcsDirect(modulePath)
+	prefix, imports, err := p.searchModuleVcsDirect(ctx, modulePath)
 	if err != nil {
-		loggerRed.Printf("refreshModPathVer: Cannot find go-import paths for %s: %s"+LOG_RST, modulePath, err.Error())
+		loggerRed.Printf(requestTag(ctx)+"refreshModPathVer: Cannot find go-import paths for %s: %s"+LOG_RST, modulePath, err.Error())
 		return
 	}
 	subPath = strings.TrimLeft(strings.TrimPrefix(modulePath, prefix), "/")
 	modulePath = prefix
-	loggerGreen.Printf("refreshModPathVer: go-import found: modulepath=%s, subpath=%s"+LOG_RST, modulePath, subPath)
+	loggerGreen.Printf(requestTag(ctx)+"refreshModPathVer: go-import found: modulepath=%s, subpath=%s"+LOG_RST, modulePath, subPath)
 	for _, im := range imports {
 		if im.VCS == "git" {
-			p.cacheModGit(modulePath, subPath, ver, im.RepoRoot)
+			err = p.checkDiscoveredRemote(im.RepoRoot)
+			if err != nil {
+				loggerRed.Printf(requestTag(ctx)+"refreshModPathVer: Refusing go-import of %s: %s"+LOG_RST, modulePath, err.Error())
+				return
+			}
+			p.cacheModGit(ctx, modulePath, subPath, ver, im.RepoRoot, prio).wait()
 			return
 		}
-		loggerYellow.Printf("refreshModPathVer: Ignoring go-import: %s %s %s"+LOG_RST, im.Prefix, im.VCS, im.RepoRoot)
+		loggerYellow.Printf(requestTag(ctx)+"refreshModPathVer: Ignoring go-import: %s %s %s"+LOG_RST, im.Prefix, im.VCS, im.RepoRoot)
 	}
-	loggerYellow.Printf("refreshModPathVer: %s is not git vcs, will have to fetch files from proxy"+LOG_RST, modulePath)
-	p.cacheModPlain(modulePath, subPath, ver)
+	loggerYellow.Printf(requestTag(ctx)+"refreshModPathVer: %s is not git vcs, will have to fetch files from proxy"+LOG_RST, modulePath)
+	p.cacheModPlain(ctx, modulePath, subPath, ver)
 }
 
-func (p *ProxyServer) processEsModPathVer(key, escapedModulePath, ver string) error {
+// processEsModPathVer starts fetching the version into the cache, the returned channel is closed when it's done
+func (p *ProxyServer) processEsModPathVer(ctx context.Context, key, escapedModulePath, ver string, prio clonePriority) (<-chan struct{}, error) {
 	// key is the URL without splitting, but with extension removed,
 	// such as golang.org/x/tools/gopls@v0.6.4.zip
 	// This helps avoid duplicate work
 	modulePath, err := module.UnescapePath(escapedModulePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, existing := p.pendingMod.LoadOrStore(key, struct{}{})
+	done := make(chan struct{})
+	v, existing := p.pendingMod.LoadOrStore(key, done)
 	if existing {
 		// Other threads already handling the jobs
-		return nil
+		return v.(chan struct{}), nil
 	}
-	go p.refreshModPathVer(key, escapedModulePath, modulePath, ver)
-	return nil
+	go p.refreshModPathVer(context.WithoutCancel(ctx), key, done, escapedModulePath, modulePath, ver, prio)
+	return done, nil
 }
 
 func (p *ProxyServer) monitorModFetch(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" {
+		p.serveIndex(w, r)
+		return
+	}
+	p.fetchMod(w, r, p.SyncFetch || r.URL.Query().Get("sync") == "1")
+}
+
+func (p *ProxyServer) syncModFetch(w http.ResponseWriter, r *http.Request) {
+	p.fetchMod(w, r, true)
+}
+
+// fetchMod starts fetching the requested version into the cache. Unless sync is set,
+// the client is redirected to upstream right away, instead of waiting for the fetch
+func (p *ProxyServer) fetchMod(w http.ResponseWriter, r *http.Request, sync bool) {
+	opts := p.requestOptions(r)
+	// Frozen, only what's cached is served
+	if opts.cacheOnly || p.frozen() {
+		p.serveModCached(w, r)
+		return
+	}
 	escapedModulePath, prop, ok := parseRequest(w, r)
-	if !ok {
+	if !ok || !p.checkPolicy(w, r, escapedModulePath, prop) {
+		return
+	}
+	if opts.refresh && !p.refreshLocalMirror(w, r) {
+		return
+	}
+	// The list there is whatever happened to be downloaded, upstream knows better
+	if prop != "list" && p.serveModCacheDir(w, r, escapedModulePath, prop) {
+		return
+	}
+	// Also applies to what would be redirected to upstream
+	if !p.checkVulns(w, r, escapedModulePath, prop) {
+		return
+	}
+	// Toolchains have no repo to discover, and are big enough to be worth keeping for every client
+	if isToolchain(escapedModulePath) && path.Ext(prop) != "" {
+		p.fetchToolchain(w, r, escapedModulePath, prop)
 		return
 	}
+	// Redirecting to a failing upstream is of no use, fetch and serve from the cache instead
+	sync = sync || opts.noRedirect || p.isDirSource(escapedModulePath) || p.upstreamBreaker.isOpen()
 	ext := path.Ext(prop)
 	switch ext {
 	case ".info", ".mod", ".zip":
+		// Branches of mirrored modules are answered from the mirror, which the refresh option updates first
+		if p.serveBranchInfo(w, r, escapedModulePath, prop, true) {
+			return
+		}
+		// A peer having it spares cloning the module here
+		if p.peerStore != nil && !opts.refresh && !p.hasLocalSource(escapedModulePath) &&
+			p.fetchFromPeers(w, r, escapedModulePath, prop) {
+			return
+		}
+		if p.Quotas != nil && !p.newModuleAllowed(w, r, escapedModulePath) {
+			return
+		}
 		ver := prop[:len(prop)-len(ext)]
 		key := r.URL.Path[:len(r.URL.Path)-len(ext)]
-		err := p.processEsModPathVer(key, escapedModulePath, ver)
+		done, err := p.processEsModPathVer(r.Context(), key, escapedModulePath, ver, clonePriorityInteractive)
 		if err != nil {
 			httpRespString(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		if sync {
+			p.serveModAfterFetch(w, r, done)
+			return
+		}
 	case "":
 		// Just redirect. We are not interested in these
+		if prop == "latest" && (p.StaleWhileRevalidate > 0 || p.upstreamBreaker.isOpen()) && p.hasLocalMirror(escapedModulePath) {
+			p.setCacheControl(w, "latest")
+			p.serveLatestCached(w, r, escapedModulePath)
+			return
+		}
+		if prop == "list" && (p.StaleWhileRevalidate > 0 || p.upstreamBreaker.isOpen()) && p.hasLocalMirror(escapedModulePath) {
+			p.setCacheControl(w, "list")
+			p.serveListCached(w, r, escapedModulePath)
+			return
+		}
+		// Never on upstream
+		if prop == "latest" && p.isBackendSource(escapedModulePath) {
+			p.setCacheControl(w, "latest")
+			p.serveLatestCached(w, r, escapedModulePath)
+			return
+		}
 		if prop == "latest" || prop == "list" {
 			break
 		}
@@ -229,6 +461,45 @@ func (p *ProxyServer) monitorModFetch(w http.ResponseWriter, r *http.Request) {
 		httpRespString(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	redirectToUpstream(w, r)
+	p.setCacheControl(w, "redirect")
+	p.redirectToUpstream(w, r)
 	return
 }
+
+// serveModAfterFetch waits for the fetch to finish and serves the version from the cache
+func (p *ProxyServer) serveModAfterFetch(w http.ResponseWriter, r *http.Request, done <-chan struct{}) {
+	if p.waitForFetch(w, r, done) {
+		p.serveModCached(w, r)
+	}
+}
+
+// waitForFetch returns false if the client went away while waiting
+func (p *ProxyServer) waitForFetch(w http.ResponseWriter, r *http.Request, done <-chan struct{}) bool {
+	rc := http.NewResponseController(w)
+	// Cloning may take far longer than the write timeout of the server
+	rc.SetWriteDeadline(time.Time{})
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return false
+	}
+	rc.SetWriteDeadline(time.Now().Add(p.stallTimeout()))
+	return true
+}
+
+// refreshLocalMirror updates the mirror of the requested module, if there's one, before answering.
+// It returns false if the client went away while waiting
+func (p *ProxyServer) refreshLocalMirror(w http.ResponseWriter, r *http.Request) bool {
+	escapedModulePath, _, _ := strings.Cut(r.URL.Path, "/@")
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		// Reported when parsing the request
+		return true
+	}
+	parentPath, _, vcs, err := p.checkModVcsLocal(modulePath)
+	if err != nil || vcs != ".git" {
+		return true
+	}
+	job := p.queueGitJob(r.Context(), p.mirrorOwner(parentPath), "", "", clonePriorityInteractive)
+	return p.waitForFetch(w, r, job.done)
+}
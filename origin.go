@@ -0,0 +1,189 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// gitRefs maps HEAD, refs/heads/* and refs/tags/* to commit hashes, annotated tags peeled,
+// the same way cmd/go records the refs of a repo
+type gitRefs map[string]string
+
+// lsRemote lists the refs of the remote of the mirror, without fetching anything
+func (p *ProxyServer) lsRemote(ctx context.Context, gitdir string) (gitRefs, error) {
+	out, err := runGitOutputShort(ctx, gitdir, append(p.forgeMirrorArgs(), "ls-remote", "origin")...)
+	if err != nil {
+		return nil, err
+	}
+	refs := gitRefs{}
+	peeled := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		hash, ref, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if !ok || (ref != "HEAD" && !strings.HasPrefix(ref, "refs/heads/") && !strings.HasPrefix(ref, "refs/tags/")) {
+			continue
+		}
+		if tag, ok := strings.CutSuffix(ref, "^{}"); ok {
+			peeled[tag] = hash
+		} else {
+			refs[ref] = hash
+		}
+	}
+	for ref, hash := range peeled {
+		refs[ref] = hash
+	}
+	return refs, nil
+}
+
+// localRefs lists the refs of the mirror in the same form as lsRemote
+func localRefs(ctx context.Context, gitdir string) (gitRefs, error) {
+	out, err := runGitOutputShort(ctx, gitdir, "for-each-ref", "--format=%(refname) %(objectname) %(*objectname)", "refs/heads/", "refs/tags/")
+	if err != nil {
+		return nil, err
+	}
+	refs := gitRefs{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		refs[fields[0]] = fields[len(fields)-1]
+	}
+	head, err := runGitOutputShort(ctx, gitdir, "rev-parse", "--verify", "--quiet", "HEAD")
+	if err == nil {
+		refs["HEAD"] = strings.TrimSpace(head)
+	}
+	return refs, nil
+}
+
+// isOriginTag reports whether the tag counts for TagSum: a semver prefix, but no pseudo-version,
+// as cmd/go also invalidates pseudo-versions with new tags of that form
+func isOriginTag(tag string) bool {
+	c := semver.Canonical(tag)
+	return c != "" && strings.HasPrefix(tag, c) && !module.IsPseudoVersion(tag)
+}
+
+// tagSum summarizes the tags with prefix (the subdirectory of the module, such as "sub/"),
+// compatible with Origin.TagSum of cmd/go
+func (refs gitRefs) tagSum(prefix string) string {
+	var tags []string
+	for ref := range refs {
+		tag, ok := strings.CutPrefix(ref, "refs/tags/")
+		if ok && strings.HasPrefix(tag, prefix) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	h := sha256.New()
+	for _, tag := range tags {
+		if isOriginTag(strings.TrimPrefix(tag, dir)) {
+			fmt.Fprintf(h, "%q %s\n", tag, refs["refs/tags/"+tag])
+		}
+	}
+	return "t1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// repoSum summarizes all refs, compatible with Origin.RepoSum of cmd/go
+func (refs gitRefs) repoSum() string {
+	var names []string
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, ref := range names {
+		fmt.Fprintf(h, "%q %s\n", ref, refs[ref])
+	}
+	return "r1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkReuse reports why a result with the origin is no longer valid against refs, nil if it still is.
+// Same checks as CheckReuse of cmd/go
+func (refs gitRefs) checkReuse(origin *Origin) error {
+	if origin == nil || (origin.Ref == "" && origin.TagSum == "" && origin.RepoSum == "") {
+		return errors.New("origin carries nothing to check")
+	}
+	if origin.RepoSum != "" {
+		if sum := refs.repoSum(); sum != origin.RepoSum {
+			return errors.New(fmt.Sprintf("repo changed, RepoSum %s is now %s", origin.RepoSum, sum))
+		}
+		return nil
+	}
+	if origin.Ref != "" {
+		hash, ok := refs[origin.Ref]
+		if !ok {
+			return errors.New(fmt.Sprintf("ref %s deleted", origin.Ref))
+		}
+		if hash != origin.Hash {
+			return errors.New(fmt.Sprintf("ref %s moved from %s to %s", origin.Ref, origin.Hash, hash))
+		}
+	}
+	if origin.TagSum != "" {
+		if sum := refs.tagSum(origin.TagPrefix); sum != origin.TagSum {
+			return errors.New(fmt.Sprintf("tags with prefix %q changed, TagSum %s is now %s", origin.TagPrefix, origin.TagSum, sum))
+		}
+	}
+	return nil
+}
+
+// mirrorCurrent reports whether the branches and tags of the mirror match its remote, in which
+// case updating it would fetch nothing
+func (p *ProxyServer) mirrorCurrent(ctx context.Context, gitdir string) bool {
+	local, err := localRefs(ctx, gitdir)
+	if err != nil {
+		return false
+	}
+	remote, err := p.lsRemote(ctx, gitdir)
+	if err != nil {
+		return false
+	}
+	return local.repoSum() == remote.repoSum()
+}
+
+// serveAdminCheckReuse checks the Origin (or RevInfo carrying it) in the body against the current
+// refs of the remote of the mirror of ?path=<module>, like CheckReuse of cmd/go
+func (p *ProxyServer) serveAdminCheckReuse(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Origin
+		// Origin of a RevInfo, such as a .info response
+		Nested *Origin `json:"Origin"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, MaxUpstreamResponse)).Decode(&body)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	origin := &body.Origin
+	if body.Nested != nil {
+		origin = body.Nested
+	}
+	parentPath, _, vcs, err := p.checkModVcsLocal(r.URL.Query().Get("path"))
+	if err != nil || vcs != ".git" {
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("no git mirror found for %s", r.URL.Query().Get("path")))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), UpstreamProxyTimeout)
+	defer cancel()
+	refs, err := p.lsRemote(ctx, path.Join(p.mirrorOwner(parentPath), ".git"))
+	if err != nil {
+		httpRespString(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	result := map[string]any{"Reusable": true}
+	if err := refs.checkReuse(origin); err != nil {
+		result = map[string]any{"Reusable": false, "Reason": err.Error()}
+	}
+	httpRespJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,233 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+const OSVQueryURL = "https://api.osv.dev/v1/query"
+const OSVCacheTTL = 24 * time.Hour
+const OSVStoreDir = ".osv"
+const VulnerabilitiesHeader = "X-Go-Module-Vulnerabilities"
+
+// Advisories of a single version rarely come close to this
+const maxOSVResponse = 8 << 20
+
+// VulnPolicy checks served versions against the OSV database
+type VulnPolicy struct {
+	// Query endpoint, OSVQueryURL if empty
+	URL string `json:",omitempty"`
+	// Add X-Go-Module-Vulnerabilities with the advisory IDs to responses of affected versions
+	Warn bool `json:",omitempty"`
+	// Refuse zips of versions with advisories of this severity or above: LOW, MODERATE, HIGH or CRITICAL.
+	// Only .zip is refused, .info/.mod stay available for module graph resolution
+	Block string `json:",omitempty"`
+	// How long results are cached, OSVCacheTTL if 0
+	CacheTTL Duration `json:",omitempty"`
+}
+
+// Advisory is the part of an OSV entry the proxy cares about
+type Advisory struct {
+	ID       string
+	Summary  string `json:",omitempty"`
+	Severity string `json:",omitempty"`
+}
+
+type osvResult struct {
+	Fetched    time.Time
+	Advisories []Advisory
+}
+
+type osvState struct {
+	mu      sync.Mutex
+	results map[string]*osvResult
+}
+
+var osvSeverities = []string{"LOW", "MODERATE", "HIGH", "CRITICAL"}
+
+func severityRank(severity string) int {
+	severity = strings.ToUpper(severity)
+	if severity == "MEDIUM" {
+		severity = "MODERATE"
+	}
+	for i, s := range osvSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// Check validates the policy
+func (v *VulnPolicy) Check() error {
+	if v.Block != "" && severityRank(v.Block) < 0 {
+		return errors.New(fmt.Sprintf("unknown severity %s, expecting one of %s", v.Block, strings.Join(osvSeverities, ", ")))
+	}
+	return nil
+}
+
+func queryOSV(ctx context.Context, client *http.Client, url, modulePath, version string) ([]Advisory, error) {
+	query, _ := json.Marshal(map[string]any{
+		"package": map[string]string{"name": modulePath, "ecosystem": "Go"},
+		// OSV has Go versions without the v prefix
+		"version": strings.TrimPrefix(version, "v"),
+	})
+	ctx, cancel := context.WithTimeout(ctx, UpstreamProxyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("HTTP error %d", resp.StatusCode))
+	}
+	var result struct {
+		Vulns []struct {
+			ID               string
+			Summary          string
+			DatabaseSpecific struct {
+				Severity string
+			} `json:"database_specific"`
+		}
+	}
+	err = json.NewDecoder(&bodyLimiter{r: resp.Body, n: maxOSVResponse}).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	advisories := []Advisory{}
+	for _, vuln := range result.Vulns {
+		advisories = append(advisories, Advisory{ID: vuln.ID, Summary: vuln.Summary, Severity: vuln.DatabaseSpecific.Severity})
+	}
+	return advisories, nil
+}
+
+// advisories returns the advisories of the version, from the in-memory or on-disk cache if fresh
+func (p *ProxyServer) advisories(ctx context.Context, escapedModulePath, escapedVersion string) ([]Advisory, error) {
+	ttl := time.Duration(p.Vulns.CacheTTL)
+	if ttl <= 0 {
+		ttl = OSVCacheTTL
+	}
+	key := escapedModulePath + "@" + escapedVersion
+	p.osv.mu.Lock()
+	result, ok := p.osv.results[key]
+	p.osv.mu.Unlock()
+	store := path.Join(OSVStoreDir, key+".json")
+	if !ok {
+		result = &osvResult{}
+		if p.loadRecord(ctx, store, result) != nil {
+			result = nil
+		}
+	}
+	if result != nil && time.Since(result.Fetched) < ttl {
+		return result.Advisories, nil
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return nil, err
+	}
+	version, err := module.UnescapeVersion(escapedVersion)
+	if err != nil {
+		return nil, err
+	}
+	url := p.Vulns.URL
+	if url == "" {
+		url = OSVQueryURL
+	}
+	advisories, err := queryOSV(ctx, p.upstreamClient, url, modulePath, version)
+	if err != nil {
+		if result != nil {
+			// Stale is better than nothing
+			return result.Advisories, nil
+		}
+		return nil, err
+	}
+	result = &osvResult{Fetched: time.Now(), Advisories: advisories}
+	p.osv.mu.Lock()
+	if p.osv.results == nil {
+		p.osv.results = make(map[string]*osvResult)
+	}
+	p.osv.results[key] = result
+	p.osv.mu.Unlock()
+	p.storeRecord(ctx, store, result)
+	return advisories, nil
+}
+
+// checkVulns applies the VulnPolicy to a request for .info/.mod/.zip. It returns false if the
+// version was refused, the response being already written. Failing to query OSV lets the request through
+func (p *ProxyServer) checkVulns(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string) bool {
+	if p.Vulns == nil {
+		return true
+	}
+	ext := path.Ext(prop)
+	if ext != ".info" && ext != ".mod" && ext != ".zip" {
+		return true
+	}
+	escapedVersion := strings.TrimSuffix(prop, ext)
+	advisories, err := p.advisories(r.Context(), escapedModulePath, escapedVersion)
+	if err != nil {
+		loggerYellow.Printf(requestTag(r.Context())+"checkVulns: Failed to query OSV for %s@%s: %s"+LOG_RST,
+			escapedModulePath, escapedVersion, err.Error())
+		return true
+	}
+	if len(advisories) == 0 {
+		return true
+	}
+	var ids []string
+	var blocking []string
+	for _, advisory := range advisories {
+		ids = append(ids, advisory.ID)
+		if p.Vulns.Block != "" && severityRank(advisory.Severity) >= severityRank(p.Vulns.Block) {
+			blocking = append(blocking, advisory.ID)
+		}
+	}
+	if p.Vulns.Warn {
+		w.Header().Set(VulnerabilitiesHeader, strings.Join(ids, ", "))
+	}
+	if ext == ".zip" && len(blocking) != 0 {
+		loggerRed.Printf(requestTag(r.Context())+"checkVulns: Refusing %s@%s: %s"+LOG_RST,
+			escapedModulePath, escapedVersion, strings.Join(blocking, ", "))
+		modulePath, _ := module.UnescapePath(escapedModulePath)
+		version, _ := module.UnescapeVersion(escapedVersion)
+		p.refusePolicy(w, modulePath, version, "affected by "+strings.Join(blocking, ", "), 0)
+		return false
+	}
+	return true
+}
+
+// serveAdminVulns serves the advisories of ?path=<module>&version=<version>
+func (p *ProxyServer) serveAdminVulns(w http.ResponseWriter, r *http.Request) {
+	if p.Vulns == nil {
+		httpRespString(w, http.StatusNotFound, "OSV checks are not enabled")
+		return
+	}
+	modulePath, version := r.URL.Query().Get("path"), r.URL.Query().Get("version")
+	err := module.Check(modulePath, version)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	escapedModulePath, _ := module.EscapePath(modulePath)
+	escapedVersion, _ := module.EscapeVersion(version)
+	advisories, err := p.advisories(r.Context(), escapedModulePath, escapedVersion)
+	if err != nil {
+		httpRespString(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	httpRespJSON(w, http.StatusOK, advisories)
+}
@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Artifacts fetched from peers are kept here in the GOPROXY layout, and served like LayoutDir
+const PeerStoreDir = ".peers"
+
+// fetchFromPeers asks the Peers, in order, for an artifact of a module with no local mirror and
+// serves it. Peers are asked through their cached-only endpoint, which never consults peers itself,
+// so requests can't loop. It returns false if no peer has it
+func (p *ProxyServer) fetchFromPeers(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string) bool {
+	for _, peer := range p.Peers {
+		url := strings.TrimSuffix(peer, "/") + "/cached-only/" + path.Join(escapedModulePath, "@v", prop)
+		err := p.fetchArtifact(r.Context(), url, p.peerStore, escapedModulePath, prop)
+		if err != nil {
+			loggerYellow.Printf(requestTag(r.Context())+"fetchFromPeers: %s: %s"+LOG_RST, url, err.Error())
+			continue
+		}
+		loggerGreen.Printf(requestTag(r.Context())+"fetchFromPeers: Fetched %s"+LOG_RST, url)
+		p.metrics.PeerHits.Add(1)
+		if p.serveModDownloadDir(w, r, p.peerStore, escapedModulePath, prop) {
+			return true
+		}
+	}
+	p.metrics.PeerMisses.Add(1)
+	return false
+}
+
+// fetchArtifact downloads the artifact at url into store, in the GOPROXY layout.
+// Interrupted downloads are resumed, and the result is verified before it's stored
+func (p *ProxyServer) fetchArtifact(ctx context.Context, url string, store *cacheRoot, escapedModulePath, prop string) error {
+	limit := p.maxZipSize()
+	if isToolchain(escapedModulePath) {
+		// Not generated here, MaxZipSize doesn't apply
+		limit = modzip.MaxZipFile
+	}
+	if !strings.HasSuffix(prop, ".zip") {
+		limit = MaxGoImportResponse
+	}
+	tmp, err := createUnnamedTmpFile(p.cachePath(".tmp"), 0600)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	header, err := downloadResumable(ctx, p.upstreamClient, url, tmp, limit)
+	if err != nil {
+		return err
+	}
+	err = verifyDownload(tmp, header, escapedModulePath, prop)
+	if err != nil {
+		return errors.New(fmt.Sprintf("verifying download: %s", err.Error()))
+	}
+	dir := path.Join(escapedModulePath, "@v")
+	err = store.mkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return writeLayoutFile(store, path.Join(dir, prop), tmp)
+}
+
+// hasLocalSource reports whether the module is served from a local mirror or directory
+func (p *ProxyServer) hasLocalSource(escapedModulePath string) bool {
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return false
+	}
+	_, _, _, err = p.checkModVcsLocal(modulePath)
+	return err == nil
+}
+
+func openStore(dir string) (*cacheRoot, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return openCacheRoot(dir)
+}
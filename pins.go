@@ -0,0 +1,305 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Pins added through the admin API are saved in the cache, shared by the nodes of a cluster
+const PinsFile = ".pins.json"
+
+// Pin protects a module, or one version of it, for reproducibility: its mirror is never evicted
+// (purged), and tags of a pinned version stay where they were when the mirror is updated
+type Pin struct {
+	Module string
+	// Version pinned, empty pins every version
+	Version string `json:",omitempty"`
+	// Never update the mirror either, serving what's cached as is
+	NoRefresh bool `json:",omitempty"`
+	// Why the module is pinned, for whoever wonders
+	Reason string `json:",omitempty"`
+}
+
+// PinStatus is a pin and the mirror it protects
+type PinStatus struct {
+	Pin
+	// Pinned in the configuration, rather than through the admin API
+	Configured bool `json:",omitempty"`
+	// Mirror serving the module, empty if it isn't cached yet
+	Mirror string `json:",omitempty"`
+}
+
+type pinState struct {
+	mu   sync.Mutex
+	Pins []Pin
+	// Modification time of PinsFile when last read
+	modTime time.Time
+}
+
+var errPinned = errors.New("module is pinned")
+
+// Check validates the pin
+func (pin *Pin) Check() error {
+	err := module.CheckPath(pin.Module)
+	if err != nil {
+		return err
+	}
+	if pin.Version != "" && semver.Canonical(pin.Version) != pin.Version {
+		return errors.New(fmt.Sprintf("invalid version %s of pinned %s, expecting a canonical semantic version", pin.Version, pin.Module))
+	}
+	return nil
+}
+
+// Pins is a list of pinned modules
+type Pins []Pin
+
+// Set adds a pin from <module>[@<version>], for command line flags. The command line is parsed
+// twice (see -config), pins already there aren't added again
+func (p *Pins) Set(s string) error {
+	modulePath, version, _ := strings.Cut(s, "@")
+	pin := Pin{Module: modulePath, Version: version}
+	err := pin.Check()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(*p, pin) {
+		*p = append(*p, pin)
+	}
+	return nil
+}
+
+func (p *Pins) String() string {
+	var pins []string
+	for _, pin := range *p {
+		if pin.Version != "" {
+			pins = append(pins, pin.Module+"@"+pin.Version)
+		} else {
+			pins = append(pins, pin.Module)
+		}
+	}
+	return strings.Join(pins, " ")
+}
+
+// Check validates the pins
+func (p Pins) Check() error {
+	for i := range p {
+		err := p[i].Check()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adminPins returns the pins added through the admin API, reading PinsFile again if another node
+// changed it. Called with the lock held
+func (p *ProxyServer) adminPins() []Pin {
+	info, err := os.Stat(p.cachePath(PinsFile))
+	if err != nil {
+		p.pinned.Pins, p.pinned.modTime = nil, time.Time{}
+		return nil
+	}
+	if info.ModTime().Equal(p.pinned.modTime) {
+		return p.pinned.Pins
+	}
+	data, err := os.ReadFile(p.cachePath(PinsFile))
+	if err != nil {
+		return p.pinned.Pins
+	}
+	var saved pinState
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		loggerYellow.Printf("adminPins: Ignoring invalid %s: %s"+LOG_RST, PinsFile, err.Error())
+		return p.pinned.Pins
+	}
+	p.pinned.Pins, p.pinned.modTime = saved.Pins, info.ModTime()
+	return p.pinned.Pins
+}
+
+// savePins writes the pins added through the admin API. Called with the lock held
+func (p *ProxyServer) savePins(pins []Pin) error {
+	data, _ := json.Marshal(&pinState{Pins: pins})
+	tmp := fmt.Sprintf("%s.%d", p.cachePath(PinsFile), os.Getpid())
+	err := os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, p.cachePath(PinsFile))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	p.pinned.Pins, p.pinned.modTime = pins, time.Time{}
+	if info, err := os.Stat(p.cachePath(PinsFile)); err == nil {
+		p.pinned.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// allPins returns the configured pins and those added through the admin API
+func (p *ProxyServer) allPins() []PinStatus {
+	var pins []PinStatus
+	for _, pin := range p.Pins {
+		pins = append(pins, PinStatus{Pin: pin, Configured: true})
+	}
+	p.pinned.mu.Lock()
+	for _, pin := range p.adminPins() {
+		pins = append(pins, PinStatus{Pin: pin})
+	}
+	p.pinned.mu.Unlock()
+	for i := range pins {
+		if parentPath, _, vcs, err := p.checkModVcsLocal(pins[i].Module); err == nil && vcs == ".git" {
+			pins[i].Mirror = parentPath
+		}
+	}
+	return pins
+}
+
+// mirrorPins returns the pins of modules served by the mirror (or alias) at modulePath. Those of
+// aliases count for the mirror they share too
+func (p *ProxyServer) mirrorPins(modulePath string) []PinStatus {
+	var pins []PinStatus
+	owner := p.mirrorOwner(modulePath)
+	for _, pin := range p.allPins() {
+		if pin.Mirror == "" {
+			continue
+		}
+		if pin.Mirror == modulePath || (modulePath == owner && p.mirrorOwner(pin.Mirror) == owner) {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// refreshPinned tells whether the mirror at modulePath serves a module pinned with NoRefresh
+func (p *ProxyServer) refreshPinned(modulePath string) bool {
+	return slices.ContainsFunc(p.mirrorPins(modulePath), func(pin PinStatus) bool {
+		return pin.NoRefresh
+	})
+}
+
+// pinnedTags resolves the tags of the versions pinned in the mirror at modulePath, before it's
+// updated
+func (p *ProxyServer) pinnedTags(ctx context.Context, modulePath string) map[string]string {
+	tags := make(map[string]string)
+	gitdir := path.Join(modulePath, ".git")
+	for _, pin := range p.mirrorPins(modulePath) {
+		if pin.Version == "" || module.IsPseudoVersion(pin.Version) {
+			continue
+		}
+		// Major versions are told apart by the version itself
+		modulePrefix, _, _ := module.SplitPathVersion(pin.Module)
+		subPath := strings.TrimPrefix(strings.TrimPrefix(modulePrefix, pin.Mirror), "/")
+		refspecs, _ := p.gitVersionRefs(pin.Mirror, subPath, pin.Version)
+		for _, refspec := range refspecs {
+			ref := "refs/tags/" + refspec
+			if oid, err := runGitOutputShort(ctx, gitdir, "rev-parse", "--verify", "--quiet", ref); err == nil {
+				tags[ref] = strings.TrimSpace(oid)
+			}
+		}
+	}
+	return tags
+}
+
+// restorePinnedTags moves back the tags of pinned versions the update moved or deleted, so that
+// pinned versions keep their content even if upstream retags them
+func (p *ProxyServer) restorePinnedTags(ctx context.Context, modulePath string, tags map[string]string) {
+	gitdir := path.Join(modulePath, ".git")
+	for ref, oid := range tags {
+		current, _ := runGitOutputShort(ctx, gitdir, "rev-parse", "--verify", "--quiet", ref)
+		if strings.TrimSpace(current) == oid {
+			continue
+		}
+		loggerYellow.Printf("cacheModGit: %s of pinned %s moved upstream, keeping it at %s"+LOG_RST, ref, modulePath, oid)
+		_, err := runGitOutputShort(ctx, gitdir, "update-ref", ref, oid)
+		if err != nil {
+			loggerRed.Printf("cacheModGit: Failed to restore %s of %s: %s"+LOG_RST, ref, modulePath, err.Error())
+		}
+	}
+}
+
+// pin adds a pin through the admin API, replacing any pin of the same module and version
+func (p *ProxyServer) pin(pin Pin) error {
+	err := pin.Check()
+	if err != nil {
+		return err
+	}
+	p.pinned.mu.Lock()
+	defer p.pinned.mu.Unlock()
+	pins := slices.DeleteFunc(slices.Clone(p.adminPins()), func(existing Pin) bool {
+		return existing.Module == pin.Module && existing.Version == pin.Version
+	})
+	return p.savePins(append(pins, pin))
+}
+
+// unpin removes a pin added through the admin API. Configured pins can't be removed
+func (p *ProxyServer) unpin(modulePath, version string) error {
+	match := func(pin Pin) bool {
+		return pin.Module == modulePath && pin.Version == version
+	}
+	if slices.ContainsFunc(p.Pins, match) {
+		return errPinned
+	}
+	p.pinned.mu.Lock()
+	defer p.pinned.mu.Unlock()
+	pins := p.adminPins()
+	if !slices.ContainsFunc(pins, match) {
+		return os.ErrNotExist
+	}
+	return p.savePins(slices.DeleteFunc(slices.Clone(pins), match))
+}
+
+func (p *ProxyServer) serveAdminPin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpRespString(w, http.StatusMethodNotAllowed, "pin requires POST")
+		return
+	}
+	query := r.URL.Query()
+	pin := Pin{
+		Module:    query.Get("path"),
+		Version:   query.Get("version"),
+		NoRefresh: query.Get("norefresh") == "1",
+		Reason:    query.Get("reason"),
+	}
+	err := p.pin(pin)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	loggerYellow.Printf(requestTag(r.Context())+"serveAdminPin: Pinned %s %s"+LOG_RST, pin.Module, pin.Version)
+	httpRespString(w, http.StatusOK, "OK")
+}
+
+func (p *ProxyServer) serveAdminUnpin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpRespString(w, http.StatusMethodNotAllowed, "unpin requires POST")
+		return
+	}
+	modulePath, version := r.URL.Query().Get("path"), r.URL.Query().Get("version")
+	err := p.unpin(modulePath, version)
+	if err == errPinned {
+		httpRespString(w, http.StatusConflict, fmt.Sprintf("%s %s is pinned in the configuration", modulePath, version))
+		return
+	}
+	if err == os.ErrNotExist {
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("%s %s is not pinned", modulePath, version))
+		return
+	}
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	loggerYellow.Printf(requestTag(r.Context())+"serveAdminUnpin: Unpinned %s %s"+LOG_RST, modulePath, version)
+	httpRespString(w, http.StatusOK, "OK")
+}
@@ -0,0 +1,120 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+
+	"golang.org/x/mod/module"
+)
+
+// Body of refusals by policy if ModulePolicy.Message is empty
+const DefaultPolicyMessage = "{{.Module}}{{if .Version}}@{{.Version}}{{end}} is refused by policy: {{.Reason}}" +
+	"{{if .Contact}}\nContact {{.Contact}} if you need it{{end}}"
+
+// ModulePolicy restricts which modules are served, and shapes the responses of every refusal by
+// policy: denied modules, VulnPolicy blocks and scanner vetoes
+type ModulePolicy struct {
+	// Comma-separated glob patterns of module path prefixes (same syntax as GOPRIVATE) served
+	// exclusively, empty allows all modules
+	Allow string `json:",omitempty"`
+	// Patterns of module path prefixes refused even if allowed
+	Deny string `json:",omitempty"`
+	// Status of refusals, 403 (default) or 410. The go command tries the next proxy in GOPROXY on 410,
+	// but fails right away on 403. Scanners answering with their own status keep it
+	Status int `json:",omitempty"`
+	// text/template of the response body, given .Module, .Version (empty for @latest and @v/list),
+	// .Reason and .Contact. DefaultPolicyMessage if empty
+	Message string `json:",omitempty"`
+	// Where developers can ask about refusals, such as the URL of an exception process
+	Contact string `json:",omitempty"`
+}
+
+type policyRefusal struct {
+	Module  string
+	Version string
+	Reason  string
+	Contact string
+}
+
+// Check validates the policy
+func (m *ModulePolicy) Check() error {
+	if m.Status != 0 && m.Status != http.StatusForbidden && m.Status != http.StatusGone {
+		return errors.New(fmt.Sprintf("policy status must be %d or %d, not %d", http.StatusForbidden, http.StatusGone, m.Status))
+	}
+	_, err := m.template()
+	return err
+}
+
+func (m *ModulePolicy) template() (*template.Template, error) {
+	message := DefaultPolicyMessage
+	if m != nil && m.Message != "" {
+		message = m.Message
+	}
+	return template.New("policy").Parse(message)
+}
+
+// denied returns why modulePath may not be served, "" if it may
+func (m *ModulePolicy) denied(modulePath string) string {
+	if m.Allow != "" && !module.MatchPrefixPatterns(m.Allow, modulePath) {
+		return "module is not in the allow list"
+	}
+	if m.Deny != "" && module.MatchPrefixPatterns(m.Deny, modulePath) {
+		return "module is in the deny list"
+	}
+	return ""
+}
+
+// refusePolicy responds with the refusal of module@version by policy. A code of 0 uses the policy's status
+func (p *ProxyServer) refusePolicy(w http.ResponseWriter, modulePath, version, reason string, code int) {
+	refusal := policyRefusal{Module: modulePath, Version: version, Reason: reason}
+	if code == 0 {
+		code = http.StatusForbidden
+		if p.Policy != nil && p.Policy.Status != 0 {
+			code = p.Policy.Status
+		}
+	}
+	if p.Policy != nil {
+		refusal.Contact = p.Policy.Contact
+	}
+	body := strings.Builder{}
+	tmpl, err := p.Policy.template()
+	if err == nil {
+		err = tmpl.Execute(&body, refusal)
+	}
+	if err != nil {
+		body.Reset()
+		template.Must(template.New("policy").Parse(DefaultPolicyMessage)).Execute(&body, refusal)
+	}
+	httpRespString(w, code, body.String())
+}
+
+// checkPolicy refuses requests for modules denied by the ModulePolicy, or versions missing from
+// the SumAllowlist. It returns false if the request was answered, the response being already written
+func (p *ProxyServer) checkPolicy(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string) bool {
+	if p.Policy == nil && p.sumAllow == nil {
+		return true
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		// Reported when parsing the request
+		return true
+	}
+	reason := ""
+	if p.Policy != nil {
+		reason = p.Policy.denied(modulePath)
+	}
+	if reason == "" {
+		return p.sumAllow == nil || p.checkSumAllowlist(w, r, modulePath, prop)
+	}
+	version := ""
+	if ext := path.Ext(prop); ext != "" {
+		version, _ = module.UnescapeVersion(strings.TrimSuffix(prop, ext))
+	}
+	loggerYellow.Printf(requestTag(r.Context())+"checkPolicy: Refusing %s: %s"+LOG_RST, modulePath, reason)
+	p.refusePolicy(w, modulePath, version, reason, 0)
+	return false
+}
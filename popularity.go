@@ -0,0 +1,243 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Popularity of mirrors is saved in the cache, so that the schedule survives restarts
+const PopularityFile = ".popularity.json"
+
+// How fast requests of a mirror are forgotten, its popularity halves in PopularityHalfLife
+const PopularityHalfLife = 7 * 24 * time.Hour
+
+// Bounds of the refresh schedule: popular mirrors are updated at most every MinRefreshInterval,
+// mirrors not requested for DefaultRefreshIdle (unless RefreshIdle says otherwise) no more
+const (
+	MinRefreshInterval = 10 * time.Minute
+	DefaultRefreshIdle = 30 * 24 * time.Hour
+)
+
+// Mirrors due are checked this often, at most maxRefreshesPerTick of them queued at once so that
+// background updates don't crowd out interactive clones
+const (
+	refreshTick         = time.Minute
+	maxRefreshesPerTick = 20
+)
+
+type mirrorPopularity struct {
+	// Requests decayed by PopularityHalfLife, as of Updated
+	Score         float64
+	Updated       time.Time
+	LastRequested time.Time
+}
+
+type popularityState struct {
+	mu      sync.Mutex
+	Mirrors map[string]*mirrorPopularity
+	dirty   bool
+}
+
+// PopularityStatus is the popularity and refresh schedule of a mirror
+type PopularityStatus struct {
+	// Recent requests a day
+	RequestsPerDay  float64
+	LastRequested   time.Time
+	LastChecked     time.Time `json:",omitempty"`
+	RefreshInterval Duration  `json:",omitempty"`
+	// Not requested for RefreshIdle, thus not refreshed
+	Idle bool `json:",omitempty"`
+}
+
+// score returns the popularity decayed to now
+func (m *mirrorPopularity) score(now time.Time) float64 {
+	return m.Score * math.Exp2(-float64(now.Sub(m.Updated))/float64(PopularityHalfLife))
+}
+
+// requestsPerDay estimates the recent request rate from the decayed count, which settles at
+// rate * PopularityHalfLife / ln 2 for a steady rate
+func (m *mirrorPopularity) requestsPerDay(now time.Time) float64 {
+	return m.score(now) * math.Ln2 / (float64(PopularityHalfLife) / float64(24*time.Hour))
+}
+
+func (p *ProxyServer) refreshIdle() time.Duration {
+	if p.RefreshIdle <= 0 {
+		return DefaultRefreshIdle
+	}
+	return time.Duration(p.RefreshIdle)
+}
+
+// refreshInterval is how often the mirror is updated: RefreshInterval for one request a day,
+// proportionally more or less often with the request rate
+func (p *ProxyServer) refreshInterval(m *mirrorPopularity, now time.Time) time.Duration {
+	rate := m.requestsPerDay(now)
+	if rate <= 0 {
+		return p.refreshIdle()
+	}
+	interval := time.Duration(float64(p.RefreshInterval) / rate)
+	if interval < MinRefreshInterval {
+		return MinRefreshInterval
+	}
+	return min(interval, p.refreshIdle())
+}
+
+func (p *ProxyServer) loadPopularity() {
+	p.popularity.Mirrors = make(map[string]*mirrorPopularity)
+	data, err := os.ReadFile(p.cachePath(PopularityFile))
+	if err != nil {
+		return
+	}
+	var saved popularityState
+	if json.Unmarshal(data, &saved) == nil && saved.Mirrors != nil {
+		p.popularity.Mirrors = saved.Mirrors
+	}
+}
+
+func (p *ProxyServer) savePopularity() {
+	p.popularity.mu.Lock()
+	if !p.popularity.dirty {
+		p.popularity.mu.Unlock()
+		return
+	}
+	data, _ := json.Marshal(&p.popularity)
+	p.popularity.dirty = false
+	p.popularity.mu.Unlock()
+	tmp := fmt.Sprintf("%s.%d", p.cachePath(PopularityFile), os.Getpid())
+	err := os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, p.cachePath(PopularityFile))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		loggerYellow.Printf("savePopularity: Failed to save popularity of mirrors: %s"+LOG_RST, err.Error())
+	}
+}
+
+// countRequest counts a request of the GOPROXY endpoints towards the popularity of the mirror
+// serving the module, if there's one
+func (p *ProxyServer) countRequest(r *http.Request) {
+	if p.RefreshInterval <= 0 {
+		return
+	}
+	escapedModulePath, _, ok := strings.Cut(r.URL.Path, "/@")
+	if !ok {
+		return
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return
+	}
+	parentPath, _, vcs, err := p.checkModVcsLocal(modulePath)
+	if err != nil || vcs != ".git" {
+		return
+	}
+	owner := p.mirrorOwner(parentPath)
+	now := time.Now()
+	p.popularity.mu.Lock()
+	defer p.popularity.mu.Unlock()
+	m, ok := p.popularity.Mirrors[owner]
+	if !ok {
+		m = &mirrorPopularity{}
+		p.popularity.Mirrors[owner] = m
+	}
+	m.Score, m.Updated, m.LastRequested = m.score(now)+1, now, now
+	p.popularity.dirty = true
+}
+
+// refresher updates mirrors in the background as often as they're requested: popular mirrors
+// every few minutes, rarely requested ones every few days, and mirrors not requested for
+// RefreshIdle not at all. In a cluster, only the leader does, as far as it knows of requests
+func (p *ProxyServer) refresher() {
+	ticker := time.NewTicker(refreshTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !p.isLeader() {
+			continue
+		}
+		p.savePopularity()
+		if p.frozen() {
+			continue
+		}
+		now := time.Now()
+		type due struct {
+			mirror   string
+			interval time.Duration
+			overdue  float64
+		}
+		var candidates, mirrors []due
+		p.popularity.mu.Lock()
+		for mirror, m := range p.popularity.Mirrors {
+			if now.Sub(m.LastRequested) > p.refreshIdle() {
+				if now.Sub(m.LastRequested) > 2*p.refreshIdle() {
+					// Long forgotten, purged or never to be requested again
+					delete(p.popularity.Mirrors, mirror)
+					p.popularity.dirty = true
+				}
+				continue
+			}
+			candidates = append(candidates, due{mirror: mirror, interval: p.refreshInterval(m, now)})
+		}
+		p.popularity.mu.Unlock()
+		for _, d := range candidates {
+			age := mirrorAge(p.cachePath(path.Join(d.mirror, ".git")))
+			if age > d.interval {
+				d.overdue = float64(age) / float64(d.interval)
+				mirrors = append(mirrors, d)
+			}
+		}
+		// The most overdue first
+		sort.Slice(mirrors, func(i, k int) bool {
+			return mirrors[i].overdue > mirrors[k].overdue
+		})
+		queued := 0
+		for _, d := range mirrors {
+			if queued == maxRefreshesPerTick {
+				break
+			}
+			if _, running := p.pendingGit.Load(d.mirror); running {
+				continue
+			}
+			if _, err := os.Stat(p.cachePath(path.Join(d.mirror, ".git"))); err != nil {
+				continue
+			}
+			loggerGreen.Printf("refresher: Updating %s"+LOG_RST, d.mirror)
+			p.metrics.ScheduledRefreshes.Add(1)
+			p.queueGitJob(p.withCacheDir(context.Background()), d.mirror, "", "", clonePriorityBackground)
+			queued++
+		}
+	}
+}
+
+// popularityReport returns the popularity and refresh schedule of every mirror requested
+func (p *ProxyServer) popularityReport() map[string]PopularityStatus {
+	report := make(map[string]PopularityStatus)
+	now := time.Now()
+	p.popularity.mu.Lock()
+	defer p.popularity.mu.Unlock()
+	for mirror, m := range p.popularity.Mirrors {
+		status := PopularityStatus{
+			RequestsPerDay: m.requestsPerDay(now),
+			LastRequested:  m.LastRequested,
+			Idle:           now.Sub(m.LastRequested) > p.refreshIdle(),
+		}
+		if !status.Idle {
+			status.RefreshInterval = Duration(p.refreshInterval(m, now))
+		}
+		if age := mirrorAge(p.cachePath(path.Join(mirror, ".git"))); age != math.MaxInt64 {
+			status.LastChecked = now.Add(-age)
+		}
+		report[mirror] = status
+	}
+	return report
+}
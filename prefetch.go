@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+
+	"golang.org/x/mod/module"
+)
+
+// PrefetchReport answers a prefetch request
+type PrefetchReport struct {
+	// Versions already cached
+	Cached int
+	// Versions queued for fetching
+	Queued int
+	// Versions not prefetched, <module>@<version> to the reason
+	Refused map[string]string `json:",omitempty"`
+	// Versions still not cached once their job is done, when waited for (see the log)
+	Failed []string `json:",omitempty"`
+}
+
+// checkPrefetch tells why the version can't be prefetched, if it can't
+func (p *ProxyServer) checkPrefetch(v module.Version) error {
+	err := module.Check(v.Path, v.Version)
+	if err != nil {
+		return err
+	}
+	if module.CanonicalVersion(v.Version) != v.Version {
+		return errors.New("not a canonical version")
+	}
+	if p.Policy != nil {
+		if reason := p.Policy.denied(v.Path); reason != "" {
+			return errors.New("refused by policy: " + reason)
+		}
+	}
+	if isToolchain(v.Path) {
+		return errors.New("toolchains are fetched when requested")
+	}
+	if p.frozen() {
+		return errFrozen
+	}
+	return nil
+}
+
+// Prefetch fetches the module versions that aren't cached into the cache, as bulk jobs, and waits
+// for them. Versions failing to be fetched are reported as Failed
+func (p *ProxyServer) Prefetch(ctx context.Context, versions []module.Version) PrefetchReport {
+	p.initOnce.Do(p.init)
+	return p.prefetch(p.withCacheDir(ctx), versions, true)
+}
+
+// prefetch queues fetching the versions that aren't cached as bulk jobs, waiting for them if wait
+// is set
+func (p *ProxyServer) prefetch(ctx context.Context, versions []module.Version, wait bool) PrefetchReport {
+	report := PrefetchReport{Refused: make(map[string]string)}
+	var valid, queued []module.Version
+	var jobs []<-chan struct{}
+	for _, v := range versions {
+		err := p.checkPrefetch(v)
+		if err != nil {
+			report.Refused[v.String()] = err.Error()
+			continue
+		}
+		valid = append(valid, v)
+	}
+	for _, info := range p.batchInfos(ctx, valid) {
+		if info.Cached {
+			report.Cached++
+			continue
+		}
+		v := module.Version{Path: info.Module, Version: info.Version}
+		escapedModulePath, err := module.EscapePath(v.Path)
+		if err != nil {
+			report.Refused[v.String()] = err.Error()
+			continue
+		}
+		escapedVersion, err := module.EscapeVersion(v.Version)
+		if err != nil {
+			report.Refused[v.String()] = err.Error()
+			continue
+		}
+		// Not the key of client requests, which would wait on this then, rather than promote the job
+		key := path.Join("prefetch", escapedModulePath, "@v", escapedVersion)
+		done, err := p.processEsModPathVer(ctx, key, escapedModulePath, escapedVersion, clonePriorityBulk)
+		if err != nil {
+			report.Refused[v.String()] = err.Error()
+			continue
+		}
+		report.Queued++
+		queued = append(queued, v)
+		jobs = append(jobs, done)
+	}
+	if !wait {
+		return report
+	}
+	for _, done := range jobs {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+	for _, info := range p.batchInfos(ctx, queued) {
+		if !info.Cached {
+			report.Failed = append(report.Failed, module.Version{Path: info.Module, Version: info.Version}.String())
+		}
+	}
+	return report
+}
+
+// serveAdminPrefetch queues fetching the module versions listed in the body (as for the batch
+// .info) that aren't cached, as bulk jobs, without waiting for them. Clients later requesting a
+// version still being fetched get its job ahead of the queue as usual
+func (p *ProxyServer) serveAdminPrefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpRespString(w, http.StatusMethodNotAllowed, "prefetch requires POST")
+		return
+	}
+	if p.frozen() {
+		httpRespString(w, http.StatusForbidden, errFrozen.Error())
+		return
+	}
+	versions, ok := readBatchRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.localTimeout())
+	defer cancel()
+	report := p.prefetch(ctx, versions, false)
+	loggerGreen.Printf(requestTag(r.Context())+"serveAdminPrefetch: %d cached, %d queued, %d refused"+LOG_RST,
+		report.Cached, report.Queued, len(report.Refused))
+	httpRespJSON(w, http.StatusOK, report)
+}
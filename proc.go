@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 
 	"golang.org/x/sys/unix"
@@ -17,13 +18,25 @@ const GitCommand = "git"
 
 func getGitCmd(ctx context.Context, wkdir string, args ...string) *exec.Cmd {
 	cmd := exec.CommandContext(ctx, GitCommand, args...)
-	cmd.Dir = wkdir
+	cmd.Dir = inCacheDir(ctx, wkdir)
+	if gitReadOnly(args) {
+		sandboxCmd(cmd, cacheDirOf(ctx), true)
+	} else {
+		trustCABundle(ctx, cmd)
+		limitCmd(cmd)
+	}
 	return cmd
 }
 
 func getGitOutputCmd(ctx context.Context, wkdir string, args ...string) (*exec.Cmd, io.ReadCloser, error) {
 	cmd := exec.CommandContext(ctx, GitCommand, args...)
-	cmd.Dir = wkdir
+	cmd.Dir = inCacheDir(ctx, wkdir)
+	if gitReadOnly(args) {
+		sandboxCmd(cmd, cacheDirOf(ctx), true)
+	} else {
+		trustCABundle(ctx, cmd)
+		limitCmd(cmd)
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, nil, err
@@ -36,19 +49,81 @@ func getGitOutputCmd(ctx context.Context, wkdir string, args ...string) (*exec.C
 	return cmd, stdout, nil
 }
 
-func runGitOutputShort(ctx context.Context, wkdir string, args ...string) (string, error) {
-	cmd, stdout, err := getGitOutputCmd(ctx, wkdir, args...)
-	if err != nil {
-		return "", err
+// GitError carries the stderr of a failed git command, so the failure can be classified
+type GitError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *GitError) Error() string {
+	if e.Stderr == "" {
+		return e.Err.Error()
 	}
-	defer stdout.Close()
-	sb := strings.Builder{}
-	io.Copy(&sb, stdout)
-	err = cmd.Wait()
+	return fmt.Sprintf("%s: %s", e.Err.Error(), e.Stderr)
+}
+
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// Stderr patterns of git indicating the object store of the repository is corrupted, as opposed
+// to the requested revision not existing or the repository being moved or purged meanwhile.
+// Mirrors are only healed once a full git fsck confirms, see healMirror
+var gitCorruptionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(loose|packed) object [0-9a-f]+ \(stored in .*\) is corrupt`),
+	regexp.MustCompile(`inflate: data stream error`),
+	regexp.MustCompile(`packfile .* (cannot be accessed|does not match index)`),
+}
+
+// Stderr patterns of git indicating the requested revision doesn't exist, or the repository is empty
+var gitNotFoundPatterns = []string{
+	"unknown revision",
+	"bad revision",
+	"Needed a single revision",
+	"not a valid object name",
+	"invalid object name",
+	"not a tree object",
+	"couldn't find remote ref",
+	"does not have any commits yet",
+}
+
+func isGitNotFound(err error) bool {
+	var gitErr *GitError
+	if !errors.As(err, &gitErr) || isGitCorruption(err) {
+		return false
+	}
+	for _, pattern := range gitNotFoundPatterns {
+		if strings.Contains(gitErr.Stderr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func isGitCorruption(err error) bool {
+	var gitErr *GitError
+	if !errors.As(err, &gitErr) {
+		return false
+	}
+	for _, pattern := range gitCorruptionPatterns {
+		if pattern.MatchString(gitErr.Stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+func runGitOutputShort(ctx context.Context, wkdir string, args ...string) (string, error) {
+	cmd := getGitCmd(ctx, wkdir, args...)
+	stdout := strings.Builder{}
+	stderr := strings.Builder{}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
 	if err != nil {
-		return "", err
+		return "", &GitError{Err: err, Stderr: strings.TrimSpace(stderr.String())}
 	}
-	return sb.String(), nil
+	return stdout.String(), nil
 }
 
 func createUnnamedTmpFile(dir string, perm uint32) (*os.File, error) {
@@ -59,7 +134,16 @@ func createUnnamedTmpFile(dir string, perm uint32) (*os.File, error) {
 	return os.NewFile(uintptr(fd), ""), nil
 }
 
-func collectGitArchiveOpts(gitdir, prefix, treeish, vertag string) ([]string, bool, error) {
+// gitArchiveArgs are the arguments of git archive. Mirrors are bare, thus with --worktree-attributes
+// git only reads the attributes of the mirror itself, not the .gitattributes of the archived tree
+func gitArchiveArgs(ignoreAttributes bool, args ...string) []string {
+	if ignoreAttributes {
+		return append([]string{"archive", "--worktree-attributes"}, args...)
+	}
+	return append([]string{"archive"}, args...)
+}
+
+func collectGitArchiveOpts(ctx context.Context, gitdir, prefix, treeish, vertag string, ignoreAttributes bool) ([]string, bool, error) {
 	vendorExcludes := []string{
 		// Upstream proxy doesn't fully respect https://go.dev/ref/mod#zip-path-size-constraints
 		// It'll serve sigs.k8s.io/kubernetes@1.26.8.zip/vendor/modules.txt|OWNERS
@@ -68,8 +152,8 @@ func collectGitArchiveOpts(gitdir, prefix, treeish, vertag string) ([]string, bo
 		":(exclude)vendor/*/**",
 		":(exclude,top)**/vendor/*",
 	}
-	cmd, out, err := getGitOutputCmd(context.Background(), gitdir,
-		append([]string{"archive", "--format=tar", treeish}, vendorExcludes...)...)
+	cmd, out, err := getGitOutputCmd(ctx, gitdir,
+		append(gitArchiveArgs(ignoreAttributes, "--format=tar", treeish), vendorExcludes...)...)
 	if err != nil {
 		return nil, false, errors.New(fmt.Sprintf("failed to start git archive (first pass): %s", err.Error()))
 	}
@@ -95,7 +179,7 @@ func collectGitArchiveOpts(gitdir, prefix, treeish, vertag string) ([]string, bo
 		case tar.TypeDir:
 			continue
 		default:
-			loggerYellow.Printf("collectGitArchiveOpts: ignoring %s for %s"+LOG_RST, hdr.Name, prefix)
+			loggerYellow.Printf(requestTag(ctx)+"collectGitArchiveOpts: ignoring %s for %s"+LOG_RST, hdr.Name, prefix)
 			filteredPaths = append(filteredPaths, hdr.Name)
 			//cmdArgs = append(cmdArgs,
 			//	fmt.Sprintf(":(exclude,top)%s", hdr.Name))
@@ -128,9 +212,7 @@ func collectGitArchiveOpts(gitdir, prefix, treeish, vertag string) ([]string, bo
 		}
 		treeish += vertag
 	}
-	cmdArgs := []string{
-		"archive", "--prefix", prefix, "--format=zip", "-0", treeish,
-	}
+	cmdArgs := gitArchiveArgs(ignoreAttributes, "--prefix", prefix, "--format=zip", "-0", treeish)
 	cmdArgs = append(cmdArgs, vendorExcludes...)
 	for _, path := range filteredPaths {
 		if !useVersionedDir {
@@ -2,14 +2,20 @@ package goproxy
 
 import (
 	"context"
+	"crypto/x509"
+	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	modzip "golang.org/x/mod/zip"
 )
 
 const UpstreamProxyScheme = "https"
@@ -19,36 +25,376 @@ const UpstreamProxyTimeout = 10 * time.Second
 const DirectConnectTimeout = 10 * time.Second
 const GitCloneTimeout = 20 * time.Minute
 const GitLocalTimeout = 5 * time.Minute
+const ClientStallTimeout = 1 * time.Minute
 
 type ProxyServer struct {
-	Prefix          string
+	Prefix string
+	// Cache directory, the working directory of the process if empty. See NewProxyServer
+	Dir string
+	// Base URL of the upstream proxy, UpstreamProxy if empty
+	Upstream string
+	// Keep generated module zips zstd-compressed in .archives and reconstitute them on demand
+	CompressArchives bool
+	// Size limit in bytes of the in-memory cache for .info/.mod responses, and @v/list answered from
+	// mirrors until they're updated. 0 disables it
+	MetadataCacheSize int64
+	// Interval between rolling integrity checks of mirrors and stored archives, 0 disables them
+	IntegrityCheckInterval Duration
+	// Per module pattern clone options, the first match wins
+	CloneOverrides []CloneOverride
+	// PEM encoded PKCS#8 ed25519 key signing served zips and their provenance
+	SigningKey string
+	// Commands scanning every generated zip before it is served or stored, see CommandScanner
+	ScanCommands [][]string
+	// Scanners in addition to ScanCommands, for programs embedding the server
+	Scanners []Scanner `json:"-"`
+	// Backend keeping the artifacts and metadata of the cache, for programs embedding the server.
+	// nil uses FileStorage in the cache directory
+	Storage Storage `json:"-"`
+	// Check served versions against the OSV database, nil disables
+	Vulns *VulnPolicy `json:",omitempty"`
+	// Modules allowed and denied, and the responses of refusals by policy, nil serves all modules
+	Policy *ModulePolicy `json:",omitempty"`
+	// Per module sources, consulted before upstream and go-import discovery
+	SourceOverrides []SourceOverride
+	// Per host internal mirrors to clone and update from
+	ForgeMirrors []ForgeMirror
+	// git credential helpers authenticating clones and updates
+	CredentialHelpers CredentialHelpers
+	// Directories holding local bare repos (such as the output of an internal build system) that
+	// go-import and upstream may point at, as absolute paths or file:// URLs. Local remotes in the
+	// configuration are always allowed
+	LocalRemoteDirs []string
+	// Per module pattern tag naming conventions, the first match wins
+	TagRules []TagRule
+	// Add X-Go-Module-Deprecated to responses of modules whose latest go.mod seen is deprecated
+	DeprecationHeader bool
+	// Abort zip responses when the client accepts no data for this long, 0 uses ClientStallTimeout
+	StallTimeout Duration
+	// Wait for fetches to finish and serve from the cache instead of redirecting to upstream.
+	// Regardless of this, <prefix>/sync/ and ?sync=1 always wait
+	SyncFetch bool
+	// Timeout of git/zip/zstd commands working on the local cache (archiving, metadata, checks),
+	// 0 uses GitLocalTimeout
+	LocalTimeout Duration
+	// Become a child subreaper and periodically kill helpers that outlived their command.
+	// Only for processes where the proxy owns all children
+	ReapOrphans bool
+	// Generate module zips and go.mod ignoring the .gitattributes of repos (export-ignore, ident,
+	// text/eol conversions), so that they only depend on the committed content. export-subst is
+	// never expanded, as trees rather than commits are archived
+	IgnoreGitAttributes bool
+	// Abort generating module zips larger than this many bytes, 0 uses modzip.MaxZipFile, the limit
+	// of the go command. Zips are stored uncompressed, thus this also bounds the extracted size
+	MaxZipSize int64
+	// Stop calling the upstream proxy for this long once most recent calls failed, then probe it
+	// with a single call. Meanwhile, modules are discovered directly and served from the cache.
+	// 0 disables the breaker
+	UpstreamBreakerCooldown Duration
+	// Limit in bytes per second of .info/.mod/.zip responses, all together. Unlimited if 0
+	ServeRateLimit int64
+	// Limit in bytes per second of what clones and updates of mirrors receive, all together. Only
+	// http(s) remotes are limited, through a proxy on the loopback interface. Unlimited if 0
+	CloneRateLimit int64
+	// Read-only GOMODCACHE (or its cache/download directory) whose artifacts are served as they are,
+	// such as the populated cache of a CI runner
+	ModCacheDir string
+	// Also keep the artifacts served from mirrors in this directory, in the GOPROXY layout
+	// (<module>/@v/list, .info, .mod, .zip), usable as a file:// GOPROXY or by a static web server
+	LayoutDir string
+	// Record the responses of the GOPROXY endpoints into this directory, for ReplayDir. What would
+	// be redirected to upstream is fetched and served instead, so that it's recorded too
+	RecordDir string
+	// Serve only the responses recorded into this directory, for hermetic CI runs. Nothing is
+	// fetched, cloned or generated, and the admin endpoints aren't served
+	ReplayDir string
+	// Cache-Control headers per endpoint, for CDNs and caches in front of the proxy
+	CacheControl CacheControl
+	// Sibling proxies (their URL including Prefix) asked for artifacts of modules without a local
+	// mirror, before going upstream or cloning. They are trusted like the upstream proxy
+	Peers []string
+	// Share the cache volume with other instances, nil if this instance has it for itself
+	Cluster *Cluster `json:",omitempty"`
+	// Standby instance (its URL including Prefix) newly cloned or updated mirrors and stored archives
+	// are pushed to in the background, so it's warm for failover
+	Standby string
+	// Shared secret of replication. A primary sends it to Standby, a standby accepts pushes with it
+	ReplicationToken string
+	// Admin requests changing the state of the cache (purge, refresh, freeze, pins, snapshots,
+	// prefetch), over HTTP or gRPC, must carry this token as "Authorization: Bearer <token>".
+	// Empty refuses them all
+	AdminToken string
+	// Mirrors last updated longer than this ago are updated in the background when @latest or a
+	// branch is queried, while the answer is served from the mirror right away. In pass-through
+	// mode, @latest of mirrored modules is then also served instead of redirected. 0 disables
+	StaleWhileRevalidate Duration
+	// Mirrors last updated longer than this ago are updated before @latest or a branch is
+	// answered from them, the client waiting, so that answers are never older than this. It
+	// takes precedence over StaleWhileRevalidate for such mirrors. 0 disables
+	MetadataMaxAge Duration
+	// Resolution of go-import hosts and http(s) git remotes: a DNS server, static hosts and
+	// caching. nil leaves it to the system, uncached
+	Resolver *Resolver `json:",omitempty"`
+	// In cached-only mode, fetch versions of locally sourced modules from the upstream proxy when
+	// generating them fails (or the mirror lacks them), instead of failing the request
+	CachedOnlyFallback bool
+	// Interval between checks of a module version served from mirrors, sampled at random, against
+	// the checksum database, 0 disables them
+	SumDBCheckInterval Duration
+	// Base URL of the checksum database, SumDBURL if empty
+	SumDB string
+	// Where alerts (repeated clone failures, checksum and timestamp mismatches) are sent, nil
+	// only logs them
+	Alerts *Alerting `json:",omitempty"`
+	// Client addresses allowed and denied, nil serves all clients
+	Clients *ClientAccess `json:",omitempty"`
+	// CIDRs (or single addresses) of load balancers and reverse proxies whose Forwarded or
+	// X-Forwarded-For headers name the client, for logs and ClientAccess. Headers of other peers
+	// are ignored
+	TrustedProxies []string
+	// PEM file of root CAs trusted in addition to the system ones for outbound TLS (such as a
+	// corporate TLS inspection proxy or an internal PKI): upstream, go-import discovery and git
+	// remotes over HTTPS
+	CABundle string
+	// Per host routes of outbound connections (direct, HTTP or SOCKS5 proxy), the first match
+	// wins. Other hosts go through the proxy of the environment
+	Egress EgressRules
+	// Per identity limits of the module endpoints, nil leaves them unlimited
+	Quotas *Quotas `json:",omitempty"`
+	// Update mirrors in the background, as often as this for a mirror requested once a day and
+	// proportionally more or less often with their recent requests. 0 disables it
+	RefreshInterval Duration
+	// Mirrors not requested for this long aren't refreshed in the background, 0 uses
+	// DefaultRefreshIdle
+	RefreshIdle Duration
+	// Modules (or versions) never purged, and optionally never updated. More can be pinned
+	// through the admin API
+	Pins Pins
+	// Serve only what's already cached and refuse to cache anything new (403), such as during
+	// release stabilization. The cache can also be frozen through the admin API
+	Freeze bool
+	// Why the cache is frozen, included in refusals
+	FreezeReason string
+	// go.sum files whose module versions are the only ones served, the zips and go.mod served
+	// from the cache matching their hashes. Others are refused with 403. Empty serves all
+	SumAllowlist []string
+
 	initOnce        sync.Once
+	prefixOnce      sync.Once
 	pendingMod      sync.Map
 	pendingGit      sync.Map
-	gitClones       chan string
+	gitClones       cloneQueue
 	gitCloneWorkers atomic.Int64
+	jobsSuspended   atomic.Bool
 	mux             *http.ServeMux
+	metaCache       *lruCache
+	metrics         proxyMetrics
+	integrity       integrityState
+	sumCheck        sumCheckState
+	quota           quotaState
+	popularity      popularityState
+	pinned          pinState
+	snapshots       snapshotState
+	alerts          alertState
+	clientACL       *clientACL
+	trustedProxies  []netip.Prefix
+	sumAllow        *sumAllowlist
+	mirrors         *mirrorIndex
+	// Shared lock of the cache directory, held until exit
+	cacheLock *fileLock
+	vcsIndex  *vcsIndex
+	// Registered with RegisterVCSBackend, by the .vcs link name
+	vcsBackends     map[string]VCSBackend
+	deprecations    deprecationState
+	root            *cacheRoot
+	modCache        *cacheRoot
+	layout          *cacheRoot
+	layoutMu        sync.Mutex
+	peerStore       *cacheRoot
+	upstreamStore   *cacheRoot
+	toolchainStore  *cacheRoot
+	toolchainFetch  sync.Map
+	record          *cacheRoot
+	replay          *cacheRoot
+	serveLimiter    *rateLimiter
+	upstreamBreaker *circuitBreaker
+	remoteProxy     *remoteProxy
+	dns             *dnsCache
+	upstreamClient  *http.Client
+	goGetClient     *http.Client
+	caBundlePath    string
+	signer          *signer
+	osv             osvState
+	leaderLock      LeaderLock
+	leader          atomic.Bool
+	steppedDown     atomic.Bool
+	replication     replicationState
 }
 
 func (p *ProxyServer) init() {
 	numCpus := runtime.NumCPU()
 	p.gitCloneWorkers.Store(int64(numCpus))
-	p.gitClones = make(chan string, numCpus)
-	p.mux = http.NewServeMux()
-	if !strings.HasSuffix(p.Prefix, "/") {
-		p.Prefix += "/"
-	}
-	p.mux.Handle(p.Prefix,
-		http.StripPrefix(p.Prefix, http.HandlerFunc(p.monitorModFetch)))
-	p.mux.Handle(p.Prefix+"cached-only/",
-		http.StripPrefix(p.Prefix+"cached-only/", http.HandlerFunc(p.serveModCached)))
-	os.MkdirAll(".gittemplate", 0700)
-	os.MkdirAll(".tmp", 0700)
-	os.Symlink("/dev/fd/3", ".tmp/zip-fd3.zip")
+	p.gitClones.init(numCpus)
+	p.metaCache = newLRUCache(p.MetadataCacheSize)
+	root, err := openCacheRoot(p.cachePath("."))
+	if err != nil {
+		log.Panicf("Failed to open cache root: %s", err.Error())
+	}
+	p.root = root
+	if p.Storage == nil {
+		p.Storage = &FileStorage{Dir: p.cachePath("."), root: root}
+	}
+	if p.ModCacheDir != "" {
+		p.modCache, err = openModCache(p.ModCacheDir)
+		if err != nil {
+			log.Panicf("Failed to open module cache %s: %s", p.ModCacheDir, err.Error())
+		}
+	}
+	for _, command := range p.ScanCommands {
+		p.Scanners = append(p.Scanners, &CommandScanner{Command: command})
+	}
+	if p.SigningKey != "" {
+		p.signer, err = loadSigningKey(p.SigningKey)
+		if err != nil {
+			log.Panicf("Failed to load signing key %s: %s", p.SigningKey, err.Error())
+		}
+	}
+	if p.LayoutDir != "" {
+		p.layout, err = openLayout(p.LayoutDir)
+		if err != nil {
+			log.Panicf("Failed to open layout directory %s: %s", p.LayoutDir, err.Error())
+		}
+	}
+	if len(p.Peers) != 0 {
+		p.peerStore, err = openStore(p.cachePath(PeerStoreDir))
+		if err != nil {
+			log.Panicf("Failed to open peer store: %s", err.Error())
+		}
+	}
+	if p.RecordDir != "" && p.ReplayDir != "" {
+		log.Panicf("Cannot record and replay at once")
+	}
+	if p.RecordDir != "" {
+		p.record, err = openStore(p.RecordDir)
+		if err != nil {
+			log.Panicf("Failed to open recording directory %s: %s", p.RecordDir, err.Error())
+		}
+	}
+	if p.ReplayDir != "" {
+		p.replay, err = openCacheRoot(p.ReplayDir)
+		if err != nil {
+			log.Panicf("Failed to open replay directory %s: %s", p.ReplayDir, err.Error())
+		}
+	}
+	p.toolchainStore, err = openStore(p.cachePath(ToolchainStoreDir))
+	if err != nil {
+		log.Panicf("Failed to open toolchain store: %s", err.Error())
+	}
+	if p.CachedOnlyFallback {
+		p.upstreamStore, err = openStore(p.cachePath(UpstreamStoreDir))
+		if err != nil {
+			log.Panicf("Failed to open upstream store: %s", err.Error())
+		}
+	}
+	p.clientACL, err = p.Clients.compile()
+	if err != nil {
+		log.Panicf("Failed to parse client access lists: %s", err.Error())
+	}
+	if len(p.SumAllowlist) != 0 {
+		p.sumAllow, err = newSumAllowlist(p.SumAllowlist)
+		if err != nil {
+			log.Panicf("Failed to load the go.sum allowlist: %s", err.Error())
+		}
+	}
+	p.trustedProxies, err = parsePrefixes(p.TrustedProxies)
+	if err != nil {
+		log.Panicf("Failed to parse trusted proxies: %s", err.Error())
+	}
+	p.serveLimiter = newRateLimiter(p.ServeRateLimit)
+	p.upstreamBreaker = newCircuitBreaker(time.Duration(p.UpstreamBreakerCooldown), &p.metrics)
+	p.dns = newDNSCache(p.Resolver)
+	p.upstreamClient = upstreamClient
+	var roots *x509.CertPool
+	if p.CABundle != "" {
+		roots, err = p.setupCABundle()
+		if err != nil {
+			log.Panicf("Failed to load CA bundle %s: %s", p.CABundle, err.Error())
+		}
+	}
+	if roots != nil || len(p.Egress) != 0 {
+		p.upstreamClient = newUpstreamClient(nil, roots, p.Egress)
+	}
+	p.goGetClient = p.upstreamClient
+	if p.dns != nil {
+		p.goGetClient = newUpstreamClient(p.dns, roots, p.Egress)
+	}
+	if p.CloneRateLimit > 0 || p.dns != nil || len(p.Egress) != 0 {
+		p.remoteProxy, err = startRemoteProxy(newRateLimiter(p.CloneRateLimit), p.dns, p.Egress)
+		if err != nil {
+			log.Panicf("Failed to start remote proxy: %s", err.Error())
+		}
+	}
+	os.MkdirAll(p.cachePath(".gittemplate"), 0700)
+	os.MkdirAll(p.cachePath(".tmp"), 0700)
+	os.Symlink("/dev/fd/3", p.cachePath(".tmp/zip-fd3.zip"))
+	p.mirrors = p.loadMirrorIndex()
+	p.integrity.results = make(map[string]IntegrityStatus)
+	if p.Cluster != nil {
+		p.leaderLock, err = p.Cluster.leaderLock(p.Dir)
+		if err != nil {
+			log.Panicf("Failed to set up leader election: %s", err.Error())
+		}
+		go p.elect()
+	}
+	if p.IntegrityCheckInterval > 0 {
+		go p.integrityChecker()
+	}
+	p.startAlerts()
+	p.startQuotas()
+	p.sumCheck.results = make(map[string]SumCheckStatus)
+	if p.SumDBCheckInterval > 0 {
+		go p.sumChecker()
+	}
+	if p.RefreshInterval > 0 {
+		p.loadPopularity()
+		go p.refresher()
+	}
+	if p.ReapOrphans {
+		go p.reaper()
+	}
+	p.lockCache(p.cleanStaleState)
+	p.vcsIndex = p.buildVcsIndex()
+	p.resumeCloneJobs()
+}
+
+func (p *ProxyServer) localTimeout() time.Duration {
+	if p.LocalTimeout <= 0 {
+		return GitLocalTimeout
+	}
+	return time.Duration(p.LocalTimeout)
+}
+
+func (p *ProxyServer) maxZipSize() int64 {
+	if p.MaxZipSize <= 0 || p.MaxZipSize > modzip.MaxZipFile {
+		return modzip.MaxZipFile
+	}
+	return p.MaxZipSize
+}
+
+func (p *ProxyServer) stallTimeout() time.Duration {
+	if p.StallTimeout <= 0 {
+		return ClientStallTimeout
+	}
+	return time.Duration(p.StallTimeout)
 }
 
+// ServeHTTP serves Handler beneath Prefix
 func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.initOnce.Do(p.init)
+	p.prefixOnce.Do(func() {
+		prefix := strings.TrimSuffix(p.Prefix, "/")
+		p.mux = http.NewServeMux()
+		p.mux.Handle(prefix+"/", http.StripPrefix(prefix, p.Handler()))
+	})
 	p.mux.ServeHTTP(w, r)
 }
 
@@ -58,23 +404,84 @@ func (p *ProxyServer) tryServeCached(w http.ResponseWriter, modulePath, verSuffi
 	return false
 }
 
+// checkModVcsLocal finds the cached module covering modulePath, returning its path, the path of
+// modulePath in it and its VCS (.git or .mod)
 func (p *ProxyServer) checkModVcsLocal(modulePath string) (string, string, string, error) {
+	parentPath, subPath, entry, ok := p.vcsIndex.lookup(modulePath)
+	target := entry.vcs
+	if !ok {
+		parentPath, target, ok = p.readVcsLink(modulePath)
+		if !ok {
+			return "", "", "", os.ErrNotExist
+		}
+		subPath = strings.TrimPrefix(strings.TrimPrefix(modulePath, parentPath), "/")
+		p.vcsIndex.set(parentPath, vcsEntry{vcs: target, owner: p.readMirrorOwner(parentPath)})
+	}
+	// The mirror itself (or the mirror shared by an alias) must be in the cache as well
+	err := p.root.beneath(path.Join(parentPath, target))
+	if err != nil {
+		if _, lerr := p.root.readlink(path.Join(parentPath, ".vcs")); lerr != nil {
+			// Removed by someone else, such as another node of the cluster
+			p.vcsIndex.remove(parentPath)
+		}
+		return "", "", "", err
+	}
+	return parentPath, subPath, target, nil
+}
+
+// readVcsLink finds the cached module covering modulePath on the file system
+func (p *ProxyServer) readVcsLink(modulePath string) (string, string, bool) {
 	sep := len(modulePath)
-	subPath := ""
 	// Start with longest path first
 	// Reason: golang.zx2c4.com/wireguard and golang.zx2c4.com/wireguard/wgctrl
 	// Are all valid projects and backed by different repo
 	for {
 		parentPath := modulePath[:sep]
-		vcsdir := path.Join(parentPath, ".vcs")
-		target, err := os.Readlink(vcsdir)
+		target, err := p.root.readlink(path.Join(parentPath, ".vcs"))
 		if err == nil {
-			return parentPath, subPath, target, nil
+			return parentPath, target, true
 		}
 		sep = strings.LastIndexByte(parentPath, '/')
 		if sep == -1 {
-			return "", "", "", os.ErrNotExist
+			return "", "", false
+		}
+	}
+}
+
+// walkLocalMirrors calls fn for every local mirror of the cache at dir ("" for the working
+// directory), including nested ones
+func walkLocalMirrors(dir string, fn func(modulePath, vcs string)) {
+	walkVcsLinks(dir, func(modulePath, vcs string) {
+		// Skip aliases sharing the mirror of another module path
+		_, err := os.Readlink(filepath.Join(dir, modulePath, vcs))
+		if err != nil {
+			fn(modulePath, vcs)
 		}
-		subPath = modulePath[sep+1:]
+	})
+}
+
+// walkVcsLinks calls fn for every module of the cache at dir ("" for the working directory) with
+// the target of its .vcs link, including aliases
+func walkVcsLinks(dir string, fn func(modulePath, vcs string)) {
+	if dir == "" {
+		dir = "."
 	}
+	filepath.WalkDir(dir, func(name string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		modulePath, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil
+		}
+		if modulePath != "." && strings.HasPrefix(d.Name(), ".") {
+			// .git, .tmp, .gittemplate etc.
+			return filepath.SkipDir
+		}
+		target, err := os.Readlink(path.Join(name, ".vcs"))
+		if err == nil {
+			fn(filepath.ToSlash(modulePath), target)
+		}
+		return nil
+	})
 }
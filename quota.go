@@ -0,0 +1,283 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage of quotas is saved this often, so that a restart doesn't reset it
+const QuotaSaveInterval = time.Minute
+
+// Quota limits what an identity may use per day (UTC). Zero limits are unlimited
+type Quota struct {
+	// Requests of the module endpoints
+	Requests int64 `json:",omitempty"`
+	// Bytes of responses of the module endpoints
+	Bytes int64 `json:",omitempty"`
+	// Distinct modules newly cloned into the cache
+	NewModules int64 `json:",omitempty"`
+}
+
+// Quotas limits the usage of the module endpoints per identity, so that one team's experiments
+// can't consume the whole cache budget. Identities over their requests or bytes get 429 until the
+// day is over, those over their new modules get 403 for modules not cached yet
+type Quotas struct {
+	// Header naming the authenticated identity, set by an authenticating proxy among
+	// TrustedProxies (such as X-Forwarded-User). Requests without it, or from other peers, are
+	// accounted to the client address
+	IdentityHeader string `json:",omitempty"`
+	// Limits of identities not in Identities
+	Default Quota
+	// Limits per identity (name or client address)
+	Identities map[string]Quota `json:",omitempty"`
+}
+
+// QuotaUsage is what an identity used today
+type QuotaUsage struct {
+	Requests   int64
+	Bytes      int64
+	NewModules []string `json:",omitempty"`
+}
+
+type QuotaReport struct {
+	Usage QuotaUsage
+	Limit Quota
+}
+
+type quotaState struct {
+	mu sync.Mutex
+	// Day (UTC) usage accounts for
+	Day   string
+	Usage map[string]*QuotaUsage
+	dirty bool
+}
+
+type identityKey struct{}
+
+func (q *Quotas) limit(identity string) Quota {
+	if quota, ok := q.Identities[identity]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+func (p *ProxyServer) quotaFile() string {
+	if p.Cluster != nil {
+		// Nodes account for what they serve themselves
+		return p.cachePath(".quotas-" + strings.ReplaceAll(p.Cluster.node(), "/", "_") + ".json")
+	}
+	return p.cachePath(".quotas.json")
+}
+
+func (p *ProxyServer) startQuotas() {
+	if p.Quotas == nil {
+		return
+	}
+	p.quota.Day = time.Now().UTC().Format(time.DateOnly)
+	p.quota.Usage = make(map[string]*QuotaUsage)
+	data, err := os.ReadFile(p.quotaFile())
+	if err == nil {
+		var saved quotaState
+		if json.Unmarshal(data, &saved) == nil && saved.Day == p.quota.Day && saved.Usage != nil {
+			p.quota.Usage = saved.Usage
+		}
+	}
+	go p.quotaSaver()
+}
+
+func (p *ProxyServer) quotaSaver() {
+	ticker := time.NewTicker(QuotaSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.quota.mu.Lock()
+		if !p.quota.dirty {
+			p.quota.mu.Unlock()
+			continue
+		}
+		data, _ := json.Marshal(&p.quota)
+		p.quota.dirty = false
+		p.quota.mu.Unlock()
+		tmp := fmt.Sprintf("%s.%d", p.quotaFile(), os.Getpid())
+		err := os.WriteFile(tmp, data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, p.quotaFile())
+		}
+		if err != nil {
+			os.Remove(tmp)
+			loggerYellow.Printf("quotaSaver: Failed to save quota usage: %s"+LOG_RST, err.Error())
+		}
+	}
+}
+
+// usage returns the usage of identity today, resetting all usage once the day is over. Called
+// with the lock held, callers changing a counter set dirty
+func (p *ProxyServer) usage(identity string) *QuotaUsage {
+	if day := time.Now().UTC().Format(time.DateOnly); day != p.quota.Day {
+		p.quota.Day = day
+		p.quota.Usage = make(map[string]*QuotaUsage)
+		p.quota.dirty = true
+	}
+	u, ok := p.quota.Usage[identity]
+	if !ok {
+		u = &QuotaUsage{}
+		p.quota.Usage[identity] = u
+	}
+	return u
+}
+
+// identity returns whom requests are accounted to: the IdentityHeader set by a trusted proxy, or
+// else the client address
+func (p *ProxyServer) identity(r *http.Request) string {
+	if p.Quotas.IdentityHeader != "" && p.trustedProxy(remoteAddr(r.RemoteAddr)) {
+		if identity := r.Header.Get(p.Quotas.IdentityHeader); identity != "" {
+			return identity
+		}
+	}
+	if addr, ok := r.Context().Value(clientAddrKey{}).(netip.Addr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// quotaBreached refuses the request with status, raising an alert
+func (p *ProxyServer) quotaBreached(w http.ResponseWriter, r *http.Request, identity string, status int, message string) {
+	p.metrics.QuotaRefusals.Add(1)
+	loggerYellow.Printf(requestTag(r.Context())+"quota: %s is over quota: %s"+LOG_RST, identity, message)
+	p.alert(AlertQuotaBreach, identity, message)
+	if status == http.StatusTooManyRequests {
+		now := time.Now().UTC()
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		w.Header().Set("Retry-After", strconv.Itoa(int(tomorrow.Sub(now).Seconds())+1))
+	}
+	httpRespString(w, status, fmt.Sprintf("%s is over quota: %s", identity, message))
+}
+
+// metered accounts the requests of fn and their responses to the identity of the client, refusing
+// them once over quota. The identity is attached to the request for newModuleAllowed
+func (p *ProxyServer) metered(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.Quotas == nil || r.URL.Path == "" {
+			fn(w, r)
+			return
+		}
+		identity := p.identity(r)
+		limit := p.Quotas.limit(identity)
+		p.quota.mu.Lock()
+		u := p.usage(identity)
+		requests, bytes := u.Requests, u.Bytes
+		if limit.Requests == 0 || requests < limit.Requests {
+			u.Requests++
+			p.quota.dirty = true
+		}
+		p.quota.mu.Unlock()
+		if limit.Requests != 0 && requests >= limit.Requests {
+			p.quotaBreached(w, r, identity, http.StatusTooManyRequests, fmt.Sprintf("%d requests a day", limit.Requests))
+			return
+		}
+		if limit.Bytes != 0 && bytes >= limit.Bytes {
+			p.quotaBreached(w, r, identity, http.StatusTooManyRequests, fmt.Sprintf("%d bytes a day", limit.Bytes))
+			return
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		fn(cw, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+		if cw.n != 0 {
+			p.quota.mu.Lock()
+			p.usage(identity).Bytes += cw.n
+			p.quota.dirty = true
+			p.quota.mu.Unlock()
+		}
+	}
+}
+
+// newModuleAllowed refuses requests that would clone a module not cached yet with 403, once the
+// identity cloned its NewModules today
+func (p *ProxyServer) newModuleAllowed(w http.ResponseWriter, r *http.Request, escapedModulePath string) bool {
+	identity, ok := r.Context().Value(identityKey{}).(string)
+	if !ok {
+		return true
+	}
+	limit := p.Quotas.limit(identity)
+	if limit.NewModules == 0 || p.hasLocalSource(escapedModulePath) {
+		return true
+	}
+	p.quota.mu.Lock()
+	n := int64(len(p.usage(identity).NewModules))
+	p.quota.mu.Unlock()
+	if n < limit.NewModules {
+		return true
+	}
+	p.quotaBreached(w, r, identity, http.StatusForbidden, fmt.Sprintf("%d new modules cached a day", limit.NewModules))
+	return false
+}
+
+// countNewModule accounts a clone of a new module to the identity attached to ctx
+func (p *ProxyServer) countNewModule(ctx context.Context, modulePath string) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	if !ok {
+		return
+	}
+	p.quota.mu.Lock()
+	defer p.quota.mu.Unlock()
+	u := p.usage(identity)
+	if !slices.Contains(u.NewModules, modulePath) {
+		u.NewModules = append(u.NewModules, modulePath)
+		p.quota.dirty = true
+	}
+}
+
+// quotaReport returns the usage and limits of every identity seen today
+func (p *ProxyServer) quotaReport() map[string]QuotaReport {
+	report := make(map[string]QuotaReport)
+	if p.Quotas == nil {
+		return report
+	}
+	p.quota.mu.Lock()
+	defer p.quota.mu.Unlock()
+	if p.quota.Day != time.Now().UTC().Format(time.DateOnly) {
+		return report
+	}
+	for identity, u := range p.quota.Usage {
+		usage := *u
+		usage.NewModules = slices.Clone(u.NewModules)
+		report[identity] = QuotaReport{Usage: usage, Limit: p.Quotas.limit(identity)}
+	}
+	return report
+}
+
+// countingWriter counts the bytes of the response body
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the zero-copy path (sendfile) of the underlying writer, counting what it copied
+func (c *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := c.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{c}, src)
+	}
+	n, err := rf.ReadFrom(src)
+	c.n += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the deadlines of the connection
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,51 @@
+package goproxy
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readerFromRecorder stands for the response writer of net/http, which copies files with sendfile
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+// Copies through countingWriter reach the ReadFrom of the response writer and are counted
+func TestCountingWriterReadFrom(t *testing.T) {
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	cw := &countingWriter{ResponseWriter: rec}
+	// Hide the WriteTo of strings.Reader, which io.Copy would prefer
+	n, err := io.Copy(cw, struct{ io.Reader }{strings.NewReader("0123456789")})
+	if err != nil || n != 10 || cw.n != 10 {
+		t.Errorf("io.Copy = %d, %v, counted %d", n, err, cw.n)
+	}
+	if !rec.readFrom {
+		t.Errorf("ReadFrom of the response writer not used")
+	}
+
+	cw = &countingWriter{ResponseWriter: httptest.NewRecorder()}
+	n, err = cw.ReadFrom(strings.NewReader("0123456789"))
+	if err != nil || n != 10 || cw.n != 10 {
+		t.Errorf("ReadFrom = %d, %v, counted %d", n, err, cw.n)
+	}
+}
+
+// Looking up usage doesn't make the quota file be saved again
+func TestUsageDirty(t *testing.T) {
+	p := &ProxyServer{}
+	p.usage("client")
+	p.quota.dirty = false
+	p.usage("client")
+	p.usage("other")
+	if p.quota.dirty {
+		t.Errorf("lookups set dirty")
+	}
+}
@@ -0,0 +1,112 @@
+package goproxy
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const ReaperInterval = 1 * time.Minute
+
+// How long Wait keeps waiting for the output of a killed command, which may be held open by its helpers
+const subprocessWaitDelay = 10 * time.Second
+
+// processGroupCmd starts the command in its own process group, so that cancellation kills the
+// whole tree, including helpers such as git-remote-https, not just the direct child
+func processGroupCmd(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+	}
+	cmd.WaitDelay = subprocessWaitDelay
+}
+
+type procStat struct {
+	pid  int
+	comm string
+	ppid int
+	pgrp int
+}
+
+// listChildren reports the processes whose parent is the proxy
+func listChildren() []procStat {
+	self := os.Getpid()
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var children []procStat
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid pgrp ..., comm may contain anything including parentheses
+		stat := string(data)
+		open, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+		if open == -1 || end == -1 {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 3 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		pgrp, _ := strconv.Atoi(fields[2])
+		if ppid == self {
+			children = append(children, procStat{pid: pid, comm: stat[open+1 : end], ppid: ppid, pgrp: pgrp})
+		}
+	}
+	return children
+}
+
+// reapOrphans kills and reaps helpers that outlived the command that spawned them. Being a
+// subreaper, they are reparented to the proxy. Commands are process group leaders, thus
+// a child not leading its group is an orphaned helper
+func reapOrphans() {
+	for _, child := range listChildren() {
+		if child.pgrp == child.pid {
+			continue
+		}
+		loggerYellow.Printf("reaper: Killing orphaned %s (pid %d, process group %d)"+LOG_RST, child.comm, child.pid, child.pgrp)
+		unix.Kill(child.pid, unix.SIGKILL)
+		var status unix.WaitStatus
+		unix.Wait4(child.pid, &status, 0, nil)
+	}
+}
+
+func (p *ProxyServer) reaper() {
+	err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+	if err != nil {
+		loggerRed.Printf("reaper: Failed to become subreaper: %s"+LOG_RST, err.Error())
+		return
+	}
+	ticker := time.NewTicker(ReaperInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reapOrphans()
+	}
+}
+
+// KillSubprocesses kills the process trees of all commands still running, meant for shutdown
+func KillSubprocesses() {
+	for _, child := range listChildren() {
+		if child.pgrp == child.pid {
+			loggerYellow.Printf("KillSubprocesses: Killing %s (pid %d)"+LOG_RST, child.comm, child.pid)
+			unix.Kill(-child.pgrp, unix.SIGKILL)
+		}
+	}
+	reapOrphans()
+}
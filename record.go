@@ -0,0 +1,200 @@
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Recorded responses are kept beneath RecordDir as <request path>.http, the path being that under
+// Prefix, the query left out. They are HTTP/1.1 responses as sent on the wire
+const recordingSuffix = ".http"
+
+// Headers not recorded, as they differ per request or per connection
+var unrecordedHeaders = []string{RequestIDHeader, "Date", "Connection", "Keep-Alive", "Transfer-Encoding"}
+
+// recordingName returns the name of the recording of a request, relative to RecordDir or ReplayDir
+func recordingName(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(urlPath, "/")
+	if name == "" {
+		name = "index"
+	}
+	if path.Clean(name) != name || strings.HasPrefix(name, "../") || strings.HasSuffix(name, "/") {
+		return "", false
+	}
+	return name + recordingSuffix, true
+}
+
+// isRecordable tells if a response is the same every time it's served, and worth replaying.
+// Failures, redirects and partial responses aren't
+func isRecordable(status int) bool {
+	return status == http.StatusOK || status == http.StatusNotFound || status == http.StatusGone
+}
+
+// recordingWriter keeps a copy of the status, headers and body of a response in a temporary file
+type recordingWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   *os.File
+	size   int64
+	err    error
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+		rw.header = rw.Header().Clone()
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	if rw.err == nil {
+		_, rw.err = rw.body.Write(b[:n])
+		rw.size += int64(n)
+	}
+	if err != nil && rw.err == nil {
+		// The client went away, what was served is incomplete
+		rw.err = err
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection, for stallWriter
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// recording serves the requests with h, recording the responses of GET requests into RecordDir.
+// The admin endpoints aren't recorded
+func (p *ProxyServer) recording(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.initOnce.Do(p.init)
+		name, ok := recordingName(r.URL.Path)
+		if r.Method != http.MethodGet || !ok || strings.HasPrefix(name, "admin/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		body, err := createUnnamedTmpFile(p.RecordDir, 0600)
+		if err != nil {
+			loggerYellow.Printf("recording: Failed to create temp file: %s"+LOG_RST, err.Error())
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer body.Close()
+		rw := &recordingWriter{ResponseWriter: w, body: body}
+		h.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			// Nothing written, net/http sends an empty 200
+			rw.status, rw.header = http.StatusOK, w.Header().Clone()
+		}
+		if rw.err != nil || !isRecordable(rw.status) {
+			return
+		}
+		err = p.saveRecording(name, rw)
+		if err != nil {
+			loggerYellow.Printf(requestTag(r.Context())+"recording: Failed to record %s: %s"+LOG_RST, name, err.Error())
+		}
+	})
+}
+
+// saveRecording writes the response recorded by rw as name, replacing an earlier recording, so
+// that the last response of a run is replayed
+func (p *ProxyServer) saveRecording(name string, rw *recordingWriter) error {
+	err := p.record.mkdirAll(path.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	if p.record.beneath(path.Dir(name)) != nil {
+		return errors.New(fmt.Sprintf("%s escapes the recording directory", name))
+	}
+	tmp, err := p.record.createTemp(path.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer p.record.remove(tmp.Name())
+	for _, key := range unrecordedHeaders {
+		rw.header.Del(key)
+	}
+	resp := &http.Response{
+		StatusCode:    rw.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header,
+		ContentLength: rw.size,
+		Body:          io.NopCloser(io.NewSectionReader(rw.body, 0, rw.size)),
+	}
+	bw := bufio.NewWriter(tmp)
+	err = resp.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return p.record.rename(tmp.Name(), name)
+}
+
+// serveReplay serves the responses recorded into ReplayDir, and nothing else. Requests not
+// recorded are answered with 404, nothing is fetched or generated
+func (p *ProxyServer) serveReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpRespString(w, http.StatusMethodNotAllowed, "only GET and HEAD are replayed")
+		return
+	}
+	name, ok := recordingName(r.URL.Path)
+	if !ok {
+		httpRespString(w, http.StatusNotFound, "not recorded")
+		return
+	}
+	f, err := p.replay.openFile(name)
+	if err != nil {
+		loggerYellow.Printf(requestTag(r.Context())+"serveReplay: %s not recorded"+LOG_RST, r.URL.Path)
+		httpRespString(w, http.StatusNotFound, "not recorded: "+r.URL.Path)
+		return
+	}
+	defer f.Close()
+	// HEAD gets the headers only
+	resp, err := http.ReadResponse(bufio.NewReader(f), r)
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, fmt.Sprintf("broken recording of %s: %s", r.URL.Path, err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// forwardToUpstream serves the request with the response of upstream, rather than redirecting the
+// client there, so that RecordDir gets the content
+func (p *ProxyServer) forwardToUpstream(w http.ResponseWriter, r *http.Request, url string) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp, err := p.upstreamClient.Do(req)
+	if err != nil {
+		httpRespString(w, http.StatusBadGateway, fmt.Sprintf("failed to fetch %s: %s", url, err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	forwardHttpResp(w, resp)
+}
@@ -0,0 +1,106 @@
+package goproxy
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+)
+
+// File in the gitdir recording the remote the mirror was last cloned or updated from
+const mirrorFetchedFile = "goproxy-fetched"
+
+// fallbackRemotes returns the remotes of override to try after remote, in order
+func fallbackRemotes(override *CloneOverride, remote string) []string {
+	if override == nil {
+		return nil
+	}
+	var remotes []string
+	for _, r := range override.Remotes {
+		if normalizeRemote(r) != normalizeRemote(remote) {
+			remotes = append(remotes, r)
+		}
+	}
+	return remotes
+}
+
+// recordFetchedRemote records where the mirror in gitdir (in the cache) was fetched from
+func (p *ProxyServer) recordFetchedRemote(gitdir, remote string) {
+	os.WriteFile(p.cachePath(path.Join(gitdir, mirrorFetchedFile)), []byte(remote+"\n"), 0644)
+}
+
+// fetchedRemote returns the remote the mirror in gitdir was last fetched from, empty if unknown
+func (p *ProxyServer) fetchedRemote(gitdir string) string {
+	data, err := os.ReadFile(p.cachePath(path.Join(gitdir, mirrorFetchedFile)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// updateMirror fetches the mirror of modulePath from origin, then from the fallback remotes of
+// override until one succeeds. Fallbacks are fetched like origin of a mirror, every ref replacing
+// the local one. It returns the remote fetched from, and the error of origin if all failed
+func (p *ProxyServer) updateMirror(ctx context.Context, modulePath string, override *CloneOverride) (string, error) {
+	gitdir := path.Join(modulePath, ".git")
+	remote, _ := runGitOutputShort(ctx, gitdir, "config", "--get", "remote.origin.url")
+	remote = strings.TrimSpace(remote)
+	cmd := getGitCmd(ctx, gitdir, append(p.forgeMirrorArgs(), "remote", "update")...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err == nil {
+		p.recordFetchedRemote(gitdir, remote)
+		return remote, nil
+	}
+	for _, fallback := range fallbackRemotes(override, remote) {
+		if ctx.Err() != nil {
+			break
+		}
+		loggerYellow.Printf("cacheModGit: Failed to update %s from %s, trying %s"+LOG_RST, modulePath, remote, fallback)
+		p.metrics.RemoteFailovers.Add(1)
+		cmd := getGitCmd(ctx, gitdir, append(p.forgeMirrorArgs(), "fetch", "--quiet", fallback, "+refs/*:refs/*")...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if cmd.Run() == nil {
+			p.recordFetchedRemote(gitdir, fallback)
+			return fallback, nil
+		}
+	}
+	return remote, err
+}
+
+// cloneMirror clones remote into tmpdir (relative to the cache), or the first of the fallback remotes of override that
+// succeeds. origin stays remote either way, so that the mirror is still updated from it first and
+// reported with it. It returns the remote cloned from, and the error of remote if all failed
+func (p *ProxyServer) cloneMirror(ctx context.Context, job *cloneJob, cloneArgs []string, override *CloneOverride, remote, tmpdir string) (string, error) {
+	cmd := getGitCmd(ctx, ".", append(cloneArgs, remote, tmpdir)...)
+	// Progress is reported through the clone job status
+	cmd.Stderr = job
+	err := cmd.Run()
+	if err == nil {
+		return remote, nil
+	}
+	for _, fallback := range fallbackRemotes(override, remote) {
+		if ctx.Err() != nil {
+			break
+		}
+		loggerYellow.Printf("cacheModGit: Failed to git clone from %s, trying %s"+LOG_RST, remote, fallback)
+		p.metrics.RemoteFailovers.Add(1)
+		// git clone wants an empty directory
+		p.root.removeAll(tmpdir)
+		if p.root.mkdirAll(tmpdir, 0700) != nil {
+			break
+		}
+		cmd := getGitCmd(ctx, ".", append(cloneArgs, fallback, tmpdir)...)
+		cmd.Stderr = job
+		if cmd.Run() != nil {
+			continue
+		}
+		if getGitCmd(ctx, tmpdir, "config", "remote.origin.url", remote).Run() != nil {
+			continue
+		}
+		return fallback, nil
+	}
+	return remote, err
+}
@@ -0,0 +1,293 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+)
+
+// Pending replications beyond this are dropped, the next update of the mirror pushes it again
+const ReplicationQueueLength = 1024
+
+type replicaItem struct {
+	// Mirror module path, or archive path relative to ArchiveStoreDir
+	mirror  string
+	archive string
+}
+
+type replicationState struct {
+	once    sync.Once
+	queue   chan replicaItem
+	pending sync.Map
+}
+
+// replicate queues pushing a mirror or stored archive to the Standby, returning right away
+func (p *ProxyServer) replicate(item replicaItem) {
+	if p.Standby == "" {
+		return
+	}
+	p.replication.once.Do(func() {
+		p.replication.queue = make(chan replicaItem, ReplicationQueueLength)
+		go p.replicationWorker()
+	})
+	_, queued := p.replication.pending.LoadOrStore(item, struct{}{})
+	if queued {
+		return
+	}
+	select {
+	case p.replication.queue <- item:
+	default:
+		p.replication.pending.Delete(item)
+		loggerYellow.Printf("replicate: Queue full, dropping %s%s"+LOG_RST, item.mirror, item.archive)
+	}
+}
+
+func (p *ProxyServer) replicationWorker() {
+	for item := range p.replication.queue {
+		// Further changes from now on are queued again
+		p.replication.pending.Delete(item)
+		var err error
+		ctx, cancel := context.WithTimeout(p.withCacheDir(context.Background()), GitCloneTimeout)
+		if item.mirror != "" {
+			err = p.pushMirror(ctx, item.mirror)
+		} else {
+			err = p.pushArchive(ctx, item.archive)
+		}
+		cancel()
+		if err != nil {
+			p.metrics.ReplicationFailures.Add(1)
+			loggerRed.Printf("replicationWorker: Failed to replicate %s%s: %s"+LOG_RST, item.mirror, item.archive, err.Error())
+			continue
+		}
+		p.metrics.Replications.Add(1)
+	}
+}
+
+func (p *ProxyServer) standbyRequest(ctx context.Context, method, endpoint string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := strings.TrimSuffix(p.Standby, "/") + "/admin/replica/" + endpoint + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", bearerAuthScheme+p.ReplicationToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, MaxUpstreamResponse))
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("standby returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg))))
+	}
+	return resp, nil
+}
+
+// pushMirror sends the standby a bundle of what its copy of the mirror lacks
+func (p *ProxyServer) pushMirror(ctx context.Context, modulePath string) error {
+	gitdir := path.Join(modulePath, ".git")
+	refs, err := runGitOutputShort(ctx, gitdir, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return err
+	}
+	remote, err := runGitOutputShort(ctx, gitdir, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return err
+	}
+	query := url.Values{"path": {modulePath}}
+	resp, err := p.standbyRequest(ctx, http.MethodGet, "refs", query, nil)
+	if err != nil {
+		return err
+	}
+	standbyRefs, err := io.ReadAll(&bodyLimiter{r: resp.Body, n: MaxGoImportResponse})
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if string(standbyRefs) == refs {
+		return nil
+	}
+	// Objects the standby has already are left out, like incremental bundle exports
+	var excludes []string
+	for _, line := range strings.Split(string(standbyRefs), "\n") {
+		hash, _, _ := strings.Cut(line, " ")
+		if hash == "" {
+			continue
+		}
+		_, err := runGitOutputShort(ctx, gitdir, "cat-file", "-e", hash)
+		if err == nil {
+			excludes = append(excludes, "^"+hash)
+		}
+	}
+	bundle, err := os.CreateTemp(p.cachePath(".tmp"), "replica-*.bundle")
+	if err != nil {
+		return err
+	}
+	bundle.Close()
+	defer os.Remove(bundle.Name())
+	bundlePath, _ := filepath.Abs(bundle.Name())
+	_, err = runGitOutputShort(ctx, gitdir, append([]string{"bundle", "create", "--quiet", bundlePath, "--all"}, excludes...)...)
+	if err != nil && len(excludes) != 0 {
+		// Only refs moved to objects the standby has, which makes an empty bundle
+		_, err = runGitOutputShort(ctx, gitdir, "bundle", "create", "--quiet", bundlePath, "--all")
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	query.Set("remote", strings.TrimSpace(remote))
+	resp, err = p.standbyRequest(ctx, http.MethodPut, "mirror", query, f)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	loggerGreen.Printf("pushMirror: Replicated %s to %s"+LOG_RST, modulePath, p.Standby)
+	return nil
+}
+
+func (p *ProxyServer) pushArchive(ctx context.Context, name string) error {
+	f, err := p.Storage.Get(ctx, path.Join(ArchiveStoreDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err := p.standbyRequest(ctx, http.MethodPut, "archive", url.Values{"name": {name}}, f)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// serveAdminReplica receives the pushes of a primary, when ReplicationToken is set
+func (p *ProxyServer) serveAdminReplica(w http.ResponseWriter, r *http.Request, endpoint string) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), bearerAuthScheme)
+	if p.ReplicationToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.ReplicationToken)) != 1 {
+		httpRespString(w, http.StatusForbidden, "replication is not enabled or the token is wrong")
+		return
+	}
+	query := r.URL.Query()
+	var err error
+	switch {
+	case endpoint == "refs" && r.Method == http.MethodGet:
+		var refs string
+		refs, err = p.replicaRefs(r.Context(), query.Get("path"))
+		if err == nil {
+			httpRespBytes(w, "text/plain; charset=utf-8", []byte(refs))
+			return
+		}
+	case endpoint == "mirror" && r.Method == http.MethodPut:
+		err = p.receiveMirror(r.Context(), query.Get("path"), query.Get("remote"), r.Body)
+	case endpoint == "archive" && r.Method == http.MethodPut:
+		err = p.receiveArchive(r.Context(), query.Get("name"), r.Body)
+	default:
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("Unsupported replica endpoint: %s %s", r.Method, endpoint))
+		return
+	}
+	if err != nil {
+		loggerRed.Printf(requestTag(r.Context())+"serveAdminReplica: %s: %s"+LOG_RST, endpoint, err.Error())
+		httpRespString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpRespString(w, http.StatusOK, "OK")
+}
+
+// replicaRefs lists the refs of the local copy of a mirror, empty if there's none yet
+func (p *ProxyServer) replicaRefs(ctx context.Context, modulePath string) (string, error) {
+	err := module.CheckImportPath(modulePath)
+	if err != nil {
+		return "", err
+	}
+	if p.root.beneath(path.Join(modulePath, ".git")) != nil {
+		return "", nil
+	}
+	return runGitOutputShort(ctx, path.Join(modulePath, ".git"), "for-each-ref", "--format=%(objectname) %(refname)")
+}
+
+// receiveMirror applies a bundle to the local copy of the mirror, creating it like a clone would
+func (p *ProxyServer) receiveMirror(ctx context.Context, modulePath, remote string, body io.Reader) error {
+	err := module.CheckImportPath(modulePath)
+	if err != nil {
+		return err
+	}
+	bundle, err := os.CreateTemp(p.cachePath(".tmp"), "replica-*.bundle")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundle.Name())
+	_, err = io.Copy(bundle, body)
+	bundle.Close()
+	if err != nil {
+		return err
+	}
+	bundlePath, _ := filepath.Abs(bundle.Name())
+	gitdir := path.Join(modulePath, ".git")
+	if p.root.beneath(gitdir) == nil {
+		_, err = runGitOutputShort(ctx, gitdir, "fetch", "--quiet", bundlePath, "+refs/*:refs/*")
+		p.dropMirrorLists(modulePath)
+		return err
+	}
+	err = p.root.mkdirAll(modulePath, 0755)
+	if err != nil {
+		return err
+	}
+	tmpdir, err := p.root.mkdirTemp(modulePath, ".gittmp")
+	if err != nil {
+		return err
+	}
+	defer p.root.removeAll(tmpdir)
+	_, err = runGitOutputShort(ctx, ".", "clone", "--template=.gittemplate", "--quiet", "--mirror", bundlePath, tmpdir)
+	if err == nil {
+		_, err = runGitOutputShort(ctx, tmpdir, "remote", "set-url", "origin", remote)
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(p.cachePath(tmpdir), 0755)
+	err = p.root.rename(tmpdir, gitdir)
+	if err != nil {
+		return err
+	}
+	err = p.root.symlink(".git", path.Join(modulePath, ".vcs"))
+	if err != nil {
+		return err
+	}
+	p.vcsIndex.set(modulePath, vcsEntry{vcs: ".git", owner: modulePath})
+	return nil
+}
+
+func (p *ProxyServer) receiveArchive(ctx context.Context, name string, body io.Reader) error {
+	clean := path.Clean(name)
+	if clean != name || path.IsAbs(name) || strings.HasPrefix(name, "../") || !strings.HasSuffix(name, ".zip.zst") {
+		return errors.New(fmt.Sprintf("invalid archive name %s", name))
+	}
+	key := path.Join(ArchiveStoreDir, name)
+	if _, err := p.Storage.Stat(ctx, key); err == nil {
+		// Archives are immutable
+		return nil
+	}
+	tmp, err := createUnnamedTmpFile(p.cachePath(".tmp"), 0600)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		return err
+	}
+	return p.Storage.Put(ctx, key, tmp)
+}
@@ -0,0 +1,40 @@
+package goproxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Headers letting individual clients adjust the behavior for a request, with values like "1" or "true"
+const (
+	// Wait for the fetch and serve from the cache instead of redirecting to upstream. Only honored
+	// for privileged clients, see requestOptions
+	NoRedirectHeader = "X-GoProxy-No-Redirect"
+	// Update the mirror from its remote before answering. Only honored for privileged clients
+	RefreshHeader = "X-GoProxy-Refresh"
+	// Only serve what's already cached, never fetch or redirect
+	CacheOnlyHeader = "X-GoProxy-Cache-Only"
+)
+
+type requestOptions struct {
+	noRedirect bool
+	refresh    bool
+	cacheOnly  bool
+}
+
+func headerBool(r *http.Request, name string) bool {
+	v, err := strconv.ParseBool(r.Header.Get(name))
+	return err == nil && v
+}
+
+// requestOptions parses the headers of r. Refreshing and waiting for a clone tie up clone workers
+// and count against the rate limits of remotes, so they're only honored for requests with the
+// AdminToken, or coming straight from one of TrustedProxies (which decide what to pass on)
+func (p *ProxyServer) requestOptions(r *http.Request) requestOptions {
+	opts := requestOptions{cacheOnly: headerBool(r, CacheOnlyHeader)}
+	if p.adminAuthorized(r) || p.trustedProxy(remoteAddr(r.RemoteAddr)) {
+		opts.noRedirect = headerBool(r, NoRedirectHeader)
+		opts.refresh = headerBool(r, RefreshHeader)
+	}
+	return opts
+}
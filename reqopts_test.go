@@ -0,0 +1,35 @@
+package goproxy
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRequestOptions(t *testing.T) {
+	p := &ProxyServer{AdminToken: "secret", trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	tests := []struct {
+		remoteAddr, auth    string
+		noRedirect, refresh bool
+	}{
+		{"192.0.2.1:1234", "", false, false},
+		{"192.0.2.1:1234", "Bearer wrong", false, false},
+		{"192.0.2.1:1234", "Bearer secret", true, true},
+		{"10.1.2.3:1234", "", true, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/example.com/m/@v/v1.0.0.info", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set(NoRedirectHeader, "1")
+		r.Header.Set(RefreshHeader, "true")
+		r.Header.Set(CacheOnlyHeader, "1")
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		opts := p.requestOptions(r)
+		if opts.noRedirect != tt.noRedirect || opts.refresh != tt.refresh || !opts.cacheOnly {
+			t.Errorf("%s %q: %+v, want noRedirect %v, refresh %v and cacheOnly", tt.remoteAddr, tt.auth, opts,
+				tt.noRedirect, tt.refresh)
+		}
+	}
+}
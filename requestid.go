@@ -0,0 +1,59 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+type clientAddrKey struct{}
+
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID accepts the X-Request-ID of the client if it's sane, otherwise generates one
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if validRequestID(id) {
+		return id
+	}
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// withRequest tags ctx with the ID and the client address (see clientAddr) of a request
+func withRequest(ctx context.Context, id string, addr netip.Addr) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	if addr.IsValid() {
+		ctx = context.WithValue(ctx, clientAddrKey{}, addr)
+	}
+	return ctx
+}
+
+// requestTag is prepended to log lines emitted on behalf of a request: its ID and client
+func requestTag(ctx context.Context) string {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	if !ok {
+		return ""
+	}
+	if addr, ok := ctx.Value(clientAddrKey{}).(netip.Addr); ok {
+		return "[" + id + " " + addr.String() + "] "
+	}
+	return "[" + id + "] "
+}
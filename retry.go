@@ -0,0 +1,96 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Upstream queries failing transiently (network errors, timeouts, 5xx, 429) are tried again this
+// many times, waiting UpstreamRetryBackoff doubled each time, up to UpstreamRetryMaxBackoff
+const (
+	UpstreamRetries         = 3
+	UpstreamRetryBackoff    = 250 * time.Millisecond
+	UpstreamRetryMaxBackoff = 4 * time.Second
+)
+
+// UpstreamError is an unsuccessful response of the upstream proxy
+type UpstreamError struct {
+	StatusCode int
+	// Start of the body, which explains the error with the go command protocol
+	Body string
+	// From Retry-After, if sent
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("HTTP error %d: %s", e.StatusCode, e.Body)
+}
+
+func newUpstreamError(resp *http.Response) *UpstreamError {
+	body, _ := io.ReadAll(&bodyLimiter{r: resp.Body, n: MaxUpstreamResponse})
+	e := &UpstreamError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// isTransient tells if err may go away by trying again: connectivity problems, timeouts and
+// responses of an overloaded or failing upstream. Definite answers (404, 410...) are not
+func isTransient(err error) bool {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		code := upstreamErr.StatusCode
+		return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retryUpstream calls fn through the breaker until it succeeds, fails for good (including the breaker
+// opening), or UpstreamRetries are exhausted. Each attempt has UpstreamProxyTimeout. Waits are jittered,
+// so that instances failing together don't come back together, and follow Retry-After when it's longer
+func retryUpstream(ctx context.Context, breaker *circuitBreaker, what string, fn func(ctx context.Context) error) error {
+	backoff := UpstreamRetryBackoff
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, UpstreamProxyTimeout)
+		err := breaker.call(func() error {
+			return fn(attemptCtx)
+		})
+		cancel()
+		if err == nil || ctx.Err() != nil || attempt == UpstreamRetries || !isTransient(err) {
+			return err
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		var upstreamErr *UpstreamError
+		if errors.As(err, &upstreamErr) && upstreamErr.RetryAfter > wait {
+			if upstreamErr.RetryAfter > UpstreamRetryMaxBackoff {
+				return err
+			}
+			wait = upstreamErr.RetryAfter
+		}
+		loggerYellow.Printf(requestTag(ctx)+"retryUpstream: %s failed, retrying in %s: %s"+LOG_RST, what, wait.Round(time.Millisecond), err.Error())
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff = min(backoff*2, UpstreamRetryMaxBackoff)
+	}
+}
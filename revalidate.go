@@ -0,0 +1,76 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// File in the gitdir whose mtime is when the mirror was last updated or found current
+const mirrorCheckedFile = "goproxy-checked"
+
+func markMirrorChecked(gitdir string) {
+	name := path.Join(gitdir, mirrorCheckedFile)
+	now := time.Now()
+	err := os.Chtimes(name, now, now)
+	if errors.Is(err, os.ErrNotExist) {
+		f, err := os.Create(name)
+		if err == nil {
+			f.Close()
+		}
+	}
+}
+
+// mirrorAge is how long ago the mirror was last checked against its remote, mirrors never checked are infinitely stale
+func mirrorAge(gitdir string) time.Duration {
+	fi, err := os.Stat(path.Join(gitdir, mirrorCheckedFile))
+	if err != nil {
+		return math.MaxInt64
+	}
+	return time.Since(fi.ModTime())
+}
+
+// revalidateMirror updates the mirror before @latest or a branch is answered from it, if it was
+// last checked longer than MetadataMaxAge ago. Otherwise, it queues a background update of the
+// mirror if it was last checked longer than StaleWhileRevalidate ago, while the answer is served
+// from the mirror as it is. It returns false if the client went away while waiting
+func (p *ProxyServer) revalidateMirror(w http.ResponseWriter, r *http.Request, parentPath string) bool {
+	if p.MetadataMaxAge <= 0 && p.StaleWhileRevalidate <= 0 {
+		return true
+	}
+	owner := p.mirrorOwner(parentPath)
+	age := mirrorAge(p.cachePath(path.Join(owner, ".git")))
+	// A frozen cache isn't updated, the answer is what it is
+	if p.MetadataMaxAge > 0 && age > time.Duration(p.MetadataMaxAge) && !p.frozen() {
+		loggerGreen.Printf(requestTag(r.Context())+"revalidateMirror: %s is older than the max age, updating before answering"+LOG_RST, owner)
+		p.metrics.MaxAgeRevalidations.Add(1)
+		job := p.queueGitJob(r.Context(), owner, "", "", clonePriorityInteractive)
+		return p.waitForFetch(w, r, job.done)
+	}
+	if p.StaleWhileRevalidate <= 0 || age <= time.Duration(p.StaleWhileRevalidate) {
+		return true
+	}
+	if _, running := p.pendingGit.Load(owner); running {
+		return true
+	}
+	loggerGreen.Printf(requestTag(r.Context())+"revalidateMirror: %s is stale, updating in the background"+LOG_RST, owner)
+	p.metrics.StaleRevalidations.Add(1)
+	p.queueGitJob(context.WithoutCancel(r.Context()), owner, "", "", clonePriorityBackground)
+	return true
+}
+
+// hasLocalMirror reports whether the module is backed by a git mirror in the cache
+func (p *ProxyServer) hasLocalMirror(escapedModulePath string) bool {
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return false
+	}
+	_, _, vcs, err := p.checkModVcsLocal(modulePath)
+	return err == nil && vcs == ".git"
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ResourceLimits are applied to every spawned git/zip/zstd command, so a pathological
+// repository can't take down the whole host. Zero values leave the limit alone
+type ResourceLimits struct {
+	// CPU time per command (RLIMIT_CPU), rounded up to seconds
+	CPUTime Duration `json:",omitempty"`
+	// Address space in bytes per command (RLIMIT_AS)
+	Memory uint64 `json:",omitempty"`
+	// Size in bytes of any file a command writes (RLIMIT_FSIZE)
+	FileSize uint64 `json:",omitempty"`
+	// Open file descriptors per command (RLIMIT_NOFILE)
+	OpenFiles uint64 `json:",omitempty"`
+	// Existing cgroup v2 directory the commands are started in, with limits such as memory.max and
+	// pids.max set by the administrator. Unlike rlimits, these apply to all commands together
+	Cgroup string `json:",omitempty"`
+}
+
+var activeLimits ResourceLimits
+var cgroupFD = -1
+
+func (l *ResourceLimits) rlimits() map[int]uint64 {
+	limits := make(map[int]uint64)
+	if l.CPUTime > 0 {
+		limits[unix.RLIMIT_CPU] = uint64((time.Duration(l.CPUTime) + time.Second - 1) / time.Second)
+	}
+	if l.Memory > 0 {
+		limits[unix.RLIMIT_AS] = l.Memory
+	}
+	if l.FileSize > 0 {
+		limits[unix.RLIMIT_FSIZE] = l.FileSize
+	}
+	if l.OpenFiles > 0 {
+		limits[unix.RLIMIT_NOFILE] = l.OpenFiles
+	}
+	return limits
+}
+
+// UseResourceLimits applies l to subsequently spawned commands
+func UseResourceLimits(l ResourceLimits) error {
+	if l.Cgroup != "" {
+		fd, err := unix.Open(l.Cgroup, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to open cgroup %s: %s", l.Cgroup, err.Error()))
+		}
+		cgroupFD = fd
+	}
+	if len(l.rlimits()) != 0 && sandboxExecutable == "" {
+		// rlimits are set by the sandbox helper before executing the command
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		sandboxExecutable = exe
+	}
+	activeLimits = l
+	return nil
+}
+
+// applyResourceLimits runs in the sandbox helper, the limits are inherited across exec
+func applyResourceLimits(l *ResourceLimits) error {
+	for resource, limit := range l.rlimits() {
+		var cur syscall.Rlimit
+		err := syscall.Getrlimit(resource, &cur)
+		if err == nil && cur.Max < limit {
+			// Raising the hard limit is not allowed
+			limit = cur.Max
+		}
+		// syscall.Setrlimit, so the runtime doesn't restore its own RLIMIT_NOFILE on exec
+		err = syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit, Max: limit})
+		if err != nil {
+			return errors.New(fmt.Sprintf("setrlimit %d: %s", resource, err.Error()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// cacheRoot confines lookups of request-derived paths to the cache directory.
+// Paths are resolved relative to a dirfd with openat2(RESOLVE_BENEATH), so neither
+// ".." nor symlinks can lead outside. Kernels without openat2 fall back to resolving
+// the path in userspace and checking the result for reads, and to walking the parent
+// directory element by element without following symlinks for writes
+type cacheRoot struct {
+	fd      int
+	openat2 bool
+	// The directory, with symlinks resolved, for the userspace fallback
+	dir string
+}
+
+var errNotBeneath = errors.New("path escapes the cache root")
+
+func openCacheRoot(dir string) (*cacheRoot, error) {
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	root := &cacheRoot{fd: fd, openat2: true}
+	probe, err := root.open(".", unix.O_PATH|unix.O_DIRECTORY)
+	if err == nil {
+		unix.Close(probe)
+	} else if err == unix.ENOSYS {
+		root.openat2 = false
+		root.dir, err = filepath.EvalSymlinks(dir)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+// open returns an fd of name opened with flags, only if it resolves beneath the root
+func (c *cacheRoot) open(name string, flags int) (int, error) {
+	fd, err := unix.Openat2(c.fd, name, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err == unix.EXDEV {
+		return -1, errNotBeneath
+	}
+	return fd, err
+}
+
+// beneath checks that name, with symlinks followed, resolves to an existing file beneath the root
+func (c *cacheRoot) beneath(name string) error {
+	if path.IsAbs(name) {
+		return errNotBeneath
+	}
+	if c.openat2 {
+		fd, err := c.open(name, unix.O_PATH)
+		if err != nil {
+			return err
+		}
+		return unix.Close(fd)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(c.dir, name))
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(c.dir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return errNotBeneath
+	}
+	return nil
+}
+
+// openFile opens name read-only, only if it resolves beneath the root
+func (c *cacheRoot) openFile(name string) (*os.File, error) {
+	if !c.openat2 {
+		err := c.beneath(name)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(filepath.Join(c.dir, name))
+	}
+	fd, err := c.open(name, unix.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// parent opens the parent directory of name, which must be beneath the root, for the *at syscalls
+// working on the last element base of name. release closes dirfd
+func (c *cacheRoot) parent(name string) (dirfd int, base string, release func(), err error) {
+	base = path.Base(name)
+	if base == "." || base == ".." || base == "/" || path.IsAbs(name) {
+		return -1, "", nil, errNotBeneath
+	}
+	var fd int
+	if c.openat2 {
+		fd, err = c.open(path.Dir(name), unix.O_PATH|unix.O_DIRECTORY)
+	} else {
+		fd, err = c.openDirNoFollow(path.Dir(name))
+	}
+	if err != nil {
+		return -1, "", nil, err
+	}
+	return fd, base, func() { unix.Close(fd) }, nil
+}
+
+// openDirNoFollow opens dir element by element from the root without following symlinks, so that
+// nothing can be swapped for a symlink between checking and using it, for kernels without openat2.
+// Unlike with openat2, symlinks to directories beneath the root are refused as well
+func (c *cacheRoot) openDirNoFollow(dir string) (int, error) {
+	fd, err := unix.Openat(c.fd, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	dir = path.Clean(dir)
+	if dir == "." {
+		return fd, nil
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == ".." {
+			unix.Close(fd)
+			return -1, errNotBeneath
+		}
+		next, err := unix.Openat(fd, elem, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// readlink reads the symlink name, whose parent must be beneath the root
+func (c *cacheRoot) readlink(name string) (string, error) {
+	dirfd, base, release, err := c.parent(name)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dirfd, base, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// lstat returns the type of name (fs.ModeDir, fs.ModeSymlink or 0 for anything else), without
+// following it
+func (c *cacheRoot) lstat(name string) (fs.FileMode, error) {
+	dirfd, base, release, err := c.parent(name)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var st unix.Stat_t
+	err = unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return 0, err
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		return fs.ModeDir, nil
+	case unix.S_IFLNK:
+		return fs.ModeSymlink, nil
+	}
+	return 0, nil
+}
+
+// remove is os.Remove, for name whose parent is beneath the root
+func (c *cacheRoot) remove(name string) error {
+	dirfd, base, release, err := c.parent(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = unix.Unlinkat(dirfd, base, 0)
+	if err == unix.EISDIR {
+		err = unix.Unlinkat(dirfd, base, unix.AT_REMOVEDIR)
+	}
+	return err
+}
+
+// removeAll is os.RemoveAll, for name whose parent is beneath the root. Symlinks are removed,
+// never followed
+func (c *cacheRoot) removeAll(name string) error {
+	dirfd, base, release, err := c.parent(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer release()
+	return removeAllAt(dirfd, base)
+}
+
+func removeAllAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	if err != unix.EISDIR {
+		return err
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	entries, err := dir.Readdirnames(-1)
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		err = removeAllAt(fd, entry)
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	err = unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	if err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// rename is os.Rename, for oldname and newname whose parents are beneath the root
+func (c *cacheRoot) rename(oldname, newname string) error {
+	olddirfd, oldbase, releaseOld, err := c.parent(oldname)
+	if err != nil {
+		return err
+	}
+	defer releaseOld()
+	newdirfd, newbase, releaseNew, err := c.parent(newname)
+	if err != nil {
+		return err
+	}
+	defer releaseNew()
+	return unix.Renameat(olddirfd, oldbase, newdirfd, newbase)
+}
+
+// link is os.Link, for oldname and newname whose parents are beneath the root
+func (c *cacheRoot) link(oldname, newname string) error {
+	olddirfd, oldbase, releaseOld, err := c.parent(oldname)
+	if err != nil {
+		return err
+	}
+	defer releaseOld()
+	newdirfd, newbase, releaseNew, err := c.parent(newname)
+	if err != nil {
+		return err
+	}
+	defer releaseNew()
+	return unix.Linkat(olddirfd, oldbase, newdirfd, newbase, 0)
+}
+
+// linkFile links the open file f as name, whose parent is beneath the root. f may be unnamed
+// (O_TMPFILE) or deleted
+func (c *cacheRoot) linkFile(f *os.File, name string) error {
+	dirfd, base, release, err := c.parent(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/dev/fd/%d", f.Fd()), dirfd, base, unix.AT_SYMLINK_FOLLOW)
+}
+
+// symlink is os.Symlink, creating name whose parent is beneath the root. target isn't checked,
+// lookups through the link are
+func (c *cacheRoot) symlink(target, name string) error {
+	dirfd, base, release, err := c.parent(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return unix.Symlinkat(target, dirfd, base)
+}
+
+// createTemp is os.CreateTemp for dir beneath the root. The name of the file is relative to the root
+func (c *cacheRoot) createTemp(dir, prefix string) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		name := path.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		dirfd, base, release, err := c.parent(name)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := unix.Openat(dirfd, base, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		release()
+		if err == unix.EEXIST && attempt < 10000 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return os.NewFile(uintptr(fd), name), nil
+	}
+}
+
+// mkdirTemp is os.MkdirTemp for dir beneath the root, returning the name relative to the root
+func (c *cacheRoot) mkdirTemp(dir, prefix string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		name := path.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		dirfd, base, release, err := c.parent(name)
+		if err != nil {
+			return "", err
+		}
+		err = unix.Mkdirat(dirfd, base, 0700)
+		release()
+		if err == unix.EEXIST && attempt < 10000 {
+			continue
+		}
+		return name, err
+	}
+}
+
+// mkdirAll is os.MkdirAll, refusing to create anything outside of the root
+func (c *cacheRoot) mkdirAll(name string, perm uint32) error {
+	name = path.Clean(name)
+	if name == "." {
+		return nil
+	}
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		dirfd, base, release, err := c.parent(path.Join(elems[:i+1]...))
+		if err != nil {
+			return errors.New(fmt.Sprintf("cannot create %s: %s", name, err.Error()))
+		}
+		err = unix.Mkdirat(dirfd, base, perm)
+		release()
+		if err != nil && err != unix.EEXIST {
+			return err
+		}
+	}
+	return nil
+}
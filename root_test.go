@@ -0,0 +1,107 @@
+package goproxy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes through the cache root never follow symlinks out of it, with openat2 or without
+func TestCacheRootConfined(t *testing.T) {
+	t.Run("openat2", func(t *testing.T) { testCacheRootConfined(t, true) })
+	t.Run("fallback", func(t *testing.T) { testCacheRootConfined(t, false) })
+}
+
+func testCacheRootConfined(t *testing.T, openat2 bool) {
+	dir, outside := t.TempDir(), t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "mod/.git"), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "mod/.git/HEAD"), []byte("x"), 0644)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(outside, "victim"), []byte("x"), 0644)
+	}
+	if err == nil {
+		err = os.Symlink(outside, filepath.Join(dir, "escape"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := openCacheRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !openat2 && root.openat2 {
+		root.openat2 = false
+		root.dir, err = filepath.EvalSymlinks(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	escapes := map[string]error{
+		"remove":     root.remove("escape/victim"),
+		"removeAll":  root.removeAll("escape/victim"),
+		"rename":     root.rename("escape/victim", "victim"),
+		"rename to":  root.rename("mod/.git", "escape/.git"),
+		"link":       root.link("mod/.git/HEAD", "escape/HEAD"),
+		"symlink":    root.symlink(".git", "escape/.vcs"),
+		"mkdirAll":   root.mkdirAll("escape/mod", 0755),
+		"parent ..":  root.remove("mod/.."),
+		"parent abs": root.remove("/victim"),
+	}
+	_, escapes["lstat"] = root.lstat("escape/victim")
+	_, escapes["createTemp"] = root.createTemp("escape", ".tmp-")
+	_, escapes["mkdirTemp"] = root.mkdirTemp("escape", ".gittmp")
+	for op, err := range escapes {
+		if err == nil {
+			t.Errorf("%s: escaped the root", op)
+		}
+	}
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 1 || entries[0].Name() != "victim" {
+		t.Errorf("outside of the root: %v", entries)
+	}
+
+	// The symlink itself is removed, not what it points to
+	mode, err := root.lstat("escape")
+	if err != nil || mode != fs.ModeSymlink {
+		t.Errorf("lstat(escape) = %v, %v", mode, err)
+	}
+	err = root.removeAll("escape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(outside, "victim")); err != nil {
+		t.Errorf("removeAll followed the symlink: %s", err.Error())
+	}
+
+	tmp, err := root.mkdirTemp("mod", ".gittmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := root.createTemp(tmp, ".tmp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	err = root.rename(tmp, "mod/.git")
+	if err == nil {
+		t.Errorf("renamed over an existing mirror")
+	}
+	err = root.symlink(".git", "mod/.vcs")
+	if err == nil {
+		_, err = root.readlink("mod/.vcs")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = root.removeAll("mod")
+	if err == nil {
+		_, err = root.lstat("mod")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("mod not removed: %v", err)
+	}
+}
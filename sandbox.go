@@ -0,0 +1,305 @@
+//go:build linux
+
+package goproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sandbox reduces the privileges of git/zip/zstd commands that only read the cache,
+// as they process untrusted repository content. Commands talking to remotes are left alone
+type Sandbox struct {
+	// Run read-only git commands as this user and group (requires root), 0 keeps the current user
+	Uid uint32 `json:",omitempty"`
+	Gid uint32 `json:",omitempty"`
+	// Restrict the file system with Landlock: read-only access to the cache and system directories,
+	// writes only beneath .tmp
+	Landlock bool `json:",omitempty"`
+	// Deny opening IPv4/IPv6 sockets with seccomp
+	NoNetwork bool `json:",omitempty"`
+}
+
+// Commands are re-executed through the proxy binary with this argv[0], which applies the
+// restrictions to itself and then executes the actual command: <sandboxArg0> <spec> -- <command> <args>...
+const sandboxArg0 = "goproxy-sandbox"
+
+type sandboxSpec struct {
+	Sandbox
+	// Cache root and its writable temp directory
+	Root string
+	Tmp  string
+	// Directories of executables
+	Exec   []string
+	Limits ResourceLimits
+}
+
+// Syscall numbers at or above this belong to a foreign ABI, such as x32 on amd64
+const seccompForeignNr = 0x40000000
+
+var activeSandbox *sandboxSpec
+var sandboxExecutable string
+
+// Git commands that only read the repository
+var gitReadOnlyCommands = []string{
+	"archive", "cat-file", "describe", "for-each-ref", "fsck", "log", "ls-tree", "rev-list", "rev-parse", "show", "show-ref",
+}
+
+func gitReadOnly(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	if args[0] == "config" {
+		return slices.Contains(args, "--get")
+	}
+	return slices.Contains(gitReadOnlyCommands, args[0])
+}
+
+// sandboxEnv is the whole environment of sandboxed commands. User and system git config is ignored,
+// which also keeps settings such as core.autocrlf from changing the generated zips
+func sandboxEnv() []string {
+	return []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=/nonexistent",
+		"LC_ALL=C",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_TERMINAL_PROMPT=0",
+	}
+}
+
+// UseSandbox enables the sandbox for subsequently spawned commands. The working directory is the cache root
+func UseSandbox(s Sandbox) error {
+	spec := &sandboxSpec{Sandbox: s}
+	var err error
+	spec.Root, err = os.Getwd()
+	if err != nil {
+		return err
+	}
+	spec.Tmp = filepath.Join(spec.Root, ".tmp")
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if filepath.IsAbs(dir) {
+			spec.Exec = append(spec.Exec, dir)
+		}
+	}
+	if s.Landlock {
+		abi, err := landlockABI()
+		if err != nil || abi < 1 {
+			return errors.New("landlock is not supported by the kernel")
+		}
+	}
+	if s.NoNetwork && seccompAuditArch == 0 {
+		return errors.New(fmt.Sprintf("seccomp filter is not supported on %s", runtime.GOARCH))
+	}
+	sandboxExecutable, err = os.Executable()
+	if err != nil {
+		return err
+	}
+	activeSandbox = spec
+	return nil
+}
+
+// sandboxCmd applies the sandbox to a command that only reads the cache at cacheDir ("" for the
+// working directory when the sandbox was set up)
+func sandboxCmd(cmd *exec.Cmd, cacheDir string, git bool) {
+	spec := sandboxSpec{}
+	s := activeSandbox
+	if s != nil {
+		// Without a sandbox, commands keep the user and system git config, such as safe.directory
+		cmd.Env = sandboxEnv()
+		spec = *s
+		if cacheDir != "" {
+			spec.Root = cacheDir
+			spec.Tmp = filepath.Join(cacheDir, ".tmp")
+		}
+	}
+	if s != nil && git && s.Uid != 0 && cmd.Err == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: s.Uid, Gid: s.Gid}}
+		// The mirrors are owned by the proxy user
+		cmd.Args = append([]string{cmd.Args[0], "-c", "safe.directory=*"}, cmd.Args[1:]...)
+	}
+	wrapCmd(cmd, spec)
+}
+
+// limitCmd applies only the resource limits, for commands talking to remotes
+func limitCmd(cmd *exec.Cmd) {
+	wrapCmd(cmd, sandboxSpec{})
+}
+
+// wrapCmd runs the command in its own process group, through the sandbox helper if there's anything for it to do
+func wrapCmd(cmd *exec.Cmd, spec sandboxSpec) {
+	if cmd.Err != nil {
+		return
+	}
+	processGroupCmd(cmd)
+	if cgroupFD >= 0 {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = cgroupFD
+	}
+	spec.Limits = activeLimits
+	if !spec.Landlock && !spec.NoNetwork && len(spec.Limits.rlimits()) == 0 {
+		return
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return
+	}
+	cmd.Args = append([]string{sandboxArg0, string(data), "--", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = sandboxExecutable
+}
+
+func init() {
+	if len(os.Args) < 4 || os.Args[0] != sandboxArg0 || os.Args[2] != "--" {
+		return
+	}
+	// Restrictions apply to the calling thread, which must also be the one executing the command
+	runtime.LockOSThread()
+	err := enterSandbox(os.Args[1])
+	if err == nil {
+		err = syscall.Exec(os.Args[3], os.Args[3:], os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", sandboxArg0, err.Error())
+	os.Exit(126)
+}
+
+func enterSandbox(specJSON string) error {
+	spec := sandboxSpec{}
+	err := json.Unmarshal([]byte(specJSON), &spec)
+	if err != nil {
+		return err
+	}
+	err = applyResourceLimits(&spec.Limits)
+	if err != nil {
+		return err
+	}
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	if spec.Landlock {
+		err = applyLandlock(&spec)
+		if err != nil {
+			return errors.New(fmt.Sprintf("landlock: %s", err.Error()))
+		}
+	}
+	if spec.NoNetwork {
+		err = applyNoNetwork()
+		if err != nil {
+			return errors.New(fmt.Sprintf("seccomp: %s", err.Error()))
+		}
+	}
+	return nil
+}
+
+func landlockABI() (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(abi), nil
+}
+
+const (
+	landlockRead  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockExec  = landlockRead | unix.LANDLOCK_ACCESS_FS_EXECUTE
+	landlockWrite = landlockRead | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG
+	landlockFile = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+func applyLandlock(spec *sandboxSpec) error {
+	abi, err := landlockABI()
+	if err != nil {
+		return err
+	}
+	// Rights known to the kernel, all of them are denied unless granted below
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	ruleset, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer unix.Close(int(ruleset))
+	rules := map[string]uint64{
+		spec.Root:   landlockRead,
+		spec.Tmp:    landlockWrite,
+		"/dev/null": landlockFile,
+	}
+	for _, dir := range []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc", "/proc", "/dev"} {
+		rules[dir] |= landlockExec
+	}
+	for _, dir := range spec.Exec {
+		rules[dir] |= landlockExec
+	}
+	for name, access := range rules {
+		fd, err := unix.Open(name, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			// Directories missing on this system
+			continue
+		}
+		var st unix.Stat_t
+		unix.Fstat(fd, &st)
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			access &= landlockFile | unix.LANDLOCK_ACCESS_FS_EXECUTE
+		}
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access & handled, Parent_fd: int32(fd)}
+		_, _, errno = unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, ruleset, unix.LANDLOCK_RULE_PATH_BENEATH,
+			uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		unix.Close(fd)
+		if errno != 0 {
+			return errors.New(fmt.Sprintf("failed to add rule for %s: %s", name, errno.Error()))
+		}
+	}
+	_, _, errno = unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, ruleset, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// applyNoNetwork installs a seccomp filter failing socket(AF_INET/AF_INET6) with EACCES.
+// Syscalls of foreign ABIs (such as x32 or i386 on amd64) are failed altogether
+func applyNoNetwork() error {
+	const (
+		offNr   = 0
+		offArch = 4
+		offArg0 = 16
+		errno   = unix.SECCOMP_RET_ERRNO | uint32(unix.EACCES)
+	)
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: seccompAuditArch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: errno},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offNr},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 0, Jf: 1, K: seccompForeignNr},
+		{Code: unix.BPF_RET | unix.BPF_K, K: errno},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 3, K: unix.SYS_SOCKET},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offArg0},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 2, Jf: 0, K: unix.AF_INET},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: unix.AF_INET6},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+		{Code: unix.BPF_RET | unix.BPF_K, K: errno},
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0)
+}
@@ -0,0 +1,7 @@
+//go:build linux
+
+package goproxy
+
+import "golang.org/x/sys/unix"
+
+const seccompAuditArch = unix.AUDIT_ARCH_AARCH64
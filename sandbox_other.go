@@ -0,0 +1,6 @@
+//go:build linux && !amd64 && !arm64
+
+package goproxy
+
+// The seccomp filter is not available on other architectures of Linux
+const seccompAuditArch = 0
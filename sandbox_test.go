@@ -0,0 +1,29 @@
+//go:build linux
+
+package goproxy
+
+import (
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+// Without a sandbox, read-only git commands keep the environment, and the git config with it
+func TestSandboxCmdEnv(t *testing.T) {
+	saved := activeSandbox
+	defer func() { activeSandbox = saved }()
+
+	activeSandbox = nil
+	cmd := exec.Command(GitCommand, "log")
+	sandboxCmd(cmd, "", true)
+	if cmd.Env != nil {
+		t.Errorf("without a sandbox, Env = %q, want the inherited environment", cmd.Env)
+	}
+
+	activeSandbox = &sandboxSpec{}
+	cmd = exec.Command(GitCommand, "log")
+	sandboxCmd(cmd, "", true)
+	if !slices.Contains(cmd.Env, "GIT_CONFIG_GLOBAL=/dev/null") {
+		t.Errorf("with a sandbox, Env = %q, want the git config ignored", cmd.Env)
+	}
+}
@@ -0,0 +1,235 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// readModuleFile returns the .info/.mod of a module version from the cache
+func (p *ProxyServer) readModuleFile(ctx context.Context, modulePath, version, ext string) ([]byte, error) {
+	modulePathTrim, verMajorTag, incompat, ok := checkModulePathVer(modulePath, version)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("module path/ver %s[%s] is invalid or not supported", modulePath, version))
+	}
+	reader, err := p.serveModLocal(ctx, modulePathTrim, verMajorTag, semver.Canonical(version), ext, incompat)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// sbomComponent is a module in the SBOM, the first one being the described module itself
+type sbomComponent struct {
+	Path     string
+	Version  string
+	Indirect bool
+	Origin   *Origin
+	Hash     string
+	// SPDX identifiers, from the license inventory
+	Licenses []string
+}
+
+func (c *sbomComponent) purl() string {
+	return fmt.Sprintf("pkg:golang/%s@%s", c.Path, c.Version)
+}
+
+// sbomComponents lists the module and the requirements of its go.mod
+func (p *ProxyServer) sbomComponents(ctx context.Context, modulePath, version string) ([]sbomComponent, error) {
+	data, err := p.readModuleFile(ctx, modulePath, version, ".mod")
+	if err != nil {
+		return nil, err
+	}
+	mod, err := modfile.ParseLax("go.mod", data, nil)
+	if err != nil {
+		return nil, err
+	}
+	main := sbomComponent{Path: modulePath, Version: version}
+	info, err := p.readModuleFile(ctx, modulePath, version, ".info")
+	if err == nil {
+		var rev RevInfo
+		if json.Unmarshal(info, &rev) == nil {
+			main.Origin = rev.Origin
+		}
+	}
+	escapedModulePath, _ := module.EscapePath(modulePath)
+	escapedVersion, _ := module.EscapeVersion(version)
+	att, err := p.loadAttestation(escapedModulePath, escapedVersion)
+	if err == nil {
+		var prov Provenance
+		if json.Unmarshal([]byte(att.Statement), &prov) == nil {
+			main.Hash = prov.Hash
+		}
+	}
+	report, err := p.loadLicenseReport(escapedModulePath, escapedVersion)
+	if err == nil {
+		for _, id := range report.Licenses {
+			if id != "unknown" {
+				main.Licenses = append(main.Licenses, id)
+			}
+		}
+	}
+	components := []sbomComponent{main}
+	for _, req := range mod.Require {
+		components = append(components, sbomComponent{Path: req.Mod.Path, Version: req.Mod.Version, Indirect: req.Indirect})
+	}
+	return components, nil
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func cycloneDXComponent(c *sbomComponent) map[string]any {
+	comp := map[string]any{
+		"type":    "library",
+		"bom-ref": c.purl(),
+		"name":    c.Path,
+		"version": c.Version,
+		"purl":    c.purl(),
+	}
+	var props []map[string]string
+	if c.Indirect {
+		props = append(props, map[string]string{"name": "go:indirect", "value": "true"})
+	}
+	if c.Hash != "" {
+		props = append(props, map[string]string{"name": "go:sum", "value": c.Hash})
+	}
+	if props != nil {
+		comp["properties"] = props
+	}
+	if len(c.Licenses) != 0 {
+		var licenses []map[string]any
+		for _, id := range c.Licenses {
+			licenses = append(licenses, map[string]any{"license": map[string]string{"id": id}})
+		}
+		comp["licenses"] = licenses
+	}
+	if c.Origin != nil && c.Origin.URL != "" {
+		comp["externalReferences"] = []map[string]string{{"type": "vcs", "url": c.Origin.URL}}
+		if c.Origin.Hash != "" {
+			comp["pedigree"] = map[string]any{"commits": []map[string]string{{"uid": c.Origin.Hash, "url": c.Origin.URL}}}
+		}
+	}
+	return comp
+}
+
+// cycloneDX renders a CycloneDX 1.5 JSON BOM
+func cycloneDX(components []sbomComponent) map[string]any {
+	var comps []map[string]any
+	var deps []string
+	for i := range components[1:] {
+		comps = append(comps, cycloneDXComponent(&components[i+1]))
+		deps = append(deps, components[i+1].purl())
+	}
+	return map[string]any{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + newUUID(),
+		"version":      1,
+		"metadata": map[string]any{
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"tools":     []map[string]string{{"name": "goproxy", "version": buildVersion()}},
+			"component": cycloneDXComponent(&components[0]),
+		},
+		"components":   comps,
+		"dependencies": []map[string]any{{"ref": components[0].purl(), "dependsOn": deps}},
+	}
+}
+
+// spdx renders an SPDX 2.3 JSON document
+func spdx(components []sbomComponent) map[string]any {
+	var packages []map[string]any
+	var relationships []map[string]string
+	for i, c := range components {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+		download := "NOASSERTION"
+		if c.Origin != nil && c.Origin.URL != "" {
+			download = "git+" + c.Origin.URL
+			if c.Origin.Hash != "" {
+				download += "@" + c.Origin.Hash
+			}
+		}
+		declared := "NOASSERTION"
+		if len(c.Licenses) != 0 {
+			declared = strings.Join(c.Licenses, " AND ")
+		}
+		pkg := map[string]any{
+			"SPDXID":           id,
+			"name":             c.Path,
+			"versionInfo":      c.Version,
+			"downloadLocation": download,
+			"filesAnalyzed":    false,
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  declared,
+			"copyrightText":    "NOASSERTION",
+			"externalRefs": []map[string]string{{
+				"referenceCategory": "PACKAGE-MANAGER",
+				"referenceType":     "purl",
+				"referenceLocator":  c.purl(),
+			}},
+		}
+		packages = append(packages, pkg)
+		if i == 0 {
+			relationships = append(relationships, map[string]string{
+				"spdxElementId": "SPDXRef-DOCUMENT", "relationshipType": "DESCRIBES", "relatedSpdxElement": id})
+		} else {
+			relationships = append(relationships, map[string]string{
+				"spdxElementId": "SPDXRef-Package-0", "relationshipType": "DEPENDS_ON", "relatedSpdxElement": id})
+		}
+	}
+	name := components[0].Path + "@" + components[0].Version
+	return map[string]any{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              name,
+		"documentNamespace": "https://spdx.org/spdxdocs/goproxy/" + name + "-" + newUUID(),
+		"creationInfo": map[string]any{
+			"created":  time.Now().UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: goproxy-" + buildVersion()},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+// serveAdminSBOM serves the SBOM of ?path=<module>&version=<version>[&format=cyclonedx|spdx]
+func (p *ProxyServer) serveAdminSBOM(w http.ResponseWriter, r *http.Request) {
+	modulePath, version := r.URL.Query().Get("path"), r.URL.Query().Get("version")
+	err := module.Check(modulePath, version)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.localTimeout())
+	defer cancel()
+	components, err := p.sbomComponents(ctx, modulePath, version)
+	if err != nil {
+		httpRespString(w, http.StatusNotFound, err.Error())
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "cyclonedx":
+		httpRespJSON(w, http.StatusOK, cycloneDX(components))
+	case "spdx":
+		httpRespJSON(w, http.StatusOK, spdx(components))
+	default:
+		httpRespString(w, http.StatusBadRequest, "format must be cyclonedx or spdx")
+	}
+}
@@ -0,0 +1,109 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ScanArtifact is a module zip about to be served and cached
+type ScanArtifact struct {
+	Module  string
+	Version string
+	// Path of the zip, only valid during the scan. Zips are unnamed files, thus this is a /dev/fd path
+	Path string
+	File *os.File
+	// Where the zip was generated from, nil if unknown
+	Origin *Origin
+}
+
+// Scanner inspects module zips after they are generated, before they are served or stored.
+// Returning an error vetoes serving, the error implementing Status() int selects the HTTP status (default 403)
+type Scanner interface {
+	Scan(ctx context.Context, artifact *ScanArtifact) error
+}
+
+// ScanError is a veto of a Scanner
+type ScanError struct {
+	Module  string
+	Version string
+	Reason  string
+	Code    int
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("%s@%s refused by scanner: %s", e.Module, e.Version, e.Reason)
+}
+
+func (e *ScanError) Status() int {
+	if e.Code == 0 {
+		return http.StatusForbidden
+	}
+	return e.Code
+}
+
+// CommandScanner runs an external command for each zip, which gets the zip as /dev/fd/3 (also
+// passed as the last argument) and GOPROXY_SCAN_MODULE/GOPROXY_SCAN_VERSION/GOPROXY_SCAN_ORIGIN
+// in the environment. A non-zero exit vetoes serving, with the first line of the output as reason
+type CommandScanner struct {
+	Command []string
+}
+
+func (s *CommandScanner) Scan(ctx context.Context, artifact *ScanArtifact) error {
+	if len(s.Command) == 0 {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, s.Command[0], append(s.Command[1:], "/dev/fd/3")...)
+	limitCmd(cmd)
+	cmd.Env = append(os.Environ(),
+		"GOPROXY_SCAN_MODULE="+artifact.Module,
+		"GOPROXY_SCAN_VERSION="+artifact.Version)
+	if artifact.Origin != nil {
+		cmd.Env = append(cmd.Env, "GOPROXY_SCAN_ORIGIN="+artifact.Origin.URL+"@"+artifact.Origin.Hash)
+	}
+	cmd.ExtraFiles = []*os.File{artifact.File}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return errors.New(fmt.Sprintf("failed to run scanner %s: %s", s.Command[0], err.Error()))
+	}
+	reason, _, _ := strings.Cut(strings.TrimSpace(out.String()), "\n")
+	if reason == "" {
+		reason = err.Error()
+	}
+	return &ScanError{Module: artifact.Module, Version: artifact.Version, Reason: reason}
+}
+
+// scanZip runs the scanners on a generated zip, the first error vetoes serving it
+func (p *ProxyServer) scanZip(ctx context.Context, modulePath, version string, zip *os.File, origin *Origin) error {
+	if len(p.Scanners) == 0 {
+		return nil
+	}
+	artifact := &ScanArtifact{
+		Module:  modulePath,
+		Version: version,
+		Path:    fmt.Sprintf("/dev/fd/%d", zip.Fd()),
+		File:    zip,
+		Origin:  origin,
+	}
+	for _, scanner := range p.Scanners {
+		err := scanner.Scan(ctx, artifact)
+		zip.Seek(0, 0)
+		if err != nil {
+			loggerRed.Printf(requestTag(ctx)+"scanZip: %s@%s vetoed: %s"+LOG_RST, modulePath, version, err.Error())
+			return err
+		}
+	}
+	return nil
+}
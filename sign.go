@@ -0,0 +1,171 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+const AttestationStoreDir = ".attestations"
+
+// Provenance records where a served zip came from. It is signed as the Statement of an Attestation
+type Provenance struct {
+	Module  string
+	Version string
+	// dirhash of the zip, as in go.sum
+	Hash      string
+	Origin    *Origin `json:",omitempty"`
+	BuildTime time.Time
+	Builder   string
+}
+
+// Attestation is kept for every zip served while SigningKey is set. Signatures are ed25519, base64 encoded
+type Attestation struct {
+	// JSON of the Provenance, exactly as signed
+	Statement string
+	Signature string
+	// Signature of the go.sum line "<module> <version> <hash>\n", also sent as X-GoProxy-Signature
+	SumSignature string
+	KeyID        string
+}
+
+type signer struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// loadSigningKey reads a PEM encoded PKCS#8 ed25519 key, as generated by
+// openssl genpkey -algorithm ed25519
+func loadSigningKey(name string) (*signer, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no PKCS#8 private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%T is not an ed25519 key", key))
+	}
+	sum := sha256.Sum256(edKey.Public().(ed25519.PublicKey))
+	return &signer{key: edKey, keyID: hex.EncodeToString(sum[:8])}, nil
+}
+
+func (s *signer) sign(data string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, []byte(data)))
+}
+
+func (s *signer) publicKeyPEM() []byte {
+	der, _ := x509.MarshalPKIXPublicKey(s.key.Public())
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func (p *ProxyServer) loadAttestation(escapedModulePath, escapedVersion string) (*Attestation, error) {
+	att := &Attestation{}
+	err := p.loadRecord(context.Background(), recordKey(AttestationStoreDir, escapedModulePath, escapedVersion), att)
+	if err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// attestZip returns the attestation of the zip, creating and storing it on first use.
+// Zips are reproducible, thus the first attestation holds for later generations
+func (p *ProxyServer) attestZip(escapedModulePath, escapedVersion, modulePath, version string, zip *os.File, origin *Origin) (*Attestation, error) {
+	att, err := p.loadAttestation(escapedModulePath, escapedVersion)
+	if err == nil {
+		return att, nil
+	}
+	hash, err := p.zipHash(escapedModulePath, escapedVersion, zip)
+	if err != nil {
+		return nil, err
+	}
+	prov := Provenance{
+		Module:    modulePath,
+		Version:   version,
+		Hash:      hash,
+		Origin:    origin,
+		BuildTime: time.Now().UTC(),
+		Builder:   "goproxy " + buildVersion(),
+	}
+	statement, err := json.Marshal(prov)
+	if err != nil {
+		return nil, err
+	}
+	att = &Attestation{
+		Statement:    string(statement),
+		Signature:    p.signer.sign(string(statement)),
+		SumSignature: p.signer.sign(fmt.Sprintf("%s %s %s\n", modulePath, version, hash)),
+		KeyID:        p.signer.keyID,
+	}
+	err = p.storeRecord(context.Background(), recordKey(AttestationStoreDir, escapedModulePath, escapedVersion), att)
+	if err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// attestServedZip sets the attestation headers of a zip about to be served, attesting it first if needed.
+// Errors are only logged, the zip is served regardless
+func (p *ProxyServer) attestServedZip(w http.ResponseWriter, r *http.Request, escapedModulePath, prop, modulePath string, zip *os.File, origin func() *Origin) {
+	escapedVersion := strings.TrimSuffix(prop, ".zip")
+	version, err := module.UnescapeVersion(escapedVersion)
+	if err == nil {
+		var att *Attestation
+		att, err = p.attestZip(escapedModulePath, escapedVersion, modulePath, version, zip, origin())
+		if err == nil {
+			setAttestationHeaders(w, att)
+			return
+		}
+	}
+	loggerYellow.Printf(requestTag(r.Context())+"attestServedZip: Failed to attest %s: %s"+LOG_RST, r.URL.Path, err.Error())
+}
+
+func setAttestationHeaders(w http.ResponseWriter, att *Attestation) {
+	var prov Provenance
+	if json.Unmarshal([]byte(att.Statement), &prov) == nil {
+		w.Header().Set("X-GoProxy-H1", prov.Hash)
+	}
+	w.Header().Set("X-GoProxy-Signature", fmt.Sprintf("ed25519 %s %s", att.KeyID, att.SumSignature))
+}
+
+// serveAdminAttestation serves the attestation of ?path=<module>&version=<version>
+func (p *ProxyServer) serveAdminAttestation(w http.ResponseWriter, r *http.Request) {
+	if p.signer == nil {
+		httpRespString(w, http.StatusNotFound, "signing is not enabled")
+		return
+	}
+	modulePath, version := r.URL.Query().Get("path"), r.URL.Query().Get("version")
+	err := module.Check(modulePath, version)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	escapedModulePath, _ := module.EscapePath(modulePath)
+	escapedVersion, _ := module.EscapeVersion(version)
+	att, err := p.loadAttestation(escapedModulePath, escapedVersion)
+	if err != nil {
+		httpRespString(w, http.StatusNotFound, "no attestation, the zip has not been served yet")
+		return
+	}
+	httpRespJSON(w, http.StatusOK, att)
+}
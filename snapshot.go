@@ -0,0 +1,388 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Snapshots are kept in SnapshotDir as <name>.json
+const SnapshotDir = ".snapshots"
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// SnapshotVersion is a module version of a snapshot, with what it resolved to when taken
+type SnapshotVersion struct {
+	Version string
+	// Commit of the mirror the version was served from
+	Hash string `json:",omitempty"`
+	// Hashes of the zip and go.mod as in go.sum, if they were known
+	H1    string `json:",omitempty"`
+	ModH1 string `json:",omitempty"`
+}
+
+// Snapshot is the immutable set of module versions cached at some point, served beneath
+// snapshot/<name>/ so that builds against it are reproducible while the cache moves on
+type Snapshot struct {
+	Name    string
+	Created time.Time
+	Modules map[string][]SnapshotVersion
+}
+
+// SnapshotSummary describes a snapshot without listing its versions
+type SnapshotSummary struct {
+	Name     string
+	Created  time.Time
+	Modules  int
+	Versions int
+}
+
+type snapshotState struct {
+	mu sync.Mutex
+	// Snapshots loaded, they never change
+	loaded map[string]*Snapshot
+}
+
+var errSnapshotExists = errors.New("snapshot already exists")
+
+func (p *ProxyServer) snapshotPath(name string) string {
+	return p.cachePath(path.Join(SnapshotDir, name+".json"))
+}
+
+func (p *ProxyServer) loadSnapshot(name string) (*Snapshot, error) {
+	if !snapshotName.MatchString(name) {
+		return nil, errors.New(fmt.Sprintf("invalid snapshot name %q", name))
+	}
+	p.snapshots.mu.Lock()
+	defer p.snapshots.mu.Unlock()
+	if s, ok := p.snapshots.loaded[name]; ok {
+		return s, nil
+	}
+	data, err := os.ReadFile(p.snapshotPath(name))
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	if p.snapshots.loaded == nil {
+		p.snapshots.loaded = make(map[string]*Snapshot)
+	}
+	p.snapshots.loaded[name] = s
+	return s, nil
+}
+
+func (s *Snapshot) version(modulePath, version string) (SnapshotVersion, bool) {
+	for _, v := range s.Modules[modulePath] {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return SnapshotVersion{}, false
+}
+
+func (s *Snapshot) summary() SnapshotSummary {
+	summary := SnapshotSummary{Name: s.Name, Created: s.Created, Modules: len(s.Modules)}
+	for _, versions := range s.Modules {
+		summary.Versions += len(versions)
+	}
+	return summary
+}
+
+// cachedVersions lists the module versions served so far: those generated from mirrors, as
+// recorded in ArtifactStoreDir, and those in the stores of the GOPROXY layout
+func (p *ProxyServer) cachedVersions() map[module.Version]*ArtifactInfo {
+	versions := make(map[module.Version]*ArtifactInfo)
+	ctx := context.Background()
+	keys, _ := p.Storage.List(ctx, ArtifactStoreDir+"/")
+	for _, key := range keys {
+		info := &ArtifactInfo{}
+		if strings.HasSuffix(key, ".json") && p.loadRecord(ctx, key, info) == nil {
+			versions[module.Version{Path: info.Module, Version: info.Version}] = info
+		}
+	}
+	for _, store := range []*cacheRoot{p.modCache, p.layout, p.peerStore, p.upstreamStore, p.toolchainStore} {
+		if store == nil {
+			continue
+		}
+		filepath.WalkDir(store.dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() || !strings.HasSuffix(name, ".info") {
+				return nil
+			}
+			rel, err := filepath.Rel(store.dir, name)
+			if err != nil {
+				return nil
+			}
+			escapedModulePath, escapedVersion, ok := strings.Cut(strings.TrimSuffix(filepath.ToSlash(rel), ".info"), "/@v/")
+			if !ok {
+				return nil
+			}
+			modulePath, err1 := module.UnescapePath(escapedModulePath)
+			version, err2 := module.UnescapeVersion(escapedVersion)
+			if err1 != nil || err2 != nil {
+				return nil
+			}
+			v := module.Version{Path: modulePath, Version: version}
+			if _, ok := versions[v]; !ok {
+				versions[v] = nil
+			}
+			return nil
+		})
+	}
+	return versions
+}
+
+// createSnapshot records the module versions cached now as snapshot name
+func (p *ProxyServer) createSnapshot(r *http.Request, name string) (*Snapshot, error) {
+	if !snapshotName.MatchString(name) {
+		return nil, errors.New(fmt.Sprintf("invalid snapshot name %q", name))
+	}
+	if _, err := os.Stat(p.snapshotPath(name)); err == nil {
+		return nil, errSnapshotExists
+	}
+	s := &Snapshot{Name: name, Created: time.Now().UTC(), Modules: make(map[string][]SnapshotVersion)}
+	for v, artifact := range p.cachedVersions() {
+		if err := module.Check(v.Path, v.Version); err != nil {
+			continue
+		}
+		if p.Policy != nil && p.Policy.denied(v.Path) != "" {
+			continue
+		}
+		data, err := p.cachedInfo(r.Context(), v.Path, v.Version)
+		if err != nil {
+			// No longer servable, such as a purged mirror
+			continue
+		}
+		sv := SnapshotVersion{Version: v.Version}
+		var info RevInfo
+		if json.Unmarshal(data, &info) == nil && info.Origin != nil {
+			sv.Hash = info.Origin.Hash
+		}
+		if artifact != nil {
+			sv.H1, sv.ModH1 = artifact.H1, artifact.ModH1
+		}
+		s.Modules[v.Path] = append(s.Modules[v.Path], sv)
+	}
+	for _, versions := range s.Modules {
+		sort.Slice(versions, func(i, k int) bool {
+			return semver.Compare(versions[i].Version, versions[k].Version) < 0
+		})
+	}
+	data, _ := json.MarshalIndent(s, "", "\t")
+	err := os.MkdirAll(p.cachePath(SnapshotDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+	tmp := fmt.Sprintf("%s.%d", p.snapshotPath(name), os.Getpid())
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	// Unlike rename, link never replaces a snapshot taken meanwhile
+	err = os.Link(tmp, p.snapshotPath(name))
+	if os.IsExist(err) {
+		return nil, errSnapshotExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// listSnapshots summarizes every snapshot, the oldest first
+func (p *ProxyServer) listSnapshots() []SnapshotSummary {
+	summaries := []SnapshotSummary{}
+	entries, _ := os.ReadDir(p.cachePath(SnapshotDir))
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if s, err := p.loadSnapshot(name); err == nil {
+			summaries = append(summaries, s.summary())
+		}
+	}
+	sort.Slice(summaries, func(i, k int) bool {
+		return summaries[i].Created.Before(summaries[k].Created)
+	})
+	return summaries
+}
+
+func (p *ProxyServer) deleteSnapshot(name string) error {
+	if !snapshotName.MatchString(name) {
+		return errors.New(fmt.Sprintf("invalid snapshot name %q", name))
+	}
+	err := os.Remove(p.snapshotPath(name))
+	if err != nil {
+		return err
+	}
+	p.snapshots.mu.Lock()
+	delete(p.snapshots.loaded, name)
+	p.snapshots.mu.Unlock()
+	return nil
+}
+
+// serveAdminSnapshot takes (POST), returns (GET) or deletes (DELETE) the snapshot ?name=
+func (p *ProxyServer) serveAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+		s, err := p.loadSnapshot(name)
+		if err != nil {
+			httpRespString(w, http.StatusNotFound, fmt.Sprintf("snapshot %s not found", name))
+			return
+		}
+		httpRespJSON(w, http.StatusOK, s)
+	case http.MethodPost:
+		s, err := p.createSnapshot(r, name)
+		if err == errSnapshotExists {
+			httpRespString(w, http.StatusConflict, fmt.Sprintf("snapshot %s already exists", name))
+			return
+		}
+		if err != nil {
+			httpRespString(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		summary := s.summary()
+		loggerGreen.Printf(requestTag(r.Context())+"serveAdminSnapshot: Took snapshot %s of %d versions of %d modules"+LOG_RST,
+			name, summary.Versions, summary.Modules)
+		httpRespJSON(w, http.StatusOK, summary)
+	case http.MethodDelete:
+		err := p.deleteSnapshot(name)
+		if err != nil {
+			httpRespString(w, http.StatusNotFound, fmt.Sprintf("snapshot %s not found", name))
+			return
+		}
+		loggerYellow.Printf(requestTag(r.Context())+"serveAdminSnapshot: Deleted snapshot %s"+LOG_RST, name)
+		httpRespString(w, http.StatusOK, "OK")
+	default:
+		httpRespString(w, http.StatusMethodNotAllowed, "snapshot requires GET, POST or DELETE")
+	}
+}
+
+// serveSnapshot serves <name>/<module>/@v/... from the cache, only the versions of the snapshot.
+// Versions that no longer resolve to what they did when the snapshot was taken (such as a tag
+// moved upstream, then fetched) are refused with 410 rather than served differently
+func (p *ProxyServer) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(r.URL.Path, "/")
+	s, err := p.loadSnapshot(name)
+	if err != nil {
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("snapshot %s not found", name))
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = rest
+	r2.URL.RawPath = ""
+	if r.URL.RawPath != "" {
+		_, r2.URL.RawPath, _ = strings.Cut(r.URL.RawPath, "/")
+	}
+	// Nothing is fetched for a snapshot
+	r2.Header.Del(RefreshHeader)
+	escapedModulePath, prop, ok := parseRequest(w, r2)
+	if !ok || !p.checkPolicy(w, r2, escapedModulePath, prop) {
+		return
+	}
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	versions := s.Modules[modulePath]
+	switch prop {
+	case "list":
+		list := strings.Builder{}
+		for _, v := range versions {
+			list.WriteString(v.Version + "\n")
+		}
+		// A snapshot never changes, neither do its list and @latest
+		p.setCacheControl(w, "info")
+		httpRespBytes(w, "text/plain; charset=UTF-8", []byte(list.String()))
+		return
+	case "latest":
+		latest := ""
+		for _, v := range versions {
+			if latest == "" || semver.Prerelease(v.Version) == "" || semver.Prerelease(latest) != "" {
+				latest = v.Version
+			}
+		}
+		if latest == "" {
+			httpRespString(w, http.StatusNotFound, fmt.Sprintf("not found: %s is not in snapshot %s", modulePath, name))
+			return
+		}
+		data, err := p.cachedInfo(r.Context(), modulePath, latest)
+		if err != nil {
+			httpRespError(w, err)
+			return
+		}
+		p.setCacheControl(w, "info")
+		httpRespBytes(w, "application/json", data)
+		return
+	}
+	ext := path.Ext(prop)
+	version, err := module.UnescapeVersion(strings.TrimSuffix(prop, ext))
+	if err != nil {
+		httpRespString(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sv, ok := s.version(modulePath, version)
+	if !ok {
+		httpRespString(w, http.StatusNotFound, fmt.Sprintf("not found: %s@%s is not in snapshot %s", modulePath, version, name))
+		return
+	}
+	if reason := p.snapshotChanged(r, modulePath, sv); reason != "" {
+		loggerRed.Printf(requestTag(r.Context())+"serveSnapshot: %s@%s of snapshot %s %s"+LOG_RST, modulePath, version, name, reason)
+		httpRespString(w, http.StatusGone, fmt.Sprintf("%s@%s of snapshot %s %s", modulePath, version, name, reason))
+		return
+	}
+	p.serveModCached(w, r2)
+}
+
+// snapshotChanged tells how the version no longer matches the snapshot, "" if it does
+func (p *ProxyServer) snapshotChanged(r *http.Request, modulePath string, sv SnapshotVersion) string {
+	if sv.Hash != "" {
+		// Resolved in the mirror again, the memory cache may predate an update
+		modulePathTrim, verMajorTag, incompat, _ := checkModulePathVer(modulePath, sv.Version)
+		reader, err := p.serveModLocal(r.Context(), modulePathTrim, verMajorTag, sv.Version, ".info", incompat)
+		if err != nil {
+			return "is no longer cached: " + err.Error()
+		}
+		var info RevInfo
+		err = json.NewDecoder(reader).Decode(&info)
+		reader.Close()
+		if err == nil && info.Origin != nil && info.Origin.Hash != sv.Hash {
+			return fmt.Sprintf("moved from commit %s to %s", sv.Hash, info.Origin.Hash)
+		}
+	}
+	escapedModulePath, _ := module.EscapePath(modulePath)
+	escapedVersion, _ := module.EscapeVersion(sv.Version)
+	if artifact, err := p.loadArtifactInfo(escapedModulePath, escapedVersion); err == nil {
+		if sv.H1 != "" && artifact.H1 != "" && artifact.H1 != sv.H1 {
+			return fmt.Sprintf("changed from %s to %s", sv.H1, artifact.H1)
+		}
+		if sv.ModH1 != "" && artifact.ModH1 != "" && artifact.ModH1 != sv.ModH1 {
+			return fmt.Sprintf("go.mod changed from %s to %s", sv.ModH1, artifact.ModH1)
+		}
+	}
+	return ""
+}
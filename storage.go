@@ -0,0 +1,242 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage keeps the artifacts and metadata of the cache: compressed archives (ArchiveStoreDir),
+// and the records of ArtifactStoreDir, AttestationStoreDir, LicenseStoreDir and OSVStoreDir.
+// Keys are slash separated paths such as .artifacts/<module>@<version>.json, both escaped.
+// Mirrors, locks and the GOPROXY layout stay on the file system. The default is FileStorage in
+// the cache directory, other backends (object stores, databases) can be set in ProxyServer
+type Storage interface {
+	// Get opens the object at key, with an error matching fs.ErrNotExist if there's none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put stores content at key, replacing the object there if any. Readers never observe a
+	// partial object
+	Put(ctx context.Context, key string, content io.Reader) error
+	// Stat describes the object at key, with an error matching fs.ErrNotExist if there's none
+	Stat(ctx context.Context, key string) (StorageInfo, error)
+	// Delete removes the object at key, if any
+	Delete(ctx context.Context, key string) error
+	// List returns the keys starting with prefix, in no particular order
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// StorageInfo describes a stored object
+type StorageInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// FileStorage stores objects as files beneath Dir, named by their keys. They're accessed relative
+// to Dir as the cache root, symlinks can't lead outside of it
+type FileStorage struct {
+	Dir string
+
+	mu   sync.Mutex
+	root *cacheRoot
+}
+
+// open checks key, returning the root to look it up in
+func (s *FileStorage) open(key string) (*cacheRoot, error) {
+	clean := path.Clean(key)
+	if clean != key || path.IsAbs(key) || key == ".." || strings.HasPrefix(key, "../") {
+		return nil, errors.New(fmt.Sprintf("invalid storage key %s", key))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.root == nil {
+		root, err := openStore(s.Dir)
+		if err != nil {
+			return nil, err
+		}
+		s.root = root
+	}
+	return s.root, nil
+}
+
+func (s *FileStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	root, err := s.open(key)
+	if err != nil {
+		return nil, err
+	}
+	return root.openFile(key)
+}
+
+// Put links files (such as unnamed temporary files) in place rather than copying them, keeping
+// their mode. Files are stored whole, regardless of their offset
+func (s *FileStorage) Put(ctx context.Context, key string, content io.Reader) error {
+	root, err := s.open(key)
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(key)
+	err = root.mkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	if f, ok := content.(*os.File); ok {
+		// A unique name to link to, that linkat doesn't replace
+		tmp := path.Join(dir, fmt.Sprintf(".tmp-%d-%d", os.Getpid(), time.Now().UnixNano()))
+		err = root.linkFile(f, tmp)
+		if err == nil {
+			return s.rename(root, tmp, key)
+		}
+		// Such as on another file system, copy it
+		f.Seek(0, io.SeekStart)
+	}
+	f, err := root.createTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	f.Close()
+	if err != nil {
+		root.remove(f.Name())
+		return err
+	}
+	return s.rename(root, f.Name(), key)
+}
+
+func (s *FileStorage) rename(root *cacheRoot, tmp, key string) error {
+	err := root.rename(tmp, key)
+	if err != nil {
+		root.remove(tmp)
+	}
+	return err
+}
+
+func (s *FileStorage) Stat(ctx context.Context, key string) (StorageInfo, error) {
+	root, err := s.open(key)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	f, err := root.openFile(key)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *FileStorage) Delete(ctx context.Context, key string) error {
+	root, err := s.open(key)
+	if err != nil {
+		return err
+	}
+	err = root.remove(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List walks the directory of prefix, skipping the temporary files of Put
+func (s *FileStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+	dir = path.Clean(dir)
+	store, err := s.open(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Only walked if it's beneath Dir, WalkDir follows it if it's a symlink
+	err = store.beneath(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(s.Dir, filepath.FromSlash(dir))
+	var keys []string
+	err = filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// deleteStored removes the objects whose key is base followed by one of patterns (as in
+// path.Match). Errors are only logged
+func (p *ProxyServer) deleteStored(ctx context.Context, base string, patterns ...string) {
+	keys, err := p.Storage.List(ctx, base)
+	if err != nil {
+		loggerYellow.Printf(requestTag(ctx)+"deleteStored: Failed to list %s: %s"+LOG_RST, base, err.Error())
+	}
+	for _, key := range keys {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, strings.TrimPrefix(key, base)); ok {
+				err = p.Storage.Delete(ctx, key)
+				if err != nil {
+					loggerYellow.Printf(requestTag(ctx)+"deleteStored: Failed to delete %s: %s"+LOG_RST, key, err.Error())
+				}
+				break
+			}
+		}
+	}
+}
+
+// recordKey is the key of the record of <module>@<version> in store, both escaped
+func recordKey(store, escapedModulePath, escapedVersion string) string {
+	return path.Join(store, escapedModulePath+"@"+escapedVersion+".json")
+}
+
+// loadRecord reads the JSON record at key into v
+func (p *ProxyServer) loadRecord(ctx context.Context, key string, v any) error {
+	r, err := p.Storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// storeRecord stores v at key as indented JSON
+func (p *ProxyServer) storeRecord(ctx context.Context, key string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return p.Storage.Put(ctx, key, bytes.NewReader(data))
+}
@@ -0,0 +1,229 @@
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// goSumEntry holds the hashes of a module version in go.sum: of the zip, and of the go.mod
+type goSumEntry struct {
+	H1    string
+	ModH1 string
+}
+
+// sumAllowlist is the union of the go.sum files of SumAllowlist, read again when one changes
+type sumAllowlist struct {
+	files    []string
+	mu       sync.Mutex
+	modTimes []time.Time
+	sums     map[module.Version]goSumEntry
+	// Versions of each module, sorted
+	versions map[string][]string
+}
+
+// parseGoSum adds the lines of a go.sum file to sums
+func parseGoSum(name string, sums map[module.Version]goSumEntry) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "h1:") {
+			return errors.New(fmt.Sprintf("%s:%d: malformed go.sum line", name, lineno))
+		}
+		version, isMod := strings.CutSuffix(fields[1], "/go.mod")
+		v := module.Version{Path: fields[0], Version: version}
+		if err := module.Check(v.Path, v.Version); err != nil {
+			return errors.New(fmt.Sprintf("%s:%d: %s", name, lineno, err.Error()))
+		}
+		entry := sums[v]
+		if isMod {
+			entry.ModH1 = fields[2]
+		} else {
+			entry.H1 = fields[2]
+		}
+		sums[v] = entry
+	}
+	return scanner.Err()
+}
+
+func newSumAllowlist(files []string) (*sumAllowlist, error) {
+	a := &sumAllowlist{files: files}
+	return a, a.load()
+}
+
+// load reads the go.sum files, called with the lock held (or before sharing a)
+func (a *sumAllowlist) load() error {
+	modTimes := make([]time.Time, len(a.files))
+	sums := make(map[module.Version]goSumEntry)
+	for i, name := range a.files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = fi.ModTime()
+		err = parseGoSum(name, sums)
+		if err != nil {
+			return err
+		}
+	}
+	versions := make(map[string][]string)
+	for v := range sums {
+		versions[v.Path] = append(versions[v.Path], v.Version)
+	}
+	for _, list := range versions {
+		sort.Slice(list, func(i, k int) bool {
+			return semver.Compare(list[i], list[k]) < 0
+		})
+	}
+	a.modTimes, a.sums, a.versions = modTimes, sums, versions
+	return nil
+}
+
+// entry returns the hashes of the version, reading the go.sum files again if they changed. A
+// broken update is logged and the previous allowlist is kept
+func (a *sumAllowlist) entry(modulePath, version string) (goSumEntry, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reload()
+	entry, ok := a.sums[module.Version{Path: modulePath, Version: version}]
+	return entry, ok
+}
+
+func (a *sumAllowlist) list(modulePath string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reload()
+	return a.versions[modulePath]
+}
+
+func (a *sumAllowlist) reload() {
+	for i, name := range a.files {
+		fi, err := os.Stat(name)
+		if err == nil && fi.ModTime().Equal(a.modTimes[i]) {
+			continue
+		}
+		modTimes := a.modTimes
+		err = a.load()
+		if err != nil {
+			loggerRed.Printf("sumAllowlist: Keeping the previous allowlist: %s"+LOG_RST, err.Error())
+			// Not retried until the files change again
+			a.modTimes = modTimes
+			if fi != nil {
+				a.modTimes[i] = fi.ModTime()
+			}
+		}
+		return
+	}
+}
+
+// refuseAllowlist answers 403 to requests of versions not in the allowlist
+func (p *ProxyServer) refuseAllowlist(w http.ResponseWriter, r *http.Request, modulePath, version, reason string) {
+	p.metrics.AllowlistRefusals.Add(1)
+	loggerYellow.Printf(requestTag(r.Context())+"checkSumAllowlist: Refusing %s@%s: %s"+LOG_RST, modulePath, version, reason)
+	p.refusePolicy(w, modulePath, version, reason, http.StatusForbidden)
+}
+
+// checkSumAllowlist refuses requests of versions missing from the go.sum files of SumAllowlist,
+// and queries resolving to a version (@latest, branches). @v/list is answered with the versions of
+// the allowlist. It returns false if the request was answered
+func (p *ProxyServer) checkSumAllowlist(w http.ResponseWriter, r *http.Request, modulePath, prop string) bool {
+	if prop == "list" {
+		list := strings.Builder{}
+		for _, version := range p.sumAllow.list(modulePath) {
+			list.WriteString(version + "\n")
+		}
+		p.setCacheControl(w, "list")
+		httpRespBytes(w, "text/plain; charset=UTF-8", []byte(list.String()))
+		return false
+	}
+	ext := path.Ext(prop)
+	version, err := module.UnescapeVersion(strings.TrimSuffix(prop, ext))
+	if prop == "latest" || err != nil || module.CanonicalVersion(version) != version {
+		p.refuseAllowlist(w, r, modulePath, "", "only exact versions of the go.sum allowlist are served")
+		return false
+	}
+	entry, ok := p.sumAllow.entry(modulePath, version)
+	if !ok {
+		p.refuseAllowlist(w, r, modulePath, version, "not in the go.sum allowlist")
+		return false
+	}
+	if ext == ".zip" && entry.H1 == "" {
+		p.refuseAllowlist(w, r, modulePath, version, "only the go.mod is in the go.sum allowlist")
+		return false
+	}
+	return true
+}
+
+// checkModSum is checkSumHash for the go.mod in data
+func (p *ProxyServer) checkModSum(w http.ResponseWriter, r *http.Request, modulePath, version string, data []byte) bool {
+	if p.sumAllow == nil {
+		return true
+	}
+	hash, err := modHash(data)
+	if err != nil {
+		hash = "unknown"
+	}
+	return p.checkSumHash(w, r, modulePath, version, ".mod", hash)
+}
+
+// checkDownloadSum is checkSumHash for a go.mod or zip of a download directory
+func (p *ProxyServer) checkDownloadSum(w http.ResponseWriter, r *http.Request, f *os.File, escapedModulePath, prop string) bool {
+	ext := path.Ext(prop)
+	if ext != ".mod" && ext != ".zip" {
+		return true
+	}
+	modulePath, err1 := module.UnescapePath(escapedModulePath)
+	version, err2 := module.UnescapeVersion(strings.TrimSuffix(prop, ext))
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	hash := "unknown"
+	if ext == ".zip" {
+		if h, err := hashZipFile(f); err == nil {
+			hash = h
+		}
+	} else if data, err := io.ReadAll(f); err == nil {
+		f.Seek(0, io.SeekStart)
+		if h, err := modHash(data); err == nil {
+			hash = h
+		}
+	}
+	return p.checkSumHash(w, r, modulePath, version, ext, hash)
+}
+
+// checkSumHash refuses serving a zip or go.mod whose hash (as in go.sum) isn't the one of the
+// allowlist. It returns false if the request was refused
+func (p *ProxyServer) checkSumHash(w http.ResponseWriter, r *http.Request, modulePath, version, ext, hash string) bool {
+	if p.sumAllow == nil {
+		return true
+	}
+	entry, _ := p.sumAllow.entry(modulePath, version)
+	expected := entry.H1
+	if ext == ".mod" {
+		expected = entry.ModH1
+	}
+	if expected == "" || expected == hash {
+		return true
+	}
+	p.refuseAllowlist(w, r, modulePath, version, fmt.Sprintf("%s hash %s doesn't match %s of the go.sum allowlist", ext[1:], hash, expected))
+	return false
+}
@@ -0,0 +1,279 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+const SumDBURL = "https://sum.golang.org"
+
+// Results of checks against the checksum database
+const (
+	SumCheckOK = "ok"
+	// The artifacts generated from the mirror differ from the checksum database
+	SumCheckMismatch = "mismatch"
+	// The checksum database doesn't know the version, such as one never published
+	SumCheckMissing = "missing"
+	// The check couldn't be done, it's retried next round
+	SumCheckError = "error"
+)
+
+// Lookups of the checksum database answer a few lines and a signed note
+const maxSumDBResponse = 64 << 10
+
+type SumCheckStatus struct {
+	Checked time.Time
+	Result  string
+	// Hashes of the zip and go.mod generated from the mirror, and in the checksum database
+	H1         string `json:",omitempty"`
+	ModH1      string `json:",omitempty"`
+	SumDBH1    string `json:",omitempty"`
+	SumDBModH1 string `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+type sumCheckState struct {
+	mu      sync.Mutex
+	results map[string]SumCheckStatus
+	// Module versions (escaped <module>@<version>) yet to be checked in the current round
+	pending []string
+}
+
+func (p *ProxyServer) sumDBURL() string {
+	if p.SumDB == "" {
+		return SumDBURL
+	}
+	return strings.TrimSuffix(p.SumDB, "/")
+}
+
+// sumCheckReport returns the last result of every module version checked
+func (p *ProxyServer) sumCheckReport() map[string]SumCheckStatus {
+	p.sumCheck.mu.Lock()
+	defer p.sumCheck.mu.Unlock()
+	report := make(map[string]SumCheckStatus, len(p.sumCheck.results))
+	for k, v := range p.sumCheck.results {
+		report[k] = v
+	}
+	return report
+}
+
+// collectSumCheckTargets lists the module versions served from mirrors, in random order so that
+// every round samples the cache differently
+func (p *ProxyServer) collectSumCheckTargets() []string {
+	var targets []string
+	keys, _ := p.Storage.List(context.Background(), ArtifactStoreDir+"/")
+	for _, key := range keys {
+		if strings.HasSuffix(key, ".json") {
+			targets = append(targets, strings.TrimSuffix(strings.TrimPrefix(key, ArtifactStoreDir+"/"), ".json"))
+		}
+	}
+	rand.Shuffle(len(targets), func(i, k int) {
+		targets[i], targets[k] = targets[k], targets[i]
+	})
+	return targets
+}
+
+// sumChecker checks one module version per tick against the checksum database, catching tags
+// moved by force-pushes or changes of how zips are generated. Modules matching GONOSUMDB (or
+// GOPRIVATE) are left out, as the go command does, not to leak their paths. In a cluster, only
+// the leader does
+func (p *ProxyServer) sumChecker() {
+	ticker := time.NewTicker(time.Duration(p.SumDBCheckInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		if !p.isLeader() {
+			continue
+		}
+		if len(p.sumCheck.pending) == 0 {
+			p.sumCheck.pending = p.collectSumCheckTargets()
+			if len(p.sumCheck.pending) == 0 {
+				continue
+			}
+		}
+		target := p.sumCheck.pending[0]
+		p.sumCheck.pending = p.sumCheck.pending[1:]
+		escapedModulePath, escapedVersion, ok := cutLast(target, "@")
+		if !ok {
+			continue
+		}
+		modulePath, err := module.UnescapePath(escapedModulePath)
+		if err != nil {
+			continue
+		}
+		version, err := module.UnescapeVersion(escapedVersion)
+		if err != nil || module.MatchPrefixPatterns(noSumDBPatterns(), modulePath) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(p.withCacheDir(context.Background()), p.localTimeout())
+		status := p.checkSum(ctx, modulePath, version)
+		cancel()
+		p.recordSumCheck(modulePath+"@"+version, status)
+	}
+}
+
+func noSumDBPatterns() string {
+	if patterns := os.Getenv("GONOSUMDB"); patterns != "" {
+		return patterns
+	}
+	return os.Getenv("GOPRIVATE")
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// checkSum generates the zip and go.mod of a module version from its mirror and compares their
+// hashes with the checksum database. The recorded hashes (see ArtifactInfo) follow what's
+// generated, so that ETags stay right after a tag moved
+func (p *ProxyServer) checkSum(ctx context.Context, modulePath, version string) SumCheckStatus {
+	status := SumCheckStatus{Checked: time.Now()}
+	fail := func(err error) SumCheckStatus {
+		status.Result, status.Error = SumCheckError, err.Error()
+		return status
+	}
+	sumH1, sumModH1, err := p.lookupSumDB(ctx, modulePath, version)
+	if err != nil {
+		return fail(err)
+	}
+	if sumH1 == "" && sumModH1 == "" {
+		status.Result = SumCheckMissing
+		return status
+	}
+	status.SumDBH1, status.SumDBModH1 = sumH1, sumModH1
+	modulePathTrim, verMajorTag, incompat, ok := checkModulePathVer(modulePath, version)
+	if !ok {
+		return fail(errors.New(fmt.Sprintf("module path/ver %s[%s] is invalid or not supported", modulePath, version)))
+	}
+	mod, err := p.serveModLocal(ctx, modulePathTrim, verMajorTag, semver.Canonical(version), ".mod", incompat)
+	if err != nil {
+		return fail(err)
+	}
+	data, err := io.ReadAll(mod)
+	mod.Close()
+	if err != nil {
+		return fail(err)
+	}
+	status.ModH1, err = modHash(data)
+	if err != nil {
+		return fail(err)
+	}
+	reader, err := p.serveModLocal(ctx, modulePathTrim, verMajorTag, semver.Canonical(version), ".zip", incompat)
+	if err != nil {
+		return fail(err)
+	}
+	defer reader.Close()
+	zip, ok := reader.(*os.File)
+	if !ok {
+		return fail(errors.New("zip is not a file"))
+	}
+	fi, err := zip.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	status.H1, err = hashZipFile(zip)
+	if err != nil {
+		return fail(err)
+	}
+	escapedModulePath, _ := module.EscapePath(modulePath)
+	escapedVersion, _ := module.EscapeVersion(version)
+	p.updateArtifactInfo(ctx, escapedModulePath, escapedVersion, func(info *ArtifactInfo) (bool, error) {
+		if info.H1 == status.H1 && info.Size == fi.Size() && info.ModH1 == status.ModH1 {
+			return false, nil
+		}
+		if info.H1 != "" && info.H1 != status.H1 {
+			loggerYellow.Printf("sumChecker: Zip of %s@%s changed since it was first served, %s then, %s now"+LOG_RST,
+				modulePath, version, info.H1, status.H1)
+		}
+		info.Size, info.H1, info.ModH1 = fi.Size(), status.H1, status.ModH1
+		return true, nil
+	})
+	status.Result = SumCheckOK
+	if (sumH1 != "" && sumH1 != status.H1) || (sumModH1 != "" && sumModH1 != status.ModH1) {
+		status.Result = SumCheckMismatch
+	}
+	return status
+}
+
+// lookupSumDB returns the hashes of the zip and go.mod of a module version in the checksum
+// database, empty if it doesn't know the version. The checksum database is trusted like the
+// upstream proxy, the signed tree note of the answer isn't verified
+func (p *ProxyServer) lookupSumDB(ctx context.Context, modulePath, version string) (string, string, error) {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", "", err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, UpstreamProxyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.sumDBURL()+"/lookup/"+escapedModulePath+"@"+escapedVersion, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := p.upstreamClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return "", "", nil
+	default:
+		return "", "", errors.New(fmt.Sprintf("HTTP error %d", resp.StatusCode))
+	}
+	// <record id>, then "<module> <version> <hash>" and "<module> <version>/go.mod <hash>"
+	var h1, modH1 string
+	scanner := bufio.NewScanner(&bodyLimiter{r: resp.Body, n: maxSumDBResponse})
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 3 || f[0] != modulePath {
+			continue
+		}
+		switch f[1] {
+		case version:
+			h1 = f[2]
+		case version + "/go.mod":
+			modH1 = f[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return h1, modH1, nil
+}
+
+func (p *ProxyServer) recordSumCheck(name string, status SumCheckStatus) {
+	p.metrics.SumChecks.Add(1)
+	switch status.Result {
+	case SumCheckMismatch:
+		p.metrics.SumMismatches.Add(1)
+		loggerRed.Printf("sumChecker: Checksum mismatch of %s: zip %s, go.mod %s generated, zip %s, go.mod %s in %s"+LOG_RST,
+			name, status.H1, status.ModH1, status.SumDBH1, status.SumDBModH1, p.sumDBURL())
+		p.alert(AlertChecksumMismatch, name, fmt.Sprintf("zip %s, go.mod %s generated from the mirror, zip %s, go.mod %s in %s",
+			status.H1, status.ModH1, status.SumDBH1, status.SumDBModH1, p.sumDBURL()))
+	case SumCheckError:
+		loggerYellow.Printf("sumChecker: Failed to check %s: %s"+LOG_RST, name, status.Error)
+	}
+	p.sumCheck.mu.Lock()
+	defer p.sumCheck.mu.Unlock()
+	p.sumCheck.results[name] = status
+}
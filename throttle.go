@@ -0,0 +1,227 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces transfers to rate bytes per second, all the transfers sharing it together.
+// Up to a second worth of bytes goes at once after idling
+type rateLimiter struct {
+	rate int64
+	mu   sync.Mutex
+	// When the bytes accounted so far are paid off
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// wait accounts for n bytes transferred, sleeping until the transfers are back within the rate
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now.Add(-time.Second)) {
+		l.next = now.Add(-time.Second)
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chunk is how much to transfer between waits, a tenth of a second worth
+func (l *rateLimiter) chunk() int64 {
+	return min(max(l.rate/10, 1<<10), stallWriterChunk)
+}
+
+// throttledReader paces reads with a rateLimiter
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.l == nil {
+		return t.r.Read(p)
+	}
+	if int64(len(p)) > t.l.chunk() {
+		p = p[:t.l.chunk()]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		werr := t.l.wait(t.ctx, n)
+		if err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// newArtifactWriter returns the writer of .info/.mod/.zip responses, paced by ServeRateLimit
+func (p *ProxyServer) newArtifactWriter(w http.ResponseWriter, r *http.Request) *stallWriter {
+	sw := newStallWriter(w, p.stallTimeout())
+	sw.ctx, sw.limiter = r.Context(), p.serveLimiter
+	return sw
+}
+
+// remoteProxy is an HTTP proxy on the loopback interface that clones and updates of mirrors go
+// through (http.proxy of git), pacing what the remotes send to CloneRateLimit and resolving their
+// hosts as configured by Resolver. Connections are made as Egress says, through the proxy of the
+// environment (HTTPS_PROXY etc.) by default if there's one
+type remoteProxy struct {
+	limiter   *rateLimiter
+	dns       *dnsCache
+	egress    EgressRules
+	transport *http.Transport
+	listener  net.Listener
+}
+
+func startRemoteProxy(limiter *rateLimiter, dns *dnsCache, egress EgressRules) (*remoteProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	t := &remoteProxy{limiter: limiter, dns: dns, egress: egress, listener: listener}
+	t.transport = http.DefaultTransport.(*http.Transport).Clone()
+	t.transport.DialContext = dns.dial
+	t.transport.Proxy = egress.proxy
+	go http.Serve(listener, t)
+	return t, nil
+}
+
+func (t *remoteProxy) url() string {
+	return "http://" + t.listener.Addr().String()
+}
+
+func (t *remoteProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		// Plain http:// remotes
+		req := r.Clone(r.Context())
+		req.RequestURI = ""
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		resp, err := t.transport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, &throttledReader{ctx: r.Context(), r: resp.Body, l: t.limiter})
+		return
+	}
+	remote, err := dialRemote(r.Context(), t.dns, t.egress, r.Host)
+	if err != nil {
+		loggerYellow.Printf("remoteProxy: Failed to connect to %s: %s"+LOG_RST, r.Host, err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+	// Either side closing ends the tunnel
+	go func() {
+		io.Copy(remote, buf)
+		remote.Close()
+	}()
+	io.Copy(conn, &throttledReader{ctx: context.Background(), r: remote, l: t.limiter})
+}
+
+// dialRemote connects to addr (host:port) resolving hosts with dns, through the proxy egress (or
+// else the environment) has for it if any
+func dialRemote(ctx context.Context, dns *dnsCache, egress EgressRules, addr string) (net.Conn, error) {
+	proxyURL, err := egress.proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dns.dial(ctx, "tcp", addr)
+	}
+	if proxyURL.Scheme == "socks5" {
+		return dialSOCKS5(ctx, dns, proxyURL, addr)
+	}
+	if proxyURL.Scheme != "http" {
+		return nil, errors.New(fmt.Sprintf("unsupported proxy %s, expecting http:// or socks5://", proxyURL.Redacted()))
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dns.dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	conn.SetDeadline(time.Now().Add(DirectConnectTimeout))
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("proxy %s refused CONNECT: %s", proxyURL.Redacted(), resp.Status))
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads what was buffered while reading the response of the proxy first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
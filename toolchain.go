@@ -0,0 +1,59 @@
+package goproxy
+
+import (
+	"context"
+	"net/http"
+	"path"
+)
+
+// Module of the Go toolchains downloaded by the go command (GOTOOLCHAIN), versioned like
+// v0.0.1-go1.22.0.linux-amd64. It's only published to proxies, there's no repo to clone
+const ToolchainModule = "golang.org/toolchain"
+
+// Toolchains fetched from upstream are kept here in the GOPROXY layout, and served like LayoutDir
+const ToolchainStoreDir = ".toolchains"
+
+// isToolchain tells if the module is ToolchainModule, which has no upper case to escape
+func isToolchain(escapedModulePath string) bool {
+	return escapedModulePath == ToolchainModule
+}
+
+// fetchToolchain serves .info/.mod/.zip of ToolchainModule from the toolchain store, downloading it
+// from upstream first. Requests of the same file share one download, which goes on if they give up,
+// and is resumed if interrupted. Failing that, the client is redirected to upstream
+func (p *ProxyServer) fetchToolchain(w http.ResponseWriter, r *http.Request, escapedModulePath, prop string) {
+	name := path.Join(escapedModulePath, "@v", prop)
+	done := make(chan struct{})
+	pending, loaded := p.toolchainFetch.LoadOrStore(name, done)
+	if !loaded {
+		url := p.upstreamURL() + "/" + name
+		go func() {
+			defer close(done)
+			defer p.toolchainFetch.Delete(name)
+			ctx := context.WithoutCancel(r.Context())
+			err := p.upstreamBreaker.call(func() error {
+				return p.fetchArtifact(ctx, url, p.toolchainStore, escapedModulePath, prop)
+			})
+			if err != nil {
+				loggerRed.Printf(requestTag(ctx)+"fetchToolchain: %s: %s"+LOG_RST, url, err.Error())
+				return
+			}
+			loggerGreen.Printf(requestTag(ctx)+"fetchToolchain: Fetched %s"+LOG_RST, url)
+			p.metrics.ToolchainDownloads.Add(1)
+		}()
+	}
+	select {
+	case <-pending.(chan struct{}):
+	case <-r.Context().Done():
+		return
+	}
+	if p.serveModDownloadDir(w, r, p.toolchainStore, escapedModulePath, prop) {
+		return
+	}
+	if p.requestOptions(r).noRedirect {
+		httpRespString(w, http.StatusBadGateway, "failed to fetch "+name+" from upstream")
+		return
+	}
+	p.setCacheControl(w, "redirect")
+	p.redirectToUpstream(w, r)
+}
@@ -1,6 +1,9 @@
 package goproxy
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // An Origin describes the provenance of a given repo method result.
 // It can be passed to CheckReuse (usually in a different go command invocation)
@@ -49,3 +52,32 @@ type RevInfo struct {
 type MetaImport struct {
 	Prefix, VCS, RepoRoot string
 }
+
+// Duration is a time.Duration that can be set from flags and JSON in the form of "1h30m"
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	return d.Set(s)
+}
@@ -0,0 +1,165 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// VCSBackend serves modules from version control systems other than git, such as Perforce or
+// internal monorepo tools. Modules are served by the backend registered (RegisterVCSBackend) with
+// the name <module>/.vcs links to in the cache, the backend keeping its data in that directory
+type VCSBackend interface {
+	// Resolve maps a query of the module, a branch or "latest", to a canonical version
+	Resolve(ctx context.Context, repo VCSRepo, query string) (string, error)
+	// EnsureRevision fetches the version into the repo, unless it's there already
+	EnsureRevision(ctx context.Context, repo VCSRepo, version string) error
+	// Stat describes the version, a NotFoundError if there's no such version
+	Stat(ctx context.Context, repo VCSRepo, version string) (*VCSRevision, error)
+	// Archive writes the module zip of the version to w, as the go command creates it
+	// (golang.org/x/mod/zip). The size of the zip is limited with MaxZipSize
+	Archive(ctx context.Context, repo VCSRepo, version string, w io.Writer) error
+}
+
+// VCSRepo is the module a VCSBackend is asked about
+type VCSRepo struct {
+	// Module path of the repo in the cache
+	Path string
+	// Directory of the module in the repo, empty for the root
+	SubPath string
+	// Major version suffix of the module path, such as v2, empty for v0 and v1
+	Major string
+	// Directory of the backend in the repo, <cache>/<Path>/<name>
+	Dir string
+}
+
+// Module returns the module path
+func (r VCSRepo) Module() string {
+	return path.Join(r.Path, r.SubPath, r.Major)
+}
+
+// VCSRevision describes a version served by a VCSBackend
+type VCSRevision struct {
+	Version string
+	Time    time.Time
+	// go.mod of the module, nil for one with only the module line
+	GoMod []byte `json:",omitempty"`
+	// Reported in .info, for go to check whether the version may be reused
+	Origin *Origin `json:",omitempty"`
+}
+
+// RegisterVCSBackend serves the modules whose .vcs links to name (such as .p4) with backend.
+// Backends are registered before serving. It panics if name is taken, as by .git and .mod
+func (p *ProxyServer) RegisterVCSBackend(name string, backend VCSBackend) {
+	if !strings.HasPrefix(name, ".") || strings.Contains(name, "/") || name == ".git" || name == ".mod" {
+		log.Panicf("Invalid VCS backend name %s, expecting .<name> other than .git and .mod", name)
+	}
+	if _, ok := p.vcsBackends[name]; ok {
+		log.Panicf("VCS backend %s registered twice", name)
+	}
+	if p.vcsBackends == nil {
+		p.vcsBackends = make(map[string]VCSBackend)
+	}
+	p.vcsBackends[name] = backend
+}
+
+func (p *ProxyServer) vcsRepo(parentPath, subPath, verMajorTag, vcs string) VCSRepo {
+	return VCSRepo{Path: parentPath, SubPath: subPath, Major: verMajorTag, Dir: p.cachePath(path.Join(parentPath, vcs))}
+}
+
+// serveModBackend is serveModLocal for modules of a registered VCSBackend
+func (p *ProxyServer) serveModBackend(ctx context.Context, backend VCSBackend, repo VCSRepo, verCanonical, ext string, incompat bool) (io.ReadCloser, error) {
+	ver := verCanonical
+	if incompat {
+		ver += "+incompatible"
+	}
+	rev, err := backend.Stat(ctx, repo, ver)
+	if err != nil {
+		return nil, err
+	}
+	switch ext {
+	case ".info":
+		data, err := json.Marshal(RevInfo{Version: ver, Time: rev.Time.In(time.UTC), Origin: rev.Origin})
+		if err != nil {
+			return nil, err
+		}
+		return nopSeekCloser{bytes.NewReader(data)}, nil
+	case ".mod":
+		data := rev.GoMod
+		if data == nil {
+			loggerYellow.Printf(requestTag(ctx)+"serveModBackend: Using synthesized go.mod for %s"+LOG_RST, repo.Module())
+			data = []byte(fmt.Sprintf("module %s\n", repo.Module()))
+		}
+		return nopSeekCloser{bytes.NewReader(data)}, nil
+	case ".zip":
+		archiveTmp, err := createUnnamedTmpFile(p.cachePath(".tmp"), 0600)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to create temp file (archive): %s", err.Error()))
+		}
+		prefix := repo.Module() + "@" + ver + "/"
+		out := &limitedWriter{w: archiveTmp, n: p.maxZipSize()}
+		p.metrics.ActiveArchives.Add(1)
+		err = backend.Archive(ctx, repo, ver, out)
+		p.metrics.ActiveArchives.Add(-1)
+		if out.exceeded {
+			archiveTmp.Close()
+			return nil, &ZipTooLargeError{Prefix: prefix, Limit: p.maxZipSize()}
+		}
+		if err != nil {
+			archiveTmp.Close()
+			return nil, errors.New(fmt.Sprintf("failed to create zip of %s: %s", prefix, err.Error()))
+		}
+		archiveTmp.Seek(0, io.SeekStart)
+		err = p.scanZip(ctx, repo.Module(), ver, archiveTmp, rev.Origin)
+		if err != nil {
+			archiveTmp.Close()
+			return nil, err
+		}
+		return archiveTmp, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported extension %s", ext))
+}
+
+// cacheModBackend is cacheModGit for modules of a registered VCSBackend
+func (p *ProxyServer) cacheModBackend(ctx context.Context, backend VCSBackend, repo VCSRepo, ver string) {
+	err := backend.EnsureRevision(ctx, repo, ver)
+	if err != nil {
+		loggerRed.Printf(requestTag(ctx)+"cacheModBackend: Failed to fetch %s@%s: %s"+LOG_RST, repo.Module(), ver, err.Error())
+	}
+}
+
+// serveBackendQuery answers @latest or a branch query of a module of backend
+func (p *ProxyServer) serveBackendQuery(w http.ResponseWriter, r *http.Request, backend VCSBackend, repo VCSRepo, query string) {
+	ver, err := backend.Resolve(r.Context(), repo, query)
+	if err == nil {
+		var rev *VCSRevision
+		rev, err = backend.Stat(r.Context(), repo, ver)
+		if err == nil {
+			httpRespJSON(w, http.StatusOK, RevInfo{Version: ver, Time: rev.Time.In(time.UTC), Origin: rev.Origin})
+			return
+		}
+	}
+	// NotFoundError being a 404
+	httpRespError(w, err)
+}
+
+// isBackendSource tells if the module is served by a registered VCSBackend
+func (p *ProxyServer) isBackendSource(escapedModulePath string) bool {
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return false
+	}
+	_, _, vcs, err := p.checkModVcsLocal(modulePath)
+	_, ok := p.vcsBackends[vcs]
+	return err == nil && ok
+}
@@ -0,0 +1,144 @@
+package goproxy
+
+import (
+	"strings"
+	"sync"
+)
+
+// vcsIndex maps the module paths of the cache to their backing mirror, so that resolving a module
+// is a walk down a prefix tree of path elements, instead of a readlink per path element. It's
+// built on startup and kept up to date as the server creates and removes mirrors. Paths it lacks
+// are still looked up on the file system, for mirrors created by others: nodes of a cluster,
+// RestoreBundles, directory sources set up by hand. A nil index has nothing
+type vcsIndex struct {
+	mu   sync.RWMutex
+	root vcsNode
+	n    int
+}
+
+// vcsNode is a path element, children being keyed by the next element
+type vcsNode struct {
+	children map[string]*vcsNode
+	// Set if a module is cached at this path
+	entry *vcsEntry
+}
+
+type vcsEntry struct {
+	// Target of the .vcs link, .git or .mod
+	vcs string
+	// Module path of the mirror an alias shares, the module path itself otherwise
+	owner string
+}
+
+func (p *ProxyServer) buildVcsIndex() *vcsIndex {
+	idx := &vcsIndex{}
+	walkVcsLinks(p.Dir, func(modulePath, vcs string) {
+		idx.set(modulePath, vcsEntry{vcs: vcs, owner: p.readMirrorOwner(modulePath)})
+	})
+	return idx
+}
+
+// lookup finds the longest module path of the index that modulePath is beneath, returning it and
+// the path of modulePath in it
+func (idx *vcsIndex) lookup(modulePath string) (string, string, vcsEntry, bool) {
+	if idx == nil {
+		return "", "", vcsEntry{}, false
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	node := &idx.root
+	var found *vcsEntry
+	foundLen, consumed := 0, 0
+	for rest := modulePath; ; {
+		elem, tail, more := strings.Cut(rest, "/")
+		node = node.children[elem]
+		if node == nil {
+			break
+		}
+		consumed += len(elem)
+		if node.entry != nil {
+			found, foundLen = node.entry, consumed
+		}
+		if !more {
+			break
+		}
+		consumed++
+		rest = tail
+	}
+	if found == nil {
+		return "", "", vcsEntry{}, false
+	}
+	return modulePath[:foundLen], strings.TrimPrefix(modulePath[foundLen:], "/"), *found, true
+}
+
+// get returns the entry of exactly modulePath
+func (idx *vcsIndex) get(modulePath string) (vcsEntry, bool) {
+	parentPath, _, entry, ok := idx.lookup(modulePath)
+	if !ok || parentPath != modulePath {
+		return vcsEntry{}, false
+	}
+	return entry, true
+}
+
+func (idx *vcsIndex) set(modulePath string, entry vcsEntry) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	node := &idx.root
+	for _, elem := range strings.Split(modulePath, "/") {
+		child := node.children[elem]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*vcsNode)
+			}
+			child = &vcsNode{}
+			node.children[elem] = child
+		}
+		node = child
+	}
+	if node.entry == nil {
+		idx.n++
+	}
+	node.entry = &entry
+}
+
+func (idx *vcsIndex) remove(modulePath string) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	elems := strings.Split(modulePath, "/")
+	nodes := []*vcsNode{&idx.root}
+	for _, elem := range elems {
+		child := nodes[len(nodes)-1].children[elem]
+		if child == nil {
+			return
+		}
+		nodes = append(nodes, child)
+	}
+	if nodes[len(nodes)-1].entry == nil {
+		return
+	}
+	nodes[len(nodes)-1].entry = nil
+	idx.n--
+	// Prune the elements left leading nowhere
+	for i := len(elems) - 1; i >= 0; i-- {
+		node := nodes[i+1]
+		if node.entry != nil || len(node.children) != 0 {
+			break
+		}
+		delete(nodes[i].children, elems[i])
+	}
+}
+
+func (idx *vcsIndex) len() int {
+	if idx == nil {
+		return 0
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.n
+}
@@ -0,0 +1,104 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// Requirements returns the module versions required by the go.mod files named by files, or by
+// those of the members of the workspaces (go.work) named, replacements applied. Modules of the
+// workspaces and those replaced by directories are local, thus left out. Since Go 1.17, go.mod
+// lists every module providing packages the module builds
+func Requirements(files []string) ([]module.Version, error) {
+	seen := make(map[module.Version]bool)
+	var versions []module.Version
+	for _, name := range files {
+		var members []*modfile.File
+		var replaces []*modfile.Replace
+		if filepath.Ext(name) == ".work" {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			work, err := modfile.ParseWork(name, data, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, use := range work.Use {
+				dir := use.Path
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(filepath.Dir(name), dir)
+				}
+				f, err := parseModFile(filepath.Join(dir, "go.mod"))
+				if err != nil {
+					return nil, err
+				}
+				members = append(members, f)
+			}
+			// Replacements of the workspace take precedence over those of its modules
+			replaces = work.Replace
+		} else {
+			f, err := parseModFile(name)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, f)
+		}
+		local := make(map[string]bool)
+		for _, f := range members {
+			local[f.Module.Mod.Path] = true
+			replaces = append(replaces, f.Replace...)
+		}
+		for _, f := range members {
+			for _, req := range f.Require {
+				if local[req.Mod.Path] {
+					continue
+				}
+				v, ok := replace(replaces, req.Mod)
+				if ok && !seen[v] {
+					seen[v] = true
+					versions = append(versions, v)
+				}
+			}
+		}
+	}
+	module.Sort(versions)
+	return versions, nil
+}
+
+func parseModFile(name string) (*modfile.File, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := modfile.Parse(name, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.Module == nil {
+		return nil, errors.New(fmt.Sprintf("%s: no module directive", name))
+	}
+	return f, nil
+}
+
+// replace applies the first of replaces matching v, those of its version before those of any
+// version. It returns false if v is replaced by a directory
+func replace(replaces []*modfile.Replace, v module.Version) (module.Version, bool) {
+	for _, exact := range []bool{true, false} {
+		for _, r := range replaces {
+			if r.Old.Path != v.Path || (r.Old.Version != "") != exact || (exact && r.Old.Version != v.Version) {
+				continue
+			}
+			if r.New.Version == "" {
+				return module.Version{}, false
+			}
+			return r.New, true
+		}
+	}
+	return v, true
+}